@@ -17,16 +17,25 @@ import (
 	"github.com/karlmutch/errors"
 )
 
+// AWSCred holds the credentials and configuration found within a directory of AWS files
+//
 type AWSCred struct {
-	Project string
-	Region  string
-	Creds   *credentials.Credentials
+	Project  string
+	Region   string   // The primary region, used for queues that are not qualified by their region
+	Regions  []string // Every region served by the credentials, starting with the primary region
+	Endpoint string   // An optional endpoint used in place of the AWS endpoints, for example a local SQS stand-in
+	Creds    *credentials.Credentials
 }
 
+// AWSExtractCreds loads the credentials and config files found in a directory.  The config file
+// supplies the region using a region=name line and can list further regions served by the same
+// credentials using a regions=name,name line, an endpoint_url=uri line overrides the AWS endpoint.
+//
 func AWSExtractCreds(filenames []string) (cred *AWSCred, err errors.Error) {
 
 	cred = &AWSCred{
 		Project: fmt.Sprintf("aws_%s", filepath.Base(filepath.Dir(filenames[0]))),
+		Regions: []string{},
 	}
 
 	credsDone := false
@@ -38,20 +47,35 @@ func AWSExtractCreds(filenames []string) (cred *AWSCred, err errors.Error) {
 			if err != nil {
 				return false
 			}
-			if len(cred.Region) == 0 {
-				scan := bufio.NewScanner(f)
-				for scan.Scan() {
-					line := scan.Text()
-					if strings.HasPrefix(strings.ToLower(line), "region=") {
-						tokens := strings.SplitN(line, "=", 2)
-						cred.Region = tokens[1]
-						return true
+			defer f.Close()
+
+			isConfig := false
+			scan := bufio.NewScanner(f)
+			for scan.Scan() {
+				tokens := strings.SplitN(scan.Text(), "=", 2)
+				if len(tokens) != 2 {
+					continue
+				}
+				value := strings.TrimSpace(tokens[1])
+				switch strings.ToLower(strings.TrimSpace(tokens[0])) {
+				case "region":
+					if len(cred.Region) == 0 {
+						cred.Region = value
 					}
+					isConfig = true
+				case "regions":
+					for _, region := range strings.Split(value, ",") {
+						if region = strings.TrimSpace(region); len(region) != 0 {
+							cred.Regions = append(cred.Regions, region)
+						}
+					}
+					isConfig = true
+				case "endpoint_url":
+					cred.Endpoint = value
+					isConfig = true
 				}
 			}
-
-			f.Close()
-			return false
+			return isConfig
 		}()
 
 		if !credsDone && !wasConfig {
@@ -60,12 +84,35 @@ func AWSExtractCreds(filenames []string) (cred *AWSCred, err errors.Error) {
 		}
 	}
 
+	if len(cred.Region) == 0 && len(cred.Regions) != 0 {
+		cred.Region = cred.Regions[0]
+	}
 	if len(cred.Region) == 0 {
 		return nil, errors.New("none of the supplied files defined a region").With("stack", stack.Trace().TrimRuntime()).With("files", filenames)
 	}
+	cred.Regions = AWSRegions(cred.Region, cred.Regions)
 
 	if !credsDone {
 		return nil, errors.New("credentials never loaded").With("stack", stack.Trace().TrimRuntime()).With("files", filenames)
 	}
 	return cred, nil
 }
+
+// AWSRegions returns the primary region followed by any other regions without duplicates
+//
+func AWSRegions(primary string, others []string) (regions []string) {
+	regions = []string{primary}
+	for _, region := range others {
+		found := false
+		for _, known := range regions {
+			if known == region {
+				found = true
+				break
+			}
+		}
+		if !found {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
@@ -0,0 +1,156 @@
+package runner
+
+// This file contains the implementation of claim checks for requests that are too
+// large to be sent directly through a queue, for example SQS has a 256KB limit.
+//
+// A claim check replaces the request on the queue with a small message that points
+// at the full request, which the client has stored using S3, Google Cloud Storage or
+// a shared file system, along with the SHA256 hash of the stored request
+//
+//    {"claim_check": {"uri": "s3://endpoint/bucket/key", "sha256": "<hex>", "env": {...}}}
+//
+// The env block is optional and is used to supply credentials needed to access the
+// storage in the same way as the env block of a request.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ClaimCheck is a pointer to a request that has been stored outside of the queue
+//
+type ClaimCheck struct {
+	URI    string            `json:"uri"`
+	SHA256 string            `json:"sha256"`
+	Env    map[string]string `json:"env,omitempty"`
+}
+
+type claimCheckMsg struct {
+	ClaimCheck *ClaimCheck `json:"claim_check"`
+}
+
+// NewClaimCheck is used by clients to create a claim check for a payload they have
+// already stored at the uri
+//
+func NewClaimCheck(uri string, payload []byte) (check *ClaimCheck) {
+	sum := sha256.Sum256(payload)
+	return &ClaimCheck{
+		URI:    uri,
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// Marshal will produce the queue message for the claim check
+//
+func (check *ClaimCheck) Marshal() (msg []byte, err errors.Error) {
+	msg, errGo := json.Marshal(&claimCheckMsg{ClaimCheck: check})
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("uri", check.URI).With("stack", stack.Trace().TrimRuntime())
+	}
+	return msg, nil
+}
+
+// OpenClaimCheck will examine a message and if it is a claim check return it.  Messages
+// that are not claim checks will result in a nil check being returned.
+//
+func OpenClaimCheck(msg []byte) (check *ClaimCheck, err errors.Error) {
+	probe := map[string]json.RawMessage{}
+	if errGo := json.Unmarshal(msg, &probe); errGo != nil {
+		return nil, errors.Wrap(errGo, "message is not a JSON object").With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, isPresent := probe["claim_check"]; !isPresent {
+		return nil, nil
+	}
+
+	claim := &claimCheckMsg{}
+	if errGo := json.Unmarshal(msg, claim); errGo != nil {
+		return nil, errors.Wrap(errGo, "claim check is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+	if claim.ClaimCheck == nil || len(claim.ClaimCheck.URI) == 0 {
+		return nil, errors.New("claim check has no uri").With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(claim.ClaimCheck.SHA256) != 2*sha256.Size {
+		return nil, errors.New("claim check has an invalid sha256").With("uri", claim.ClaimCheck.URI).With("stack", stack.Trace().TrimRuntime())
+	}
+	return claim.ClaimCheck, nil
+}
+
+// Fetch retrieves the payload the claim check points at using the storage implementation
+// that matches the scheme of the uri.  The payload is not verified, Verify should
+// be used once the payload has been retrieved.
+//
+func (check *ClaimCheck) Fetch(projectID string, creds string, env map[string]string, dir string, timeout time.Duration) (payload []byte, err errors.Error) {
+
+	uri, errGo := url.ParseRequestURI(check.URI)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("uri", check.URI).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	art := &Artifact{
+		Qualified: check.URI,
+	}
+
+	name := ""
+	switch uri.Scheme {
+	case "gs":
+		art.Bucket = uri.Host
+		name = strings.TrimPrefix(uri.Path, "/")
+	case "s3":
+		// The bucket and key are extracted from the uri path by NewStorage
+	case "file":
+		name = uri.Path
+	}
+
+	storage, err := NewStorage(&StoreOpts{
+		Art:       art,
+		ProjectID: projectID,
+		Creds:     creds,
+		Env:       env,
+		Validate:  true,
+		Timeout:   timeout,
+	})
+	if err != nil {
+		return nil, err.With("uri", check.URI)
+	}
+	defer storage.Close()
+
+	if len(name) == 0 {
+		name = art.Key
+	}
+
+	output, errGo := ioutil.TempDir(dir, "claim-check-")
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("uri", check.URI).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(output)
+
+	if _, err = storage.Fetch(name, false, output, nil, timeout); err != nil {
+		return nil, err.With("uri", check.URI)
+	}
+
+	if payload, errGo = ioutil.ReadFile(filepath.Join(output, filepath.Base(name))); errGo != nil {
+		return nil, errors.Wrap(errGo).With("uri", check.URI).With("stack", stack.Trace().TrimRuntime())
+	}
+	return payload, nil
+}
+
+// Verify checks that the payload retrieved matches the hash within the claim check
+//
+func (check *ClaimCheck) Verify(payload []byte) (err errors.Error) {
+	sum := sha256.Sum256(payload)
+	if hash := hex.EncodeToString(sum[:]); !strings.EqualFold(hash, check.SHA256) {
+		return errors.New("claim check payload hash mismatch").With("uri", check.URI).
+			With("expected", check.SHA256).With("actual", hash).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
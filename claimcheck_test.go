@@ -0,0 +1,59 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// This file contains tests for requests sent using claim checks
+
+func TestClaimCheckLocal(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "claim-check")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "request.json")
+	if errGo = ioutil.WriteFile(fn, []byte(validLegacyRqst), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	msg, err := NewClaimCheck("file://"+fn, []byte(validLegacyRqst)).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check, err := OpenClaimCheck(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check == nil {
+		t.Fatal("claim check was not recognized")
+	}
+
+	payload, err := check.Fetch("", "", nil, dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = check.Verify(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnmarshalRequest(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	// A request that was modified after the claim check was issued
+	if err = check.Verify(append(payload, ' ')); err == nil {
+		t.Fatal("modified payload was accepted")
+	}
+
+	// Requests that are not claim checks are left alone
+	if check, err = OpenClaimCheck([]byte(validLegacyRqst)); err != nil || check != nil {
+		t.Fatal("request was treated as a claim check")
+	}
+}
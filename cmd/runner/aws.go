@@ -10,6 +10,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"strings"
 	"time"
@@ -38,31 +39,42 @@ func (*awsCred) validate(ctx context.Context, filenames []string) (cred *runner.
 		return cred, err
 	}
 
-	sess, errGo := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String(cred.Region),
+	// Each of the regions served by the credentials must be usable
+	for _, region := range cred.Regions {
+		cfg := aws.Config{
+			Region:                        aws.String(region),
 			Credentials:                   cred.Creds,
 			CredentialsChainVerboseErrors: aws.Bool(true),
-		},
-		Profile: "default",
-	})
+		}
+		if len(cred.Endpoint) != 0 {
+			cfg.Endpoint = aws.String(cred.Endpoint)
+		}
 
-	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-	}
+		sess, errGo := session.NewSessionWithOptions(session.Options{
+			Config:  cfg,
+			Profile: "default",
+		})
 
-	// Create a SQS client
-	svc := sqs.New(sess)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
 
-	_, errGo = svc.ListQueuesWithContext(ctx, &sqs.ListQueuesInput{})
-	if errGo != nil {
-		return nil, errors.Wrap(errGo, "unable to list SQS queues").With("stack", stack.Trace().TrimRuntime()).With("filenames", filenames).With("region", cred.Region)
+		// Create a SQS client
+		svc := sqs.New(sess)
+
+		_, errGo = svc.ListQueuesWithContext(ctx, &sqs.ListQueuesInput{})
+		if errGo != nil {
+			return nil, errors.Wrap(errGo, "unable to list SQS queues").With("stack", stack.Trace().TrimRuntime()).With("filenames", filenames).With("region", region)
+		}
 	}
 
 	return cred, nil
 }
 
-func (awsC *awsCred) refreshAWSCert(dir string, timeout time.Duration) (project string, awsFiles []string, err errors.Error) {
+// refreshAWSCert validates the credentials within a directory returning the sqs:// URI for
+// the queues the credentials give access to along with the credential files
+//
+func (awsC *awsCred) refreshAWSCert(dir string, timeout time.Duration) (uri string, awsFiles []string, err errors.Error) {
 
 	awsFiles = []string{}
 
@@ -92,7 +104,12 @@ func (awsC *awsCred) refreshAWSCert(dir string, timeout time.Duration) (project
 	if err != nil {
 		return "", []string{}, err
 	}
-	return cred.Project, awsFiles, nil
+	queues := url.URL{
+		Scheme:   "sqs",
+		Host:     cred.Region,
+		RawQuery: url.Values{"project": []string{cred.Project}}.Encode(),
+	}
+	return queues.String(), awsFiles, nil
 }
 
 func (awsC *awsCred) refreshAWSCerts(dir string, timeout time.Duration) (found map[string]string, err errors.Error) {
@@ -0,0 +1,120 @@
+package main
+
+// This file contains the resolution of claim checks, messages that point at requests
+// stored outside of the queue because they are too large to be sent directly
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	claimCheckLocationsOpt = flag.String("claim-check-locations", "", "an optional comma separated list of locations, such as s3://endpoint/bucket/, gs://bucket/ or file:///dir/, from which claim checked requests are fetched using the credentials of the runner, claim checks pointing elsewhere must supply their own AWS credentials")
+)
+
+// claimCheckLocation returns a uri in a form used to compare locations, with any . and .. elements
+// of the path removed, false is returned when the uri is not usable
+//
+func claimCheckLocation(uri string) (location string, isValid bool) {
+	parsed, errGo := url.Parse(uri)
+	if errGo != nil || len(parsed.Scheme) == 0 {
+		return "", false
+	}
+	return strings.ToLower(parsed.Scheme) + "://" + strings.ToLower(parsed.Host) + path.Clean("/"+parsed.Path), true
+}
+
+// claimCheckAllowed is true when a claim check points within one of the locations that the runner
+// fetches claim checks from using its own credentials
+//
+func claimCheckAllowed(uri string) (allowed bool) {
+	location, isValid := claimCheckLocation(uri)
+	if !isValid {
+		return false
+	}
+	for _, prefix := range strings.Split(*claimCheckLocationsOpt, ",") {
+		prefix, isValid := claimCheckLocation(strings.TrimSpace(prefix))
+		if !isValid {
+			continue
+		}
+		if location == prefix || strings.HasPrefix(location, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// claimCheckEnv prepares the environment used to access the storage holding a claim
+// checked request.  Encrypted values are decrypted and, for claim checks within the
+// claim-check-locations, any AWS credentials not supplied by the client are taken from
+// the runners own environment.  Claim checks pointing elsewhere must be S3 claim checks
+// supplying their own credentials, so that clients cannot use the runner to read storage
+// they have no access to.
+//
+func claimCheckEnv(check *runner.ClaimCheck) (env map[string]string, err errors.Error) {
+	env = make(map[string]string, len(check.Env))
+	for k, v := range check.Env {
+		if runner.IsEncryptedEnvValue(v) {
+			if v, err = decryptEnv(k, v); err != nil {
+				return nil, err
+			}
+		}
+		env[k] = v
+	}
+
+	if !claimCheckAllowed(check.URI) {
+		if !strings.HasPrefix(strings.ToLower(check.URI), "s3://") || len(env["AWS_ACCESS_KEY_ID"]) == 0 || len(env["AWS_SECRET_ACCESS_KEY"]) == 0 {
+			return nil, errors.New("claim check is outside of the claim-check-locations and does not supply AWS credentials").With("uri", check.URI).With("stack", stack.Trace().TrimRuntime())
+		}
+		return env, nil
+	}
+
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_DEFAULT_REGION"} {
+		if _, isPresent := env[k]; !isPresent {
+			if v := os.Getenv(k); len(v) != 0 {
+				env[k] = v
+			}
+		}
+	}
+	return env, nil
+}
+
+// resolveClaimCheck will replace a claim check message with the request it points at.  Messages that
+// are not claim checks are returned unchanged.
+//
+// Failures to retrieve the request are returned as errors with the retry flag set so that the message
+// can be redelivered, payloads that do not match the claim check are returned as errors that should not
+// be retried.
+//
+func resolveClaimCheck(project string, credentials string, msg []byte) (payload []byte, retry bool, err errors.Error) {
+
+	check, err := runner.OpenClaimCheck(msg)
+	if err != nil || check == nil {
+		return msg, false, err
+	}
+
+	env, err := claimCheckEnv(check)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if payload, err = check.Fetch(project, credentials, env, *tempOpt, 5*time.Minute); err != nil {
+		return nil, true, err
+	}
+
+	if err = check.Verify(payload); err != nil {
+		return nil, false, err
+	}
+
+	logger.Debug(fmt.Sprintf("claim check %s resolved", check.URI))
+	return payload, false, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+// This file contains tests for the locations and credentials used to fetch claim checks
+
+import (
+	"os"
+	"testing"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+)
+
+// TestClaimCheckEnv checks that the credentials of the runner are only used for claim checks within
+// the configured locations, and that claim checks elsewhere must supply their own
+//
+func TestClaimCheckEnv(t *testing.T) {
+
+	oldLocations := *claimCheckLocationsOpt
+	*claimCheckLocationsOpt = "s3://s3.amazonaws.com/requests/, gs://requests"
+	defer func() {
+		*claimCheckLocationsOpt = oldLocations
+	}()
+
+	oldKey, oldSecret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	os.Setenv("AWS_ACCESS_KEY_ID", "runner-key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "runner-secret")
+	defer func() {
+		os.Setenv("AWS_ACCESS_KEY_ID", oldKey)
+		os.Setenv("AWS_SECRET_ACCESS_KEY", oldSecret)
+	}()
+
+	// Configured locations use the credentials of the runner
+	for _, uri := range []string{"s3://s3.amazonaws.com/requests/1.json", "gs://requests/1.json"} {
+		env, err := claimCheckEnv(&runner.ClaimCheck{URI: uri})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env["AWS_ACCESS_KEY_ID"] != "runner-key" {
+			t.Fatalf("runner credentials not used for %s", uri)
+		}
+	}
+
+	// Other locations, including those reached using relative paths, are refused unless the
+	// claim check supplies credentials, the runner credentials never being added
+	for _, uri := range []string{
+		"s3://s3.amazonaws.com/other/1.json",
+		"s3://s3.amazonaws.com/requests-other/1.json",
+		"s3://s3.amazonaws.com/requests/../other/1.json",
+		"gs://other/1.json",
+		"file:///etc/passwd",
+	} {
+		if _, err := claimCheckEnv(&runner.ClaimCheck{URI: uri}); err == nil {
+			t.Fatalf("claim check %s without credentials was accepted", uri)
+		}
+	}
+
+	env, err := claimCheckEnv(&runner.ClaimCheck{
+		URI: "s3://s3.amazonaws.com/other/1.json",
+		Env: map[string]string{"AWS_ACCESS_KEY_ID": "client-key", "AWS_SECRET_ACCESS_KEY": "client-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["AWS_ACCESS_KEY_ID"] != "client-key" || env["AWS_SECRET_ACCESS_KEY"] != "client-secret" {
+		t.Fatalf("claim check credentials were replaced %v", env)
+	}
+	if _, err = claimCheckEnv(&runner.ClaimCheck{URI: "gs://other/1.json", Env: env}); err == nil {
+		t.Fatal("AWS credentials were accepted for a claim check outside of S3")
+	}
+}
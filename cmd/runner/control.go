@@ -0,0 +1,265 @@
+package main
+
+// This file contains the implementation of the control messages used to manage experiments
+// that are already running.  Control messages arrive on control queues, kept apart from
+// the queues carrying experiments, or are POSTed to the admin http server of the runner.
+//
+// The only message currently supported is "cancel experiment <key>" which stops the
+// experiment, returns any output it produced, and then dead-letters its request.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	controlMatchOpt = flag.String("control-match", "", "an optional regular expression matching queues that carry control messages, such as 'cancel experiment <key>', rather than experiments, each runner should have its own control queue, or a copy of every message")
+	adminAddrOpt    = flag.String("admin-address", "", "an optional address for the admin http server within the runner, control messages can be POSTed to /control")
+
+	// running is the catalog of experiments being processed by this runner
+	running = &RunningExperiments{procs: map[string]*processor{}}
+)
+
+// cancellation is used to stop a running experiment and to later check that it was stopped
+// by a control message rather than failing
+//
+type cancellation struct {
+	cancel    context.CancelFunc
+	cancelled bool
+	sync.Mutex
+}
+
+func (c *cancellation) setCancel(cancel context.CancelFunc) {
+	c.Lock()
+	defer c.Unlock()
+	c.cancel = cancel
+}
+
+func (c *cancellation) stop() {
+	c.Lock()
+	defer c.Unlock()
+	c.cancelled = true
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+func (c *cancellation) isCancelled() (cancelled bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.cancelled
+}
+
+// RunningExperiments holds the processors of the experiments running on this runner indexed
+// by their experiment keys
+//
+type RunningExperiments struct {
+	procs map[string]*processor
+	sync.Mutex
+}
+
+// add records a processor that can be cancelled using its context cancellation function
+//
+func (run *RunningExperiments) add(p *processor, cancel context.CancelFunc) {
+	p.stop.setCancel(cancel)
+
+	run.Lock()
+	defer run.Unlock()
+	run.procs[p.Request.Experiment.Key] = p
+}
+
+func (run *RunningExperiments) remove(p *processor) {
+	run.Lock()
+	defer run.Unlock()
+	if run.procs[p.Request.Experiment.Key] == p {
+		delete(run.procs, p.Request.Experiment.Key)
+	}
+}
+
+// cancel stops the experiment with the key, false is returned if the experiment is not running
+// on this runner
+//
+func (run *RunningExperiments) cancel(key string) (found bool) {
+	run.Lock()
+	p, found := run.procs[key]
+	run.Unlock()
+
+	if found {
+		p.stop.stop()
+	}
+	return found
+}
+
+// doControl carries out a control message, found is false when the experiment the message
+// refers to is not running on this runner
+//
+func doControl(msg string) (found bool, err errors.Error) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || !strings.EqualFold(fields[0], "cancel") || !strings.EqualFold(fields[1], "experiment") {
+		return false, errors.New("unrecognized control message").With("stack", stack.Trace().TrimRuntime()).With("msg", msg)
+	}
+
+	if found = running.cancel(fields[2]); found {
+		logger.Info(fmt.Sprintf("experiment %s cancelled by control message", fields[2]))
+	} else {
+		logger.Debug(fmt.Sprintf("experiment %s to be cancelled is not running", fields[2]))
+	}
+	return found, nil
+}
+
+// isControl is true when the queue carries control messages rather than experiments.  The bare
+// name of the queue is matched, in the same way as the queue-match option, rather than the
+// subscription returned by the refresh of the task queue.
+//
+func isControl(tasker runner.TaskQueue, subscription string) (control bool) {
+	if len(*controlMatchOpt) == 0 {
+		return false
+	}
+	matcher, errGo := regexp.Compile(*controlMatchOpt)
+	if errGo != nil {
+		return false
+	}
+	return matcher.MatchString(runner.QueueName(tasker, subscription))
+}
+
+// openControl returns the text of a control message.  Control messages are plain text, unless
+// they are carried in a signed envelope which is required when signature checking is enabled.
+//
+func openControl(msg []byte) (payload []byte, err errors.Error) {
+	trustedKeys.Lock()
+	signed := trustedKeys.keys != nil
+	trustedKeys.Unlock()
+
+	if signed || json.Valid(msg) {
+		return verifyMsg(msg)
+	}
+	return msg, nil
+}
+
+// handleControl is the message handler for control queues.  Messages for experiments not running
+// on this runner are acknowledged as control queues are expected to be specific to each runner.
+//
+func handleControl(ctx context.Context, project string, subscription string, credentials string, msg []byte) (rsc *runner.Resource, consume bool) {
+
+	msg, err := openControl(msg)
+	if err == nil {
+		_, err = doControl(string(msg))
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("%s:%s rejected control msg due to %s", project, subscription, err.Error()))
+		runner.FailDelivery(ctx, err, false)
+		return nil, false
+	}
+	return nil, true
+}
+
+// controller checks the control queues of the queuer for messages until the queuer is stopped
+//
+func (qr *Queuer) controller(quitC chan bool) {
+
+	check := time.NewTicker(qr.checkInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-check.C:
+			for _, name := range qr.controlQueues() {
+				ctx, cancel := context.WithCancel(context.Background())
+				if _, _, err := qr.tasker.Work(ctx, qr.timeout, name, handleControl); err != nil {
+					logger.Info(fmt.Sprintf("%s:%s control queue could not be checked due to %s", qr.project, name, err.Error()))
+				}
+				cancel()
+			}
+		case <-quitC:
+			return
+		}
+	}
+}
+
+// controlQueues returns the control queues seen by the last refresh of the queuer
+//
+func (qr *Queuer) controlQueues() (names []string) {
+	qr.subs.Lock()
+	defer qr.subs.Unlock()
+
+	names = make([]string, 0, len(qr.controls))
+	for name := range qr.controls {
+		names = append(names, name)
+	}
+	return names
+}
+
+// serveControl accepts control messages POSTed as the body of a request, control messages must
+// be signed when signature checking is enabled
+//
+func serveControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "control messages must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, errGo := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Control messages POSTed to the runner are checked in the same way as those on control queues
+	msg, err := openControl(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	found, err := doControl(string(msg))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !found {
+		http.Error(w, "experiment not running", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// runAdmin starts the admin http server, if one is configured
+//
+func runAdmin(ctx context.Context) (err errors.Error) {
+	if len(*adminAddrOpt) == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control", serveControl)
+
+	h := &http.Server{
+		Addr:    *adminAddrOpt,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		h.Close()
+	}()
+
+	logger.Info(fmt.Sprintf("admin listening on %s", h.Addr))
+
+	if errGo := h.ListenAndServe(); errGo != nil && errGo != http.ErrServerClosed {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("address", *adminAddrOpt)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+// This file contains the claiming of experiments used to detect messages that the queue
+// server has delivered more than once, see dedup.go in the runner package for the stores
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/karlmutch/errors"
+)
+
+var (
+	dedupStoreOpt     = flag.String("dedup-store", "", "an optional URI used to claim experiments so that duplicate deliveries are acknowledged rather than run again, file:///dir for runners sharing a host, s3://endpoint/bucket/prefix or gs://bucket/prefix for runners sharing the storage")
+	dedupExpiryOpt    = flag.Duration("dedup-expiry", 30*time.Minute, "the time after which claims on experiments that have not been renewed by their runner are abandoned, 0 for claims that never expire")
+	dedupRetentionOpt = flag.Duration("dedup-retention", 14*24*time.Hour, "the time claims on finished experiments are kept, after which they are pruned and later deliveries of the experiment run again, 0 keeps them forever")
+
+	// dedup holds the store opened for the dedup-store option
+	dedup = &dedupSafe{}
+)
+
+type dedupSafe struct {
+	uri   string
+	store runner.DedupStore
+	sync.Mutex
+}
+
+// dedupStore returns the store used to claim experiments, nil when no store is configured
+//
+func dedupStore() (store runner.DedupStore, err errors.Error) {
+	dedup.Lock()
+	defer dedup.Unlock()
+
+	if dedup.store != nil && dedup.uri == *dedupStoreOpt {
+		return dedup.store, nil
+	}
+	dedup.store = nil
+	dedup.uri = *dedupStoreOpt
+	if len(dedup.uri) == 0 {
+		return nil, nil
+	}
+
+	// Object stores use the credentials of the runner itself rather than those of any one experiment
+	env := map[string]string{}
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_DEFAULT_REGION"} {
+		if v := os.Getenv(k); len(v) != 0 {
+			env[k] = v
+		}
+	}
+	if dedup.store, err = runner.NewDedupStore(dedup.uri, "", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), env, time.Minute); err != nil {
+		return nil, err
+	}
+	return dedup.store, nil
+}
+
+// serviceDedup prunes the claims that are no longer held from stores able to remove them, such as
+// finished claims older than the dedup-retention
+//
+func serviceDedup(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		store, err := dedupStore()
+		if err != nil {
+			logger.Warn(fmt.Sprintf("experiment claims not pruned due to %s", err.Error()))
+			continue
+		}
+		pruner, isPruner := store.(runner.DedupPruner)
+		if !isPruner {
+			continue
+		}
+		pruned, err := pruner.Prune(*dedupExpiryOpt, *dedupRetentionOpt)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("experiment claims not pruned due to %s", err.Error()))
+		}
+		if pruned != 0 {
+			logger.Debug(fmt.Sprintf("pruned %d experiment claims", pruned))
+		}
+	}
+}
+
+// experimentClaim is the claim held by this runner on an experiment while it is being run
+//
+type experimentClaim struct {
+	store runner.DedupStore
+	claim *runner.DedupClaim
+	stopC chan struct{}
+	done  bool
+	sync.Mutex
+}
+
+// claimExperiment claims the experiment for the delivery attempt in the context.  When another
+// delivery of the experiment already holds a claim its claim is returned as the holder.  A nil
+// claim is returned when no store is configured.
+//
+func claimExperiment(ctx context.Context, key string) (held *experimentClaim, holder *runner.DedupClaim, err errors.Error) {
+	store, err := dedupStore()
+	if err != nil || store == nil {
+		return nil, nil, err
+	}
+
+	claim := runner.NewDedupClaim(key, runner.DeliveryAttempt(ctx))
+	if holder, err = store.Claim(claim, *dedupExpiryOpt, *dedupRetentionOpt); err != nil || holder != nil {
+		return nil, holder, err
+	}
+
+	held = &experimentClaim{
+		store: store,
+		claim: claim,
+		stopC: make(chan struct{}),
+	}
+	if *dedupExpiryOpt > 0 {
+		go held.renew(*dedupExpiryOpt / 3)
+	}
+	return held, nil, nil
+}
+
+// renew refreshes the claim until it is settled so that it does not expire while the experiment runs
+//
+func (held *experimentClaim) renew(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			held.Lock()
+			err := errors.Error(nil)
+			if !held.done {
+				err = held.store.Renew(held.claim)
+			}
+			held.Unlock()
+			if err != nil {
+				logger.Warn(fmt.Sprintf("experiment %s claim not renewed due to %s", held.claim.Key, err.Error()))
+			}
+		case <-held.stopC:
+			return
+		}
+	}
+}
+
+// settle finishes the claim for experiments that will not be run again and otherwise releases
+// it so that the redelivered message can be run
+//
+func (held *experimentClaim) settle(finished bool) {
+	if held == nil {
+		return
+	}
+	close(held.stopC)
+
+	held.Lock()
+	defer held.Unlock()
+	held.done = true
+
+	err := errors.Error(nil)
+	if finished {
+		err = held.store.Finish(held.claim)
+	} else {
+		err = held.store.Release(held.claim)
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("experiment %s claim not settled due to %s", held.claim.Key, err.Error()))
+	}
+}
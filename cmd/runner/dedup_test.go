@@ -0,0 +1,52 @@
+package main
+
+// This file contains tests for the claims used to detect duplicate deliveries of experiments
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/xid"
+)
+
+// TestDedupClaims checks that experiments are only claimed by one delivery at a time and that
+// settled claims either allow, or prevent, later deliveries from running
+//
+func TestDedupClaims(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "dedup")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	oldStore := *dedupStoreOpt
+	*dedupStoreOpt = "file://" + dir
+	defer func() {
+		*dedupStoreOpt = oldStore
+	}()
+
+	ctx := context.Background()
+	key := "dedup-" + xid.New().String()
+
+	held, holder, err := claimExperiment(ctx, key)
+	if err != nil || held == nil || holder != nil {
+		t.Fatalf("experiment not claimed, holder %+v, error %v", holder, err)
+	}
+	if _, holder, err = claimExperiment(ctx, key); err != nil || holder == nil {
+		t.Fatalf("duplicate delivery was not detected, error %v", err)
+	}
+
+	// Experiments that are to be retried release their claims
+	held.settle(false)
+	if held, holder, err = claimExperiment(ctx, key); err != nil || held == nil {
+		t.Fatalf("retried experiment not claimed, holder %+v, error %v", holder, err)
+	}
+
+	held.settle(true)
+	if _, holder, err = claimExperiment(ctx, key); err != nil || holder == nil || !holder.Finished {
+		t.Fatalf("finished experiment was claimed again, holder %+v, error %v", holder, err)
+	}
+}
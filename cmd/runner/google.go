@@ -84,7 +84,7 @@ func refreshGoogleCerts(dir string, timeout time.Duration) (found map[string]str
 				}
 
 				// If so include it
-				found[project] = path
+				found["pubsub://"+project] = path
 			} else {
 				logger.Trace(fmt.Sprintf("did not match %s (%s)", f.Name(), path))
 			}
@@ -0,0 +1,70 @@
+package main
+
+// This file contains the node labels the runner advertises and which are tested
+// against the constraints experiments place on the nodes they can run on
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/karlmutch/errors"
+)
+
+var (
+	labelsOpt = flag.String("labels", "", "an optional comma separated list of name=value labels that experiment constraints can select, for example zone=us-west")
+
+	nodeLabels = &NodeLabelsSafe{}
+)
+
+// NodeLabelsSafe guards the labels that are initialized once the runner options are known
+//
+type NodeLabelsSafe struct {
+	labels runner.Labels
+	sync.Mutex
+}
+
+// initNodeLabels builds the label set from the hardware and the labels specified on the command line
+//
+func initNodeLabels() (err errors.Error) {
+	operator, err := runner.ParseLabels(*labelsOpt)
+	if err != nil {
+		return err
+	}
+
+	labels := runner.NewNodeLabels(operator)
+
+	nodeLabels.Lock()
+	nodeLabels.labels = labels
+	nodeLabels.Unlock()
+
+	names := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if k == "cpu.flags" {
+			v = []string{fmt.Sprintf("%d flags", len(v))}
+		}
+		names = append(names, k+"="+strings.Join(v, "|"))
+	}
+	sort.Strings(names)
+	logger.Debug(fmt.Sprintf("node labels %s", strings.Join(names, ", ")))
+
+	return nil
+}
+
+// unmetConstraints returns the constraints of the resource that this node cannot satisfy
+//
+func unmetConstraints(rsc *runner.Resource) (unmet []string, err errors.Error) {
+	if rsc == nil || len(rsc.Constraints) == 0 {
+		return nil, nil
+	}
+
+	nodeLabels.Lock()
+	labels := nodeLabels.labels
+	nodeLabels.Unlock()
+
+	return rsc.Unmet(labels)
+}
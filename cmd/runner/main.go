@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
@@ -31,8 +32,11 @@ var (
 
 	logger = runner.NewLogger("runner")
 
-	amqpURL    = flag.String("amqp-url", "", "The URI for an amqp message exchange through which StudioML is being sent")
-	queueMatch = flag.String("queue-match", "^(rmq|sqs)_.*$", "User supplied regular expression that needs to match a queues name to be considered for work")
+	amqpURL        = flag.String("amqp-url", "", "The URI for an amqp message exchange through which StudioML is being sent")
+	localQueuesOpt = flag.String("local-queues", "", "The file:// URI of a spool directory, containing one directory per queue, through which StudioML is being sent")
+	redisURL       = flag.String("redis-url", "", "The redis:// URI of a redis server whose streams StudioML is being sent through")
+	natsURL        = flag.String("nats-url", "", "The nats://, or nats+tls://, URI of a NATS JetStream server whose streams StudioML is being sent through")
+	queueMatch     = flag.String("queue-match", "^(rmq|sqs|local|redis|nats)_.*$", "User supplied regular expression that needs to match a queues name to be considered for work")
 
 	googleCertsDirOpt = flag.String("google-certs", "/opt/studioml/google-certs", "Directory containing certificate files used to access studio projects [Mandatory]. Does not descend.")
 	tempOpt           = flag.String("working-dir", setTemp(), "the local working directory being used for runner storage, defaults to env var %TMPDIR, or /tmp")
@@ -101,10 +105,10 @@ func usage() {
 
 func resourceLimits() (cores uint, mem uint64, storage uint64, err error) {
 	cores = *maxCoresOpt
-	if mem, err = humanize.ParseBytes(*maxMemOpt); err != nil {
+	if mem, err = runner.ParseBytes(*maxMemOpt); err != nil {
 		return 0, 0, 0, err
 	}
-	if storage, err = humanize.ParseBytes(*maxDiskOpt); err != nil {
+	if storage, err = runner.ParseBytes(*maxDiskOpt); err != nil {
 		return 0, 0, 0, err
 	}
 	return cores, mem, storage, err
@@ -264,16 +268,16 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 	if TestMode {
 		logger.Warn("running in test mode, queue validation not performed")
 	} else {
-		if len(*googleCertsDirOpt) == 0 && len(*sqsCertsDirOpt) == 0 && len(*amqpURL) == 0 {
-			errs = append(errs, errors.New("One of the amqp-url, sqs-certs, or google-certs options must be set for the runner to work"))
+		if len(*googleCertsDirOpt) == 0 && len(*sqsCertsDirOpt) == 0 && len(*amqpURL) == 0 && len(*localQueuesOpt) == 0 && len(*redisURL) == 0 && len(*natsURL) == 0 {
+			errs = append(errs, errors.New("One of the amqp-url, redis-url, nats-url, local-queues, sqs-certs, or google-certs options must be set for the runner to work"))
 		} else {
 			stat, err := os.Stat(*googleCertsDirOpt)
 			if err != nil || !stat.Mode().IsDir() {
 				stat, err = os.Stat(*sqsCertsDirOpt)
 				if err != nil || !stat.Mode().IsDir() {
-					if len(*amqpURL) == 0 {
+					if len(*amqpURL) == 0 && len(*localQueuesOpt) == 0 && len(*redisURL) == 0 && len(*natsURL) == 0 {
 						msg := fmt.Sprintf(
-							"One of the sqs-certs, or google-certs options must be set to an existing directory, or amqp-url is specified, for the runner to perform any useful work (%s,%s)",
+							"One of the sqs-certs, or google-certs options must be set to an existing directory, or amqp-url, redis-url, nats-url, or local-queues is specified, for the runner to perform any useful work (%s,%s)",
 							*googleCertsDirOpt, *sqsCertsDirOpt)
 						errs = append(errs, errors.New(msg))
 					}
@@ -282,12 +286,67 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 		}
 	}
 
-	if len(*amqpURL) != 0 {
+	if err := initTrustedKeys(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := initEnvKey(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := initNodeLabels(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(*amqpURL) != 0 || len(*localQueuesOpt) != 0 || len(*redisURL) != 0 || len(*natsURL) != 0 {
 		if _, errGo := regexp.Compile(*queueMatch); errGo != nil {
 			errs = append(errs, errors.Wrap(errGo))
 		}
 	}
 
+	if _, err := loadPriorities(*queuePrioritiesOpt); err != nil {
+		errs = append(errs, err)
+	}
+
+	if *queueConcurrencyOpt < 0 {
+		errs = append(errs, errors.New("the queue-concurrency option must not be negative").With("queue-concurrency", *queueConcurrencyOpt))
+	}
+
+	if len(*controlMatchOpt) != 0 {
+		if _, errGo := regexp.Compile(*controlMatchOpt); errGo != nil {
+			errs = append(errs, errors.Wrap(errGo).With("control-match", *controlMatchOpt))
+		}
+	}
+
+	if len(*localQueuesOpt) != 0 {
+		if uri, errGo := url.Parse(*localQueuesOpt); errGo != nil || uri.Scheme != "file" {
+			errs = append(errs, errors.New("the local-queues option must be a file:// URI").With("local-queues", *localQueuesOpt))
+		}
+	}
+
+	if _, err := dedupStore(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(*amqpURL) != 0 {
+		// Creating the queue validates the URI along with the exchange, management and TLS options
+		if _, err := runner.NewRabbitMQ(*amqpURL, runner.RabbitMQFlagOptions()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(*redisURL) != 0 {
+		if uri, errGo := url.Parse(*redisURL); errGo != nil || (uri.Scheme != "redis" && uri.Scheme != "rediss") {
+			errs = append(errs, errors.New("the redis-url option must be a redis:// or rediss:// URI"))
+		}
+	}
+
+	if len(*natsURL) != 0 {
+		if uri, errGo := url.Parse(*natsURL); errGo != nil || (uri.Scheme != "nats" && uri.Scheme != "nats+tls") {
+			errs = append(errs, errors.New("the nats-url option must be a nats:// or nats+tls:// URI"))
+		}
+	}
+
 	// Now check for any fatal errors before allowing the system to continue.  This allows
 	// all errors that could have ocuured as a result of incorrect options to be flushed
 	// out rather than having a frustrating single failure at a time loop for users
@@ -311,6 +370,21 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 		}
 	}()
 
+	// start the admin http server used to control running experiments
+	go func() {
+		if err := runAdmin(quitCtx); err != nil {
+			logger.Warn(err.Error())
+		}
+	}()
+
+	// Reload the keys used to check message signatures on a regular basis
+	//
+	go serviceTrustedKeys(quitCtx, time.Minute)
+
+	// Remove the experiment claims that are no longer needed to detect duplicate deliveries
+	//
+	go serviceDedup(quitCtx, time.Hour)
+
 	// Create a component that listens to a credentials directory
 	// and starts and stops run methods as needed based on the credentials
 	// it has for the Google cloud infrastructure
@@ -328,5 +402,16 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 	//
 	go serviceRMQ(quitCtx, time.Minute, 15*time.Second)
 
+	// Create components that watch a local spool directory, a redis server, and a NATS
+	// JetStream server for queues carrying work
+	//
+	for option, uri := range map[string]string{"local-queues": *localQueuesOpt, "redis-url": *redisURL, "nats-url": *natsURL} {
+		if len(uri) == 0 {
+			logger.Info(fmt.Sprintf("%s services disabled", option))
+			continue
+		}
+		go serviceURI(quitCtx, uri, time.Minute, 15*time.Second)
+	}
+
 	return nil
 }
@@ -0,0 +1,180 @@
+package main
+
+// This file contains the implementation of the priorities and weights used to choose the
+// next queue checked for work.  Priorities come from a runner configuration file or, when a
+// queue is not listed in the file, from the tags, labels or arguments of the queue.
+//
+// Idle queues with the highest priority are checked first.  Between queues of the same priority
+// checks are shared according to the queue weights, and queues gain a level of priority for each
+// starvation interval they wait so that lower priority queues are still checked.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	queuePrioritiesOpt = flag.String("queue-priorities", "", "an optional JSON file containing an array of {\"match\": regexp, \"priority\": int, \"weight\": float} items applied to matching queue names, overriding priorities set on the queues")
+	queueStarvationOpt = flag.Duration("queue-starvation", 10*time.Minute, "the time an idle queue waits before its priority is raised by one level, 0 disables raising priorities")
+)
+
+// priorityRule assigns a priority and weight to the queues whose names match an expression
+//
+type priorityRule struct {
+	Match string `json:"match"`
+	runner.QueuePriority
+	matcher *regexp.Regexp
+}
+
+// loadPriorities reads the priority rules from a configuration file, an empty file name
+// results in no rules
+//
+func loadPriorities(fn string) (rules []priorityRule, err errors.Error) {
+	rules = []priorityRule{}
+	if len(fn) == 0 {
+		return rules, nil
+	}
+
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	if errGo = json.Unmarshal(data, &rules); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+
+	for i, rule := range rules {
+		if rules[i].matcher, errGo = regexp.Compile(rule.Match); errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn).With("match", rule.Match)
+		}
+		if rule.Weight == 0 {
+			rules[i].Weight = runner.DefaultQueuePriority.Weight
+		}
+		if rule.Weight < 0 {
+			return nil, errors.New("queue weights must be positive").With("stack", stack.Trace().TrimRuntime()).With("file", fn).With("match", rule.Match)
+		}
+	}
+	return rules, nil
+}
+
+// matchPriority returns the priority of the first rule matching the queue name.  The bare name of
+// the queue is matched, in the same way as the queue-match option, rather than the subscription
+// returned by the refresh of the task queue.
+//
+func matchPriority(rules []priorityRule, tasker runner.TaskQueue, subscription string) (priority runner.QueuePriority, isPresent bool) {
+	name := runner.QueueName(tasker, subscription)
+	for _, rule := range rules {
+		if rule.matcher.MatchString(name) {
+			return rule.QueuePriority, true
+		}
+	}
+	return runner.DefaultQueuePriority, false
+}
+
+// prioritize updates the priorities of the known queues, queues whose priorities cannot be
+// retrieved retain any they had
+//
+func (qr *Queuer) prioritize() {
+
+	// The file is read on every refresh allowing priorities to be changed while the runner is running
+	rules, err := loadPriorities(*queuePrioritiesOpt)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("%s queue priorities not loaded due to %s", qr.project, err.Error()))
+	}
+	prioritizer, _ := qr.tasker.(runner.QueuePrioritizer)
+
+	for _, sub := range qr.rank() {
+		priority, isPresent := matchPriority(rules, qr.tasker, sub.name)
+		if !isPresent && prioritizer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), qr.timeout)
+			priority, isPresent, err = prioritizer.Priority(ctx, sub.name)
+			cancel()
+			if err != nil {
+				logger.Debug(fmt.Sprintf("%s:%s priority not retrieved due to %s", qr.project, sub.name, err.Error()))
+				continue
+			}
+		}
+		if !isPresent {
+			priority = runner.DefaultQueuePriority
+		}
+		qr.subs.setPriority(sub.name, priority)
+	}
+}
+
+// setPriority records the priority and weight of a queue
+//
+func (subs *Subscriptions) setPriority(name string, priority runner.QueuePriority) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	if q, isPresent := subs.subs[name]; isPresent {
+		q.priority = priority
+	}
+}
+
+// checked records that a queue was chosen to be checked for work, increasing its share of
+// checks by an amount that is smaller for queues with larger weights
+//
+func (subs *Subscriptions) checked(name string, now time.Time) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	if q, isPresent := subs.subs[name]; isPresent {
+		q.share += 1 / q.priority.Weight
+		q.waiting = now
+	}
+}
+
+// minShare returns the smallest share of checks held by a queue, queues that are added start
+// with this share so that they do not take every check until they catch up with older queues.
+// The caller is expected to hold the subs lock.
+//
+func (subs *Subscriptions) minShare() (share float64) {
+	first := true
+	for _, q := range subs.subs {
+		if first || q.share < share {
+			share = q.share
+			first = false
+		}
+	}
+	return share
+}
+
+// effectivePriority is the priority of a queue after it has been raised for the time it has
+// waited to be checked
+//
+func (sub *Subscription) effectivePriority(now time.Time, starvation time.Duration) (priority int) {
+	priority = sub.priority.Priority
+	if starvation > 0 && now.After(sub.waiting) {
+		priority += int(now.Sub(sub.waiting) / starvation)
+	}
+	return priority
+}
+
+// pickQueue selects the queue to be checked next from the idle queues, the queue with the
+// highest effective priority is chosen, and between queues of equal priority the queue with
+// the smallest share of checks.  The first queue wins any remaining tie.
+//
+func pickQueue(idle []Subscription, now time.Time, starvation time.Duration) (picked Subscription) {
+	picked = idle[0]
+	pickedPriority := picked.effectivePriority(now, starvation)
+
+	for _, sub := range idle[1:] {
+		priority := sub.effectivePriority(now, starvation)
+		if priority > pickedPriority || (priority == pickedPriority && sub.share < picked.share) {
+			picked = sub
+			pickedPriority = priority
+		}
+	}
+	return picked
+}
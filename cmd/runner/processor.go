@@ -25,7 +25,6 @@ import (
 	"github.com/SentientTechnologies/studio-go-runner"
 	"github.com/davecgh/go-spew/spew"
 
-	"github.com/dustin/go-humanize"
 	"github.com/karlmutch/go-shortid"
 
 	"github.com/go-stack/stack"
@@ -38,11 +37,14 @@ type processor struct {
 	ExprDir    string            `json:"expr_dir"`
 	ExprSubDir string            `json:"expr_sub_dir"`
 	ExprEnvs   map[string]string `json:"expr_envs"`
+	secrets    map[string]string // Decrypted env values, passed to the experiment using its process environment only
 	Request    *runner.Request   `json:"request"` // merge these two fields, to avoid split data in a DB and some in JSON
 	Creds      string            `json:"credentials_file"`
 	Artifacts  *runner.ArtifactCache
 	Executor   Executor
-	ready      chan bool // Used by the processor to indicate it has released resources or state has changed
+	events     *runner.EventPublisher // Lifecycle events are sent to the reply queue of the experiment, if any
+	terminated bool                   // Set once a finished or failed event has been sent
+	stop       cancellation           // Used by control messages to cancel the experiment
 }
 
 type TempSafe struct {
@@ -109,16 +111,18 @@ type Executor interface {
 	// Make is used to allow a script to be generated for the specific run strategy being used
 	Make(alloc *runner.Allocated, e interface{}) (err errors.Error)
 
-	// Run will execute the worker task used by the experiment
-	Run(ctx context.Context, refresh map[string]runner.Artifact) (err errors.Error)
+	// Run will execute the worker task used by the experiment, secrets are added to the environment
+	// of the experiment without appearing in generated scripts or logs
+	Run(ctx context.Context, refresh map[string]runner.Artifact, secrets map[string]string) (err errors.Error)
 
 	// Close can be used to tidy up after an experiment has completed
 	Close() (err errors.Error)
 }
 
-// newProcessor will create a new working directory
+// newProcessor will create a new working directory for a request that has already been
+// validated
 //
-func newProcessor(group string, msg []byte, creds string, quitC <-chan struct{}) (proc *processor, err errors.Error) {
+func newProcessor(group string, rqst *runner.Request, creds string, quitC <-chan struct{}) (proc *processor, err errors.Error) {
 
 	// When a processor is initialized make sure that the logger is enabled first time through
 	//
@@ -156,13 +160,7 @@ func newProcessor(group string, msg []byte, creds string, quitC <-chan struct{})
 		RootDir: temp,
 		Group:   group,
 		Creds:   creds,
-		ready:   make(chan bool),
-	}
-
-	// restore the msg into the processing data structure from the JSON queue payload
-	p.Request, err = runner.UnmarshalRequest(msg)
-	if err != nil {
-		return nil, err
+		Request: rqst,
 	}
 
 	if _, err = p.mkUniqDir(); err != nil {
@@ -226,6 +224,19 @@ func (p *processor) Close() (err error) {
 	return os.RemoveAll(p.ExprDir)
 }
 
+// event publishes the stage the experiment has reached to the reply queue of the experiment,
+// failing to do so is logged but does not interrupt the experiment
+//
+func (p *processor) event(stage runner.LifecycleStage, failure error) {
+	if stage == runner.StageFinished || stage == runner.StageFailed {
+		p.terminated = true
+	}
+	if err := p.events.Publish(stage, failure); err != nil {
+		logger.Warn(fmt.Sprintf("%s %s %s event not published due to %s", p.Request.Config.Database.ProjectId,
+			p.Request.Experiment.Key, stage, err.Error()))
+	}
+}
+
 // fetchAll is used to retrieve from the storage system employed by studioml any and all available
 // artifacts and to unpack them into the experiment directory
 //
@@ -248,7 +259,7 @@ func (p *processor) fetchAll() (err errors.Error) {
 		// The current convention is that the archives include the directory name under which
 		// the files are unpacked in their table of contents
 		//
-		if warns, err := artifactCache.Fetch(&artifact, p.Request.Config.Database.ProjectId, group, p.Creds, p.ExprEnvs, p.ExprDir); err != nil {
+		if warns, err := artifactCache.Fetch(&artifact, p.Request.Config.Database.ProjectId, group, p.Creds, p.artifactEnv(), p.ExprDir); err != nil {
 			logger.Warn(err.With("group", group).With("project", p.Request.Config.Database.ProjectId).With("Experiment", p.Request.Experiment.Key).Error())
 			for _, warn := range warns {
 				logger.Warn(warn.With("group", group).With("project", p.Request.Config.Database.ProjectId).With("Experiment", p.Request.Experiment.Key).Error())
@@ -263,11 +274,38 @@ func (p *processor) fetchAll() (err errors.Error) {
 	return nil
 }
 
+// recordGit fills in the git provenance of the experiment using the fetched workspace when it
+// was sent along with its git metadata.  Values sent by the client are kept, with any that are
+// missing taken from the workspace.
+//
+func (p *processor) recordGit() {
+	found := runner.WorkspaceGit(filepath.Join(p.ExprDir, "workspace"))
+	if found == nil {
+		return
+	}
+
+	g := p.Request.Experiment.Git
+	if g == nil {
+		p.Request.Experiment.Git = found
+		return
+	}
+	if len(g.Repo) == 0 {
+		g.Repo = found.Repo
+	}
+	if len(g.Commit) == 0 {
+		g.Commit = found.Commit
+	}
+	if len(g.Branch) == 0 {
+		g.Branch = found.Branch
+	}
+	g.Dirty = g.Dirty || found.Dirty
+}
+
 // returnOne is used to upload a single artifact to the data store specified by the experimenter
 //
 func (p *processor) returnOne(group string, artifact runner.Artifact) (uploaded bool, warns []errors.Error, err errors.Error) {
 
-	uploaded, warns, err = artifactCache.Restore(&artifact, p.Request.Config.Database.ProjectId, group, p.Creds, p.ExprEnvs, p.ExprDir)
+	uploaded, warns, err = artifactCache.Restore(&artifact, p.Request.Config.Database.ProjectId, group, p.Creds, p.artifactEnv(), p.ExprDir)
 	if err != nil {
 		runner.WarningSlack(p.Request.Config.Runner.SlackDest, fmt.Sprintf("output from %s %s %v could not be returned due to %s", p.Request.Config.Database.ProjectId,
 			p.Request.Experiment.Key, artifact, err.Error()), []string{})
@@ -341,28 +379,22 @@ func (p *processor) allocate() (alloc *runner.Allocated, err errors.Error) {
 		Group: p.Group,
 	}
 
-	// Before continuing locate GPU resources for the task that has been received
+	// The resource values were parsed when the request was received and are exact
 	//
-	var errGo error
-	// The GPU values are optional and default to 0
-	if 0 != len(p.Request.Experiment.Resource.GpuMem) {
-		if rqst.MaxGPUMem, errGo = runner.ParseBytes(p.Request.Experiment.Resource.GpuMem); errGo != nil {
-			msg := fmt.Sprintf("could not handle the gpuMem value %s", p.Request.Experiment.Resource.GpuMem)
-			// TODO Add an output function here for Issues #4, https://github.com/SentientTechnologies/studio-go-runner/issues/4
-			return nil, errors.Wrap(errGo, msg).With("stack", stack.Trace().TrimRuntime())
-		}
+	values, err := p.Request.Experiment.Resource.Quantities()
+	if err != nil {
+		// TODO Add an output function here for Issues #4, https://github.com/SentientTechnologies/studio-go-runner/issues/4
+		return nil, err
 	}
 
-	rqst.MaxGPU = uint(p.Request.Experiment.Resource.Gpus)
+	rqst.MaxGPU = values.Gpus
+	rqst.MaxGPUMem = values.GpuMem
 
-	rqst.MaxCPU = uint(p.Request.Experiment.Resource.Cpus)
-	if rqst.MaxMem, errGo = humanize.ParseBytes(p.Request.Experiment.Resource.Ram); errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-	}
-	if rqst.MaxDisk, errGo = humanize.ParseBytes(p.Request.Experiment.Resource.Hdd); errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-	}
+	rqst.MaxMilliCPU = values.MilliCPU
+	rqst.MaxMem = values.Ram
+	rqst.MaxDisk = values.Hdd
 
+	var errGo error
 	if alloc, errGo = resources.AllocResources(rqst); errGo != nil {
 		msg := fmt.Sprintf("alloc %s failed", spew.Sdump(p.Request.Experiment.Resource))
 		return nil, errors.Wrap(errGo, msg).With("stack", stack.Trace().TrimRuntime())
@@ -373,7 +405,9 @@ func (p *processor) allocate() (alloc *runner.Allocated, err errors.Error) {
 	return alloc, nil
 }
 
-// deallocate first releases resources and then triggers a ready channel to notify any listener that the
+// deallocate first releases resources and then wakes the queue producers so that the capacity
+// released is offered to queues straight away
+//
 func (p *processor) deallocate(alloc *runner.Allocated) {
 
 	if errs := alloc.Release(); len(errs) != 0 {
@@ -384,12 +418,7 @@ func (p *processor) deallocate(alloc *runner.Allocated) {
 		logger.Debug(fmt.Sprintf("released %s", spew.Sdump(*alloc)))
 	}
 
-	// Only wait a second to alter others that the resources have been released
-	//
-	select {
-	case <-time.After(time.Second):
-	case p.ready <- true:
-	}
+	producers.wakeAll()
 }
 
 // ProcessMsg is the main function where experiment processing occurs.
@@ -402,12 +431,15 @@ func (p *processor) Process(ctx context.Context) (wait time.Duration, ack bool,
 	// the allocation we received
 	alloc, err := p.allocate()
 	if err != nil {
-		return errBackoff, false, errors.Wrap(err, "allocation fail backing off").With("stack", stack.Trace().TrimRuntime())
+		err = errors.Wrap(err, "allocation fail backing off").With("stack", stack.Trace().TrimRuntime())
+		return errBackoff, false, err
 	}
 
 	// Setup a function to release resources that have been allocated
 	defer p.deallocate(alloc)
 
+	p.event(runner.StageAllocated, nil)
+
 	// Use a panic handler to catch issues related to, or unrelated to the runner
 	//
 	defer func() {
@@ -416,13 +448,23 @@ func (p *processor) Process(ctx context.Context) (wait time.Duration, ack bool,
 		}
 	}()
 
+	// Record the times the experiment ran for so that they are available to anything
+	// reporting on the experiment
+	p.Request.Experiment.TimeStarted = runner.NewTimestamp(time.Now())
+	defer func() {
+		p.Request.Experiment.TimeFinished = runner.NewTimestamp(time.Now())
+	}()
+
 	// The allocation details are passed in to the runner to allow the
 	// resource reservations to become known to the running applications.
-	// This call will block until the task stops processing.
+	// This call will block until the task stops processing.  Failures are
+	// reported by the caller once it is known whether the experiment will
+	// be retried.
 	if _, err = p.deployAndRun(ctx, alloc); err != nil {
 		return time.Duration(0), true, err
 	}
 
+	p.event(runner.StageFinished, nil)
 	return time.Duration(0), true, nil
 }
 
@@ -552,9 +594,15 @@ func extractValidEnv() (envs map[string]string) {
 //
 // This behavior is specific to the go runner at this time.
 //
-func (p *processor) applyEnv(alloc *runner.Allocated) {
+// Values that were encrypted by the client are decrypted into the secrets of the processor
+// only, the request retains the encrypted form so that the plain text is never logged or
+// returned with the experiment.  Secrets are kept out of the generated scripts, which echo
+// their contents into the experiment output.
+//
+func (p *processor) applyEnv(alloc *runner.Allocated) (err errors.Error) {
 
 	p.ExprEnvs = extractValidEnv()
+	p.secrets = map[string]string{}
 
 	// Expand %...% pairs by iterating the env table for the process and explicitly replacing on each line
 	re := regexp.MustCompile(`(?U)(?:\%(.*)*\%)+`)
@@ -562,6 +610,15 @@ func (p *processor) applyEnv(alloc *runner.Allocated) {
 	// Environment variables need to be applied here to assist in unpacking S3 files etc
 	for k, v := range p.Request.Config.Env {
 
+		if runner.IsEncryptedEnvValue(v) {
+			plain, err := decryptEnv(k, v)
+			if err != nil {
+				return err
+			}
+			p.secrets[k] = plain
+			continue
+		}
+
 		for _, match := range re.FindAllString(v, -1) {
 			if envV := os.Getenv(match[1 : len(match)-1]); len(envV) != 0 {
 				v = strings.Replace(envV, match, envV, -1)
@@ -587,6 +644,21 @@ func (p *processor) applyEnv(alloc *runner.Allocated) {
 			p.ExprEnvs[k] = v
 		}
 	}
+	return nil
+}
+
+// artifactEnv returns the environment used to access the storage of artifacts, which can need
+// the credentials held in the secrets of the experiment
+//
+func (p *processor) artifactEnv() (env map[string]string) {
+	env = make(map[string]string, len(p.ExprEnvs)+len(p.secrets))
+	for k, v := range p.ExprEnvs {
+		env[k] = v
+	}
+	for k, v := range p.secrets {
+		env[k] = v
+	}
+	return env
 }
 
 func (p *processor) calcTimeLimit() (maxDuration time.Duration) {
@@ -632,6 +704,9 @@ func (p *processor) doOutput(refresh map[string]runner.Artifact) {
 	for group, artifact := range refresh {
 		p.returnOne(group, artifact)
 	}
+	p.Request.Experiment.TimeLastCheckpoint = runner.NewTimestamp(time.Now())
+
+	p.event(runner.StageCheckpointed, nil)
 }
 
 func (p *processor) checkpointOutput(refresh map[string]runner.Artifact, quitC chan bool) (doneC chan bool) {
@@ -692,7 +767,7 @@ func (p *processor) runScript(ctx context.Context, refresh map[string]runner.Art
 	doneC := p.checkpointOutput(refresh, quitC)
 
 	// Blocking call to run the process that uses the ctx for timeouts etc
-	err = p.Executor.Run(ctx, refresh)
+	err = p.Executor.Run(ctx, refresh, p.secrets)
 
 	// Notify the checkpointer that things are done with
 	close(quitC)
@@ -731,6 +806,7 @@ func (p *processor) run(alloc *runner.Allocated, ctx context.Context) (err error
 
 	fmt.Printf("alloc sent to Make is %+v\n", alloc.GPU)
 	// Now we have the files locally stored we can begin the work
+	p.event(runner.StageBuildingEnv, nil)
 	if err = p.Executor.Make(alloc, p); err != nil {
 		return err
 	}
@@ -776,6 +852,7 @@ func (p *processor) run(alloc *runner.Allocated, ctx context.Context) (err error
 
 	// Blocking call to run the script and only return when done.  Cancellation is done
 	// if needed using the cancel function created by the context
+	p.event(runner.StageRunning, nil)
 	err = p.runScript(runCtx, refresh)
 
 	// Send any output to the slack reporter
@@ -793,7 +870,9 @@ func (p *processor) deployAndRun(ctx context.Context, alloc *runner.Allocated) (
 	}
 
 	// Update and apply environment variables for the experiment
-	p.applyEnv(alloc)
+	if err = p.applyEnv(alloc); err != nil {
+		return warns, err
+	}
 
 	if *debugOpt {
 		// The following log can expose passwords etc.  As a result we do not allow it unless the debug
@@ -803,16 +882,27 @@ func (p *processor) deployAndRun(ctx context.Context, alloc *runner.Allocated) (
 
 	// fetchAll when called will have access to the environment variables used by the experiment in order that
 	// credentials can be used
+	p.event(runner.StageFetching, nil)
 	if err = p.fetchAll(); err != nil {
 		return warns, err
 	}
+	p.recordGit()
 
 	// Blocking call to run the task
 	if err = p.run(alloc, ctx); err != nil {
+		// Experiments that were cancelled return any output they produced before being stopped
+		if p.stop.isCancelled() {
+			p.event(runner.StageReturning, nil)
+			if _, errRtn := p.returnAll(); errRtn != nil {
+				logger.Warn(fmt.Sprintf("%s %s cancelled output not returned due to %s", p.Request.Config.Database.ProjectId,
+					p.Request.Experiment.Key, errRtn.Error()))
+			}
+		}
 		// TODO: We could push work back onto the queue at this point if needed
 		// TODO: If the failure was related to the healthcheck then requeue and backoff the queue
 		return warns, err
 	}
 
+	p.event(runner.StageReturning, nil)
 	return p.returnAll()
 }
@@ -0,0 +1,122 @@
+package main
+
+// This file contains the gauges used to export the depth, messages in flight, and age of the
+// oldest message of the queues seen by the runner, allowing the size of runner pools to follow
+// the work waiting for them
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueMetricsOpt = flag.Duration("queue-metrics-interval", 30*time.Second, "the interval at which the depth, messages in flight, and age of the oldest message of queues are measured and exported, 0 disables the queue gauges")
+
+	queueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_depth",
+			Help: "Number of messages waiting to be delivered from a queue.",
+		},
+		[]string{"project", "queue"},
+	)
+	queueInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_in_flight",
+			Help: "Number of messages delivered from a queue that are not yet acknowledged.",
+		},
+		[]string{"project", "queue"},
+	)
+	queueAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_oldest_age_seconds",
+			Help: "Age of the oldest message waiting to be delivered from a queue.",
+		},
+		[]string{"project", "queue"},
+	)
+)
+
+func init() {
+	for _, gauge := range []*prometheus.GaugeVec{queueDepth, queueInFlight, queueAge} {
+		if errGo := prometheus.Register(gauge); errGo != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
+
+// setGauge reports a metric, metrics the queue server was unable to supply are removed
+//
+func setGauge(gauge *prometheus.GaugeVec, labels prometheus.Labels, value float64) {
+	if value < 0 {
+		gauge.Delete(labels)
+		return
+	}
+	gauge.With(labels).Set(value)
+}
+
+// forget removes the gauges of queues that have gone away
+//
+func (qr *Queuer) forget(removed []string) {
+	for _, name := range removed {
+		labels := prometheus.Labels{"project": qr.project, "queue": name}
+		queueDepth.Delete(labels)
+		queueInFlight.Delete(labels)
+		queueAge.Delete(labels)
+	}
+}
+
+// measurer updates the gauges of the queues on a regular basis until the queuer is stopped.  It
+// runs apart from the refresh of the queues, which happens far less often, so that slow queue
+// servers do not hold up the discovery of queues.
+//
+func (qr *Queuer) measurer(quitC chan bool) {
+	if qr.metricsInterval <= 0 {
+		return
+	}
+
+	tick := time.NewTicker(qr.metricsInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			qr.measure()
+		case <-quitC:
+			return
+		}
+	}
+}
+
+// measure updates the gauges of the queues known to the queuer
+//
+func (qr *Queuer) measure() {
+
+	inspector, isInspector := qr.tasker.(runner.QueueInspector)
+	if !isInspector {
+		return
+	}
+
+	for _, sub := range qr.rank() {
+		ctx, cancel := context.WithTimeout(context.Background(), qr.timeout)
+		metrics, err := inspector.Metrics(ctx, sub.name)
+		cancel()
+		if err != nil {
+			logger.Debug(fmt.Sprintf("%s:%s metrics not retrieved due to %s", qr.project, sub.name, err.Error()))
+			metrics = runner.UnknownQueueMetrics
+		}
+
+		labels := prometheus.Labels{"project": qr.project, "queue": sub.name}
+		setGauge(queueDepth, labels, float64(metrics.Depth))
+		setGauge(queueInFlight, labels, float64(metrics.InFlight))
+		setGauge(queueAge, labels, metrics.Age.Seconds())
+	}
+}
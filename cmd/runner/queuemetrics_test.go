@@ -0,0 +1,83 @@
+package main
+
+// This file contains tests for the gauges exporting the metrics of queues
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/xid"
+)
+
+// TestQueuerMetrics checks that the depth and messages in flight of queues are exported by the
+// measurer, rather than the refresh of the queues, and are removed once the queue goes away
+//
+func TestQueuerMetrics(t *testing.T) {
+
+	qr, mq, request := newMemQueuer(t, nil)
+	for i := 0; i != 2; i++ {
+		if err := mq.Send(request.subscription, []byte(xid.New().String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := qr.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := prometheus.Labels{"project": request.project, "queue": request.subscription}
+	if queueDepth.Delete(labels) {
+		t.Fatal("gauge was measured by the refresh")
+	}
+
+	qr.metricsInterval = 10 * time.Millisecond
+	quitC := make(chan bool)
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		qr.measurer(quitC)
+	}()
+
+	// Wait for the measurer to have exported the depth of the queue
+	for timeout := time.Now().Add(10 * time.Second); ; {
+		m := &dto.Metric{}
+		if errGo := queueDepth.With(labels).Write(m); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if m.GetGauge().GetValue() != 0 {
+			break
+		}
+		if time.Now().After(timeout) {
+			t.Fatal("gauge was not measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(quitC)
+	<-doneC
+
+	for _, expected := range []struct {
+		gauge *prometheus.GaugeVec
+		value float64
+	}{
+		{queueDepth, 3},
+		{queueInFlight, 0},
+	} {
+		m := &dto.Metric{}
+		if errGo := expected.gauge.With(labels).Write(m); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if m.GetGauge().GetValue() != expected.value {
+			t.Fatalf("gauge value %f rather than %f", m.GetGauge().GetValue(), expected.value)
+		}
+	}
+
+	mq.DeleteQueue(request.subscription)
+	if err := qr.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	// Delete reports if the gauge was still present
+	if queueDepth.Delete(labels) {
+		t.Fatal("gauge of a removed queue is still reported")
+	}
+}
@@ -9,6 +9,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
@@ -22,7 +24,6 @@ import (
 	"github.com/SentientTechnologies/studio-go-runner"
 
 	"github.com/davecgh/go-spew/spew"
-	"github.com/dustin/go-humanize"
 
 	"github.com/karlmutch/go-cache"
 
@@ -46,10 +47,12 @@ var (
 	//
 	backoffs = cache.New(10*time.Second, time.Minute)
 
-	// busyQs is used to indicate when a worker is active for a named project:subscription so
-	// that only one worker is activate at a time
+	// busyQs counts the workers active for a named project:subscription so that the number of
+	// experiments run concurrently from a queue can be limited
 	//
-	busyQs = SubsBusy{subs: map[string]bool{}}
+	busyQs = SubsBusy{subs: map[string]*QueueWorkers{}}
+
+	queueConcurrencyOpt = flag.Int("queue-concurrency", 0, "the maximum number of experiments run concurrently from a single queue, 0 derives the limit from the number of copies of the resources requested by the queue that fit into the free resources of the runner")
 
 	refreshSuccesses = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -145,15 +148,83 @@ func (live *Projects) Lifecycle(found map[string]string) {
 	}
 }
 
+// QueueWorkers counts the workers of a queue
+//
+type QueueWorkers struct {
+	active   uint // Workers retrieving or handling messages from the queue
+	handling uint // Workers handling a message, and so holding resources for an experiment
+}
+
 type SubsBusy struct {
-	subs map[string]bool // The catalog of all known queues (subscriptions) within the project this server is handling
+	subs map[string]*QueueWorkers // The workers of the queues (subscriptions) that have workers
 	sync.Mutex
 }
 
+// workers returns the number of workers active for a queue, and those of them that are
+// handling messages
+//
+func (busy *SubsBusy) workers(fqName string) (active uint, handling uint) {
+	busy.Lock()
+	defer busy.Unlock()
+	if workers, isPresent := busy.subs[fqName]; isPresent {
+		return workers.active, workers.handling
+	}
+	return 0, 0
+}
+
+// acquire adds a worker for a queue, false is returned if the queue already has the
+// maximum number of workers
+//
+func (busy *SubsBusy) acquire(fqName string, limit uint) (acquired bool) {
+	busy.Lock()
+	defer busy.Unlock()
+
+	workers, isPresent := busy.subs[fqName]
+	if !isPresent {
+		workers = &QueueWorkers{}
+		busy.subs[fqName] = workers
+	}
+	if workers.active >= limit {
+		return false
+	}
+	workers.active++
+	return true
+}
+
+// release removes a worker from a queue
+//
+func (busy *SubsBusy) release(fqName string) {
+	busy.Lock()
+	defer busy.Unlock()
+
+	if workers, isPresent := busy.subs[fqName]; isPresent {
+		workers.active--
+		if workers.active == 0 {
+			delete(busy.subs, fqName)
+		}
+	}
+}
+
+// handling records a worker of the queue starting, a positive delta, or stopping the handling
+// of a message
+//
+func (busy *SubsBusy) handling(fqName string, delta int) {
+	busy.Lock()
+	defer busy.Unlock()
+
+	if workers, isPresent := busy.subs[fqName]; isPresent {
+		workers.handling = uint(int(workers.handling) + delta)
+	}
+}
+
 type Subscription struct {
 	name string           // The subscription name that represents a queue of potential for our purposes
 	rsc  *runner.Resource // If known the resources that experiments asked for in this subscription
-	cnt  uint             // The number of instances that are running for this queue
+	cnt  uint             // The number of workers active for this queue on this runner
+
+	priority runner.QueuePriority // The priority and weight used when choosing between idle queues
+	share    float64              // The checks the queue has received, scaled by its weight
+	waiting  time.Time            // The time the queue was last checked, or was found
 }
 
 type Subscriptions struct {
@@ -167,6 +238,15 @@ type Queuer struct {
 	subs    Subscriptions // The subscriptions that exist within this project
 	timeout time.Duration
 	tasker  runner.TaskQueue
+	handler runner.MsgHandler // The function messages retrieved from queues are passed to
+
+	checkInterval   time.Duration // The interval at which idle subscriptions are checked for work
+	existsInterval  time.Duration // The interval at which the queue for running work is checked for existence
+	metricsInterval time.Duration // The interval at which the gauges of the queues are updated, 0 when they are not exported
+	maxWorkers      uint          // The number of workers a queue can have, 0 derives the number using the resources of the queue
+	wakeC           chan struct{} // Used to have the producer check for work ahead of its regular interval
+
+	controls map[string]interface{} // The control queues found by the last refresh, guarded by the subs lock
 }
 
 type SubRequest struct {
@@ -176,18 +256,42 @@ type SubRequest struct {
 }
 
 func NewQueuer(projectID string, creds string) (qr *Queuer, err errors.Error) {
-	qr = &Queuer{
+	tasker, err := runner.NewTaskQueue(projectID, creds)
+	if err != nil {
+		return nil, err
+	}
+	return newQueuer(projectID, creds, tasker), nil
+}
+
+// newQueuer creates a queuer for an existing task queue implementation, it is also
+// used by tests to supply queues that do not require a broker
+//
+func newQueuer(projectID string, creds string, tasker runner.TaskQueue) (qr *Queuer) {
+	return &Queuer{
 		project: projectID,
 		cred:    creds,
 		subs:    Subscriptions{subs: map[string]*Subscription{}},
 		timeout: 15 * time.Second,
+		tasker:  tasker,
+		handler: handleMsg,
+
+		checkInterval:   5 * time.Second,
+		existsInterval:  5 * time.Minute,
+		metricsInterval: *queueMetricsOpt,
+		maxWorkers:      uint(*queueConcurrencyOpt),
+		wakeC:           make(chan struct{}, 1),
+
+		controls: map[string]interface{}{},
 	}
-	qr.tasker, err = runner.NewTaskQueue(projectID, creds)
-	if err != nil {
-		return nil, err
-	}
-	return qr, nil
+}
 
+// wake has the producer check for work without waiting for the next check interval
+//
+func (qr *Queuer) wake() {
+	select {
+	case qr.wakeC <- struct{}{}:
+	default:
+	}
 }
 
 // refresh is used to update the queuer with a list of available queues
@@ -195,7 +299,12 @@ func NewQueuer(projectID string, creds string) (qr *Queuer, err errors.Error) {
 //
 func (qr *Queuer) refresh() (err errors.Error) {
 
-	matcher, _ := regexp.Compile(*queueMatch)
+	// Control queues are found along with the queues used for experiments
+	match := *queueMatch
+	if len(*controlMatchOpt) != 0 {
+		match = "(?:" + match + ")|(?:" + *controlMatchOpt + ")"
+	}
+	matcher, _ := regexp.Compile(match)
 	known, err := qr.tasker.Refresh(matcher, qr.timeout)
 	if err != nil {
 		refreshFailures.With(prometheus.Labels{"host": host, "project": qr.project}).Inc()
@@ -205,6 +314,19 @@ func (qr *Queuer) refresh() (err errors.Error) {
 
 	logger.Debug(fmt.Sprintf("on refresh got %#v", known))
 
+	// Control queues are checked for control messages and never for experiments
+	//
+	controls := map[string]interface{}{}
+	for name, value := range known {
+		if isControl(qr.tasker, name) {
+			controls[name] = value
+			delete(known, name)
+		}
+	}
+	qr.subs.Lock()
+	qr.controls = controls
+	qr.subs.Unlock()
+
 	// Bring the queues collection uptodate with what the system has in terms
 	// of functioning queues
 	//
@@ -221,6 +343,15 @@ func (qr *Queuer) refresh() (err errors.Error) {
 		logger.Info(msg)
 		runner.InfoSlack("", msg, []string{})
 	}
+
+	qr.prioritize()
+	qr.forget(removed)
+
+	// Queues that were found are checked for work straight away
+	if len(added) != 0 {
+		qr.wake()
+	}
+
 	return nil
 }
 
@@ -235,10 +366,16 @@ func (subs *Subscriptions) align(expected map[string]interface{}) (added []strin
 	subs.Lock()
 	defer subs.Unlock()
 
+	share := subs.minShare()
 	for sub := range expected {
 		if _, isPresent := subs.subs[sub]; !isPresent {
 
-			subs.subs[sub] = &Subscription{name: sub}
+			subs.subs[sub] = &Subscription{
+				name:     sub,
+				priority: runner.DefaultQueuePriority,
+				share:    share,
+				waiting:  time.Now(),
+			}
 			added = append(added, sub)
 		}
 	}
@@ -283,7 +420,11 @@ func (qr *Queuer) producer(rqst chan *SubRequest, quitC chan bool) {
 	logger.Debug("started the queue checking producer")
 	defer logger.Debug("stopped the queue checking producer")
 
-	check := time.NewTicker(time.Duration(5 * time.Second))
+	// Resources being released by experiments wake the producer
+	producers.add(qr)
+	defer producers.remove(qr)
+
+	check := time.NewTicker(qr.checkInterval)
 	defer check.Stop()
 
 	nextQDbg := time.Now()
@@ -293,86 +434,166 @@ func (qr *Queuer) producer(rqst chan *SubRequest, quitC chan bool) {
 	lastReadyAbs := time.Now()
 
 	for {
+		// Checks are done on a regular basis and also whenever a worker finishes and capacity
+		// might have become available
 		select {
 		case <-check.C:
+		case <-qr.wakeC:
+		case <-quitC:
+			return
+		}
 
-			ranked := qr.rank()
+		ranked := qr.rank()
 
-			// Some monitoring logging used to tracking traffic on queues
-			if logger.IsTrace() {
-				if len(ranked) != 0 {
-					logger.Trace(fmt.Sprintf("processing %s %d ranked subscriptions %s", qr.project, len(ranked), spew.Sdump(ranked)))
-				} else {
-					logger.Trace(fmt.Sprintf("no %s subscriptions found", qr.project))
-				}
+		// Some monitoring logging used to tracking traffic on queues
+		if logger.IsTrace() {
+			if len(ranked) != 0 {
+				logger.Trace(fmt.Sprintf("processing %s %d ranked subscriptions %s", qr.project, len(ranked), spew.Sdump(ranked)))
 			} else {
-				if logger.IsDebug() {
-					// If either the queue length has changed, or sometime has passed since
-					// the last debug log, one minute, print the queue checking state
-					if nextQDbg.Before(time.Now()) || lastQs != len(ranked) {
-						lastQs = len(ranked)
-						nextQDbg = time.Now().Add(10 * time.Minute)
-						if len(ranked) != 0 {
-							logger.Debug(fmt.Sprintf("processing %d ranked subscriptions %v", len(ranked), ranked))
-						} else {
-							logger.Debug(fmt.Sprintf("no %s subscriptions found", qr.project))
-						}
+				logger.Trace(fmt.Sprintf("no %s subscriptions found", qr.project))
+			}
+		} else {
+			if logger.IsDebug() {
+				// If either the queue length has changed, or sometime has passed since
+				// the last debug log, one minute, print the queue checking state
+				if nextQDbg.Before(time.Now()) || lastQs != len(ranked) {
+					lastQs = len(ranked)
+					nextQDbg = time.Now().Add(10 * time.Minute)
+					if len(ranked) != 0 {
+						logger.Debug(fmt.Sprintf("processing %d ranked subscriptions %v", len(ranked), ranked))
+					} else {
+						logger.Debug(fmt.Sprintf("no %s subscriptions found", qr.project))
 					}
 				}
 			}
+		}
 
-			// track the first queue that has not been checked for the longest period of time that
-			// also has no traffic on this node.  This queue will be check but it wont be until the next
-			// pass that a new empty or idle queue will be checked.
-			idle := []Subscription{}
-
-			for _, sub := range ranked {
-				// IDLE queue processing, that is queues that have no work running
-				// against this runner
-				if sub.cnt == 0 {
-					if _, isPresent := backoffs.Get(qr.project + ":" + sub.name); isPresent {
-						logger.Trace(fmt.Sprintf("backed off %s:%s", qr.project, sub.name))
-						continue
-					}
-					// Save the queue that has been waiting the longest into the
-					// idle slot that we will be processing on this pass
-					idle = append(idle, sub)
-				}
+		// track the first queue that has not been checked for the longest period of time that
+		// also has no traffic on this node.  This queue will be check but it wont be until the next
+		// pass that a new empty or idle queue will be checked.
+		idle := []Subscription{}
+
+		for _, sub := range ranked {
+			// IDLE queue processing, that is queues whose workers are all handling
+			// messages and that can have more workers on this runner
+			if _, isPresent := backoffs.Get(qr.project + ":" + sub.name); isPresent {
+				logger.Trace(fmt.Sprintf("backed off %s:%s", qr.project, sub.name))
+				continue
 			}
+			// Queues that already have the maximum number of workers, perhaps waiting for
+			// work to be pushed by the broker, would be refused by the consumer
+			if _, handling := busyQs.workers(qr.project + ":" + sub.name); sub.cnt >= qr.concurrency(sub.name, handling) {
+				continue
+			}
+			idle = append(idle, sub)
+		}
 
-			if len(idle) != 0 {
+		if len(idle) != 0 {
+
+			// Shuffle the queues so that ties between queues of equal priority and share are
+			// broken at random, fisher yates shuffle introduced in go 1.10, c.f. https://golang.org/pkg/math/rand/#Shuffle
+			rand.Shuffle(len(idle), func(i, j int) {
+				idle[i], idle[j] = idle[j], idle[i]
+			})
+
+			// Several queues are checked on each pass, in the order they are picked, while the free
+			// resources of the runner can accommodate the experiments of the queues already checked.
+			// Queues that do not fit are passed over allowing smaller experiments to use the headroom.
+			headroom, _ := getMachineResources().Quantities()
+			now := time.Now()
+
+			for dispatched := 0; len(idle) != 0; {
+				picked := pickQueue(idle, now, *queueStarvationOpt)
+				remaining := idle[:0]
+				for _, sub := range idle {
+					if sub.name != picked.name {
+						remaining = append(remaining, sub)
+					}
+				}
+				idle = remaining
 
-				// Shuffle the queues to pick one at random, fisher yates shuffle introduced in
-				// go 1.10, c.f. https://golang.org/pkg/math/rand/#Shuffle
-				rand.Shuffle(len(idle), func(i, j int) {
-					idle[i], idle[j] = idle[j], idle[i]
-				})
+				// The first queue is always checked so that queues that can never fit are reported
+				if fits := reserve(&headroom, qr.getResources(picked.name)); !fits && dispatched != 0 {
+					continue
+				}
 
-				if err := qr.check(idle[0].name, rqst, quitC); err != nil {
+				if err := qr.check(picked.name, rqst, quitC); err != nil {
 
-					backoffs.Set(qr.project+":"+idle[0].name, true, time.Duration(time.Minute))
+					backoffs.Set(qr.project+":"+picked.name, true, time.Duration(time.Minute))
 
-					logger.Warn(fmt.Sprintf("checking %s for work failed due to %s, backoff 1 minute", qr.project+":"+idle[0].name, err.Error()))
-					break
+					logger.Warn(fmt.Sprintf("checking %s for work failed due to %s, backoff 1 minute", qr.project+":"+picked.name, err.Error()))
+					continue
 				}
+				dispatched++
+				qr.subs.checked(picked.name, now)
 				lastReady = time.Now()
 				lastReadyAbs = time.Now()
 			}
+		}
 
-			// Check to see if we were last ready for work more than one hour ago as
-			// this could be a resource problem
-			if lastReady.Before(time.Now().Add(-1 * time.Hour)) {
-				// If we have been unavailable for work alter slack once every 10 minutes and then
-				// bump the ready timer for wait for another 10 before resending the advisory
-				lastReady = lastReady.Add(10 * time.Minute)
-				msg := fmt.Sprintf("no work has been requested by this system for %v, please check for disk space etc resource availability",
-					time.Now().Sub(lastReadyAbs))
-				runner.WarningSlack("", msg, []string{})
-				logger.Warn(msg)
+		// Check to see if we were last ready for work more than one hour ago as
+		// this could be a resource problem
+		if lastReady.Before(time.Now().Add(-1 * time.Hour)) {
+			// If we have been unavailable for work alter slack once every 10 minutes and then
+			// bump the ready timer for wait for another 10 before resending the advisory
+			lastReady = lastReady.Add(10 * time.Minute)
+			msg := fmt.Sprintf("no work has been requested by this system for %v, please check for disk space etc resource availability",
+				time.Now().Sub(lastReadyAbs))
+			runner.WarningSlack("", msg, []string{})
+			logger.Warn(msg)
+		}
+	}
+}
+
+// concurrency returns the number of workers a queue may have on this runner, handling being the
+// number of its workers that are handling messages and so already hold resources.  Unless a limit
+// is configured queues whose resource needs are not yet known have a single worker, otherwise workers
+// are added while the resources of the queue fit into those that are free.
+//
+func (qr *Queuer) concurrency(name string, handling uint) (limit uint) {
+	if qr.maxWorkers != 0 {
+		return qr.maxWorkers
+	}
+
+	rsc := qr.getResources(name)
+	if rsc == nil {
+		return 1
+	}
+	copies, unbounded, err := rsc.FitCount(getMachineResources())
+	if err != nil || unbounded {
+		copies = 1
+	}
+	// Queues that do not fit are given a single worker that will be refused by the
+	// capacity check and backed off
+	if limit = handling + uint(copies); limit == 0 {
+		limit = 1
+	}
+	return limit
+}
+
+// counted wraps the message handler of the queuer to count the workers of a queue that are
+// handling messages, the producer is woken when a message arrives as the queue may be able
+// to have another worker waiting for the next message.
+//
+// The resources of handled messages are recorded against the subscription whether or not the
+// message was acknowledged, queues only return the resources of acknowledged messages and the
+// checks of the queue need the resources of work that was refused or returned to the queue.
+//
+func (qr *Queuer) counted(request *SubRequest) (handler runner.MsgHandler) {
+	fqName := request.project + ":" + request.subscription
+	return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		busyQs.handling(fqName, 1)
+		defer busyQs.handling(fqName, -1)
+
+		qr.wake()
+
+		rsc, ack := qr.handler(withBackoffKey(ctx, fqName), project, subscription, credentials, data)
+		if rsc != nil {
+			if err := qr.subs.setResources(request.subscription, rsc); err != nil {
+				logger.Info(fmt.Sprintf("%s resources not updated due to %s", fqName, err))
 			}
-		case <-quitC:
-			return
 		}
+		return rsc, ack
 	}
 }
 
@@ -381,7 +602,7 @@ func (qr *Queuer) getResources(name string) (rsc *runner.Resource) {
 	defer qr.subs.Unlock()
 
 	item, isPresent := qr.subs.subs[name]
-	if !isPresent {
+	if !isPresent || item.rsc == nil {
 		return nil
 	}
 	return item.rsc.Clone()
@@ -395,6 +616,7 @@ func (qr *Queuer) rank() (ranked []Subscription) {
 
 	ranked = make([]Subscription, 0, len(qr.subs.subs))
 	for _, sub := range qr.subs.subs {
+		sub.cnt, _ = busyQs.workers(qr.project + ":" + sub.name)
 		ranked = append(ranked, *sub)
 	}
 
@@ -407,31 +629,29 @@ func (qr *Queuer) rank() (ranked []Subscription) {
 }
 
 // getMachineResources extracts the current system state in terms of memory etc
-// and coverts this into the resource specification used by jobs.  Because resources
-// specified by users are not exact quantities the resource is used for the machines
-// resources even in the face of some loss of precision
+// and coverts this into the resource specification used by jobs.  The exact
+// quantities are retained so that comparisons with the resources needed by jobs
+// do not suffer any loss of precision
 //
 func getMachineResources() (rsc *runner.Resource) {
 
-	rsc = &runner.Resource{}
+	values := runner.ResourceQuantities{}
 
 	// For specified queue look for any free slots on existing GPUs is
 	// applicable and fill them, or find empty GPUs and groups to fill
 	// in with work
 
-	cpus, v := runner.CPUFree()
-	rsc.Cpus = uint(cpus)
-	rsc.Ram = humanize.Bytes(v)
+	values.MilliCPU, values.Ram = runner.CPUFree()
 
-	rsc.Hdd = humanize.Bytes(runner.GetDiskFree())
+	values.Hdd = runner.GetDiskFree()
 
 	// go runner allows GPU resources at the board level so obtain the largest single
 	// board form factor and use that as our max
 	//
-	rsc.Gpus = runner.LargestFreeGPUSlots()
-	rsc.GpuMem = humanize.Bytes(runner.LargestFreeGPUMem())
+	values.Gpus = runner.LargestFreeGPUSlots()
+	values.GpuMem = runner.LargestFreeGPUMem()
 
-	return rsc
+	return runner.NewResource(values)
 }
 
 // check will first validate a subscription and will add it to the list of subscriptions
@@ -443,25 +663,38 @@ func (qr *Queuer) check(name string, rQ chan *SubRequest, quitC chan bool) (err
 	fqName := qr.project + ":" + name
 
 	// Check to see if anyone is listening for a queue to check by sending a dummy request, and then
-	// send the real request if the check message is consumed
+	// send the real request if the check message is consumed.  Several queues can be checked on
+	// each pass so the consumer is given a moment to return from handing off the previous request.
 	select {
 	case rQ <- &SubRequest{}:
-	default:
+	case <-time.After(250 * time.Millisecond):
 		return errors.New("busy checking consumer, at the 1ˢᵗ stage").With("stack", stack.Trace().TrimRuntime())
 	}
 
-	sub, isPresent := qr.subs.subs[name]
+	qr.subs.Lock()
+	_, isPresent := qr.subs.subs[name]
+	qr.subs.Unlock()
 	if !isPresent {
 		return errors.New(fmt.Sprintf("subscription %s could not be found", fqName)).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	if sub.rsc != nil {
-		if fit, err := sub.rsc.Fit(getMachineResources()); !fit {
+	// Workers on the queue can update the resources while the check is being done
+	if rsc := qr.getResources(name); rsc != nil {
+		// Experiments whose constraints cannot be met by this node will never be run here
+		unmet, err := unmetConstraints(rsc)
+		if err != nil {
+			return err
+		}
+		if len(unmet) != 0 {
+			return errors.New(fmt.Sprintf("%s constraints cannot be met by this node", fqName)).With("unmet", unmet).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		if fit, err := rsc.Fit(getMachineResources()); !fit {
 			if err != nil {
 				return err
 			}
 
-			return errors.New(fmt.Sprintf("%s could not be accommodated %#v -> headroom was %#v", fqName, sub.rsc, getMachineResources())).With("stack", stack.Trace().TrimRuntime())
+			return errors.New(fmt.Sprintf("%s could not be accommodated %#v -> headroom was %#v", fqName, rsc, getMachineResources())).With("stack", stack.Trace().TrimRuntime())
 		} else {
 			if logger.IsTrace() {
 				logger.Trace(fmt.Sprintf("%s passed capacity check", fqName))
@@ -519,6 +752,12 @@ func (qr *Queuer) run(refreshInterval time.Duration, quitC chan bool) (err error
 
 	go qr.producer(sendWork, quitC)
 
+	// start checking any control queues for requests to manage running experiments
+	go qr.controller(quitC)
+
+	// start measuring the queues for the gauges used by autoscalers
+	go qr.measurer(quitC)
+
 	refresh := time.Duration(time.Second)
 
 	for {
@@ -576,35 +815,71 @@ func (qr *Queuer) filterWork(request *SubRequest, quitC chan bool) {
 		}
 	}()
 
-	busyQs.Lock()
-	_, busy := busyQs.subs[request.project+":"+request.subscription]
-	if !busy {
-		busyQs.subs[request.project+":"+request.subscription] = true
-	}
-	busyQs.Unlock()
-
-	if busy {
+	fqName := request.project + ":" + request.subscription
+	_, handling := busyQs.workers(fqName)
+	if !busyQs.acquire(fqName, qr.concurrency(request.subscription, handling)) {
 		logger.Trace(fmt.Sprintf("busy %v", request))
 		return
-	} else {
-		logger.Trace(fmt.Sprintf("mark as busy %v", request))
 	}
+	logger.Trace(fmt.Sprintf("add worker %v", request))
 
+	rearm := false
 	defer func() {
-		busyQs.Lock()
-		delete(busyQs.subs, request.project+":"+request.subscription)
-		busyQs.Unlock()
+		busyQs.release(fqName)
 
-		logger.Trace(fmt.Sprintf("mark as free %v", request))
+		logger.Trace(fmt.Sprintf("remove worker %v", request))
+
+		// Once the queue is free look for more work straight away
+		if rearm {
+			qr.wake()
+		}
 	}()
 
-	qr.doWork(request, quitC)
+	rearm = qr.doWork(request, quitC)
+}
+
+type taskQueueKey struct{}
+
+// withTaskQueue adds the queue a message was received from to the context passed to handlers
+//
+func withTaskQueue(ctx context.Context, tasker runner.TaskQueue) (queueCtx context.Context) {
+	return context.WithValue(ctx, taskQueueKey{}, tasker)
+}
+
+// taskQueue returns the queue the message being handled was received from, or nil
+//
+func taskQueue(ctx context.Context) (tasker runner.TaskQueue) {
+	tasker, _ = ctx.Value(taskQueueKey{}).(runner.TaskQueue)
+	return tasker
+}
+
+type backoffKeyKey struct{}
+
+// withBackoffKey adds the name the queuer uses to back off the queue a message was received from
+// to the context passed to handlers.  Queues can pass a project and subscription to handlers that
+// differ from those the queuer knows the queue by.
+//
+func withBackoffKey(ctx context.Context, fqName string) (keyCtx context.Context) {
+	return context.WithValue(ctx, backoffKeyKey{}, fqName)
+}
+
+// backoffKey returns the name used to back off the queue the message being handled was received
+// from, falling back to the project and subscription passed to the handler
+//
+func backoffKey(ctx context.Context, project string, subscription string) (fqName string) {
+	if key, isPresent := ctx.Value(backoffKeyKey{}).(string); isPresent {
+		return key
+	}
+	return project + ":" + subscription
 }
 
 func handleMsg(ctx context.Context, project string, subscription string, credentials string, msg []byte) (rsc *runner.Resource, consume bool) {
 
 	rsc = nil
 
+	// The queuer that received the message checks for back offs using its own name for the queue
+	fqName := backoffKey(ctx, project, subscription)
+
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Warn(fmt.Sprintf("%#v", r))
@@ -614,9 +889,10 @@ func handleMsg(ctx context.Context, project string, subscription string, credent
 	// Check for the back off and self destruct if one is seen for this subscription, leave the message for
 	// redelivery upto the framework
 	//
-	// TODO Ack for PubSub Nack for SQS due to SQS supporting dead letter queues
+	// Messages that fail are not acknowledged, instead the failure is recorded using runner.FailDelivery
+	// so that the queue can retry the message until it runs out of attempts, and then dead-letter it
 	//
-	if _, isPresent := backoffs.Get(project + ":" + subscription); isPresent {
+	if _, isPresent := backoffs.Get(fqName); isPresent {
 		logger.Debug(fmt.Sprintf("stopping checking %s:%s backing off", project, subscription))
 		return rsc, false
 	}
@@ -624,22 +900,134 @@ func handleMsg(ctx context.Context, project string, subscription string, credent
 	logger.Trace(fmt.Sprintf("msg processing started on %s:%s", project, subscription))
 	defer logger.Trace(fmt.Sprintf("msg processing completed on %s:%s", project, subscription))
 
+	// Check that the message was sent by a trusted client before anything else is done with it
+	//
+	msg, err := verifyMsg(msg)
+	if err != nil {
+		rejectMsg(project, subscription, nil, err)
+		runner.FailDelivery(ctx, err, false)
+		return rsc, false
+	}
+
+	// Claim checks are replaced by the request they point at, the hash having been
+	// covered by any signature that was checked
+	//
+	msg, retry, err := resolveClaimCheck(project, credentials, msg)
+	if err != nil {
+		if retry {
+			logger.Warn(fmt.Sprintf("unable to retrieve claim check msg from %s:%s on attempt %d due to %s", project, subscription, runner.DeliveryAttempt(ctx), err.Error()))
+
+			// Claim checks pointing at payloads that never become available run out of attempts
+			// and are dead-lettered like any other failing message
+			backoffs.Set(fqName, true, time.Duration(10*time.Second))
+			runner.FailDelivery(ctx, err, true)
+			return rsc, false
+		}
+		rejectMsg(project, subscription, nil, err)
+		runner.FailDelivery(ctx, err, false)
+		return rsc, false
+	}
+
+	// Validate the entire message before any resources are committed to it, messages that
+	// fail validation will never succeed and so are dead-lettered after they are reported
+	//
+	rqst, report, err := runner.ParseRequest(msg)
+	if err != nil {
+		rejectMsg(project, subscription, report, err)
+		runner.FailDelivery(ctx, err, false)
+		return rsc, false
+	}
+	if !report.Valid() {
+		rejectMsg(project, subscription, report, nil)
+		err = errors.New("request failed validation").With("fields", strings.Join(report.Fields(), ", ")).With("stack", stack.Trace().TrimRuntime())
+		runner.FailDeliveryReport(ctx, err, report, false)
+		return rsc, false
+	}
+	if len(report.Warnings) != 0 {
+		logger.Warn(fmt.Sprintf("%s:%s msg accepted with %d warning(s)", project, subscription, len(report.Warnings)), "warnings", strings.Join(report.WarningFields(), ", "))
+	}
+
 	// allocate the processor and sub the subscription as
 	// the group mechanism for work coming down the
 	// pipe that is sent to the resource allocation
 	// module
-	proc, err := newProcessor(subscription, msg, credentials, ctx.Done())
+	proc, err := newProcessor(subscription, rqst, credentials, ctx.Done())
 	if err != nil {
-		logger.Warn(fmt.Sprintf("unable to process msg from %s:%s due to %s", project, subscription, err.Error()))
+		logger.Warn(fmt.Sprintf("unable to process msg from %s:%s on attempt %d due to %s", project, subscription, runner.DeliveryAttempt(ctx), err.Error()))
 
-		backoffs.Set(project+":"+subscription, true, time.Duration(10*time.Second))
-		return rsc, true
+		backoffs.Set(fqName, true, time.Duration(10*time.Second))
+		runner.FailDelivery(ctx, err, true)
+		return rsc, false
 	}
 	defer proc.Close()
 
 	rsc = proc.Request.Experiment.Resource.Clone()
 
+	// Lifecycle events are published to the reply queue named by the experiment using the queue
+	// server the request arrived from
+	proc.events = runner.NewEventPublisher(taskQueue(ctx), proc.Request.Config.Runner.ReplyTo,
+		proc.Request.Config.Database.ProjectId, proc.Request.Experiment.Key, runner.DeliveryAttempt(ctx), runner.MessageGroup(ctx))
+
+	// Work that this node cannot satisfy the constraints of is returned to the queue for another
+	// runner, the resources are returned so that the queuer records them against the queue and its
+	// checks skip the queue while its work cannot be run here.  The
+	// refusal is reported using a refused event naming this host, the outcome of the experiment
+	// being left to the finished or failed event of the runner that does receive it.
+	//
+	if unmet, err := unmetConstraints(rsc); err != nil || len(unmet) != 0 {
+		if err == nil {
+			err = errors.New("constraints cannot be met by this node").With("unmet", unmet).With("stack", stack.Trace().TrimRuntime())
+		}
+		logger.Info(fmt.Sprintf("%s:%s experiment %s refused due to %s", project, subscription, proc.Request.Experiment.Key, err.Error()))
+		proc.event(runner.StageRefused, err)
+
+		backoffs.Set(fqName, true, time.Duration(time.Minute))
+		return rsc, false
+	}
+
+	// Experiments claimed by an earlier delivery of the same request are acknowledged without being
+	// run again.  Claims are finished once the experiment will not be retried, and otherwise released
+	// so that the redelivered message can run.  Experiments that cannot be claimed are still run.
+	//
+	claim, holder, err := claimExperiment(ctx, proc.Request.Experiment.Key)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("%s:%s experiment %s not claimed due to %s", project, subscription, proc.Request.Experiment.Key, err.Error()))
+	}
+	if holder != nil {
+		txt := fmt.Sprintf("%s:%s experiment %s duplicate acknowledged without running, claimed by attempt %d on %s at %s",
+			project, subscription, proc.Request.Experiment.Key, holder.Attempt, holder.Host, holder.Time.Format(time.RFC3339))
+		runner.InfoSlack(proc.Request.Config.Runner.SlackDest, txt, []string{})
+		logger.Info(txt)
+		return rsc, true
+	}
+	defer func() {
+		claim.settle(consume || proc.stop.isCancelled())
+	}()
+
+	// Every exit once the experiment has been received is reported.  Successful runs send a finished
+	// event while being processed.  Other exits, including panics while processing, send a failed event
+	// when the message will not be delivered again and otherwise a retrying event, so that clients only
+	// see a failure once the experiment will not be run again.
+	var failure error
+	proc.event(runner.StageReceived, nil)
+	defer func() {
+		if proc.terminated {
+			return
+		}
+		if failure == nil {
+			failure = errors.New("experiment stopped without completing").With("stack", stack.Trace().TrimRuntime())
+		}
+		if consume || runner.FinalDelivery(ctx) {
+			proc.event(runner.StageFailed, failure)
+			return
+		}
+		proc.event(runner.StageRetrying, failure)
+	}()
+
 	header := fmt.Sprintf("%s:%s project %s experiment %s", project, subscription, proc.Request.Config.Database.ProjectId, proc.Request.Experiment.Key)
+	if group := runner.MessageGroup(ctx); len(group) != 0 {
+		header += " group " + group
+	}
 	logger.Info("started " + header)
 	runner.InfoSlack(proc.Request.Config.Runner.SlackDest, "started "+header, []string{})
 
@@ -654,6 +1042,10 @@ func handleMsg(ctx context.Context, project string, subscription string, credent
 		}()
 		prcCancel()
 	}()
+	// Control messages can cancel the experiment using its key
+	running.add(proc, prcCancel)
+	defer running.remove(proc)
+
 	// If the outer context gets cancelled cancel our inner context
 	go func() {
 		select {
@@ -666,6 +1058,20 @@ func handleMsg(ctx context.Context, project string, subscription string, credent
 
 	// Blocking call to run the entire task and only return on termination due to error or success
 	backoff, ack, err := proc.Process(prcCtx)
+	if err != nil {
+		failure = err
+	}
+	if err != nil && proc.stop.isCancelled() {
+		txt := fmt.Sprintf("%s cancelled by control message", header)
+
+		runner.InfoSlack(proc.Request.Config.Runner.SlackDest, txt, []string{})
+		logger.Info(txt)
+
+		// Cancelled experiments are not retried, they are dead-lettered when a dead-letter queue is
+		// configured and otherwise discarded
+		runner.FailDelivery(ctx, errors.Wrap(err, "experiment cancelled").With("stack", stack.Trace().TrimRuntime()), false)
+		return rsc, false
+	}
 	if err != nil {
 
 		// Do at least a minimal backoff
@@ -674,7 +1080,7 @@ func handleMsg(ctx context.Context, project string, subscription string, credent
 		}
 
 		response := fmt.Sprintf(", backing off for %s, ", backoff)
-		backoffs.Set(project+":"+subscription, true, backoff)
+		backoffs.Set(fqName, true, backoff)
 
 		if !ack {
 			txt := fmt.Sprintf("%s retry%s due to %s", header, response, err.Error())
@@ -682,30 +1088,58 @@ func handleMsg(ctx context.Context, project string, subscription string, credent
 			runner.InfoSlack(proc.Request.Config.Runner.SlackDest, txt, []string{})
 			logger.Info(txt)
 		} else {
-			txt := fmt.Sprintf("%s dumped%s due to %s", header, response, err.Error())
+			txt := fmt.Sprintf("%s failed on attempt %d%s due to %s", header, runner.DeliveryAttempt(ctx), response, err.Error())
 
 			runner.WarningSlack(proc.Request.Config.Runner.SlackDest, txt, []string{})
 			logger.Warn(txt)
+
+			// Runs that fail are retried by the queue until they run out of attempts
+			runner.FailDelivery(ctx, err, true)
 		}
 		logger.Warn(err.Error())
 
-		return rsc, ack
+		return rsc, false
 	}
 
 	runner.InfoSlack(proc.Request.Config.Runner.SlackDest, header+" stopped", []string{})
 
 	// At this point we could look for a backoff for this queue and set it to a small value as we are about to release resources
-	if _, isPresent := backoffs.Get(project + ":" + subscription); isPresent {
-		backoffs.Set(project+":"+subscription, true, time.Second)
+	if _, isPresent := backoffs.Get(fqName); isPresent {
+		backoffs.Set(fqName, true, time.Second)
 	}
 	return rsc, ack
 }
 
-func (qr *Queuer) doWork(request *SubRequest, quitC chan bool) {
+// rejectMsg is used to report messages that failed validation.  The report containing
+// every problem found is logged along with being sent to the slack channel used by the runner
+//
+func rejectMsg(project string, subscription string, report *runner.ValidationReport, err errors.Error) {
+
+	if err != nil {
+		msg := fmt.Sprintf("%s:%s rejected msg due to %s", project, subscription, err.Error())
+		runner.WarningSlack("", msg, []string{})
+		logger.Warn(msg)
+		return
+	}
+
+	b, errGo := json.Marshal(report)
+	if errGo != nil {
+		b = []byte(strings.Join(report.Fields(), ", "))
+	}
+
+	msg := fmt.Sprintf("%s:%s rejected msg with %d invalid field(s)", project, subscription, len(report.Errors))
+	runner.WarningSlack("", msg, report.Fields())
+	logger.Warn(msg, "report", string(b))
+}
+
+// doWork retrieves and processes work from a queue, true is returned when the producer
+// should look for more work without waiting for its next regular check
+//
+func (qr *Queuer) doWork(request *SubRequest, quitC chan bool) (rearm bool) {
 
 	if _, isPresent := backoffs.Get(request.project + ":" + request.subscription); isPresent {
 		logger.Trace(fmt.Sprintf("%v, backed off", request))
-		return
+		return false
 	}
 
 	logger.Trace(fmt.Sprintf("started checking %#v", *request))
@@ -721,12 +1155,20 @@ func (qr *Queuer) doWork(request *SubRequest, quitC chan bool) {
 	cCtx, cCancel := context.WithCancel(context.Background())
 	// The cancel is called explicitly below due to GC and defers being delayed
 
+	rearmC := make(chan bool, 1)
+
 	go func() {
 		logger.Trace(fmt.Sprintf("started queue check %#v", *request))
 		defer logger.Trace(fmt.Sprintf("completed queue check for %#v", *request))
 
+		start := time.Now()
+
 		// Spins out a go routine to handle messages
-		cnt, rsc, err := qr.tasker.Work(cCtx, qr.timeout, request.subscription, handleMsg)
+		cnt, rsc, err := qr.tasker.Work(withTaskQueue(cCtx, qr.tasker), qr.timeout, request.subscription, qr.counted(request))
+
+		// Look for more work straight away when a message was processed, or when the queue held the
+		// worker while waiting for work to be pushed, as in both cases checking again will not spin
+		rearmC <- err == nil && ((cnt != 0 && rsc != nil) || time.Since(start) >= qr.checkInterval)
 
 		cCancel()
 
@@ -739,9 +1181,13 @@ func (qr *Queuer) doWork(request *SubRequest, quitC chan bool) {
 		}
 
 		// Set the default resource requirements for the next message fetch to that of the most recently
-		// seen resource request
+		// seen resource request.  Messages that were returned to the queue have no resources, their
+		// handler having recorded them along with any backoff that it needed.
 		//
 		if rsc == nil {
+			if _, isPresent := backoffs.Get(request.project + ":" + request.subscription); isPresent {
+				return
+			}
 			if cnt > 0 {
 				logger.Warn(fmt.Sprintf("%#v handled msg that lacked a resource spec", *request))
 
@@ -763,7 +1209,7 @@ func (qr *Queuer) doWork(request *SubRequest, quitC chan bool) {
 	// everything as this is an indication that the work is intended to
 	// be stopped in a minute or so
 	func() {
-		check := time.NewTicker(5 * time.Minute)
+		check := time.NewTicker(qr.existsInterval)
 		defer check.Stop()
 
 		for {
@@ -795,4 +1241,10 @@ func (qr *Queuer) doWork(request *SubRequest, quitC chan bool) {
 	}()
 
 	cCancel()
+
+	select {
+	case rearm = <-rearmC:
+	default:
+	}
+	return rearm
 }
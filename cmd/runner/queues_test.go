@@ -0,0 +1,528 @@
+package main
+
+// This file contains tests for the queue scheduling functions that use an in-memory
+// task queue in place of a message broker, allowing failures of the queuing system
+// to be injected
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/rs/xid"
+)
+
+// newMemQueuer creates a queuer for an in-memory queue holding a single message
+//
+func newMemQueuer(t *testing.T, handler runner.MsgHandler) (qr *Queuer, mq *runner.MemQueue, request *SubRequest) {
+	project := "mem-" + xid.New().String()
+	subscription := "local_" + xid.New().String()
+
+	mq = runner.NewMemQueue(project)
+	if err := mq.Send(subscription, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	qr = newQueuer(project, "", mq)
+	qr.handler = handler
+
+	if err := qr.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	return qr, mq, &SubRequest{project: project, subscription: subscription}
+}
+
+// waitStats polls the queue until the test function is satisfied with its statistics
+//
+func waitStats(mq *runner.MemQueue, subscription string, test func(stats runner.MemQueueStats) bool) (stats runner.MemQueueStats, err error) {
+	timeout := time.After(10 * time.Second)
+	for {
+		stats, _ = mq.Stats(subscription)
+		if test(stats) {
+			return stats, nil
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			return stats, fmt.Errorf("timeout waiting on queue %s, last stats %+v", subscription, stats)
+		}
+	}
+}
+
+// waitBackoff waits for the backoff of a queue, which is set once the work on the queue has finished
+//
+func waitBackoff(fqName string) (err error) {
+	for i := 0; i < 200; i++ {
+		if _, isPresent := backoffs.Get(fqName); isPresent {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("%s was not backed off", fqName)
+}
+
+// TestQueuerRedelivery checks that messages not acknowledged by the handler are redelivered
+// and that the resources of the acknowledged message are recorded against the subscription
+//
+func TestQueuerRedelivery(t *testing.T) {
+
+	rsc := runner.NewResource(runner.ResourceQuantities{MilliCPU: 500, Ram: 1024 * 1024})
+
+	calls := 0
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		calls++
+		if calls == 1 {
+			return nil, false
+		}
+		return rsc, true
+	}
+
+	qr, mq, request := newMemQueuer(t, handler)
+
+	fqName := request.project + ":" + request.subscription
+	defer backoffs.Delete(fqName)
+
+	qr.filterWork(request, make(chan bool))
+
+	stats, _ := mq.Stats(request.subscription)
+	if stats.Delivered != 1 || stats.Nacked != 1 || stats.Pending != 1 {
+		t.Fatal(fmt.Errorf("unexpected stats after nack %+v", stats))
+	}
+
+	// Messages that were returned without a resource specification back off the queue
+	if err := waitBackoff(fqName); err != nil {
+		t.Fatal(err)
+	}
+	backoffs.Delete(fqName)
+
+	qr.filterWork(request, make(chan bool))
+
+	stats, _ = mq.Stats(request.subscription)
+	if stats.Delivered != 2 || stats.Acked != 1 || stats.Pending != 0 {
+		t.Fatal(fmt.Errorf("unexpected stats after ack %+v", stats))
+	}
+
+	// The resources are recorded asynchronously once the work is done
+	for i := 0; ; i++ {
+		if got := qr.getResources(request.subscription); got != nil {
+			if got.Cpus != rsc.Cpus || got.Ram != rsc.Ram {
+				t.Fatal(fmt.Errorf("unexpected resources %+v, expected %+v", got, rsc))
+			}
+			break
+		}
+		if i > 100 {
+			t.Fatal(fmt.Errorf("resources for %s were never recorded", request.subscription))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestQueuerHandlerBackoff checks that the backoff set by a handler that returned its message
+// to the queue is not replaced by the longer backoff used for messages lacking resources
+//
+func TestQueuerHandlerBackoff(t *testing.T) {
+
+	var fqName string
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		backoffs.Set(fqName, true, 200*time.Millisecond)
+		return nil, false
+	}
+
+	qr, mq, request := newMemQueuer(t, handler)
+
+	fqName = request.project + ":" + request.subscription
+	defer backoffs.Delete(fqName)
+
+	qr.filterWork(request, make(chan bool))
+
+	if stats, _ := mq.Stats(request.subscription); stats.Delivered != 1 || stats.Pending != 1 {
+		t.Fatal(fmt.Errorf("unexpected stats after nack %+v", stats))
+	}
+
+	time.Sleep(time.Second)
+	if _, isPresent := backoffs.Get(fqName); isPresent {
+		t.Fatal(fmt.Errorf("%s backoff set by the handler was replaced", fqName))
+	}
+}
+
+// TestQueuerWorkFailure checks that a failure to retrieve work backs off the subscription
+//
+func TestQueuerWorkFailure(t *testing.T) {
+
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		return runner.NewResource(runner.ResourceQuantities{MilliCPU: 500}), true
+	}
+
+	qr, mq, request := newMemQueuer(t, handler)
+	mq.SetFaults(runner.MemFaults{WorkErrs: 1, Latency: 10 * time.Millisecond})
+
+	fqName := request.project + ":" + request.subscription
+	defer backoffs.Delete(fqName)
+
+	qr.filterWork(request, make(chan bool))
+
+	if err := waitBackoff(fqName); err != nil {
+		t.Fatal(err)
+	}
+
+	// While backed off the queue should not be touched
+	qr.filterWork(request, make(chan bool))
+
+	if stats, _ := mq.Stats(request.subscription); stats.Delivered != 0 {
+		t.Fatal(fmt.Errorf("%s delivered work while backed off %+v", fqName, stats))
+	}
+
+	backoffs.Delete(fqName)
+
+	qr.filterWork(request, make(chan bool))
+
+	if stats, _ := mq.Stats(request.subscription); stats.Delivered != 1 || stats.Acked != 1 {
+		t.Fatal(fmt.Errorf("%s work not done after the backoff was cleared %+v", fqName, stats))
+	}
+}
+
+// TestQueuerQueueDeleted checks that running work is cancelled when the queue it
+// came from is deleted, and that failures checking for the queue are tolerated
+//
+func TestQueuerQueueDeleted(t *testing.T) {
+
+	startedC := make(chan struct{})
+	cancelledC := make(chan struct{})
+
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		close(startedC)
+		<-ctx.Done()
+		close(cancelledC)
+		return nil, false
+	}
+
+	qr, mq, request := newMemQueuer(t, handler)
+	qr.existsInterval = 50 * time.Millisecond
+	mq.SetFaults(runner.MemFaults{ExistsErrs: 2, Latency: 10 * time.Millisecond})
+
+	doneC := make(chan struct{})
+	go func() {
+		qr.filterWork(request, make(chan bool))
+		close(doneC)
+	}()
+
+	select {
+	case <-startedC:
+	case <-time.After(5 * time.Second):
+		t.Fatal(fmt.Errorf("work on %s was never started", request.subscription))
+	}
+
+	// Give the failing existence checks a chance to run and be ignored
+	time.Sleep(200 * time.Millisecond)
+
+	select {
+	case <-doneC:
+		t.Fatal(fmt.Errorf("work on %s stopped while the queue was still present", request.subscription))
+	default:
+	}
+
+	mq.DeleteQueue(request.subscription)
+
+	for _, waitC := range []chan struct{}{cancelledC, doneC} {
+		select {
+		case <-waitC:
+		case <-time.After(5 * time.Second):
+			t.Fatal(fmt.Errorf("work on %s was not cancelled after the queue was deleted", request.subscription))
+		}
+	}
+}
+
+// TestQueuerProducer runs the producer and consumer to check that work is found on
+// idle queues without being prompted
+//
+func TestQueuerProducer(t *testing.T) {
+
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		return runner.NewResource(runner.ResourceQuantities{MilliCPU: 1, Ram: 1024}), true
+	}
+
+	qr, mq, request := newMemQueuer(t, handler)
+	qr.checkInterval = 50 * time.Millisecond
+
+	quitC := make(chan bool)
+	defer close(quitC)
+
+	go qr.run(time.Minute, quitC)
+
+	if _, err := waitStats(mq, request.subscription, func(stats runner.MemQueueStats) bool { return stats.Acked == 1 }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestQueuerWake checks that the producer keeps taking work from a queue, without waiting
+// for its regular check interval, while the queue is producing work
+//
+func TestQueuerWake(t *testing.T) {
+
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		return runner.NewResource(runner.ResourceQuantities{MilliCPU: 1, Ram: 1024}), true
+	}
+
+	qr, mq, request := newMemQueuer(t, handler)
+	qr.checkInterval = time.Hour
+
+	for i := 0; i != 2; i++ {
+		if err := mq.Send(request.subscription, []byte(xid.New().String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quitC := make(chan bool)
+	defer close(quitC)
+
+	go qr.run(time.Minute, quitC)
+
+	// Only the first check is prompted, once the consumer has had time to start, the
+	// remaining messages should be picked up as each one is finished with
+	time.Sleep(100 * time.Millisecond)
+	qr.wake()
+
+	if _, err := waitStats(mq, request.subscription, func(stats runner.MemQueueStats) bool { return stats.Acked == 3 }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestQueuerConcurrency checks that a queue is worked by more than one worker, up to the
+// configured limit
+//
+func TestQueuerConcurrency(t *testing.T) {
+
+	releaseC := make(chan struct{})
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		<-releaseC
+		return runner.NewResource(runner.ResourceQuantities{MilliCPU: 1, Ram: 1024}), true
+	}
+
+	qr, mq, request := newMemQueuer(t, handler)
+	qr.checkInterval = 20 * time.Millisecond
+	qr.maxWorkers = 3
+
+	for i := 0; i != 4; i++ {
+		if err := mq.Send(request.subscription, []byte(xid.New().String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quitC := make(chan bool)
+	defer close(quitC)
+
+	go qr.run(time.Minute, quitC)
+
+	if _, err := waitStats(mq, request.subscription, func(stats runner.MemQueueStats) bool { return stats.InFlight == 3 }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit holds while the workers remain busy
+	time.Sleep(100 * time.Millisecond)
+	if stats, _ := mq.Stats(request.subscription); stats.InFlight != 3 || stats.Pending != 2 {
+		t.Fatalf("unexpected stats with all workers busy %+v", stats)
+	}
+	if active, handling := busyQs.workers(request.project + ":" + request.subscription); active != 3 || handling != 3 {
+		t.Fatalf("unexpected workers %d handling %d", active, handling)
+	}
+
+	close(releaseC)
+
+	if _, err := waitStats(mq, request.subscription, func(stats runner.MemQueueStats) bool { return stats.Acked == 5 }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHandleMsgRefusedEvent checks that an experiment refused because of its constraints is
+// reported on its reply queue using a refused event, and not a terminal event
+//
+func TestHandleMsgRefusedEvent(t *testing.T) {
+
+	project := "mem-" + xid.New().String()
+	subscription := "local_" + xid.New().String()
+	mq := runner.NewMemQueue(project)
+	mq.CreateQueue("events")
+
+	rqst := `{
+  "experiment": {
+    "key": "refused_` + xid.New().String() + `",
+    "filename": "train.py",
+    "owner": "guest",
+    "pythonver": 3,
+    "resources_needed": {"hdd": "1gb", "ram": "1gb", "cpus": 1, "constraints": ["zone == nowhere"]},
+    "artifacts": {
+      "workspace": {"bucket": "b", "key": "k", "qualified": "s3://host/b/k", "mutable": false, "unpack": true}
+    }
+  },
+  "config": {
+    "runner": {"reply_to": "events"}
+  }
+}`
+
+	if rsc, consume := handleMsg(withTaskQueue(context.Background(), mq), project, subscription, "", []byte(rqst)); consume || rsc == nil {
+		t.Fatalf("a refused experiment was consumed %v, or had no resources %v", consume, rsc)
+	}
+
+	events := []runner.LifecycleEvent{}
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		event := runner.LifecycleEvent{}
+		if errGo := json.Unmarshal(data, &event); errGo != nil {
+			t.Fatal(errGo)
+		}
+		events = append(events, event)
+		return nil, true
+	}
+	for {
+		cnt, _, err := mq.Work(context.Background(), time.Second, "events", handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cnt == 0 {
+			break
+		}
+	}
+
+	if len(events) != 1 || events[0].Stage != runner.StageRefused || !strings.Contains(events[0].Error, "constraints") {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+// TestHandleMsgBackoffKey checks that work refused by a handler backs off the queue using the
+// name the queuer knows it by, rather than the project the queue passed to the handler
+//
+func TestHandleMsgBackoffKey(t *testing.T) {
+
+	qr, _, request := newMemQueuer(t, handleMsg)
+
+	fqName := request.project + ":" + request.subscription
+	defer backoffs.Delete(fqName)
+
+	rqst := `{
+  "experiment": {
+    "key": "refused_` + xid.New().String() + `",
+    "filename": "train.py",
+    "owner": "guest",
+    "pythonver": 3,
+    "resources_needed": {"hdd": "1gb", "ram": "1gb", "cpus": 1, "constraints": ["zone == nowhere"]},
+    "artifacts": {
+      "workspace": {"bucket": "b", "key": "k", "qualified": "s3://host/b/k", "mutable": false, "unpack": true}
+    }
+  }
+}`
+
+	// Queues such as PubSub pass the bare project to handlers
+	bare := "bare-" + xid.New().String()
+	if _, consume := qr.counted(request)(context.Background(), bare, request.subscription, "", []byte(rqst)); consume {
+		t.Fatal(fmt.Errorf("a refused experiment was consumed"))
+	}
+
+	if _, isPresent := backoffs.Get(fqName); !isPresent {
+		t.Fatal(fmt.Errorf("%s was not backed off", fqName))
+	}
+	if _, isPresent := backoffs.Get(bare + ":" + request.subscription); isPresent {
+		backoffs.Delete(bare + ":" + request.subscription)
+		t.Fatal(fmt.Errorf("the project passed to the handler was backed off"))
+	}
+}
+
+// TestHandleMsgClaimCheckAttempts checks that a claim check whose payload cannot be retrieved
+// counts as a failed attempt, and is dead-lettered once it runs out of attempts
+//
+func TestHandleMsgClaimCheckAttempts(t *testing.T) {
+
+	project := "mem-" + xid.New().String()
+	subscription := "local_" + xid.New().String()
+	mq := runner.NewMemQueue(project)
+
+	fqName := project + ":" + subscription
+	defer backoffs.Delete(fqName)
+
+	oldLocations := *claimCheckLocationsOpt
+	*claimCheckLocationsOpt = "file:///nonexistent/"
+	defer func() {
+		*claimCheckLocationsOpt = oldLocations
+	}()
+
+	msg, err := runner.NewClaimCheck("file:///nonexistent/"+xid.New().String(), []byte(`{}`)).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mq.Send(subscription, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i != 10; i++ {
+		// Each failure backs off the queue, which would otherwise stop the next attempt
+		backoffs.Delete(fqName)
+		if _, _, err := mq.Work(context.Background(), time.Second, subscription, handleMsg); err != nil {
+			t.Fatal(err)
+		}
+		if stats, _ := mq.Stats(subscription); stats.Dead != 0 {
+			if stats.Delivered < 2 || stats.Pending != 0 {
+				t.Fatalf("unexpected stats once dead-lettered %+v", stats)
+			}
+			return
+		}
+	}
+	stats, _ := mq.Stats(subscription)
+	t.Fatalf("claim check was never dead-lettered %+v", stats)
+}
+
+// TestQueuerSkipsRefusedWork checks that once work has been refused because its constraints
+// cannot be met by this node the queue is skipped by the checks of the queuer
+//
+func TestQueuerSkipsRefusedWork(t *testing.T) {
+
+	project := "mem-" + xid.New().String()
+	subscription := "local_" + xid.New().String()
+
+	mq := runner.NewMemQueue(project)
+	rqst := `{
+  "experiment": {
+    "key": "refused_` + xid.New().String() + `",
+    "filename": "train.py",
+    "owner": "guest",
+    "pythonver": 3,
+    "resources_needed": {"hdd": "1gb", "ram": "1gb", "cpus": 1, "constraints": ["zone == nowhere"]},
+    "artifacts": {
+      "workspace": {"bucket": "b", "key": "k", "qualified": "s3://host/b/k", "mutable": false, "unpack": true}
+    }
+  }
+}`
+	if err := mq.Send(subscription, []byte(rqst)); err != nil {
+		t.Fatal(err)
+	}
+
+	qr := newQueuer(project, "", mq)
+	qr.handler = handleMsg
+	if err := qr.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	fqName := project + ":" + subscription
+	defer backoffs.Delete(fqName)
+
+	rQ := make(chan *SubRequest, 2)
+	if err := qr.check(subscription, rQ, make(chan bool)); err != nil {
+		t.Fatal(err)
+	}
+
+	qr.filterWork(&SubRequest{project: project, subscription: subscription}, make(chan bool))
+
+	if stats, _ := mq.Stats(subscription); stats.Delivered != 1 || stats.Pending != 1 {
+		t.Fatalf("refused work was not returned to the queue %+v", stats)
+	}
+
+	// The refusal backs off the queue, once that has expired the queue is still skipped
+	backoffs.Delete(fqName)
+	rQ = make(chan *SubRequest, 2)
+	if err := qr.check(subscription, rQ, make(chan bool)); err == nil || !strings.Contains(err.Error(), "constraints") {
+		t.Fatalf("queue holding refused work was not skipped %v", err)
+	}
+}
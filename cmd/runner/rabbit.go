@@ -7,12 +7,21 @@ import (
 	"time"
 
 	runner "github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/karlmutch/errors"
 )
 
 // This file contains the implementation of a RabbitMQ service for
 // retriving and handling StudioML workloads within a self hosted
 // queue context
 
+// knownQueues is implemented by task queues that list their queues using the URI of each
+// queue, each of which is processed as a project of its own, for example RabbitMQ
+//
+type knownQueues interface {
+	GetKnown(matcher *regexp.Regexp, timeout time.Duration) (found map[string]string, err errors.Error)
+}
+
 func serviceRMQ(ctx context.Context, checkInterval time.Duration, connTimeout time.Duration) {
 
 	if len(*amqpURL) == 0 {
@@ -22,9 +31,15 @@ func serviceRMQ(ctx context.Context, checkInterval time.Duration, connTimeout ti
 
 	live := &Projects{projects: map[string]chan bool{}}
 
-	rmq, err := runner.NewRabbitMQ(*amqpURL, "")
+	tq, err := runner.NewTaskQueue(*amqpURL, "")
 	if err != nil {
 		logger.Error(err.Error())
+		return
+	}
+	rmq, isKnown := tq.(knownQueues)
+	if !isKnown {
+		logger.Error(fmt.Sprintf("the queues of %s cannot be listed", *amqpURL))
+		return
 	}
 
 	// The regular expression is validated in the main.go file
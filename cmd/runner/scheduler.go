@@ -0,0 +1,69 @@
+package main
+
+// This file contains the events that drive the scheduling of work.  Producers are woken
+// whenever an experiment releases its resources, or queues are found, so that capacity is
+// offered to the queues straight away rather than at the next regular check.  The headroom
+// functions are used to share the capacity of the runner between the queues being checked.
+
+import (
+	"sync"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+)
+
+var (
+	// producers holds the queuers whose producers are woken when resources are released
+	producers = &Producers{queuers: map[*Queuer]bool{}}
+)
+
+// Producers is the set of queuers with running producers
+//
+type Producers struct {
+	queuers map[*Queuer]bool
+	sync.Mutex
+}
+
+func (prods *Producers) add(qr *Queuer) {
+	prods.Lock()
+	defer prods.Unlock()
+	prods.queuers[qr] = true
+}
+
+func (prods *Producers) remove(qr *Queuer) {
+	prods.Lock()
+	defer prods.Unlock()
+	delete(prods.queuers, qr)
+}
+
+// wakeAll has every producer check its queues for work, for example after resources are released
+//
+func (prods *Producers) wakeAll() {
+	prods.Lock()
+	defer prods.Unlock()
+	for qr := range prods.queuers {
+		qr.wake()
+	}
+}
+
+// reserve removes the resources a queue needs from the headroom, false is returned when they do
+// not fit.  Queues whose resources are not yet known always fit.
+//
+func reserve(headroom *runner.ResourceQuantities, rsc *runner.Resource) (fits bool) {
+	if rsc == nil {
+		return true
+	}
+	needs, err := rsc.Quantities()
+	if err != nil {
+		return false
+	}
+	if needs.MilliCPU > headroom.MilliCPU || needs.Gpus > headroom.Gpus || needs.Hdd > headroom.Hdd ||
+		needs.Ram > headroom.Ram || needs.GpuMem > headroom.GpuMem {
+		return false
+	}
+	headroom.MilliCPU -= needs.MilliCPU
+	headroom.Gpus -= needs.Gpus
+	headroom.Hdd -= needs.Hdd
+	headroom.Ram -= needs.Ram
+	headroom.GpuMem -= needs.GpuMem
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+// This file contains tests for the event driven scheduling of work across queues
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/rs/xid"
+)
+
+func TestSchedulerReserve(t *testing.T) {
+
+	headroom := runner.ResourceQuantities{MilliCPU: 2000, Ram: 4096, Gpus: 1}
+	gpu := runner.NewResource(runner.ResourceQuantities{MilliCPU: 1000, Ram: 1024, Gpus: 1})
+
+	if !reserve(&headroom, gpu) {
+		t.Fatal("resources that fit were refused")
+	}
+	if headroom.MilliCPU != 1000 || headroom.Ram != 3072 || headroom.Gpus != 0 {
+		t.Fatalf("unexpected headroom %+v", headroom)
+	}
+	if reserve(&headroom, gpu) {
+		t.Fatal("resources that did not fit were reserved")
+	}
+	if headroom.MilliCPU != 1000 {
+		t.Fatalf("headroom was changed by a failed reservation %+v", headroom)
+	}
+	if !reserve(&headroom, nil) {
+		t.Fatal("queues with unknown resources should always fit")
+	}
+}
+
+// TestSchedulerEvents checks that queues found by a refresh, and resources being released, have the
+// producer check queues without waiting for its regular interval, and that several queues are
+// checked at once
+//
+func TestSchedulerEvents(t *testing.T) {
+
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*runner.Resource, bool) {
+		return runner.NewResource(runner.ResourceQuantities{MilliCPU: 1, Ram: 1024}), true
+	}
+
+	qr, mq, request := newMemQueuer(t, handler)
+	qr.checkInterval = time.Hour
+
+	other := "local_" + xid.New().String()
+	if err := mq.Send(other, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	quitC := make(chan bool)
+	defer close(quitC)
+
+	go qr.run(time.Hour, quitC)
+
+	// The first refresh finds both queues and the single wake that follows checks them both
+	for _, name := range []string{request.subscription, other} {
+		if _, err := waitStats(mq, name, func(stats runner.MemQueueStats) bool { return stats.Acked == 1 }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the queue is idle resources being released by an experiment prompt a check
+	time.Sleep(100 * time.Millisecond)
+	if err := mq.Send(request.subscription, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	producers.wakeAll()
+
+	if _, err := waitStats(mq, request.subscription, func(stats runner.MemQueueStats) bool { return stats.Acked == 2 }); err != nil {
+		t.Fatal(err)
+	}
+}
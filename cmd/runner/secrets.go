@@ -0,0 +1,62 @@
+package main
+
+// This file contains the handling of the private key used to decrypt environment
+// variable values that clients have encrypted within the env section of a request
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	envKeyOpt = flag.String("env-key", "", "an optional file containing a base64 encoded curve25519 private key used to decrypt encrypted env values within requests")
+
+	envKey = &EnvKeySafe{}
+)
+
+// EnvKeySafe guards the key used to decrypt environment variables
+//
+type EnvKeySafe struct {
+	key *runner.EnvKey
+	sync.Mutex
+}
+
+// initEnvKey loads the private key, if any, that was specified on the command line
+//
+func initEnvKey() (err errors.Error) {
+	if len(*envKeyOpt) == 0 {
+		return nil
+	}
+
+	key, err := runner.LoadEnvKey(*envKeyOpt)
+	if err != nil {
+		return err
+	}
+
+	envKey.Lock()
+	envKey.key = key
+	envKey.Unlock()
+
+	logger.Info(fmt.Sprintf("encrypted env values can be sent using the public key %s", key.PublicKey()))
+
+	return nil
+}
+
+// decryptEnv will decrypt the named environment variable value from a request
+//
+func decryptEnv(name string, value string) (plain string, err errors.Error) {
+	envKey.Lock()
+	key := envKey.key
+	envKey.Unlock()
+
+	if key == nil {
+		return "", errors.New("encrypted env value present but no env-key was configured").With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	return key.DecryptEnvValue(name, value)
+}
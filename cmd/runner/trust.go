@@ -0,0 +1,99 @@
+package main
+
+// This file contains the implementation of message signature checking for
+// experiments arriving on queues.  When a trusted keys directory is configured
+// every message must be signed by one of the keys in the directory otherwise
+// it is rejected before any processing is done.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SentientTechnologies/studio-go-runner"
+
+	"github.com/karlmutch/errors"
+)
+
+var (
+	trustedKeysOpt = flag.String("trusted-keys", "", "an optional directory of ed25519 public keys, if set only messages signed by one of these keys will be processed")
+
+	trustedKeys = &TrustedKeysSafe{}
+)
+
+// TrustedKeysSafe guards the key catalog that is initialized once the runner options are known
+//
+type TrustedKeysSafe struct {
+	keys *runner.TrustedKeys
+	sync.Mutex
+}
+
+// initTrustedKeys loads the trusted keys, if any, that were specified on the command line
+//
+func initTrustedKeys() (err errors.Error) {
+	if len(*trustedKeysOpt) == 0 {
+		return nil
+	}
+
+	keys, err := runner.NewTrustedKeys(*trustedKeysOpt)
+	if err != nil {
+		return err
+	}
+
+	trustedKeys.Lock()
+	trustedKeys.keys = keys
+	trustedKeys.Unlock()
+
+	return nil
+}
+
+// serviceTrustedKeys reloads the trusted keys directory on a regular basis so that keys
+// can be added and revoked without restarting the runner
+//
+func serviceTrustedKeys(ctx context.Context, refreshInterval time.Duration) {
+
+	trustedKeys.Lock()
+	keys := trustedKeys.keys
+	trustedKeys.Unlock()
+
+	if keys == nil {
+		logger.Info("message signature checking disabled")
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(refreshInterval):
+			if err := keys.Refresh(); err != nil {
+				logger.Warn(fmt.Sprintf("unable to refresh trusted keys due to %v", err))
+			}
+		}
+	}
+}
+
+// verifyMsg checks the signature of a message and returns the payload the message contained.
+//
+// If signature checking is disabled signed messages will have their payload returned
+// without the signature being checked and unsigned messages are returned as is
+//
+func verifyMsg(msg []byte) (payload []byte, err errors.Error) {
+	trustedKeys.Lock()
+	keys := trustedKeys.keys
+	trustedKeys.Unlock()
+
+	if keys == nil {
+		_, payload, err = runner.OpenSignedMsg(msg)
+		return payload, err
+	}
+
+	payload, keyID, err := keys.Verify(msg)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug(fmt.Sprintf("msg signed by %s verified", keyID))
+	return payload, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+// This file contains the implementation of a service for retrieving and handling
+// StudioML workloads from queue servers identified using a single URI, for example a
+// spool directory, a redis server, or a NATS JetStream server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	runner "github.com/SentientTechnologies/studio-go-runner"
+)
+
+// serviceURI watches the queue server identified by the URI, using the task queue
+// backend registered for the URI scheme, and starts processing its queues once the
+// server can be reached
+//
+func serviceURI(ctx context.Context, uri string, checkInterval time.Duration, connTimeout time.Duration) {
+
+	live := &Projects{projects: map[string]chan bool{}}
+
+	tq, err := runner.NewTaskQueue(uri, "")
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	// The regular expression is validated in the main.go file
+	matcher, _ := regexp.Compile(*queueMatch)
+
+	// first time through make sure the server is checked immediately
+	qCheck := time.Duration(time.Second)
+
+	for {
+		select {
+		case <-ctx.Done():
+			live.Lock()
+			defer live.Unlock()
+
+			// When shutting down stop all projects
+			for _, quiter := range live.projects {
+				close(quiter)
+			}
+			return
+		case <-time.After(qCheck):
+			qCheck = checkInterval
+
+			// The server acts as the project, it is only started once the server can be
+			// reached, or for spool directories once the directory is present so that it
+			// can be mounted after the runner is started
+			found := map[string]string{}
+			if _, err := tq.Refresh(matcher, connTimeout); err != nil {
+				logger.Warn(fmt.Sprintf("unable to refresh the queues of %s due to %v", uri, err))
+				qCheck = qCheck * 2
+			} else {
+				found[uri] = ""
+			}
+
+			live.Lifecycle(found)
+		}
+	}
+}
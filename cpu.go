@@ -20,14 +20,14 @@ import (
 type cpuTracker struct {
 	cpuInfo []cpu.InfoStat // CPU Information is static so cache it for later reference
 
-	AllocCores uint   // The number of cores currently consumed and allocated
-	AllocMem   uint64 // The amount of memory currently allocated
+	AllocMilliCPU uint64 // The number of millicores currently consumed and allocated
+	AllocMem      uint64 // The amount of memory currently allocated
 
-	HardMaxCores uint   // The number of cores that the hardware has provisioned
-	HardMaxMem   uint64 // The amount of RAM the system has provisioned
+	HardMaxMilliCPU uint64 // The number of millicores that the hardware has provisioned
+	HardMaxMem      uint64 // The amount of RAM the system has provisioned
 
-	SoftMaxCores uint   // User specified limit on the number of cores to permit to be used in allocations
-	SoftMaxMem   uint64 // User specified memory that is available for allocation
+	SoftMaxMilliCPU uint64 // User specified limit on the number of millicores to permit to be used in allocations
+	SoftMaxMem      uint64 // User specified memory that is available for allocation
 
 	InitErr errors.Error // Any error that might have been recorded during initialization, if set this package may produce unexpected results
 
@@ -41,7 +41,7 @@ var (
 func init() {
 	cpuTrack.cpuInfo, _ = cpu.Info()
 
-	cpuTrack.HardMaxCores = uint(len(cpuTrack.cpuInfo))
+	cpuTrack.HardMaxMilliCPU = uint64(len(cpuTrack.cpuInfo)) * 1000
 	mem, err := mem.VirtualMemory()
 	if err != nil {
 		cpuTrack.InitErr = errors.Wrap(err).With("stack", stack.Trace().TrimRuntime())
@@ -49,7 +49,7 @@ func init() {
 	}
 	cpuTrack.HardMaxMem = mem.Available
 
-	cpuTrack.SoftMaxCores = cpuTrack.HardMaxCores
+	cpuTrack.SoftMaxMilliCPU = cpuTrack.HardMaxMilliCPU
 	cpuTrack.SoftMaxMem = cpuTrack.HardMaxMem
 }
 
@@ -57,17 +57,18 @@ func init() {
 // resources that will be returned at a later time
 //
 type CPUAllocated struct {
-	cores uint
-	mem   uint64
+	milliCPU uint64
+	mem      uint64
 }
 
-// GetCPUFree is used to retrieve information about the currently available CPU resources
+// GetCPUFree is used to retrieve information about the currently available CPU resources,
+// CPU is measured in millicores
 //
-func CPUFree() (cores uint, mem uint64) {
+func CPUFree() (milliCPU uint64, mem uint64) {
 	cpuTrack.Lock()
 	defer cpuTrack.Unlock()
 
-	return cpuTrack.SoftMaxCores - cpuTrack.AllocCores,
+	return cpuTrack.SoftMaxMilliCPU - cpuTrack.AllocMilliCPU,
 		cpuTrack.SoftMaxMem - cpuTrack.AllocMem
 }
 
@@ -97,17 +98,17 @@ func SetCPULimits(maxCores uint, maxMem uint64) (err errors.Error) {
 		return cpuTrack.InitErr
 	}
 
-	if maxCores > cpuTrack.HardMaxCores {
-		return errors.New(fmt.Sprintf("new soft cores limit %d, violated hard limit %d", maxCores, cpuTrack.HardMaxCores)).With("stack", stack.Trace().TrimRuntime())
+	if uint64(maxCores)*1000 > cpuTrack.HardMaxMilliCPU {
+		return errors.New(fmt.Sprintf("new soft cores limit %d, violated hard limit %s", maxCores, FormatCPU(cpuTrack.HardMaxMilliCPU))).With("stack", stack.Trace().TrimRuntime())
 	}
 	if maxMem > cpuTrack.HardMaxMem {
 		return errors.New(fmt.Sprintf("new soft memory limit %d, violated hard limit %d", maxMem, cpuTrack.HardMaxMem)).With("stack", stack.Trace().TrimRuntime())
 	}
 
 	if maxCores == 0 {
-		cpuTrack.SoftMaxCores = cpuTrack.HardMaxCores
+		cpuTrack.SoftMaxMilliCPU = cpuTrack.HardMaxMilliCPU
 	} else {
-		cpuTrack.SoftMaxCores = maxCores
+		cpuTrack.SoftMaxMilliCPU = uint64(maxCores) * 1000
 	}
 
 	if maxMem == 0 {
@@ -120,9 +121,9 @@ func SetCPULimits(maxCores uint, maxMem uint64) (err errors.Error) {
 }
 
 // AllocCPU is used by callers to attempt to allocate a CPU resource from the system, CPU affinity is not implemented
-// and so this is soft accounting
+// and so this is soft accounting.  CPU is allocated in millicores.
 //
-func AllocCPU(maxCores uint, maxMem uint64) (alloc *CPUAllocated, err errors.Error) {
+func AllocCPU(maxMilliCPU uint64, maxMem uint64) (alloc *CPUAllocated, err errors.Error) {
 
 	cpuTrack.Lock()
 	defer cpuTrack.Unlock()
@@ -131,19 +132,19 @@ func AllocCPU(maxCores uint, maxMem uint64) (alloc *CPUAllocated, err errors.Err
 		return nil, cpuTrack.InitErr
 	}
 
-	if maxCores+cpuTrack.AllocCores > cpuTrack.SoftMaxCores {
+	if maxMilliCPU+cpuTrack.AllocMilliCPU > cpuTrack.SoftMaxMilliCPU {
 		return nil, errors.New("no available CPU slots found").With("stack", stack.Trace().TrimRuntime())
 	}
 	if maxMem+cpuTrack.AllocMem > cpuTrack.SoftMaxMem {
 		return nil, errors.New(fmt.Sprintf("insufficient available memory %s requested from pool of %s", humanize.Bytes(maxMem), humanize.Bytes(cpuTrack.SoftMaxMem))).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	cpuTrack.AllocCores += maxCores
+	cpuTrack.AllocMilliCPU += maxMilliCPU
 	cpuTrack.AllocMem += maxMem
 
 	return &CPUAllocated{
-		cores: maxCores,
-		mem:   maxMem,
+		milliCPU: maxMilliCPU,
+		mem:      maxMem,
 	}, nil
 }
 
@@ -158,6 +159,19 @@ func (cpu *CPUAllocated) Release() {
 		return
 	}
 
-	cpuTrack.AllocCores -= cpu.cores
+	cpuTrack.AllocMilliCPU -= cpu.milliCPU
 	cpuTrack.AllocMem -= cpu.mem
 }
+
+// CPUCapabilities returns the vendor, model and feature flags of the CPUs
+//
+func CPUCapabilities() (vendor string, model string, flags []string) {
+	cpuTrack.Lock()
+	defer cpuTrack.Unlock()
+
+	if len(cpuTrack.cpuInfo) == 0 {
+		return "", "", nil
+	}
+	info := cpuTrack.cpuInfo[0]
+	return info.VendorID, info.ModelName, info.Flags
+}
@@ -31,6 +31,8 @@ type cudaDevices struct {
 
 type GPUTrack struct {
 	UUID      string // The UUID designation for the GPU being managed
+	Model     string // The model name reported by the device
+	Compute   string // The CUDA compute capability of the device, if known
 	Group     string // The user grouping to which this GPU has been bound
 	Slots     uint   // The number of logical slots the GPU based on its size has
 	Mem       uint64 // The amount of memory the GPU posses
@@ -108,6 +110,8 @@ func init() {
 
 		track := &GPUTrack{
 			UUID:      dev.UUID,
+			Model:     dev.Name,
+			Compute:   cudaCompute(dev.Name),
 			Mem:       dev.MemFree,
 			Slots:     1,
 			FreeSlots: 1,
@@ -128,6 +132,51 @@ func init() {
 	}
 }
 
+// cudaComputeModels maps fragments of device model names to their CUDA compute capability,
+// more specific names appear before names they contain
+//
+var cudaComputeModels = []struct {
+	model   string
+	compute string
+}{
+	{"A100", "8.0"}, {"A10", "8.6"}, {"A40", "8.6"}, {"RTX 30", "8.6"},
+	{"T4", "7.5"}, {"RTX 20", "7.5"}, {"TITAN RTX", "7.5"}, {"Quadro RTX", "7.5"},
+	{"V100", "7.0"}, {"TITAN V", "7.0"},
+	{"P100", "6.0"}, {"P40", "6.1"}, {"P4", "6.1"}, {"GTX 10", "6.1"}, {"TITAN Xp", "6.1"}, {"TITAN X (Pascal)", "6.1"},
+	{"TITAN X", "5.2"}, {"GTX 9", "5.2"}, {"M60", "5.2"}, {"M40", "5.2"},
+	{"K80", "3.7"}, {"K40", "3.5"},
+}
+
+// cudaCompute returns the CUDA compute capability for a device model name, the
+// management library does not expose this and so a table of known devices is used
+//
+func cudaCompute(model string) (compute string) {
+	for _, known := range cudaComputeModels {
+		if strings.Contains(model, known.model) {
+			return known.compute
+		}
+	}
+	return ""
+}
+
+// GPUCapabilities returns the model names and known CUDA compute capabilities of the
+// GPU devices the runner is using
+//
+func GPUCapabilities() (models []string, compute []string) {
+	gpuAllocs.Lock()
+	defer gpuAllocs.Unlock()
+
+	for _, alloc := range gpuAllocs.Allocs {
+		if len(alloc.Model) != 0 {
+			models = append(models, alloc.Model)
+		}
+		if len(alloc.Compute) != 0 {
+			compute = append(compute, alloc.Compute)
+		}
+	}
+	return models, compute
+}
+
 // GPUSlots gets the free and total number of GPU capacity slots within
 // the machine
 //
@@ -0,0 +1,142 @@
+package runner
+
+// This file contains the retry policy shared by the task queues.  Queues record the number
+// of times a message has been attempted in the context passed to message handlers, and
+// handlers record why a message failed.  Messages that fail more than the maximum number
+// of attempts, or that can never succeed, are sent to a dead-letter queue along with the
+// reason for the failure, or are discarded when no dead-letter queue is configured.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"sync"
+
+	"github.com/karlmutch/errors"
+)
+
+var (
+	maxAttemptsOpt = flag.Int("max-attempts", 5, "the number of times a failing message is attempted before it is sent to the dead-letter queue, 0 retries failing messages indefinitely")
+	deadLetterOpt  = flag.String("dead-letter-queue", "", "the queue, on the same queue server, failed messages are sent to along with the reason for the failure, failed messages are discarded when not set")
+)
+
+const (
+	// FailureReasonAttr is the name of the attribute, or header, containing the reason
+	// a message was sent to the dead-letter queue
+	FailureReasonAttr = "studioml-failure-reason"
+
+	// AttemptsAttr is the name of the attribute, or header, used by queues that count
+	// attempts by sending failed messages back to the queue
+	AttemptsAttr = "studioml-attempts"
+)
+
+// Delivery describes a message being handled, along with any failure the handler recorded
+//
+type Delivery struct {
+	Attempt int // The delivery attempt starting at 1, 0 if the queue could not count attempts
+	failure errors.Error
+	reason  string // A JSON document describing the failure, used in place of the error when present
+	retry   bool
+	sync.Mutex
+}
+
+type deliveryKey struct{}
+
+// withDelivery adds the delivery information for a message to the context passed to handlers
+//
+func withDelivery(ctx context.Context, attempt int) (deliveryCtx context.Context, delivery *Delivery) {
+	delivery = &Delivery{Attempt: attempt}
+	return context.WithValue(ctx, deliveryKey{}, delivery), delivery
+}
+
+// DeliveryAttempt returns the attempt of the message being handled, starting at 1, or 0
+// when the queue was not able to count attempts
+//
+func DeliveryAttempt(ctx context.Context) (attempt int) {
+	if delivery, isPresent := ctx.Value(deliveryKey{}).(*Delivery); isPresent {
+		return delivery.Attempt
+	}
+	return 0
+}
+
+// FailDelivery is used by message handlers to record why the message being handled failed.  The
+// handler should then return without acknowledging the message.  Messages that can be retried are
+// returned to the queue until they run out of attempts, other messages are dead-lettered at once.
+//
+func FailDelivery(ctx context.Context, err errors.Error, retry bool) {
+	delivery, isPresent := ctx.Value(deliveryKey{}).(*Delivery)
+	if !isPresent || err == nil {
+		return
+	}
+	delivery.Lock()
+	defer delivery.Unlock()
+	delivery.failure = err
+	delivery.reason = ""
+	delivery.retry = retry
+}
+
+// FailDeliveryReport records a failure in the same way as FailDelivery, the report being
+// marshalled to JSON and used as the reason the message was dead-lettered in place of the error,
+// for example the validation report of a request with every problem that was found
+//
+func FailDeliveryReport(ctx context.Context, err errors.Error, report interface{}, retry bool) {
+	FailDelivery(ctx, err, retry)
+
+	delivery, isPresent := ctx.Value(deliveryKey{}).(*Delivery)
+	if !isPresent || err == nil {
+		return
+	}
+	reason, errGo := json.Marshal(report)
+	if errGo != nil {
+		return
+	}
+	delivery.Lock()
+	defer delivery.Unlock()
+	delivery.reason = string(reason)
+}
+
+// FinalDelivery is true when the failure the handler recorded for the message being handled
+// will result in the message being dead-lettered, or discarded, rather than delivered again
+//
+func FinalDelivery(ctx context.Context) (final bool) {
+	delivery, isPresent := ctx.Value(deliveryKey{}).(*Delivery)
+	if !isPresent {
+		return false
+	}
+	_, final = delivery.deadLetter()
+	return final
+}
+
+// failed is true when the handler recorded a failure for the message
+//
+func (delivery *Delivery) failed() (failed bool) {
+	delivery.Lock()
+	defer delivery.Unlock()
+	return delivery.failure != nil
+}
+
+// deadLetter is used by queues when a handler has not acknowledged a message to decide if the
+// message is to be dead-lettered, the reason for the failure being returned when it is
+//
+func (delivery *Delivery) deadLetter() (reason string, isDead bool) {
+	delivery.Lock()
+	defer delivery.Unlock()
+
+	if delivery.failure == nil {
+		return "", false
+	}
+	if delivery.retry && (*maxAttemptsOpt <= 0 || delivery.Attempt < *maxAttemptsOpt) {
+		return "", false
+	}
+	if len(delivery.reason) != 0 {
+		return delivery.reason, true
+	}
+	return delivery.failure.Error(), true
+}
+
+// deadLetterQueue returns the name of the queue failed messages are sent to, failed messages
+// are discarded when this is empty
+//
+func deadLetterQueue() (name string) {
+	return *deadLetterOpt
+}
@@ -0,0 +1,226 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// This file contains tests for the retry policy and dead-lettering of failed messages
+
+// failingHandler records the attempts it sees and fails every message, retry indicating
+// if the failure can be retried
+//
+func failingHandler(attempts *[]int, retry bool) (handler MsgHandler) {
+	return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+		*attempts = append(*attempts, DeliveryAttempt(ctx))
+		FailDelivery(ctx, errors.New("experiment failed").With("stack", stack.Trace().TrimRuntime()), retry)
+		return nil, false
+	}
+}
+
+func setDeadLetter(t *testing.T, maxAttempts int, dlq string) (restore func()) {
+	oldMax, oldDLQ := *maxAttemptsOpt, *deadLetterOpt
+	*maxAttemptsOpt, *deadLetterOpt = maxAttempts, dlq
+	return func() {
+		*maxAttemptsOpt, *deadLetterOpt = oldMax, oldDLQ
+	}
+}
+
+func TestDeadLetterRetries(t *testing.T) {
+
+	defer setDeadLetter(t, 3, "dead_letters")()
+
+	mq := NewMemQueue("dead-letter")
+	if err := mq.Send("work", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := []int{}
+	handler := failingHandler(&attempts, true)
+	for i := 0; i != 4; i++ {
+		if _, _, err := mq.Work(context.Background(), time.Second, "work", handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+	stats, _ := mq.Stats("work")
+	if stats.Pending != 0 || stats.Nacked != 2 || stats.Dead != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	reasons := mq.Failures("dead_letters")
+	if len(reasons) != 1 || !strings.Contains(reasons[0], "experiment failed") {
+		t.Fatalf("unexpected dead-letters %v", reasons)
+	}
+}
+
+// TestFinalDelivery checks that failures are only final once they will not be retried
+//
+func TestFinalDelivery(t *testing.T) {
+
+	defer setDeadLetter(t, 2, "")()
+
+	if FinalDelivery(context.Background()) {
+		t.Fatal("a message without delivery information was final")
+	}
+
+	failure := errors.New("experiment failed").With("stack", stack.Trace().TrimRuntime())
+	for _, retry := range []bool{true, false} {
+		for attempt := 1; attempt != 3; attempt++ {
+			ctx, _ := withDelivery(context.Background(), attempt)
+			if FinalDelivery(ctx) {
+				t.Fatalf("attempt %d was final without a failure", attempt)
+			}
+			FailDelivery(ctx, failure, retry)
+			if expected := !retry || attempt == 2; FinalDelivery(ctx) != expected {
+				t.Fatalf("attempt %d with retry %v was not final %v", attempt, retry, expected)
+			}
+		}
+	}
+}
+
+// TestDeadLetterReport checks that a structured report recorded with a failure is used as the
+// reason the message was dead-lettered
+//
+func TestDeadLetterReport(t *testing.T) {
+
+	defer setDeadLetter(t, 3, "dead_letters")()
+
+	mq := NewMemQueue("dead-letter")
+	if err := mq.Send("work", []byte(`{"experiment": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+		report, err := ValidateRequest(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		FailDeliveryReport(ctx, errors.New("request failed validation").With("stack", stack.Trace().TrimRuntime()), report, false)
+		return nil, false
+	}
+	if _, _, err := mq.Work(context.Background(), time.Second, "work", handler); err != nil {
+		t.Fatal(err)
+	}
+
+	reasons := mq.Failures("dead_letters")
+	if len(reasons) != 1 {
+		t.Fatalf("unexpected dead-letters %v", reasons)
+	}
+	report := &ValidationReport{}
+	if errGo := json.Unmarshal([]byte(reasons[0]), report); errGo != nil {
+		t.Fatalf("reason %s is not a validation report %v", reasons[0], errGo)
+	}
+	if report.Valid() || len(report.Errors) != 2 {
+		t.Fatalf("unexpected report %s", reasons[0])
+	}
+}
+
+func TestDeadLetterPoison(t *testing.T) {
+
+	defer setDeadLetter(t, 3, "")()
+
+	mq := NewMemQueue("dead-letter")
+	if err := mq.Send("work", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages that can never succeed are not retried, without a dead-letter queue they are discarded
+	attempts := []int{}
+	if _, _, err := mq.Work(context.Background(), time.Second, "work", failingHandler(&attempts, false)); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := mq.Stats("work"); stats.Pending != 0 || stats.Dead != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, isPresent := mq.Stats("dead_letters"); isPresent {
+		t.Fatal("a dead-letter queue was created when none was configured")
+	}
+
+	// Messages the handler does not acknowledge, without recording a failure, are always returned
+	if err := mq.Send("work", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	refuse := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+		return nil, false
+	}
+	for i := 0; i != 5; i++ {
+		if _, _, err := mq.Work(context.Background(), time.Second, "work", refuse); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats, _ := mq.Stats("work"); stats.Pending != 1 || stats.Nacked != 5 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLocalQueueDeadLetter(t *testing.T) {
+
+	defer setDeadLetter(t, 2, "dead_letters")()
+
+	dir, errGo := ioutil.TempDir("", "local-dead-letter")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	lq, err := NewLocalQueue("file://"+dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lq.Send("local_work", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := []int{}
+	handler := failingHandler(&attempts, true)
+	for i := 0; i != 3; i++ {
+		if _, _, err := lq.Work(context.Background(), time.Second, "local_work", handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "dead_letters", "*"))
+	if len(files) != 2 {
+		t.Fatalf("unexpected dead-letter files %v", files)
+	}
+	reasons, _ := filepath.Glob(filepath.Join(dir, "dead_letters", "*"+localFailure))
+	if len(reasons) != 1 {
+		t.Fatalf("failure reason missing from %v", files)
+	}
+	if reason, _ := ioutil.ReadFile(reasons[0]); !strings.Contains(string(reason), "experiment failed") {
+		t.Fatalf("unexpected failure reason %s", string(reason))
+	}
+
+	// The reason file is not itself a message
+	known, err := lq.Refresh(nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isPresent := known["dead_letters"]; !isPresent {
+		t.Fatal("dead-letter queue not found")
+	}
+	cnt, _, err := lq.Work(context.Background(), time.Second, "dead_letters", func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+		return nil, true
+	})
+	if err != nil || cnt != 1 {
+		t.Fatalf("dead-letter could not be consumed %d %v", cnt, err)
+	}
+	if cnt, _, _ = lq.Work(context.Background(), time.Second, "dead_letters", nil); cnt != 0 {
+		t.Fatal("failure reason was treated as a message")
+	}
+}
@@ -0,0 +1,449 @@
+package runner
+
+// This file contains the stores used to detect experiments that have been delivered more than
+// once by queues offering at-least-once delivery, such as SQS, PubSub and RabbitMQ.
+//
+// Before an experiment is run the runner claims it using the experiment key, recording the
+// delivery attempt and host holding the claim.  Claims are renewed while the experiment runs,
+// finished when the experiment will not be run again, and released when the queue is expected
+// to retry the message.  Claims that are not renewed within the expiry interval are treated as
+// abandoned, for example by a runner that was killed, and can be taken over.  Finished claims
+// are kept for a retention period, long enough for the queues to have stopped redelivering
+// the experiment, after which they no longer prevent the experiment from running and can be
+// pruned.
+//
+// Two stores are available.  The file store keeps claims in a directory and is atomic for runners
+// sharing a host.  The object store keeps claims as markers written through the Storage interface,
+// to S3 or Google Cloud Storage, allowing them to be shared between hosts.  Object stores do not
+// offer an atomic create so claims are read back after being written, which reduces but does not
+// remove the chance of two runners claiming the same experiment at the same moment.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"github.com/rs/xid"
+)
+
+// DedupClaim records the runner holding, or that held, an experiment
+//
+type DedupClaim struct {
+	Key      string    `json:"key"`      // The experiment key
+	Attempt  int       `json:"attempt"`  // The delivery attempt of the message holding the claim
+	Host     string    `json:"host"`     // The host of the runner holding the claim
+	ID       string    `json:"id"`       // Unique to each claim allowing the holder to recognize its own claim
+	Time     time.Time `json:"time"`     // When the claim was made or last renewed
+	Finished bool      `json:"finished"` // Set once the experiment will not be run again, finished claims are kept for the retention period
+	Released bool      `json:"released"` // Set when the claim was given up so that the experiment can be retried
+}
+
+// NewDedupClaim creates a claim for the delivery attempt of an experiment by this host
+//
+func NewDedupClaim(key string, attempt int) (claim *DedupClaim) {
+	return &DedupClaim{
+		Key:     key,
+		Attempt: attempt,
+		Host:    GetHostName(),
+		ID:      xid.New().String(),
+		Time:    time.Now(),
+	}
+}
+
+// isHeld is true when a claim prevents other deliveries of the experiment from being run.  Claims
+// that have not been renewed within the expiry, and finished claims older than the retention,
+// are no longer held, an expiry or retention of 0 never being reached.
+//
+func (claim *DedupClaim) isHeld(expiry time.Duration, retention time.Duration) (held bool) {
+	if claim.Released {
+		return false
+	}
+	if claim.Finished {
+		return retention <= 0 || time.Since(claim.Time) < retention
+	}
+	return expiry <= 0 || time.Since(claim.Time) < expiry
+}
+
+// DedupStore is implemented by the stores used to claim experiments
+//
+type DedupStore interface {
+	// Claim takes the experiment for the claim, when the experiment is already held the claim
+	// of the holder is returned and the experiment should not be run
+	Claim(claim *DedupClaim, expiry time.Duration, retention time.Duration) (holder *DedupClaim, err errors.Error)
+
+	// Renew refreshes the time of a claim so that it does not expire
+	Renew(claim *DedupClaim) (err errors.Error)
+
+	// Finish marks the experiment as one that will not be run again
+	Finish(claim *DedupClaim) (err errors.Error)
+
+	// Release gives up a claim so that a later delivery of the experiment can be run
+	Release(claim *DedupClaim) (err errors.Error)
+}
+
+// DedupPruner is implemented by stores able to remove the claims that are no longer held
+//
+type DedupPruner interface {
+	Prune(expiry time.Duration, retention time.Duration) (pruned int, err errors.Error)
+}
+
+// NewDedupStore creates a store from a uri, file:///dir for claims shared by runners on one host,
+// or s3://endpoint/bucket/prefix and gs://bucket/prefix for claims shared between hosts
+//
+func NewDedupStore(uri string, projectID string, creds string, env map[string]string, timeout time.Duration) (store DedupStore, err errors.Error) {
+	u, errGo := url.Parse(uri)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", uri)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewDedupFileStore(u.Path)
+	case "s3", "gs":
+		return &DedupObjectStore{
+			uri:       uri,
+			projectID: projectID,
+			creds:     creds,
+			env:       env,
+			timeout:   timeout,
+		}, nil
+	default:
+		return nil, errors.New("unknown, or unsupported URI scheme, file, s3 or gs expected").With("stack", stack.Trace().TrimRuntime()).With("uri", uri)
+	}
+}
+
+// dedupName is the name used by stores for the claim of an experiment
+//
+func dedupName(key string) (name string) {
+	return url.PathEscape(key) + ".json"
+}
+
+// DedupFileStore keeps claims as files within a directory
+//
+type DedupFileStore struct {
+	dir string
+}
+
+// NewDedupFileStore creates a store keeping claims within the directory, which is created if needed
+//
+func NewDedupFileStore(dir string) (store *DedupFileStore, err errors.Error) {
+	if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", dir)
+	}
+	return &DedupFileStore{dir: dir}, nil
+}
+
+func (store *DedupFileStore) read(fn string) (claim *DedupClaim, err errors.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	claim = &DedupClaim{}
+	if errGo = json.Unmarshal(data, claim); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	return claim, nil
+}
+
+// write replaces the claim file, using a rename so that readers never see a partial claim
+//
+func (store *DedupFileStore) write(fn string, claim *DedupClaim) (err errors.Error) {
+	data, errGo := json.Marshal(claim)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	tmp := fn + "." + claim.ID
+	if errGo = ioutil.WriteFile(tmp, data, 0600); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", tmp)
+	}
+	if errGo = os.Rename(tmp, fn); errGo != nil {
+		os.Remove(tmp)
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	return nil
+}
+
+// Claim creates the claim file exclusively, replacing claims that are no longer held
+//
+func (store *DedupFileStore) Claim(claim *DedupClaim, expiry time.Duration, retention time.Duration) (holder *DedupClaim, err errors.Error) {
+	fn := filepath.Join(store.dir, dedupName(claim.Key))
+
+	data, errGo := json.Marshal(claim)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+
+	// A claim that is no longer held is removed and the create retried once, if another runner
+	// creates a claim in the meantime that claim is the holder
+	for i := 0; i < 2; i++ {
+		f, errGo := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errGo == nil {
+			_, errGo = f.Write(data)
+			if errClose := f.Close(); errGo == nil {
+				errGo = errClose
+			}
+			if errGo != nil {
+				os.Remove(fn)
+				return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+			}
+			return nil, nil
+		}
+		if !os.IsExist(errGo) {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+		}
+
+		if holder, err = store.read(fn); err != nil {
+			return nil, err
+		}
+		if holder.isHeld(expiry, retention) {
+			return holder, nil
+		}
+		if errGo = os.Remove(fn); errGo != nil && !os.IsNotExist(errGo) {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+		}
+	}
+	return nil, errors.New("experiment claim is being replaced by another runner").With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+}
+
+// update rewrites a claim file that is still held by the claim
+//
+func (store *DedupFileStore) update(claim *DedupClaim) (err errors.Error) {
+	fn := filepath.Join(store.dir, dedupName(claim.Key))
+
+	current, err := store.read(fn)
+	if err != nil {
+		return err
+	}
+	if current.ID != claim.ID {
+		return errors.New("experiment claimed by another runner").With("stack", stack.Trace().TrimRuntime()).With("file", fn).With("host", current.Host)
+	}
+	return store.write(fn, claim)
+}
+
+// Renew refreshes the time of the claim
+//
+func (store *DedupFileStore) Renew(claim *DedupClaim) (err errors.Error) {
+	claim.Time = time.Now()
+	return store.update(claim)
+}
+
+// Finish marks the claim as finished so that it is kept for the retention period
+//
+func (store *DedupFileStore) Finish(claim *DedupClaim) (err errors.Error) {
+	claim.Time = time.Now()
+	claim.Finished = true
+	return store.update(claim)
+}
+
+// Release removes the claim file
+//
+func (store *DedupFileStore) Release(claim *DedupClaim) (err errors.Error) {
+	fn := filepath.Join(store.dir, dedupName(claim.Key))
+
+	current, err := store.read(fn)
+	if err != nil {
+		return err
+	}
+	if current.ID != claim.ID {
+		return nil
+	}
+	if errGo := os.Remove(fn); errGo != nil && !os.IsNotExist(errGo) {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	return nil
+}
+
+// Prune removes the claim files that are no longer held, such as abandoned claims and finished
+// claims older than the retention
+//
+func (store *DedupFileStore) Prune(expiry time.Duration, retention time.Duration) (pruned int, err errors.Error) {
+	files, errGo := ioutil.ReadDir(store.dir)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", store.dir)
+	}
+
+	for _, file := range files {
+		// Claims being written use a temporary name ending in the claim ID
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		fn := filepath.Join(store.dir, file.Name())
+		claim, err := store.read(fn)
+		if err != nil || claim.isHeld(expiry, retention) {
+			continue
+		}
+		if errGo = os.Remove(fn); errGo != nil && !os.IsNotExist(errGo) {
+			return pruned, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// DedupObjectStore keeps claims as markers written to object storage using the Storage interface.
+// The Storage interface cannot list or remove objects and so markers are not pruned by the runner,
+// markers that are no longer held are replaced when the experiment is next claimed.
+//
+type DedupObjectStore struct {
+	uri       string
+	projectID string
+	creds     string
+	env       map[string]string
+	timeout   time.Duration
+}
+
+// open returns the storage holding the markers along with the name of the marker for a key.
+// Markers are tar files as uploads using the Storage interface are always archives.
+//
+func (store *DedupObjectStore) open(key string) (storage Storage, name string, err errors.Error) {
+	u, errGo := url.Parse(store.uri)
+	if errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", store.uri)
+	}
+
+	art := &Artifact{
+		Qualified: store.uri,
+	}
+
+	prefix := ""
+	switch u.Scheme {
+	case "gs":
+		art.Bucket = u.Host
+		prefix = strings.TrimPrefix(u.Path, "/")
+	case "s3":
+		parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+		art.Bucket = parts[0]
+		if len(parts) > 1 {
+			prefix = parts[1]
+		}
+	}
+
+	storage, err = NewStorage(&StoreOpts{
+		Art:       art,
+		ProjectID: store.projectID,
+		Creds:     store.creds,
+		Env:       store.env,
+		Validate:  false,
+		Timeout:   store.timeout,
+	})
+	if err != nil {
+		return nil, "", err.With("uri", store.uri)
+	}
+	return storage, path.Join(prefix, dedupName(key)+".tar"), nil
+}
+
+// read retrieves the marker for the key, nil is returned when no marker could be read
+//
+func (store *DedupObjectStore) read(storage Storage, name string) (claim *DedupClaim) {
+	dir, errGo := ioutil.TempDir("", "dedup-")
+	if errGo != nil {
+		return nil
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := storage.Fetch(name, true, dir, nil, store.timeout); err != nil {
+		return nil
+	}
+	data, errGo := ioutil.ReadFile(filepath.Join(dir, "claim.json"))
+	if errGo != nil {
+		return nil
+	}
+	claim = &DedupClaim{}
+	if errGo = json.Unmarshal(data, claim); errGo != nil {
+		return nil
+	}
+	return claim
+}
+
+// write uploads the claim as the marker for its key
+//
+func (store *DedupObjectStore) write(storage Storage, name string, claim *DedupClaim) (err errors.Error) {
+	data, errGo := json.Marshal(claim)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", store.uri)
+	}
+
+	dir, errGo := ioutil.TempDir("", "dedup-")
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(dir)
+
+	if errGo = ioutil.WriteFile(filepath.Join(dir, "claim.json"), data, 0600); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", dir)
+	}
+	if _, err = storage.Deposit(dir, name, store.timeout); err != nil {
+		return err.With("uri", store.uri).With("name", name)
+	}
+	return nil
+}
+
+// Claim writes a marker for the claim, unless one is already held, and then reads it back to
+// check that no other runner wrote its own marker at the same time
+//
+func (store *DedupObjectStore) Claim(claim *DedupClaim, expiry time.Duration, retention time.Duration) (holder *DedupClaim, err errors.Error) {
+	storage, name, err := store.open(claim.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+
+	// Markers that cannot be read are treated as missing, as the storage interface does not
+	// separate missing objects from other failures
+	if holder = store.read(storage, name); holder != nil && holder.isHeld(expiry, retention) {
+		return holder, nil
+	}
+
+	if err = store.write(storage, name, claim); err != nil {
+		return nil, err
+	}
+
+	if holder = store.read(storage, name); holder != nil && holder.ID != claim.ID {
+		return holder, nil
+	}
+	return nil, nil
+}
+
+func (store *DedupObjectStore) update(claim *DedupClaim) (err errors.Error) {
+	storage, name, err := store.open(claim.Key)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	if current := store.read(storage, name); current != nil && current.ID != claim.ID {
+		return errors.New("experiment claimed by another runner").With("stack", stack.Trace().TrimRuntime()).With("name", name).With("host", current.Host)
+	}
+	return store.write(storage, name, claim)
+}
+
+// Renew refreshes the time of the claim
+//
+func (store *DedupObjectStore) Renew(claim *DedupClaim) (err errors.Error) {
+	claim.Time = time.Now()
+	return store.update(claim)
+}
+
+// Finish marks the claim as finished so that it is kept for the retention period
+//
+func (store *DedupObjectStore) Finish(claim *DedupClaim) (err errors.Error) {
+	claim.Time = time.Now()
+	claim.Finished = true
+	return store.update(claim)
+}
+
+// Release marks the claim as released, markers cannot be removed using the Storage interface
+//
+func (store *DedupObjectStore) Release(claim *DedupClaim) (err errors.Error) {
+	claim.Time = time.Now()
+	claim.Released = true
+	return store.update(claim)
+}
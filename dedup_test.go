@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// This file contains tests for the stores used to detect experiments delivered more than once
+
+func TestDedupFileStore(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "dedup")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewDedupStore("file://"+dir, "", "", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "experiment/" + xid.New().String()
+
+	first := NewDedupClaim(key, 1)
+	if holder, err := store.Claim(first, time.Minute, time.Hour); err != nil || holder != nil {
+		t.Fatalf("first delivery was not claimed, holder %+v, error %v", holder, err)
+	}
+
+	// A second delivery while the first is running is a duplicate
+	second := NewDedupClaim(key, 1)
+	holder, err := store.Claim(second, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder == nil || holder.ID != first.ID || holder.Attempt != 1 {
+		t.Fatalf("duplicate delivery was claimed, holder %+v", holder)
+	}
+
+	if err = store.Renew(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Renew(second); err == nil {
+		t.Fatal("claim held by another delivery was renewed")
+	}
+
+	// Released claims allow the retried delivery to run
+	if err = store.Release(first); err != nil {
+		t.Fatal(err)
+	}
+	retry := NewDedupClaim(key, 2)
+	if holder, err = store.Claim(retry, time.Minute, time.Hour); err != nil || holder != nil {
+		t.Fatalf("retried delivery was not claimed, holder %+v, error %v", holder, err)
+	}
+
+	// Claims that are not renewed are abandoned, unless the experiment finished
+	time.Sleep(20 * time.Millisecond)
+	abandoned := NewDedupClaim(key, 2)
+	if holder, err = store.Claim(abandoned, 10*time.Millisecond, time.Hour); err != nil || holder != nil {
+		t.Fatalf("abandoned claim was not taken over, holder %+v, error %v", holder, err)
+	}
+	if err = store.Finish(abandoned); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if holder, err = store.Claim(NewDedupClaim(key, 3), 10*time.Millisecond, time.Hour); err != nil || holder == nil || !holder.Finished {
+		t.Fatalf("finished experiment was claimed again, holder %+v, error %v", holder, err)
+	}
+
+	// Finished claims are kept for the retention period and then pruned
+	pruner, isPruner := store.(DedupPruner)
+	if !isPruner {
+		t.Fatal("the file store cannot be pruned")
+	}
+	if pruned, err := pruner.Prune(10*time.Millisecond, time.Hour); err != nil || pruned != 0 {
+		t.Fatalf("%d claims pruned within the retention period, error %v", pruned, err)
+	}
+	if pruned, err := pruner.Prune(10*time.Millisecond, 10*time.Millisecond); err != nil || pruned != 1 {
+		t.Fatalf("%d claims pruned after the retention period, error %v", pruned, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d claim files remain after pruning", len(files))
+	}
+
+	// Claims that are past the retention period no longer prevent the experiment being run
+	if holder, err = store.Claim(NewDedupClaim(key, 1), time.Minute, time.Hour); err != nil || holder != nil {
+		t.Fatalf("experiment was not claimed after pruning, holder %+v, error %v", holder, err)
+	}
+}
+
+func TestDedupRetention(t *testing.T) {
+
+	finished := &DedupClaim{Finished: true, Time: time.Now().Add(-2 * time.Hour)}
+	if finished.isHeld(time.Minute, time.Hour) {
+		t.Fatal("a finished claim older than the retention was held")
+	}
+	if !finished.isHeld(time.Minute, 0) || !finished.isHeld(time.Minute, 3*time.Hour) {
+		t.Fatal("a finished claim within the retention was not held")
+	}
+	running := &DedupClaim{Time: time.Now().Add(-2 * time.Minute)}
+	if running.isHeld(time.Minute, 0) || !running.isHeld(0, time.Hour) {
+		t.Fatal("the expiry of running claims was not used")
+	}
+}
@@ -0,0 +1,137 @@
+package runner
+
+// This file contains the lifecycle events published by the runner as an experiment moves through
+// the stages of being processed.  Events are sent as JSON documents to the reply queue named
+// in the request allowing clients to follow experiments without polling storage for results.
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// LifecycleStage names a stage of experiment processing
+//
+type LifecycleStage string
+
+const (
+	StageReceived     LifecycleStage = "received"     // The request was accepted by a runner
+	StageRefused      LifecycleStage = "refused"      // The runner cannot meet the constraints of the request and left it for other runners
+	StageAllocated    LifecycleStage = "allocated"    // Resources were allocated to the experiment
+	StageFetching     LifecycleStage = "fetching"     // Artifacts are being downloaded
+	StageBuildingEnv  LifecycleStage = "building_env" // The python or container environment is being prepared
+	StageRunning      LifecycleStage = "running"      // The experiment has been started
+	StageCheckpointed LifecycleStage = "checkpointed" // Output artifacts were saved while the experiment ran
+	StageReturning    LifecycleStage = "returning"    // Output artifacts are being uploaded after the experiment stopped
+	StageRetrying     LifecycleStage = "retrying"     // The attempt failed and the request was returned to the queue to be tried again
+	StageFinished     LifecycleStage = "finished"     // The experiment completed successfully
+	StageFailed       LifecycleStage = "failed"       // The experiment could not be completed and will not be tried again
+)
+
+// LifecycleEvent is the document published to the reply queue of an experiment
+//
+type LifecycleEvent struct {
+	Project    string         `json:"project"`
+	Experiment string         `json:"experiment"`
+	Stage      LifecycleStage `json:"stage"`
+	Time       time.Time      `json:"time"`
+	Host       string         `json:"host"`
+	Attempt    int            `json:"attempt,omitempty"`
+	Group      string         `json:"group,omitempty"`       // The message group of requests from queues that order messages within groups
+	ExitStatus *int           `json:"exit_status,omitempty"` // Present on finished events, and failed or retrying events caused by the experiment exiting
+	Error      string         `json:"error,omitempty"`
+}
+
+// ExitStatus returns the exit status of an experiment process from the error returned when
+// running it, false is returned when the error was not caused by the process exiting
+//
+func ExitStatus(err error) (status int, isPresent bool) {
+	if err == nil {
+		return 0, true
+	}
+	if exitErr, isExit := errors.Cause(err).(*exec.ExitError); isExit {
+		if waitStatus, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return waitStatus.ExitStatus(), true
+		}
+	}
+	return 0, false
+}
+
+// EventPublisher sends the lifecycle events of a single experiment to its reply queue
+//
+type EventPublisher struct {
+	queue   TaskQueue
+	replyTo string
+	timeout time.Duration
+	event   LifecycleEvent // The fields common to every event
+}
+
+// NewEventPublisher creates a publisher for an experiment, nil is returned when either the
+// queue or the reply queue is missing and the caller need not publish events
+//
+func NewEventPublisher(queue TaskQueue, replyTo string, project string, experiment string, attempt int, group string) (pub *EventPublisher) {
+	if queue == nil || len(replyTo) == 0 {
+		return nil
+	}
+	return &EventPublisher{
+		queue:   queue,
+		replyTo: replyTo,
+		timeout: 15 * time.Second,
+		event: LifecycleEvent{
+			Project:    project,
+			Experiment: experiment,
+			Host:       GetHostName(),
+			Attempt:    attempt,
+			Group:      group,
+		},
+	}
+}
+
+// Publish sends an event for the stage the experiment has reached.  The error that caused a
+// failure is included in the event along with the exit status of the experiment, if known.
+// A nil publisher discards events.
+//
+func (pub *EventPublisher) Publish(stage LifecycleStage, failure error) (err errors.Error) {
+	if pub == nil {
+		return nil
+	}
+
+	event := pub.event
+	event.Stage = stage
+	event.Time = time.Now().UTC()
+
+	if stage == StageFinished || stage == StageFailed || stage == StageRetrying {
+		if status, isPresent := ExitStatus(failure); isPresent {
+			event.ExitStatus = &status
+		}
+	}
+	if failure != nil {
+		event.Error = failure.Error()
+	}
+
+	msg, errGo := json.Marshal(event)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("reply_to", pub.replyTo)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pub.timeout)
+	defer cancel()
+
+	// Reply queues that order messages within groups keep the events of an experiment in order
+	// using the group of the request, or the experiment key when the request had no group
+	group := pub.event.Group
+	if len(group) == 0 {
+		group = pub.event.Experiment
+	}
+	ctx = withMessageGroup(ctx, group)
+
+	if err = pub.queue.Publish(ctx, pub.replyTo, msg); err != nil {
+		return err.With("reply_to", pub.replyTo).With("stage", string(stage))
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/karlmutch/errors"
+)
+
+// This file contains tests for the lifecycle events published to the reply queues of experiments
+
+func TestLifecycleEvents(t *testing.T) {
+
+	if pub := NewEventPublisher(NewMemQueue("events"), "", "project", "experiment", 1, ""); pub != nil {
+		t.Fatal("a publisher was created without a reply queue")
+	}
+
+	// Publishers that were not created discard events
+	var none *EventPublisher
+	if err := none.Publish(StageReceived, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mq := NewMemQueue("events")
+	pub := NewEventPublisher(mq, "replies", "project", "experiment", 2, "generations")
+
+	failure := exec.Command("sh", "-c", "exit 3").Run()
+	if failure == nil {
+		t.Fatal("the experiment stand-in did not fail")
+	}
+	if status, isPresent := ExitStatus(errors.Wrap(failure)); !isPresent || status != 3 {
+		t.Fatalf("unexpected exit status %d %v", status, isPresent)
+	}
+
+	stages := []LifecycleStage{StageReceived, StageAllocated, StageRunning, StageFailed}
+	for _, stage := range stages {
+		var err error
+		if stage == StageFailed {
+			err = errors.Wrap(failure)
+		}
+		if errPub := pub.Publish(stage, err); errPub != nil {
+			t.Fatal(errPub)
+		}
+	}
+
+	events := []LifecycleEvent{}
+	for {
+		cnt, _, err := mq.Work(context.Background(), time.Second, "replies", func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+			event := LifecycleEvent{}
+			if errGo := json.Unmarshal(data, &event); errGo != nil {
+				t.Fatal(errGo)
+			}
+			events = append(events, event)
+			return nil, true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cnt == 0 {
+			break
+		}
+	}
+
+	if len(events) != len(stages) {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	for i, event := range events {
+		if event.Stage != stages[i] || event.Project != "project" || event.Experiment != "experiment" || event.Attempt != 2 ||
+			event.Group != "generations" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	}
+	if events[0].ExitStatus != nil || len(events[0].Error) != 0 {
+		t.Fatalf("unexpected exit details %+v", events[0])
+	}
+	if failed := events[3]; failed.ExitStatus == nil || *failed.ExitStatus != 3 || len(failed.Error) == 0 {
+		t.Fatalf("unexpected exit details %+v", failed)
+	}
+}
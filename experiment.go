@@ -0,0 +1,321 @@
+package runner
+
+// This file contains the implementation of the typed structures used to describe
+// the provenance, metrics, and timing information for experiments.
+//
+// The studioml python client, and other JSON clients, send these values in a
+// number of loose forms.  For example timestamps are usually floating point seconds
+// since the epoch but can be null, and metrics are usually a 'name:goal' string.
+// The unmarshalling functions in this file accept all of these forms, while marshalling
+// retains the forms that the python client understands.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	jsonNull = []byte("null")
+)
+
+func isNull(data []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(data), jsonNull)
+}
+
+// Git contains the source code provenance of the experiment as captured by the client
+//
+type Git struct {
+	Repo   string `json:"url"`
+	Commit string `json:"commit"`
+	Branch string `json:"branch,omitempty"`
+	Dirty  bool   `json:"dirty"`
+}
+
+// UnmarshalJSON accepts either a plain string containing the repository URL, or an
+// object using any of the field names used by known clients
+//
+func (g *Git) UnmarshalJSON(data []byte) (errGo error) {
+	if isNull(data) {
+		return nil
+	}
+
+	repo := ""
+	if errGo = json.Unmarshal(data, &repo); errGo == nil {
+		*g = Git{Repo: repo}
+		return nil
+	}
+
+	loose := map[string]interface{}{}
+	if errGo = json.Unmarshal(data, &loose); errGo != nil {
+		return errors.Wrap(errGo, "git provenance was neither a string nor an object").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	*g = Git{
+		Repo:   looseString(loose, "url", "repo", "remote"),
+		Commit: looseString(loose, "commit", "hash", "sha"),
+		Branch: looseString(loose, "branch"),
+		Dirty:  looseBool(loose, "dirty", "is_dirty"),
+	}
+	return nil
+}
+
+func looseString(loose map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if value, isPresent := loose[name]; isPresent && value != nil {
+			if text, ok := value.(string); ok {
+				return text
+			}
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
+func looseBool(loose map[string]interface{}, names ...string) bool {
+	for _, name := range names {
+		switch value := loose[name].(type) {
+		case bool:
+			return value
+		case string:
+			flag, _ := strconv.ParseBool(value)
+			return flag
+		case float64:
+			return value != 0
+		}
+	}
+	return false
+}
+
+// WorkspaceGit returns the git provenance of a workspace directory that was unpacked along with
+// its git metadata.  nil is returned when the directory is not the top of a git working tree, or
+// git is not installed.
+//
+func WorkspaceGit(dir string) (g *Git) {
+	if _, errGo := os.Stat(filepath.Join(dir, ".git")); errGo != nil {
+		return nil
+	}
+	git, errGo := exec.LookPath("git")
+	if errGo != nil {
+		return nil
+	}
+
+	run := func(args ...string) (out string, errGo error) {
+		output, errGo := exec.Command(git, append([]string{"-C", dir}, args...)...).Output()
+		return strings.TrimSpace(string(output)), errGo
+	}
+
+	commit, errGo := run("rev-parse", "HEAD")
+	if errGo != nil {
+		return nil
+	}
+	g = &Git{Commit: commit}
+
+	// Workspaces without a remote, or with a detached head, leave those fields empty
+	g.Repo, _ = run("config", "--get", "remote.origin.url")
+	if branch, errGo := run("rev-parse", "--abbrev-ref", "HEAD"); errGo == nil && branch != "HEAD" {
+		g.Branch = branch
+	}
+	if status, errGo := run("status", "--porcelain"); errGo == nil {
+		g.Dirty = len(status) != 0
+	}
+	return g
+}
+
+// Metric describes the value an experiment reports on, and whether the experimenter
+// is looking to minimize or maximize it
+//
+type Metric struct {
+	Name string `json:"name"`
+	Goal string `json:"goal,omitempty"`
+}
+
+// MarshalJSON retains the 'name:goal' string form used by the python client
+//
+func (m *Metric) MarshalJSON() ([]byte, error) {
+	if len(m.Goal) == 0 {
+		return json.Marshal(m.Name)
+	}
+	return json.Marshal(m.Name + ":" + m.Goal)
+}
+
+// UnmarshalJSON accepts either the 'name:goal' string form or an object
+//
+func (m *Metric) UnmarshalJSON(data []byte) (errGo error) {
+	if isNull(data) {
+		return nil
+	}
+
+	text := ""
+	if errGo = json.Unmarshal(data, &text); errGo == nil {
+		parts := strings.SplitN(text, ":", 2)
+		*m = Metric{Name: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			m.Goal = strings.ToLower(strings.TrimSpace(parts[1]))
+		}
+		return nil
+	}
+
+	loose := map[string]interface{}{}
+	if errGo = json.Unmarshal(data, &loose); errGo != nil {
+		return errors.Wrap(errGo, "metric was neither a string nor an object").With("stack", stack.Trace().TrimRuntime())
+	}
+	*m = Metric{
+		Name: looseString(loose, "name", "metric"),
+		Goal: strings.ToLower(looseString(loose, "goal", "direction")),
+	}
+	return nil
+}
+
+// Project identifies the experimenter assigned project for an experiment
+//
+type Project struct {
+	Name string `json:"name"`
+}
+
+// MarshalJSON retains the plain string form used by the python client
+//
+func (p *Project) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Name)
+}
+
+// UnmarshalJSON accepts either a string or an object containing the project name
+//
+func (p *Project) UnmarshalJSON(data []byte) (errGo error) {
+	if isNull(data) {
+		return nil
+	}
+
+	name := ""
+	if errGo = json.Unmarshal(data, &name); errGo == nil {
+		*p = Project{Name: name}
+		return nil
+	}
+
+	loose := map[string]interface{}{}
+	if errGo = json.Unmarshal(data, &loose); errGo != nil {
+		return errors.Wrap(errGo, "project was neither a string nor an object").With("stack", stack.Trace().TrimRuntime())
+	}
+	*p = Project{Name: looseString(loose, "name", "id", "key")}
+	return nil
+}
+
+// Timestamp is a point in time that is exchanged with clients as floating point seconds since
+// the epoch
+//
+type Timestamp struct {
+	time.Time
+}
+
+// NewTimestamp returns a Timestamp for the time specified
+//
+func NewTimestamp(t time.Time) *Timestamp {
+	return &Timestamp{Time: t}
+}
+
+// MarshalJSON produces floating point seconds since the epoch with microsecond precision,
+// or null when the time is not set
+//
+func (ts Timestamp) MarshalJSON() ([]byte, error) {
+	if ts.IsZero() {
+		return jsonNull, nil
+	}
+	secs := float64(ts.UnixNano()/int64(time.Microsecond)) / 1e6
+	return []byte(strconv.FormatFloat(secs, 'f', 6, 64)), nil
+}
+
+// UnmarshalJSON accepts floating point seconds since the epoch, either as a number or a string,
+// along with RFC 3339 formatted strings
+//
+func (ts *Timestamp) UnmarshalJSON(data []byte) (errGo error) {
+	if isNull(data) {
+		return nil
+	}
+
+	text := ""
+	if errGo = json.Unmarshal(data, &text); errGo != nil {
+		text = string(bytes.TrimSpace(data))
+	}
+	if len(text) == 0 {
+		return nil
+	}
+
+	if secs, errGo := strconv.ParseFloat(text, 64); errGo == nil {
+		// Clients only have microsecond precision so round to that to avoid float noise
+		whole, frac := math.Modf(secs)
+		ts.Time = time.Unix(int64(whole), int64(math.Round(frac*1e6))*int64(time.Microsecond))
+		return nil
+	}
+
+	if ts.Time, errGo = time.Parse(time.RFC3339Nano, text); errGo != nil {
+		return errors.Wrap(errGo, "timestamp was neither epoch seconds nor RFC 3339").With("value", text).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Cloud contains details of the cloud infrastructure the client used to queue the experiment
+//
+type Cloud struct {
+	Queue map[string]string `json:"queue,omitempty"`
+
+	// Other contains any fields not used by the runner so that they can be passed through
+	Other map[string]json.RawMessage `json:"-"`
+}
+
+// MarshalJSON combines the fields known to the runner with those passed through
+//
+func (c *Cloud) MarshalJSON() ([]byte, error) {
+	all := make(map[string]interface{}, len(c.Other)+1)
+	for k, v := range c.Other {
+		all[k] = v
+	}
+	if len(c.Queue) != 0 {
+		all["queue"] = c.Queue
+	}
+	return json.Marshal(all)
+}
+
+// UnmarshalJSON extracts the queue details used by the runner retaining everything else
+//
+func (c *Cloud) UnmarshalJSON(data []byte) (errGo error) {
+	if isNull(data) {
+		return nil
+	}
+
+	all := map[string]json.RawMessage{}
+	if errGo = json.Unmarshal(data, &all); errGo != nil {
+		return errors.Wrap(errGo, "cloud was not an object").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	*c = Cloud{Other: all}
+
+	queue, isPresent := all["queue"]
+	if !isPresent {
+		return nil
+	}
+	delete(all, "queue")
+
+	loose := map[string]interface{}{}
+	if errGo = json.Unmarshal(queue, &loose); errGo != nil {
+		// Not something the runner understands so pass it through
+		all["queue"] = queue
+		return nil
+	}
+	c.Queue = make(map[string]string, len(loose))
+	for k, v := range loose {
+		if v != nil {
+			c.Queue[k] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package runner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// This file contains tests for the typed experiment fields that accept the
+// loose forms sent by JSON clients
+
+func TestExperimentLooseForms(t *testing.T) {
+
+	loose := strings.Replace(validLegacyRqst, `"owner": "guest",`, `"owner": "guest",
+    "git": {"url": "https://github.com/studioml/studio.git", "commit": "685f489", "is_dirty": true},
+    "metric": "val_loss:MIN",
+    "project": "cifar",
+    "time_last_checkpoint": "2018-06-26T23:06:54Z",
+    "time_finished": null,`, 1)
+	loose = strings.Replace(loose, `"experimentLifetime": "30m",`, `"experimentLifetime": "30m",
+    "cloud": {"queue": {"rmq": "amqp://localhost:5672/"}, "type": "local"},`, 1)
+
+	r, err := UnmarshalRequest([]byte(loose))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Experiment.Git == nil || r.Experiment.Git.Commit != "685f489" || !r.Experiment.Git.Dirty {
+		t.Fatalf("git provenance not extracted %#v", r.Experiment.Git)
+	}
+	if r.Experiment.Metric == nil || r.Experiment.Metric.Name != "val_loss" || r.Experiment.Metric.Goal != "min" {
+		t.Fatalf("metric not extracted %#v", r.Experiment.Metric)
+	}
+	if r.Experiment.Project == nil || r.Experiment.Project.Name != "cifar" {
+		t.Fatalf("project not extracted %#v", r.Experiment.Project)
+	}
+	if r.Experiment.TimeLastCheckpoint == nil || !r.Experiment.TimeLastCheckpoint.Equal(time.Date(2018, 6, 26, 23, 6, 54, 0, time.UTC)) {
+		t.Fatalf("checkpoint time not extracted %#v", r.Experiment.TimeLastCheckpoint)
+	}
+	if r.Experiment.TimeFinished != nil || r.Experiment.TimeStarted != nil {
+		t.Fatal("null times were populated")
+	}
+	if r.Config.Cloud == nil || r.Config.Cloud.Queue["rmq"] != "amqp://localhost:5672/" {
+		t.Fatalf("cloud queue not extracted %#v", r.Config.Cloud)
+	}
+
+	// Make sure the round trip retains the forms used by the python client
+	r.Experiment.TimeStarted = NewTimestamp(time.Unix(1530054413, 134781000))
+	b, errGo := r.Marshal()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	for _, expected := range []string{`"metric":"val_loss:min"`, `"project":"cifar"`, `"time_started":1530054413.134781`, `"type":"local"`} {
+		if !strings.Contains(string(b), expected) {
+			t.Fatalf("%s missing from %s", expected, string(b))
+		}
+	}
+
+	again := &Request{}
+	if errGo := json.Unmarshal(b, again); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !again.Experiment.TimeStarted.Equal(r.Experiment.TimeStarted.Time) {
+		t.Fatalf("time started %v did not survive the round trip as %v", r.Experiment.TimeStarted, again.Experiment.TimeStarted)
+	}
+}
+
+func TestWorkspaceGit(t *testing.T) {
+
+	git, errGo := exec.LookPath("git")
+	if errGo != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, errGo := ioutil.TempDir("", "workspace-git")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	if g := WorkspaceGit(dir); g != nil {
+		t.Fatalf("provenance found for a directory that is not a git working tree %#v", g)
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"checkout", "-q", "-b", "trial"},
+		{"remote", "add", "origin", "https://github.com/studioml/studio.git"},
+		{"-c", "user.name=runner", "-c", "user.email=runner@localhost", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		if output, errGo := exec.Command(git, append([]string{"-C", dir}, args...)...).CombinedOutput(); errGo != nil {
+			t.Fatalf("git %v failed %v %s", args, errGo, string(output))
+		}
+	}
+
+	g := WorkspaceGit(dir)
+	if g == nil || len(g.Commit) != 40 || g.Branch != "trial" || g.Repo != "https://github.com/studioml/studio.git" || g.Dirty {
+		t.Fatalf("unexpected provenance %#v", g)
+	}
+
+	if errGo = ioutil.WriteFile(filepath.Join(dir, "train.py"), []byte("print('hello')\n"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if g = WorkspaceGit(dir); g == nil || !g.Dirty {
+		t.Fatalf("modified workspace was not dirty %#v", g)
+	}
+}
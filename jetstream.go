@@ -0,0 +1,544 @@
+package runner
+
+// This file contains the implementation of a task queue that uses NATS JetStream.  Each
+// durable pull consumer, with an explicit acknowledgement policy, on a stream whose name
+// matches the queue matching expression is a queue.  Queues are named using the stream and
+// consumer names separated by a '/', a character that JetStream does not allow in names.
+//
+// Consumers are created by the operator, allowing the ack wait, maximum deliveries and
+// other settings to be chosen for each queue.  Runners pull a single message at a time and
+// indicate the work is in progress periodically so that the ack wait does not expire while
+// experiments are running.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	jsAPIPrefix  = "$JS.API"
+	jsQueueSep   = "/"
+	jsPullExpiry = time.Duration(2 * time.Second)
+	jsPullBatch  = 1
+)
+
+func init() {
+	factory := func(uri string, creds string) (tq TaskQueue, err errors.Error) {
+		return NewJetStream(uri, creds)
+	}
+	RegisterTaskQueue("nats", factory)
+	RegisterTaskQueue("nats+tls", factory)
+}
+
+// JetStream is a task queue implemented using NATS JetStream pull consumers
+//
+type JetStream struct {
+	project string   // The nats URI the queue was created from
+	url     *url.URL // The parsed nats URI
+	api     string   // The subject prefix for the JetStream API, changed when using domains
+}
+
+type jsAPIError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code"`
+	Description string `json:"description"`
+}
+
+type jsPaged struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Error  *jsAPIError `json:"error"`
+}
+
+type jsConsumerConfig struct {
+	Durable        string `json:"durable_name"`
+	DeliverSubject string `json:"deliver_subject"`
+	AckPolicy      string `json:"ack_policy"`
+	AckWait        int64  `json:"ack_wait"`
+}
+
+type jsConsumerInfo struct {
+	Stream string           `json:"stream_name"`
+	Name   string           `json:"name"`
+	Config jsConsumerConfig `json:"config"`
+	Error  *jsAPIError      `json:"error"`
+}
+
+type jsStreamInfo struct {
+	Config struct {
+		Subjects []string `json:"subjects"`
+	} `json:"config"`
+	Error *jsAPIError `json:"error"`
+}
+
+type jsPubAck struct {
+	Stream string      `json:"stream"`
+	Seq    uint64      `json:"seq"`
+	Error  *jsAPIError `json:"error"`
+}
+
+// NewJetStream creates a task queue using a nats:// URI, or a nats+tls:// URI when TLS is required,
+// the JetStream domain can be specified using the domain query parameter
+//
+func NewJetStream(project string, creds string) (js *JetStream, err errors.Error) {
+
+	uri, errGo := url.Parse(project)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if uri.Scheme != "nats" && uri.Scheme != "nats+tls" {
+		return nil, errors.New("JetStream queues require a nats:// or nats+tls:// URI").With("stack", stack.Trace().TrimRuntime()).With("scheme", uri.Scheme)
+	}
+
+	api := jsAPIPrefix
+	if domain := uri.Query().Get("domain"); len(domain) != 0 {
+		api = "$JS." + domain + ".API"
+	}
+
+	return &JetStream{
+		project: project,
+		url:     uri,
+		api:     api,
+	}, nil
+}
+
+func (js *JetStream) attach(timeout time.Duration) (conn *natsConn, err errors.Error) {
+	if conn, err = dialNATS(js.url, timeout); err != nil {
+		return nil, err.With("host", js.url.Host)
+	}
+	return conn, nil
+}
+
+// reattach returns the connection when it is still working, otherwise it is closed and replaced by
+// a new connection.  A nil connection is returned when the new connection could not be made.
+//
+func (js *JetStream) reattach(conn *natsConn, timeout time.Duration) (working *natsConn, err errors.Error) {
+	if conn != nil {
+		if err = conn.flush(timeout); err == nil {
+			return conn, nil
+		}
+		conn.Close()
+	}
+	return js.attach(timeout)
+}
+
+// inProgress signals that a message is in progress periodically, until quitC is closed, to reset
+// its ack wait.  Failures are logged and the connection replaced so that a network blip does not
+// let the ack wait expire and the message be run a second time.
+//
+func (js *JetStream) inProgress(conn *natsConn, reply string, interval time.Duration, timeout time.Duration, quitC <-chan struct{}) (doneC chan struct{}) {
+	doneC = make(chan struct{})
+	go func() {
+		defer close(doneC)
+
+		// Connections made to replace the one supplied by the caller are closed here
+		var replacement *natsConn
+		defer func() {
+			if replacement != nil {
+				replacement.Close()
+			}
+		}()
+
+		for {
+			select {
+			case <-time.After(interval):
+			case <-quitC:
+				return
+			}
+
+			// A failed signal is retried immediately using a new connection
+			for retry := 0; retry != 2; retry++ {
+				if conn == nil {
+					var err errors.Error
+					if conn, err = js.attach(timeout); err != nil {
+						queueLogger.Warn("NATS in progress signal could not connect", "host", js.url.Host, "error", err.Error())
+						continue
+					}
+					replacement = conn
+				}
+				err := conn.publish(reply, "", []byte("+WIP"))
+				if err == nil {
+					err = conn.flush(timeout)
+				}
+				if err == nil {
+					break
+				}
+				queueLogger.Warn("NATS in progress signal failed", "host", js.url.Host, "error", err.Error())
+				if replacement != nil {
+					replacement.Close()
+					replacement = nil
+				}
+				conn = nil
+			}
+		}
+	}()
+	return doneC
+}
+
+// splitQueue extracts the stream and consumer names from a queue name
+//
+func splitQueue(subscription string) (stream string, consumer string, err errors.Error) {
+	parts := strings.SplitN(subscription, jsQueueSep, 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", errors.New("JetStream queues must be named stream/consumer").With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+	}
+	return parts[0], parts[1], nil
+}
+
+// call makes a JetStream API request, the reply being decoded into resp
+//
+func (js *JetStream) call(conn *natsConn, subject string, req interface{}, resp interface{}, timeout time.Duration) (err errors.Error) {
+	data := []byte{}
+	if req != nil {
+		b, errGo := json.Marshal(req)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subject", subject)
+		}
+		data = b
+	}
+	msg, err := conn.request(js.api+"."+subject, data, timeout)
+	if err != nil {
+		return err.With("host", js.url.Host)
+	}
+	if errGo := json.Unmarshal(msg.data, resp); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subject", subject)
+	}
+	return nil
+}
+
+func jsError(apiErr *jsAPIError, subject string) (err errors.Error) {
+	return errors.New(apiErr.Description).With("stack", stack.Trace().TrimRuntime()).With("code", apiErr.Code).With("subject", subject)
+}
+
+// QueueName returns the name of the stream, which is matched by queue expressions, from a
+// subscription holding the stream and consumer names
+//
+func (js *JetStream) QueueName(subscription string) (name string) {
+	return strings.SplitN(subscription, jsQueueSep, 2)[0]
+}
+
+// Refresh lists the pull consumers on streams whose names match the expression
+//
+func (js *JetStream) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (known map[string]interface{}, err errors.Error) {
+
+	conn, err := js.attach(timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	streams := []string{}
+	for offset := 0; ; {
+		resp := struct {
+			jsPaged
+			Streams []string `json:"streams"`
+		}{}
+		if err = js.call(conn, "STREAM.NAMES", map[string]int{"offset": offset}, &resp, timeout); err != nil {
+			return nil, err
+		}
+		if resp.Error != nil {
+			return nil, jsError(resp.Error, "STREAM.NAMES")
+		}
+		streams = append(streams, resp.Streams...)
+		offset += len(resp.Streams)
+		if len(resp.Streams) == 0 || offset >= resp.Total {
+			break
+		}
+	}
+
+	known = map[string]interface{}{}
+	for _, stream := range streams {
+		if qNameMatch != nil && !qNameMatch.MatchString(stream) {
+			continue
+		}
+		for offset := 0; ; {
+			resp := struct {
+				jsPaged
+				Consumers []jsConsumerInfo `json:"consumers"`
+			}{}
+			if err = js.call(conn, "CONSUMER.LIST."+stream, map[string]int{"offset": offset}, &resp, timeout); err != nil {
+				return nil, err
+			}
+			if resp.Error != nil {
+				return nil, jsError(resp.Error, "CONSUMER.LIST."+stream)
+			}
+			for _, consumer := range resp.Consumers {
+				// Only consumers that runners can pull from, and explicitly acknowledge, are queues
+				if len(consumer.Config.DeliverSubject) != 0 || consumer.Config.AckPolicy != "explicit" {
+					continue
+				}
+				known[stream+jsQueueSep+consumer.Name] = stream
+			}
+			offset += len(resp.Consumers)
+			if len(resp.Consumers) == 0 || offset >= resp.Total {
+				break
+			}
+		}
+	}
+	return known, nil
+}
+
+// consumer retrieves the information for a consumer, nil being returned when the stream,
+// or consumer, could not be found
+//
+func (js *JetStream) consumer(conn *natsConn, subscription string, timeout time.Duration) (info *jsConsumerInfo, err errors.Error) {
+	stream, consumer, err := splitQueue(subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	info = &jsConsumerInfo{}
+	if err = js.call(conn, "CONSUMER.INFO."+stream+"."+consumer, nil, info, timeout); err != nil {
+		return nil, err
+	}
+	if info.Error != nil {
+		if info.Error.Code == 404 {
+			return nil, nil
+		}
+		return nil, jsError(info.Error, "CONSUMER.INFO."+stream+"."+consumer)
+	}
+	return info, nil
+}
+
+// Exists checks that the consumer for the queue is still present
+//
+func (js *JetStream) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
+
+	conn, err := js.attach(15 * time.Second)
+	if err != nil {
+		return true, err
+	}
+	defer conn.Close()
+
+	info, err := js.consumer(conn, subscription, 15*time.Second)
+	if err != nil {
+		return true, err
+	}
+	return info != nil, nil
+}
+
+// Send publishes a message to the stream of the queue using the first subject of the stream
+//
+func (js *JetStream) Send(subscription string, msg []byte) (err errors.Error) {
+
+	stream, _, err := splitQueue(subscription)
+	if err != nil {
+		return err
+	}
+
+	conn, err := js.attach(15 * time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return js.publish(conn, stream, nil, msg, 15*time.Second)
+}
+
+// Publish sends a message to a stream, the queue being either the name of the stream or a
+// stream/consumer pair
+//
+func (js *JetStream) Publish(ctx context.Context, queue string, msg []byte) (err errors.Error) {
+
+	stream := strings.SplitN(queue, jsQueueSep, 2)[0]
+
+	timeout := 15 * time.Second
+	if deadline, isPresent := ctx.Deadline(); isPresent {
+		timeout = time.Until(deadline)
+	}
+
+	conn, err := js.attach(timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return js.publish(conn, stream, nil, msg, timeout)
+}
+
+// publish adds a message, along with any headers, to a stream using the first subject of the stream
+//
+func (js *JetStream) publish(conn *natsConn, stream string, headers map[string]string, msg []byte, timeout time.Duration) (err errors.Error) {
+
+	info := &jsStreamInfo{}
+	if err = js.call(conn, "STREAM.INFO."+stream, nil, info, timeout); err != nil {
+		return err
+	}
+	if info.Error != nil {
+		return jsError(info.Error, "STREAM.INFO."+stream)
+	}
+	if len(info.Config.Subjects) == 0 || strings.ContainsAny(info.Config.Subjects[0], "*>") {
+		return errors.New("stream has no literal subject to publish to").With("stack", stack.Trace().TrimRuntime()).With("stream", stream)
+	}
+
+	reply, err := conn.requestHeaders(info.Config.Subjects[0], headers, msg, timeout)
+	if err != nil {
+		return err.With("stream", stream)
+	}
+	ack := &jsPubAck{}
+	if errGo := json.Unmarshal(reply.data, ack); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("stream", stream)
+	}
+	if ack.Error != nil {
+		return jsError(ack.Error, info.Config.Subjects[0])
+	}
+	return nil
+}
+
+// jsAttempts extracts the delivery count from the reply subject of a message, the subject
+// being $JS.ACK.<stream>.<consumer>.<delivered>.<stream seq>.<consumer seq>.<time>.<pending>,
+// or with the domain and account hash following $JS.ACK for newer servers
+//
+func jsAttempts(reply string) (attempts int) {
+	tokens := strings.Split(reply, ".")
+	idx := 4
+	if len(tokens) >= 11 {
+		idx = 6
+	}
+	if len(tokens) < 9 || tokens[0] != "$JS" || tokens[1] != "ACK" {
+		return 0
+	}
+	attempts, errGo := strconv.Atoi(tokens[idx])
+	if errGo != nil {
+		return 0
+	}
+	return attempts
+}
+
+// Work pulls a single message from the consumer and passes it to the handler, the message being
+// marked as in progress until the handler is done.  Messages that are not acknowledged by the
+// handler are returned to the consumer for redelivery.
+//
+func (js *JetStream) Work(ctx context.Context, qTimeout time.Duration, subscription string, handler MsgHandler) (msgCnt uint64, resource *Resource, err errors.Error) {
+
+	conn, err := js.attach(qTimeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	info, err := js.consumer(conn, subscription, qTimeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	if info == nil {
+		return 0, nil, errors.New("queue not found").With("stack", stack.Trace().TrimRuntime()).With("host", js.url.Host).With("subscription", subscription)
+	}
+
+	// The subscription holds the messages of the batch along with the status message that can
+	// follow them
+	inbox := newInbox()
+	sid, msgC, err := conn.subscribe(inbox, jsPullBatch+1)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	pull := fmt.Sprintf(`{"batch":%d,"expires":%d}`, jsPullBatch, int64(jsPullExpiry))
+	if err = conn.publish(js.api+".CONSUMER.MSG.NEXT."+info.Stream+"."+info.Name, inbox, []byte(pull)); err != nil {
+		return 0, nil, err
+	}
+
+	var msg *natsMsg
+	select {
+	case msg = <-msgC:
+	case <-time.After(jsPullExpiry + qTimeout):
+	}
+	conn.unsubscribe(sid)
+
+	// Status messages, such as 404 and 408, are sent when no messages are available
+	if msg == nil || len(msg.status) != 0 || len(msg.reply) == 0 {
+		return 0, nil, nil
+	}
+
+	// Make sure that the main ctx has not been Done with before continuing
+	select {
+	case <-ctx.Done():
+		conn.publish(msg.reply, "", []byte("-NAK"))
+		conn.flush(qTimeout)
+		return 0, nil, errors.New("queue worker cancel received").With("stack", stack.Trace().TrimRuntime()).With("host", js.url.Host).With("subscription", subscription)
+	default:
+	}
+
+	// Indicate the work is in progress periodically to reset the ack wait of the message
+	ackWait := time.Duration(info.Config.AckWait)
+	if ackWait <= 0 {
+		ackWait = 30 * time.Second
+	}
+	quitC := make(chan struct{})
+	doneC := js.inProgress(conn, msg.reply, ackWait/3, qTimeout, quitC)
+
+	ctx, delivery := withDelivery(ctx, jsAttempts(msg.reply))
+	rsc, ack := handler(ctx, js.project, subscription, "", msg.data)
+	close(quitC)
+	<-doneC
+
+	// Acknowledgements can be sent using any connection, the connection the message arrived on
+	// is replaced if it failed while the message was being handled.  A failed settle is retried
+	// using another connection, as an unsettled message is redelivered once its ack wait expires.
+	for retry := 0; retry != 2; retry++ {
+		working, errSettle := js.reattach(conn, qTimeout)
+		// reattach has closed the connection when it was replaced
+		conn = nil
+		if errSettle != nil {
+			queueLogger.Warn("NATS message settle could not connect", "host", js.url.Host, "subscription", subscription, "error", errSettle.Error())
+			err = errSettle
+			continue
+		}
+		conn = working
+
+		var settled bool
+		if resource, settled, err = js.settle(conn, subscription, msg, rsc, ack, delivery, qTimeout); settled {
+			return 1, resource, err
+		}
+		queueLogger.Warn("NATS message settle failed", "host", js.url.Host, "subscription", subscription, "error", err.Error())
+		conn.Close()
+		conn = nil
+	}
+	return 1, nil, err
+}
+
+// settle acknowledges, dead-letters or negatively acknowledges a message that has been handled
+// according to the handlers result and the delivery policy.  settled is false when the message
+// was left as it was because the connection failed.
+//
+func (js *JetStream) settle(conn *natsConn, subscription string, msg *natsMsg, rsc *Resource, ack bool, delivery *Delivery, timeout time.Duration) (resource *Resource, settled bool, err errors.Error) {
+
+	if !ack {
+		reason, isDead := delivery.deadLetter()
+		if isDead && len(deadLetterQueue()) != 0 {
+			// The dead-letter queue is a stream, any consumer name is ignored
+			dlq := strings.SplitN(deadLetterQueue(), jsQueueSep, 2)[0]
+			if err = js.publish(conn, dlq, map[string]string{FailureReasonAttr: reason}, msg.data, timeout); err != nil {
+				err = err.With("host", js.url.Host).With("subscription", subscription).With("dead-letter", dlq)
+				isDead = false
+			}
+		}
+		if !isDead {
+			conn.publish(msg.reply, "", []byte("-NAK"))
+			if errFlush := conn.flush(timeout); errFlush != nil {
+				return nil, false, errFlush.With("host", js.url.Host).With("subscription", subscription)
+			}
+			return nil, true, err
+		}
+	}
+
+	// The acknowledgement is sent as a request so that the server confirms it was recorded
+	if _, err = conn.request(msg.reply, []byte("+ACK"), timeout); err != nil {
+		return nil, false, err.With("host", js.url.Host).With("subscription", subscription)
+	}
+	return rsc, true, nil
+}
@@ -0,0 +1,664 @@
+package runner
+
+// This file contains tests for the NATS JetStream task queue along with an in-process
+// stand-in for a NATS server that implements the subset of the JetStream API used by
+// the queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type jsStandInConsumer struct {
+	info     jsConsumerInfo
+	inFlight map[uint64]time.Time // The time at which an unacknowledged message can be redelivered
+	acked    map[uint64]bool
+}
+
+type jsStandInStream struct {
+	subjects  []string
+	msgs      [][]byte
+	consumers map[string]*jsStandInConsumer
+}
+
+type jsStandInSub struct {
+	conn *jsStandInConn
+	sid  string
+}
+
+type jsStandInConn struct {
+	conn net.Conn
+	sync.Mutex
+}
+
+func (c *jsStandInConn) send(subject string, sid string, reply string, status string, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(reply) != 0 {
+		reply = " " + reply
+	}
+	if len(status) != 0 {
+		hdr := "NATS/1.0 " + status + "\r\n\r\n"
+		fmt.Fprintf(c.conn, "HMSG %s %s%s %d %d\r\n%s%s\r\n", subject, sid, reply, len(hdr), len(hdr)+len(data), hdr, data)
+		return
+	}
+	fmt.Fprintf(c.conn, "MSG %s %s%s %d\r\n%s\r\n", subject, sid, reply, len(data), data)
+}
+
+// jsStandIn is a NATS server supporting the JetStream API requests used by the queue
+//
+type jsStandIn struct {
+	listener net.Listener
+	user     string
+	pass     string
+	streams  map[string]*jsStandInStream
+	subs     map[string][]*jsStandInSub
+	conns    map[*jsStandInConn]bool // Open client connections
+	connects int                     // CONNECT requests received
+	refused  int                     // The number of new connections still to be refused
+	sync.Mutex
+}
+
+func newJSStandIn(user string, pass string) (srv *jsStandIn, errGo error) {
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		return nil, errGo
+	}
+	srv = &jsStandIn{
+		listener: listener,
+		user:     user,
+		pass:     pass,
+		streams:  map[string]*jsStandInStream{},
+		subs:     map[string][]*jsStandInSub{},
+		conns:    map[*jsStandInConn]bool{},
+	}
+	go func() {
+		for {
+			conn, errGo := listener.Accept()
+			if errGo != nil {
+				return
+			}
+			go srv.serve(&jsStandInConn{conn: conn})
+		}
+	}()
+	return srv, nil
+}
+
+func (srv *jsStandIn) Close() {
+	srv.listener.Close()
+}
+
+// drop closes the open client connections, as a network failure would
+//
+func (srv *jsStandIn) drop() {
+	srv.Lock()
+	defer srv.Unlock()
+	for c := range srv.conns {
+		c.conn.Close()
+	}
+}
+
+// refuse closes the next count client connections as soon as they are accepted
+//
+func (srv *jsStandIn) refuse(count int) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.refused = count
+}
+
+func (srv *jsStandIn) addStream(name string, subject string) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.streams[name] = &jsStandInStream{subjects: []string{subject}, consumers: map[string]*jsStandInConsumer{}}
+}
+
+func (srv *jsStandIn) addConsumer(stream string, name string, deliverSubject string, ackWait time.Duration) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.streams[stream].consumers[name] = &jsStandInConsumer{
+		info: jsConsumerInfo{
+			Stream: stream,
+			Name:   name,
+			Config: jsConsumerConfig{
+				Durable:        name,
+				DeliverSubject: deliverSubject,
+				AckPolicy:      "explicit",
+				AckWait:        int64(ackWait),
+			},
+		},
+		inFlight: map[uint64]time.Time{},
+		acked:    map[uint64]bool{},
+	}
+}
+
+func (srv *jsStandIn) deleteConsumer(stream string, name string) {
+	srv.Lock()
+	defer srv.Unlock()
+	delete(srv.streams[stream].consumers, name)
+}
+
+func (srv *jsStandIn) unacked(stream string, name string) (cnt int) {
+	srv.Lock()
+	defer srv.Unlock()
+	s := srv.streams[stream]
+	return len(s.msgs) - len(s.consumers[name].acked)
+}
+
+func (srv *jsStandIn) serve(c *jsStandInConn) {
+	srv.Lock()
+	if srv.refused > 0 {
+		srv.refused--
+		srv.Unlock()
+		c.conn.Close()
+		return
+	}
+	srv.conns[c] = true
+	srv.Unlock()
+	defer func() {
+		srv.Lock()
+		delete(srv.conns, c)
+		for subject, subs := range srv.subs {
+			kept := []*jsStandInSub{}
+			for _, sub := range subs {
+				if sub.conn != c {
+					kept = append(kept, sub)
+				}
+			}
+			srv.subs[subject] = kept
+		}
+		srv.Unlock()
+		c.conn.Close()
+	}()
+
+	fmt.Fprintf(c.conn, "INFO {\"server_id\":\"stand-in\",\"headers\":true,\"max_payload\":1048576}\r\n")
+
+	rd := bufio.NewReader(c.conn)
+	for {
+		line, errGo := rd.ReadString('\n')
+		if errGo != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "CONNECT":
+			srv.Lock()
+			srv.connects++
+			srv.Unlock()
+			connect := natsConnect{}
+			json.Unmarshal([]byte(strings.TrimSpace(line[len(fields[0]):])), &connect)
+			if connect.User != srv.user || connect.Pass != srv.pass {
+				c.Lock()
+				fmt.Fprintf(c.conn, "-ERR 'Authorization Violation'\r\n")
+				c.Unlock()
+				return
+			}
+		case "PING":
+			c.Lock()
+			fmt.Fprintf(c.conn, "PONG\r\n")
+			c.Unlock()
+		case "SUB":
+			srv.Lock()
+			srv.subs[fields[1]] = append(srv.subs[fields[1]], &jsStandInSub{conn: c, sid: fields[len(fields)-1]})
+			srv.Unlock()
+		case "UNSUB":
+			srv.Lock()
+			for subject, subs := range srv.subs {
+				for i, sub := range subs {
+					if sub.conn == c && sub.sid == fields[1] {
+						srv.subs[subject] = append(subs[:i], subs[i+1:]...)
+						break
+					}
+				}
+			}
+			srv.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size+2)
+			if _, errGo = io.ReadFull(rd, data); errGo != nil {
+				return
+			}
+			reply := ""
+			if len(fields) == 4 {
+				reply = fields[2]
+			}
+			srv.publish(fields[1], reply, data[:size])
+		}
+	}
+}
+
+// deliver sends a message to the subscribers of a subject
+//
+func (srv *jsStandIn) deliver(subject string, reply string, status string, data []byte) {
+	srv.Lock()
+	subs := append([]*jsStandInSub{}, srv.subs[subject]...)
+	srv.Unlock()
+
+	for _, sub := range subs {
+		sub.conn.send(subject, sub.sid, reply, status, data)
+	}
+}
+
+func (srv *jsStandIn) respond(reply string, resp interface{}) {
+	if len(reply) == 0 {
+		return
+	}
+	b, _ := json.Marshal(resp)
+	srv.deliver(reply, "", "", b)
+}
+
+func jsNotFound(what string) (resp map[string]interface{}) {
+	return map[string]interface{}{"error": jsAPIError{Code: 404, Description: what + " not found"}}
+}
+
+// page returns a single item from the list, the small page size exercising the paging used by clients
+//
+func page(req []byte, total int) (offset int, limit int) {
+	paging := struct {
+		Offset int `json:"offset"`
+	}{}
+	json.Unmarshal(req, &paging)
+	if paging.Offset >= total {
+		return total, 0
+	}
+	return paging.Offset, 1
+}
+
+func (srv *jsStandIn) publish(subject string, reply string, data []byte) {
+
+	switch {
+	case strings.HasPrefix(subject, jsAPIPrefix+"."):
+		srv.api(strings.Split(strings.TrimPrefix(subject, jsAPIPrefix+"."), "."), reply, data)
+		return
+	case strings.HasPrefix(subject, "$JS.ACK."):
+		srv.ack(strings.Split(subject, "."), data)
+		srv.respond(reply, map[string]interface{}{})
+		return
+	}
+
+	srv.Lock()
+	for name, stream := range srv.streams {
+		if stream.subjects[0] == subject {
+			stream.msgs = append(stream.msgs, append([]byte{}, data...))
+			ack := jsPubAck{Stream: name, Seq: uint64(len(stream.msgs))}
+			srv.Unlock()
+			srv.respond(reply, ack)
+			return
+		}
+	}
+	_, hasSubs := srv.subs[subject]
+	srv.Unlock()
+
+	if hasSubs {
+		srv.deliver(subject, reply, "", data)
+		return
+	}
+	if len(reply) != 0 {
+		srv.deliver(reply, "", "503", nil)
+	}
+}
+
+func (srv *jsStandIn) api(tokens []string, reply string, data []byte) {
+	srv.Lock()
+	defer srv.Unlock()
+
+	// Pull requests are sent to CONSUMER.MSG.NEXT.<stream>.<consumer>
+	if len(tokens) > 2 && tokens[1] == "MSG" {
+		tokens = append(tokens[:2], tokens[3:]...)
+	}
+	op := strings.Join(tokens[:2], ".")
+	switch op {
+	case "STREAM.NAMES":
+		names := []string{}
+		for name := range srv.streams {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		offset, limit := page(data, len(names))
+		go srv.respond(reply, map[string]interface{}{"total": len(names), "offset": offset, "limit": limit, "streams": names[offset : offset+limit]})
+		return
+	case "STREAM.INFO":
+		stream, isPresent := srv.streams[tokens[2]]
+		if !isPresent {
+			go srv.respond(reply, jsNotFound("stream"))
+			return
+		}
+		info := jsStreamInfo{}
+		info.Config.Subjects = stream.subjects
+		go srv.respond(reply, info)
+		return
+	}
+
+	stream, isPresent := srv.streams[tokens[2]]
+	if !isPresent {
+		go srv.respond(reply, jsNotFound("stream"))
+		return
+	}
+
+	switch op {
+	case "CONSUMER.LIST":
+		names := []string{}
+		for name := range stream.consumers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		offset, limit := page(data, len(names))
+		infos := []jsConsumerInfo{}
+		for _, name := range names[offset : offset+limit] {
+			infos = append(infos, stream.consumers[name].info)
+		}
+		go srv.respond(reply, map[string]interface{}{"total": len(names), "offset": offset, "limit": limit, "consumers": infos})
+		return
+	}
+
+	consumer, isPresent := stream.consumers[tokens[3]]
+	if !isPresent {
+		go srv.respond(reply, jsNotFound("consumer"))
+		return
+	}
+
+	switch op {
+	case "CONSUMER.INFO":
+		go srv.respond(reply, consumer.info)
+	case "CONSUMER.MSG":
+		pull := struct {
+			Expires int64 `json:"expires"`
+		}{}
+		json.Unmarshal(data, &pull)
+		go srv.next(tokens[2], tokens[3], reply, time.Now().Add(time.Duration(pull.Expires)))
+	}
+}
+
+// next delivers the oldest message that is available to the consumer, waiting until the
+// deadline for one to become available
+//
+func (srv *jsStandIn) next(streamName string, consumerName string, reply string, deadline time.Time) {
+	for {
+		srv.Lock()
+		stream, isPresent := srv.streams[streamName]
+		if !isPresent {
+			srv.Unlock()
+			return
+		}
+		consumer, isPresent := stream.consumers[consumerName]
+		if !isPresent {
+			srv.Unlock()
+			srv.deliver(reply, "", "409 Consumer Deleted", nil)
+			return
+		}
+		for i, msg := range stream.msgs {
+			seq := uint64(i + 1)
+			if consumer.acked[seq] {
+				continue
+			}
+			if redeliver, isPresent := consumer.inFlight[seq]; isPresent && time.Now().Before(redeliver) {
+				continue
+			}
+			consumer.inFlight[seq] = time.Now().Add(time.Duration(consumer.info.Config.AckWait))
+			srv.Unlock()
+
+			ackSubject := fmt.Sprintf("$JS.ACK.%s.%s.1.%d.%d.%d.0", streamName, consumerName, seq, seq, time.Now().UnixNano())
+			srv.deliver(reply, ackSubject, "", msg)
+			return
+		}
+		srv.Unlock()
+
+		if time.Now().After(deadline) {
+			srv.deliver(reply, "", "408 Request Timeout", nil)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ack handles acknowledgements sent to subjects of the form
+// $JS.ACK.<stream>.<consumer>.<delivered>.<stream seq>.<consumer seq>.<timestamp>.<pending>
+//
+func (srv *jsStandIn) ack(tokens []string, data []byte) {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if len(tokens) != 9 {
+		return
+	}
+	stream, isPresent := srv.streams[tokens[2]]
+	if !isPresent {
+		return
+	}
+	consumer, isPresent := stream.consumers[tokens[3]]
+	if !isPresent {
+		return
+	}
+	seq, _ := strconv.ParseUint(tokens[5], 10, 64)
+
+	switch string(data) {
+	case "+ACK":
+		consumer.acked[seq] = true
+		delete(consumer.inFlight, seq)
+	case "-NAK":
+		consumer.inFlight[seq] = time.Now()
+	case "+WIP":
+		consumer.inFlight[seq] = time.Now().Add(time.Duration(consumer.info.Config.AckWait))
+	}
+}
+
+// TestJetStreamQueue exercises the JetStream task queue against the stand-in server
+//
+func TestJetStreamQueue(t *testing.T) {
+
+	srv, errGo := newJSStandIn("runner", "secret")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer srv.Close()
+
+	ackWait := 300 * time.Millisecond
+
+	srv.addStream("nats_work", "work.requests")
+	srv.addConsumer("nats_work", "runners", "", ackWait)
+	srv.addConsumer("nats_work", "pushed", "work.pushed", ackWait)
+	srv.addStream("other", "other.requests")
+	srv.addConsumer("other", "runners", "", ackWait)
+
+	addr := srv.listener.Addr().String()
+
+	tq, err := NewTaskQueue("nats://runner:secret@"+addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, isJetStream := tq.(*JetStream)
+	if !isJetStream {
+		t.Fatal(fmt.Errorf("nats URI did not create a JetStream queue"))
+	}
+
+	bad, err := NewJetStream("nats://runner:wrong@"+addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bad.Refresh(nil, time.Second); err == nil {
+		t.Fatal(fmt.Errorf("an incorrect password was accepted"))
+	}
+
+	known, err := js.Refresh(regexp.MustCompile("^nats_"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isPresent := known["nats_work/runners"]; !isPresent || len(known) != 1 {
+		t.Fatal(fmt.Errorf("unexpected queues %v", known))
+	}
+
+	queue := "nats_work/runners"
+	for _, msg := range []string{"first", "second"} {
+		if err = js.Send(queue, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+
+	received := []string{}
+	handler := func(ack bool) MsgHandler {
+		return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+			received = append(received, string(data))
+			return &Resource{Cpus: "1"}, ack
+		}
+	}
+
+	// A message that is not acknowledged is redelivered ahead of newer messages
+	if cnt, rsc, err := js.Work(ctx, time.Second, queue, handler(false)); err != nil || cnt != 1 || rsc != nil {
+		t.Fatal(fmt.Errorf("unexpected nack result %d %v %v", cnt, rsc, err))
+	}
+	for i := 0; i != 2; i++ {
+		if cnt, rsc, err := js.Work(ctx, time.Second, queue, handler(true)); err != nil || cnt != 1 || rsc == nil {
+			t.Fatal(fmt.Errorf("unexpected ack result %d %v %v", cnt, rsc, err))
+		}
+	}
+	if strings.Join(received, ",") != "first,first,second" {
+		t.Fatal(fmt.Errorf("unexpected delivery order %v", received))
+	}
+	if cnt := srv.unacked("nats_work", "runners"); cnt != 0 {
+		t.Fatal(fmt.Errorf("%d messages left unacknowledged", cnt))
+	}
+
+	// Work that runs longer than the ack wait must not be redelivered to other runners
+	if err = js.Send(queue, []byte("long")); err != nil {
+		t.Fatal(err)
+	}
+	received = []string{}
+	// Connections are dropped part way through, the in progress signals sent after that, and
+	// the acknowledgement, must reconnect
+	slow := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+		received = append(received, string(data))
+		time.Sleep(ackWait / 2)
+		srv.drop()
+		time.Sleep(5 * ackWait / 2)
+		return nil, true
+	}
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		if cnt, _, err := js.Work(ctx, time.Second, queue, slow); err != nil || cnt != 1 {
+			t.Error(fmt.Errorf("long running message was not processed %d %v", cnt, err))
+		}
+	}()
+
+	time.Sleep(2 * ackWait)
+	if cnt, _, err := js.Work(ctx, time.Second, queue, handler(true)); err != nil || cnt != 0 {
+		t.Fatal(fmt.Errorf("message being processed was redelivered %d %v", cnt, err))
+	}
+	<-doneC
+
+	if strings.Join(received, ",") != "long" {
+		t.Fatal(fmt.Errorf("unexpected messages %v", received))
+	}
+	if cnt := srv.unacked("nats_work", "runners"); cnt != 0 {
+		t.Fatal(fmt.Errorf("%d messages left unacknowledged", cnt))
+	}
+
+	// TLS is required for nats+tls:// URIs, and when asked for, even though the server does not
+	// require it and so the credentials must not be sent
+	srv.Lock()
+	connects := srv.connects
+	srv.Unlock()
+	for _, uri := range []string{"nats+tls://runner:secret@" + addr, "nats://runner:secret@" + addr + "?tls=true"} {
+		secure, err := NewTaskQueue(uri, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = secure.Refresh(nil, 500*time.Millisecond); err == nil {
+			t.Fatal(fmt.Errorf("%s connected without TLS", uri))
+		}
+	}
+	srv.Lock()
+	if srv.connects != connects {
+		t.Fatal(fmt.Errorf("credentials were sent without TLS"))
+	}
+	srv.Unlock()
+
+	if exists, err := js.Exists(ctx, queue); err != nil || !exists {
+		t.Fatal(fmt.Errorf("consumer was not found %v", err))
+	}
+	srv.deleteConsumer("nats_work", "runners")
+	if exists, err := js.Exists(ctx, queue); err != nil || exists {
+		t.Fatal(fmt.Errorf("deleted consumer was found %v", err))
+	}
+	if _, err := js.Exists(ctx, "nats_work"); err == nil {
+		t.Fatal(fmt.Errorf("malformed queue name was accepted"))
+	}
+}
+
+// TestJetStreamReattach checks that a message is acknowledged when the connection it arrived on
+// fails and the first replacement cannot be made, and that a worker whose reattach keeps failing
+// returns an error leaving the message to be redelivered
+//
+func TestJetStreamReattach(t *testing.T) {
+
+	srv, errGo := newJSStandIn("runner", "secret")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer srv.Close()
+
+	srv.addStream("nats_reattach", "reattach.requests")
+	srv.addConsumer("nats_reattach", "runners", "", time.Minute)
+
+	js, err := NewJetStream("nats://runner:secret@"+srv.listener.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := "nats_reattach/runners"
+	for _, msg := range []string{"first", "second"} {
+		if err = js.Send(queue, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failing := func(count int) MsgHandler {
+		return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+			srv.refuse(count)
+			srv.drop()
+			return &Resource{Cpus: "1"}, true
+		}
+	}
+
+	if cnt, rsc, err := js.Work(context.Background(), time.Second, queue, failing(1)); err != nil || cnt != 1 || rsc == nil {
+		t.Fatal(fmt.Errorf("message was not acknowledged after a failed reattach %d %v %v", cnt, rsc, err))
+	}
+	if cnt := srv.unacked("nats_reattach", "runners"); cnt != 1 {
+		t.Fatal(fmt.Errorf("%d messages left unacknowledged", cnt))
+	}
+
+	if cnt, _, err := js.Work(context.Background(), time.Second, queue, failing(2)); err == nil || cnt != 1 {
+		t.Fatal(fmt.Errorf("failed reattaches were not reported %d %v", cnt, err))
+	}
+	if cnt := srv.unacked("nats_reattach", "runners"); cnt != 1 {
+		t.Fatal(fmt.Errorf("unsettled message was acknowledged, %d messages left unacknowledged", cnt))
+	}
+}
+
+func TestJetStreamAttempts(t *testing.T) {
+	for reply, expected := range map[string]int{
+		"$JS.ACK.work.runners.3.10.10.1600000000000000000.0":                  3,
+		"$JS.ACK.hub.a1b2c3.work.runners.4.10.10.1600000000000000000.0.token": 4,
+		"_INBOX.abc": 0,
+	} {
+		if attempts := jsAttempts(reply); attempts != expected {
+			t.Fatalf("%s gave %d attempts, expected %d", reply, attempts, expected)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package runner
+
+// This file contains the implementation of node labels that runners advertise and the
+// constraints that experiments can place upon the nodes they are willing to run on.
+//
+// Constraints are strings of the form '<label> <operator> <value>', for example
+//
+//    cuda.compute >= 7.0
+//    gpu.model contains V100
+//    cpu.flags contains avx512
+//    zone = us-west
+//
+// The operators supported are =, ==, !=, >, >=, <, <=, and contains.  A constraint
+// with only a label name is met when the label is present.  Labels can have multiple
+// values, for example one for each GPU, and a constraint is met when any of the
+// values satisfies it, with the exception of != that requires none of the values match.
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// Labels are the capabilities a node advertises, each label can have multiple values
+//
+type Labels map[string][]string
+
+// Constraint is a single test that is applied to a nodes labels
+//
+type Constraint struct {
+	Label string
+	Op    string
+	Value string
+}
+
+var (
+	constraintRE = regexp.MustCompile(`^\s*([A-Za-z0-9_./-]+)\s*(?:(==|!=|>=|<=|=|>|<|\scontains\s)\s*([^=!<>\s].*?))?\s*$`)
+)
+
+// NewNodeLabels builds the label set for the node the runner is running on using
+// the GPU and CPU hardware information and labels supplied by the operator, operator
+// labels replace any detected labels with the same name
+//
+func NewNodeLabels(operator map[string]string) (labels Labels) {
+	labels = Labels{
+		"os":   {runtime.GOOS},
+		"arch": {runtime.GOARCH},
+	}
+
+	models, compute := GPUCapabilities()
+	labels["gpu.count"] = []string{strconv.Itoa(len(models))}
+	if len(models) != 0 {
+		labels["gpu.model"] = models
+	}
+	if len(compute) != 0 {
+		labels["cuda.compute"] = compute
+	}
+
+	vendor, model, flags := CPUCapabilities()
+	if len(vendor) != 0 {
+		labels["cpu.vendor"] = []string{vendor}
+	}
+	if len(model) != 0 {
+		labels["cpu.model"] = []string{model}
+	}
+	if len(flags) != 0 {
+		labels["cpu.flags"] = flags
+	}
+
+	for k, v := range operator {
+		labels[k] = []string{v}
+	}
+	return labels
+}
+
+// ParseLabels extracts operator labels from a comma separated list of name=value pairs
+//
+func ParseLabels(spec string) (labels map[string]string, err errors.Error) {
+	labels = map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || len(name) == 0 {
+			return nil, errors.New("labels must be name=value pairs").With("label", pair).With("stack", stack.Trace().TrimRuntime())
+		}
+		labels[name] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+// ParseConstraint extracts a constraint from its string form
+//
+func ParseConstraint(spec string) (constraint *Constraint, err errors.Error) {
+	matches := constraintRE.FindStringSubmatch(spec)
+	if matches == nil {
+		return nil, errors.New("constraint is malformed").With("constraint", spec).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &Constraint{
+		Label: matches[1],
+		Op:    strings.TrimSpace(matches[2]),
+		Value: matches[3],
+	}, nil
+}
+
+// String returns the constraint in a normalized form suitable for reporting
+//
+func (c *Constraint) String() string {
+	if len(c.Op) == 0 {
+		return c.Label
+	}
+	return fmt.Sprintf("%s %s %s", c.Label, c.Op, c.Value)
+}
+
+// compare tests a single label value against the constraint
+//
+func (c *Constraint) compare(value string) bool {
+	switch c.Op {
+	case "=", "==":
+		return value == c.Value
+	case "contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(c.Value))
+	}
+
+	// The remaining operators are numeric
+	have, errGo := strconv.ParseFloat(value, 64)
+	if errGo != nil {
+		return false
+	}
+	want, errGo := strconv.ParseFloat(c.Value, 64)
+	if errGo != nil {
+		return false
+	}
+	switch c.Op {
+	case ">":
+		return have > want
+	case ">=":
+		return have >= want
+	case "<":
+		return have < want
+	case "<=":
+		return have <= want
+	}
+	return false
+}
+
+// Met tests whether the labels satisfy the constraint
+//
+func (c *Constraint) Met(labels Labels) bool {
+	values, isPresent := labels[c.Label]
+
+	switch c.Op {
+	case "":
+		return isPresent
+	case "!=":
+		for _, value := range values {
+			if value == c.Value {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, value := range values {
+		if c.compare(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unmet returns the constraints that the labels do not satisfy, the returned list is
+// sorted to allow it to be used for reporting
+//
+func (labels Labels) Unmet(constraints []string) (unmet []string, err errors.Error) {
+	for _, spec := range constraints {
+		constraint, err := ParseConstraint(spec)
+		if err != nil {
+			return nil, err
+		}
+		if !constraint.Met(labels) {
+			unmet = append(unmet, constraint.String())
+		}
+	}
+	sort.Strings(unmet)
+	return unmet, nil
+}
@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// This file contains tests for node labels and the constraints experiments place on them
+
+func TestConstraints(t *testing.T) {
+
+	labels := NewNodeLabels(map[string]string{"zone": "us-west"})
+	labels["gpu.model"] = []string{"GeForce GTX 1080 Ti", "Tesla V100-SXM2-16GB"}
+	labels["cuda.compute"] = []string{cudaCompute("GeForce GTX 1080 Ti"), cudaCompute("Tesla V100-SXM2-16GB")}
+	labels["cpu.flags"] = []string{"sse4_2", "avx2", "avx512f"}
+
+	met := []string{"cuda.compute >= 7.0", "gpu.model contains v100", "cpu.flags contains avx512", "zone = us-west", "zone", "zone != us-east", "arch"}
+	unmet, err := labels.Unmet(met)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unmet) != 0 {
+		t.Fatalf("constraints %v were not met", unmet)
+	}
+
+	unmet, err = labels.Unmet([]string{"cuda.compute > 7.5", "zone==us-east", "rack", "gpu.model contains A100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"cuda.compute > 7.5", "gpu.model contains A100", "rack", "zone == us-east"}
+	if !reflect.DeepEqual(unmet, expected) {
+		t.Fatalf("unmet constraints %v, expected %v", unmet, expected)
+	}
+
+	if _, err = ParseConstraint("zone >> us-west"); err == nil {
+		t.Fatal("malformed constraint was accepted")
+	}
+
+	// Constraints are validated as part of the request
+	rqst := strings.Replace(validLegacyRqst, `"gpus": 1,`, `"gpus": 1, "constraints": ["cuda.compute >= 7.0", "=bad"],`, 1)
+	report, err := ValidateRequest([]byte(rqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() || !strings.Contains(strings.Join(report.Fields(), "\n"), "constraints[1]") {
+		t.Fatalf("invalid constraint not reported %v", report.Fields())
+	}
+}
@@ -0,0 +1,359 @@
+package runner
+
+// This file contains the implementation of a task queue that uses a spool directory on
+// a local, or shared, file system.  It is intended for use on a laptop, or within CI,
+// when no message broker is available.
+//
+// Each sub directory of the spool directory is a queue and each file within a queue
+// is a message.  Messages are processed in the order of their file names.  Producers
+// should write messages using a name starting with a '.', or ending with '.tmp', and then
+// rename them once complete, the Send method does this.
+//
+// Runners claim a message by renaming it into the .in-progress directory of the queue,
+// the rename being atomic ensures only one runner can claim a message.  Claimed messages
+// have a lease that the runner extends by touching the file while the work is being done,
+// if the runner crashes the lease will expire and the message is returned to the queue.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	localQueueLeaseOpt = flag.Duration("local-queue-lease", time.Duration(5*time.Minute), "the period of time a claimed local queue message is held without being renewed before being returned to the queue")
+)
+
+func init() {
+	RegisterTaskQueue("file", func(uri string, creds string) (tq TaskQueue, err errors.Error) {
+		return NewLocalQueue(uri, creds)
+	})
+}
+
+const (
+	localInProgress = ".in-progress"
+	localClaimSep   = "~"
+	localAttemptSep = "@"
+	localFailure    = ".failure"
+)
+
+// LocalQueue is a task queue implemented using a spool directory
+//
+type LocalQueue struct {
+	project string        // The file URI the queue was created from
+	root    string        // The spool directory
+	lease   time.Duration // The time a claimed message is held without being renewed
+}
+
+// NewLocalQueue creates a task queue using the spool directory within a file:// URI
+//
+func NewLocalQueue(project string, creds string) (lq *LocalQueue, err errors.Error) {
+
+	uri, errGo := url.Parse(project)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", project)
+	}
+	if uri.Scheme != "file" || len(uri.Path) == 0 {
+		return nil, errors.New("local queues require a file:// URI with a directory").With("stack", stack.Trace().TrimRuntime()).With("project", project)
+	}
+
+	info, errGo := os.Stat(uri.Path)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", project)
+	}
+	if !info.IsDir() {
+		return nil, errors.New("local queue spool is not a directory").With("stack", stack.Trace().TrimRuntime()).With("project", project)
+	}
+
+	return &LocalQueue{
+		project: project,
+		root:    uri.Path,
+		lease:   *localQueueLeaseOpt,
+	}, nil
+}
+
+// isMsg is used to skip files that producers have not finished writing, along with the
+// failure reasons stored beside dead-lettered messages
+//
+func isMsg(info os.FileInfo) bool {
+	return !info.IsDir() && !strings.HasPrefix(info.Name(), ".") && !strings.HasSuffix(info.Name(), ".tmp") &&
+		!strings.HasSuffix(info.Name(), localFailure)
+}
+
+// msgAttempts splits the name of a message file into the name given to it by the sender and
+// the number of failed attempts that have been made to process it
+//
+func msgAttempts(name string) (base string, attempts int) {
+	i := strings.LastIndex(name, localAttemptSep)
+	if i < 0 {
+		return name, 0
+	}
+	attempts, errGo := strconv.Atoi(name[i+1:])
+	if errGo != nil {
+		return name, 0
+	}
+	return name[:i], attempts
+}
+
+// Refresh lists the queue directories within the spool directory
+//
+func (lq *LocalQueue) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (known map[string]interface{}, err errors.Error) {
+
+	files, errGo := ioutil.ReadDir(lq.root)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project)
+	}
+
+	known = map[string]interface{}{}
+	for _, file := range files {
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		if qNameMatch != nil && !qNameMatch.MatchString(file.Name()) {
+			continue
+		}
+		known[file.Name()] = lq.root
+	}
+	return known, nil
+}
+
+// Exists checks that the queue directory is still present
+//
+func (lq *LocalQueue) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
+	info, errGo := os.Stat(filepath.Join(lq.root, subscription))
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return false, nil
+		}
+		return true, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+	}
+	return info.IsDir(), nil
+}
+
+// Metrics counts the messages waiting within the queue directory and those claimed by runners,
+// the age of the oldest waiting message is taken from the modification time of its file
+//
+func (lq *LocalQueue) Metrics(ctx context.Context, subscription string) (metrics QueueMetrics, err errors.Error) {
+	dir := filepath.Join(lq.root, subscription)
+
+	files, errGo := ioutil.ReadDir(dir)
+	if errGo != nil {
+		return UnknownQueueMetrics, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+	}
+	for _, file := range files {
+		if !isMsg(file) {
+			continue
+		}
+		metrics.Depth++
+		if age := time.Since(file.ModTime()); age > metrics.Age {
+			metrics.Age = age
+		}
+	}
+
+	// The in progress directory is only created once the first message is claimed
+	claimed, errGo := ioutil.ReadDir(filepath.Join(dir, localInProgress))
+	if errGo != nil && !os.IsNotExist(errGo) {
+		return UnknownQueueMetrics, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+	}
+	for _, file := range claimed {
+		if !file.IsDir() {
+			metrics.InFlight++
+		}
+	}
+	return metrics, nil
+}
+
+// Send places a message onto the named queue, creating the queue if needed
+//
+func (lq *LocalQueue) Send(subscription string, msg []byte) (err errors.Error) {
+	return lq.send(subscription, msg, "")
+}
+
+// Publish places a message onto the named queue, creating the queue if needed
+//
+func (lq *LocalQueue) Publish(ctx context.Context, queue string, msg []byte) (err errors.Error) {
+	return lq.send(queue, msg, "")
+}
+
+// send places a message onto the named queue, a failure reason being written beside the
+// message when one is supplied
+//
+func (lq *LocalQueue) send(subscription string, msg []byte, reason string) (err errors.Error) {
+	dir := filepath.Join(lq.root, subscription)
+	if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+	}
+
+	// xids sort by time and so the file names retain the order messages were sent in
+	name := xid.New().String() + ".json"
+
+	// The reason is written first so that it is present once the message appears
+	if len(reason) != 0 {
+		if errGo := ioutil.WriteFile(filepath.Join(dir, name+localFailure), []byte(reason), 0600); errGo != nil {
+			return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+		}
+	}
+
+	tmp := filepath.Join(dir, "."+name)
+	if errGo := ioutil.WriteFile(tmp, msg, 0600); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+	}
+	if errGo := os.Rename(tmp, filepath.Join(dir, name)); errGo != nil {
+		os.Remove(tmp)
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+	}
+	return nil
+}
+
+// expire returns any messages whose lease has not been renewed to the queue
+//
+func (lq *LocalQueue) expire(dir string) {
+	inProgress := filepath.Join(dir, localInProgress)
+	files, errGo := ioutil.ReadDir(inProgress)
+	if errGo != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || time.Since(file.ModTime()) < lq.lease {
+			continue
+		}
+		name := file.Name()
+		if i := strings.LastIndex(name, localClaimSep); i > 0 {
+			name = name[:i]
+		}
+		// Another runner might have returned the message first in which case this will fail
+		os.Rename(filepath.Join(inProgress, file.Name()), filepath.Join(dir, name))
+	}
+}
+
+// claim attempts to take the oldest message on the queue, an empty path is returned if
+// there are no messages left to claim
+//
+func (lq *LocalQueue) claim(dir string) (original string, claimed string, err errors.Error) {
+
+	files, errGo := ioutil.ReadDir(dir)
+	if errGo != nil {
+		return "", "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("dir", dir)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	inProgress := filepath.Join(dir, localInProgress)
+	if errGo = os.MkdirAll(inProgress, 0700); errGo != nil {
+		return "", "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("dir", dir)
+	}
+
+	for _, file := range files {
+		if !isMsg(file) {
+			continue
+		}
+
+		// The claimed name is unique to this claim so that a runner whose lease has expired
+		// cannot remove a message that was since claimed by another runner
+		original = filepath.Join(dir, file.Name())
+		claimed = filepath.Join(inProgress, file.Name()+localClaimSep+xid.New().String())
+
+		// Losing a race with another runner is expected, move to the next message
+		if errGo = os.Rename(original, claimed); errGo != nil {
+			continue
+		}
+
+		now := time.Now()
+		os.Chtimes(claimed, now, now)
+
+		return original, claimed, nil
+	}
+	return "", "", nil
+}
+
+// Work claims a single message from the queue and passes it to the handler, messages that
+// are not acknowledged by the handler are returned to the queue unless they are dead-lettered
+//
+func (lq *LocalQueue) Work(ctx context.Context, qTimeout time.Duration, subscription string, handler MsgHandler) (msgCnt uint64, resource *Resource, err errors.Error) {
+
+	dir := filepath.Join(lq.root, subscription)
+
+	lq.expire(dir)
+
+	original, claimed, err := lq.claim(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(claimed) == 0 {
+		return 0, nil, nil
+	}
+
+	data, errGo := ioutil.ReadFile(claimed)
+	if errGo != nil {
+		os.Rename(claimed, original)
+		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+	}
+
+	// Make sure that the main ctx has not been Done with before continuing
+	select {
+	case <-ctx.Done():
+		os.Rename(claimed, original)
+		return 0, nil, errors.New("queue worker cancel received").With("stack", stack.Trace().TrimRuntime()).With("project", lq.project)
+	default:
+	}
+
+	// Renew the lease on the message until the work is done
+	quitC := make(chan struct{})
+	interval := lq.lease / 3
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+				now := time.Now()
+				if errGo := os.Chtimes(claimed, now, now); errGo != nil {
+					return
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+
+	// The number of failed attempts is carried in the name of the message file
+	base, attempts := msgAttempts(original)
+
+	ctx, delivery := withDelivery(ctx, attempts+1)
+	rsc, ack := handler(ctx, lq.project, subscription, "", data)
+	close(quitC)
+
+	if !ack {
+		reason, isDead := delivery.deadLetter()
+		if !isDead {
+			if delivery.failed() {
+				original = fmt.Sprintf("%s%s%d", base, localAttemptSep, attempts+1)
+			}
+			os.Rename(claimed, original)
+			return 1, nil, nil
+		}
+		if dlq := deadLetterQueue(); len(dlq) != 0 {
+			if err = lq.send(dlq, data, reason); err != nil {
+				os.Rename(claimed, original)
+				return 1, nil, err
+			}
+		}
+	}
+
+	resource = rsc
+	if errGo = os.Remove(claimed); errGo != nil && !os.IsNotExist(errGo) {
+		return 1, resource, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", lq.project).With("subscription", subscription)
+	}
+	return 1, resource, nil
+}
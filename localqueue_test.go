@@ -0,0 +1,126 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// This file contains tests for the spool directory based task queue
+
+func TestLocalQueue(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "local-queue")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	tq, err := NewTaskQueue("file://"+dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lq, isLocal := tq.(*LocalQueue)
+	if !isLocal {
+		t.Fatal("file URI did not produce a local queue")
+	}
+
+	if err = lq.Send("local_test", []byte(validLegacyRqst)); err != nil {
+		t.Fatal(err)
+	}
+	if err = lq.Send("other", []byte(validLegacyRqst)); err != nil {
+		t.Fatal(err)
+	}
+
+	known, err := lq.Refresh(regexp.MustCompile("^local_.*$"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isPresent := known["local_test"]; !isPresent || len(known) != 1 {
+		t.Fatalf("unexpected queues %v", known)
+	}
+	if exists, err := lq.Exists(context.Background(), "local_test"); err != nil || !exists {
+		t.Fatal("queue not found")
+	}
+
+	// A message that is not acknowledged is returned to the queue
+	handled := 0
+	handler := func(ack bool) MsgHandler {
+		return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (resource *Resource, consume bool) {
+			handled++
+			if string(data) != validLegacyRqst {
+				t.Fatal("message was corrupted")
+			}
+			return &Resource{}, ack
+		}
+	}
+	if cnt, _, err := lq.Work(context.Background(), time.Second, "local_test", handler(false)); err != nil || cnt != 1 {
+		t.Fatalf("nack work failed %d %v", cnt, err)
+	}
+	if cnt, rsc, err := lq.Work(context.Background(), time.Second, "local_test", handler(true)); err != nil || cnt != 1 || rsc == nil {
+		t.Fatalf("ack work failed %d %v", cnt, err)
+	}
+	if cnt, _, err := lq.Work(context.Background(), time.Second, "local_test", handler(true)); err != nil || cnt != 0 {
+		t.Fatalf("queue was not empty %d %v", cnt, err)
+	}
+	if handled != 2 {
+		t.Fatalf("handler called %d times", handled)
+	}
+
+	// A claimed message, for example from a crashed runner, is returned once its lease expires
+	lq.lease = time.Minute
+	if err = lq.Send("local_test", []byte(validLegacyRqst)); err != nil {
+		t.Fatal(err)
+	}
+	if _, claimed, err := lq.claim(filepath.Join(dir, "local_test")); err != nil || len(claimed) == 0 {
+		t.Fatalf("claim failed %v", err)
+	} else {
+		if cnt, _, err := lq.Work(context.Background(), time.Second, "local_test", handler(true)); err != nil || cnt != 0 {
+			t.Fatalf("claimed message was delivered %d %v", cnt, err)
+		}
+		past := time.Now().Add(-2 * time.Minute)
+		if errGo = os.Chtimes(claimed, past, past); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+	if cnt, _, err := lq.Work(context.Background(), time.Second, "local_test", handler(true)); err != nil || cnt != 1 {
+		t.Fatalf("expired message was not redelivered %d %v", cnt, err)
+	}
+}
+
+func TestLocalQueueMetrics(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "local-queue")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	lq, err := NewLocalQueue("file://"+dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i != 3; i++ {
+		if err = lq.Send("local_test", []byte(validLegacyRqst)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, claimed, err := lq.claim(filepath.Join(dir, "local_test")); err != nil || len(claimed) == 0 {
+		t.Fatalf("claim failed %v", err)
+	}
+
+	metrics, err := lq.Metrics(context.Background(), "local_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Depth != 2 || metrics.InFlight != 1 || metrics.Age < 0 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+	if _, err = lq.Metrics(context.Background(), "local_missing"); err == nil {
+		t.Fatal("metrics returned for a missing queue")
+	}
+}
@@ -0,0 +1,306 @@
+package runner
+
+// This file contains the implementation of an in-process task queue intended for testing.
+// Messages can be sent, queues deleted, and the outcome of processing inspected using
+// a Go API.  Faults such as latency and errors can be injected into the queue operations
+// in order to exercise the error handling of the queue consumers.
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// MemFaults describes the faults to be injected into the operations of a MemQueue
+//
+type MemFaults struct {
+	Latency     time.Duration // A delay applied to every Refresh, Exists and Work call
+	RefreshErrs int           // The number of subsequent Refresh calls that will fail
+	ExistsErrs  int           // The number of subsequent Exists calls that will fail
+	WorkErrs    int           // The number of subsequent Work calls that will fail
+}
+
+// MemQueueStats summarizes the state of a single queue and the outcomes of the messages
+// that have been delivered from it
+//
+type MemQueueStats struct {
+	Pending   int    // Messages waiting to be delivered
+	InFlight  int    // Messages currently being handled
+	Delivered uint64 // Count of deliveries including redeliveries
+	Acked     uint64 // Count of messages acknowledged by the handler
+	Nacked    uint64 // Count of messages returned to the queue by the handler
+	Dead      uint64 // Count of failed messages sent to the dead-letter queue, or discarded
+}
+
+type memMsg struct {
+	id         uint64
+	data       []byte
+	deliveries int
+	sent       time.Time
+	reason     string // The failure reason of messages that were dead-lettered
+}
+
+type memQ struct {
+	pending  []*memMsg
+	inFlight map[uint64]*memMsg
+	stats    MemQueueStats
+}
+
+// MemQueue is an in-process task queue
+//
+type MemQueue struct {
+	project string
+	queues  map[string]*memQ
+	faults  MemFaults
+	lastID  uint64
+	sync.Mutex
+}
+
+// NewMemQueue creates an empty in-process task queue for the named project
+//
+func NewMemQueue(project string) (mq *MemQueue) {
+	return &MemQueue{
+		project: project,
+		queues:  map[string]*memQ{},
+	}
+}
+
+// SetFaults replaces the faults that are injected into subsequent queue operations
+//
+func (mq *MemQueue) SetFaults(faults MemFaults) {
+	mq.Lock()
+	defer mq.Unlock()
+	mq.faults = faults
+}
+
+// inject applies any latency and returns an error if the operation has been selected to fail
+//
+func (mq *MemQueue) inject(ctx context.Context, op string, errs *int) (err errors.Error) {
+	mq.Lock()
+	latency := mq.faults.Latency
+	fail := *errs > 0
+	if fail {
+		*errs--
+	}
+	mq.Unlock()
+
+	if latency != 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return errors.New("queue operation cancelled").With("op", op).With("project", mq.project).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if fail {
+		return errors.New(fmt.Sprintf("injected %s failure", op)).With("project", mq.project).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// CreateQueue adds an empty queue if it does not already exist
+//
+func (mq *MemQueue) CreateQueue(subscription string) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	if _, isPresent := mq.queues[subscription]; !isPresent {
+		mq.queues[subscription] = &memQ{inFlight: map[uint64]*memMsg{}}
+	}
+}
+
+// DeleteQueue removes a queue along with any pending messages, messages in flight
+// are discarded when their handler completes
+//
+func (mq *MemQueue) DeleteQueue(subscription string) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	delete(mq.queues, subscription)
+}
+
+// Send places a message onto the named queue, creating the queue if needed
+//
+func (mq *MemQueue) Send(subscription string, msg []byte) (err errors.Error) {
+	mq.CreateQueue(subscription)
+
+	mq.Lock()
+	defer mq.Unlock()
+
+	q, isPresent := mq.queues[subscription]
+	if !isPresent {
+		return errors.New("queue was deleted").With("project", mq.project).With("subscription", subscription).With("stack", stack.Trace().TrimRuntime())
+	}
+	mq.lastID++
+	q.pending = append(q.pending, &memMsg{id: mq.lastID, data: append([]byte{}, msg...), sent: time.Now()})
+	return nil
+}
+
+// Publish places a message onto the named queue, creating the queue if needed
+//
+func (mq *MemQueue) Publish(ctx context.Context, queue string, msg []byte) (err errors.Error) {
+	return mq.Send(queue, msg)
+}
+
+// Failures returns the failure reasons of the messages waiting on a queue, typically
+// the dead-letter queue
+//
+func (mq *MemQueue) Failures(subscription string) (reasons []string) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	reasons = []string{}
+	if q, isPresent := mq.queues[subscription]; isPresent {
+		for _, msg := range q.pending {
+			reasons = append(reasons, msg.reason)
+		}
+	}
+	return reasons
+}
+
+// Stats returns the state of the named queue, false is returned if the queue does not exist
+//
+func (mq *MemQueue) Stats(subscription string) (stats MemQueueStats, exists bool) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	q, isPresent := mq.queues[subscription]
+	if !isPresent {
+		return stats, false
+	}
+	stats = q.stats
+	stats.Pending = len(q.pending)
+	stats.InFlight = len(q.inFlight)
+	return stats, true
+}
+
+// Metrics returns the number of messages pending and in flight along with the age of the oldest
+// pending message
+//
+func (mq *MemQueue) Metrics(ctx context.Context, subscription string) (metrics QueueMetrics, err errors.Error) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	q, isPresent := mq.queues[subscription]
+	if !isPresent {
+		return UnknownQueueMetrics, errors.New("queue not found").With("project", mq.project).With("subscription", subscription).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	metrics = QueueMetrics{
+		Depth:    int64(len(q.pending)),
+		InFlight: int64(len(q.inFlight)),
+	}
+	for _, msg := range q.pending {
+		if age := time.Since(msg.sent); age > metrics.Age {
+			metrics.Age = age
+		}
+	}
+	return metrics, nil
+}
+
+// Refresh returns the queues whose names match the expression
+//
+func (mq *MemQueue) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (known map[string]interface{}, err errors.Error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err = mq.inject(ctx, "refresh", &mq.faults.RefreshErrs); err != nil {
+		return nil, err
+	}
+
+	mq.Lock()
+	defer mq.Unlock()
+
+	names := make([]string, 0, len(mq.queues))
+	for name := range mq.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	known = make(map[string]interface{}, len(names))
+	for _, name := range names {
+		if qNameMatch != nil && !qNameMatch.MatchString(name) {
+			continue
+		}
+		known[name] = mq.project
+	}
+	return known, nil
+}
+
+// Exists checks that the queue has not been deleted
+//
+func (mq *MemQueue) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
+
+	if err = mq.inject(ctx, "exists", &mq.faults.ExistsErrs); err != nil {
+		return true, err
+	}
+
+	mq.Lock()
+	defer mq.Unlock()
+
+	_, exists = mq.queues[subscription]
+	return exists, nil
+}
+
+// Work delivers the oldest message on the queue to the handler, messages that are not
+// acknowledged are returned to the front of the queue unless they are dead-lettered
+//
+func (mq *MemQueue) Work(ctx context.Context, qTimeout time.Duration, subscription string, handler MsgHandler) (msgCnt uint64, resource *Resource, err errors.Error) {
+
+	if err = mq.inject(ctx, "work", &mq.faults.WorkErrs); err != nil {
+		return 0, nil, err
+	}
+
+	mq.Lock()
+	q, isPresent := mq.queues[subscription]
+	if !isPresent {
+		mq.Unlock()
+		return 0, nil, errors.New("queue not found").With("project", mq.project).With("subscription", subscription).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(q.pending) == 0 {
+		mq.Unlock()
+		return 0, nil, nil
+	}
+	msg := q.pending[0]
+	q.pending = q.pending[1:]
+	q.inFlight[msg.id] = msg
+	msg.deliveries++
+	attempt := msg.deliveries
+	q.stats.Delivered++
+	mq.Unlock()
+
+	ctx, delivery := withDelivery(ctx, attempt)
+	rsc, ack := handler(ctx, mq.project, subscription, "", msg.data)
+
+	reason, isDead := delivery.deadLetter()
+
+	mq.Lock()
+	defer mq.Unlock()
+
+	delete(q.inFlight, msg.id)
+	switch {
+	case ack:
+		q.stats.Acked++
+		resource = rsc
+	case isDead:
+		q.stats.Dead++
+		resource = rsc
+		if dlq := deadLetterQueue(); len(dlq) != 0 {
+			if _, isPresent := mq.queues[dlq]; !isPresent {
+				mq.queues[dlq] = &memQ{inFlight: map[uint64]*memMsg{}}
+			}
+			mq.lastID++
+			mq.queues[dlq].pending = append(mq.queues[dlq].pending, &memMsg{id: mq.lastID, data: msg.data, sent: time.Now(), reason: reason})
+		}
+	default:
+		q.stats.Nacked++
+		q.pending = append([]*memMsg{msg}, q.pending...)
+	}
+	return 1, resource, nil
+}
@@ -0,0 +1,449 @@
+package runner
+
+// This file contains a minimal client for the NATS text protocol used by the JetStream
+// task queue.  Only publishing, subscriptions to inboxes, and request reply interactions
+// are implemented, messages carrying headers are decoded so that the status replies used
+// by JetStream can be recognized.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// natsMsg is a message delivered to a subscription, status is the status line of any
+// header that accompanied the message, for example "404 No Messages"
+//
+type natsMsg struct {
+	subject string
+	reply   string
+	status  string
+	data    []byte
+}
+
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+type natsConnect struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+}
+
+// natsConn is a single connection to a NATS server
+//
+type natsConn struct {
+	conn  net.Conn
+	rd    *bufio.Reader
+	wLock sync.Mutex
+
+	subs    map[string]chan *natsMsg
+	lastSID uint64
+	pongs   []chan struct{}
+	failure error
+	sync.Mutex
+}
+
+// dialNATS connects to the server identified by a nats:// URI, user and password, or a
+// token, can be supplied using the user information of the URI.  TLS is used when the server
+// requires it, and is required by the runner for nats+tls:// URIs and those with a tls=true query
+// parameter so that credentials are never sent in the clear to a server that does not ask for TLS.
+//
+func dialNATS(uri *url.URL, timeout time.Duration) (c *natsConn, err errors.Error) {
+
+	host := uri.Host
+	if len(uri.Port()) == 0 {
+		host = net.JoinHostPort(uri.Hostname(), "4222")
+	}
+
+	useTLS := uri.Scheme == "nats+tls"
+	if value := uri.Query().Get("tls"); len(value) != 0 {
+		required, errGo := strconv.ParseBool(value)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host).With("tls", value)
+		}
+		useTLS = useTLS || required
+	}
+
+	conn, errGo := net.DialTimeout("tcp", host, timeout)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	rd := bufio.NewReader(conn)
+	line, errGo := rd.ReadString('\n')
+	if errGo != nil {
+		conn.Close()
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, errors.New("unexpected NATS greeting").With("stack", stack.Trace().TrimRuntime()).With("host", host)
+	}
+	info := natsInfo{}
+	if errGo = json.Unmarshal([]byte(line[5:]), &info); errGo != nil {
+		conn.Close()
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+	}
+	if !info.Headers {
+		conn.Close()
+		return nil, errors.New("NATS server does not support headers, which JetStream requires").With("stack", stack.Trace().TrimRuntime()).With("host", host)
+	}
+
+	if useTLS || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: uri.Hostname()})
+		if errGo = tlsConn.Handshake(); errGo != nil {
+			conn.Close()
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+		}
+		conn = tlsConn
+		rd = bufio.NewReader(conn)
+	}
+
+	connect := natsConnect{
+		Name:         "studio-go-runner",
+		Lang:         "go",
+		Version:      "1.0.0",
+		Protocol:     1,
+		Headers:      true,
+		NoResponders: true,
+	}
+	if uri.User != nil {
+		if pass, hasPass := uri.User.Password(); hasPass {
+			connect.User = uri.User.Username()
+			connect.Pass = pass
+		} else {
+			connect.AuthToken = uri.User.Username()
+		}
+	}
+	b, errGo := json.Marshal(connect)
+	if errGo != nil {
+		conn.Close()
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+	}
+	if _, errGo = io.WriteString(conn, "CONNECT "+string(b)+"\r\nPING\r\n"); errGo != nil {
+		conn.Close()
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+	}
+
+	// The server replies to the PING once the connection has been accepted, or with an
+	// error if the credentials were not accepted
+	for {
+		line, errGo = rd.ReadString('\n')
+		if errGo != nil {
+			conn.Close()
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, errors.New(strings.Trim(strings.TrimSpace(line[4:]), "'")).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c = &natsConn{
+		conn: conn,
+		rd:   rd,
+		subs: map[string]chan *natsMsg{},
+	}
+	go c.read()
+
+	return c, nil
+}
+
+// Close releases the network connection, which will in turn stop the reader
+//
+func (c *natsConn) Close() {
+	c.conn.Close()
+}
+
+func (c *natsConn) write(timeout time.Duration, data string) (err errors.Error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, errGo := io.WriteString(c.conn, data); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// read processes the protocol messages sent by the server until the connection is closed
+//
+func (c *natsConn) read() {
+	defer func() {
+		c.Lock()
+		if c.failure == nil {
+			c.failure = fmt.Errorf("connection closed")
+		}
+		for _, sub := range c.subs {
+			close(sub)
+		}
+		c.subs = map[string]chan *natsMsg{}
+		for _, pong := range c.pongs {
+			close(pong)
+		}
+		c.pongs = nil
+		c.Unlock()
+	}()
+
+	for {
+		line, errGo := c.rd.ReadString('\n')
+		if errGo != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op := strings.SplitN(line, " ", 2)[0]
+
+		switch strings.ToUpper(op) {
+		case "PING":
+			c.write(5*time.Second, "PONG\r\n")
+		case "PONG":
+			c.Lock()
+			if len(c.pongs) != 0 {
+				close(c.pongs[0])
+				c.pongs = c.pongs[1:]
+			}
+			c.Unlock()
+		case "-ERR":
+			c.Lock()
+			c.failure = fmt.Errorf("%s", strings.Trim(strings.TrimSpace(line[4:]), "'"))
+			c.Unlock()
+		case "MSG", "HMSG":
+			msg, sid, errGo := c.readMsg(strings.Fields(line))
+			if errGo != nil {
+				c.Lock()
+				c.failure = errGo
+				c.Unlock()
+				return
+			}
+			c.Lock()
+			if sub, isPresent := c.subs[sid]; isPresent {
+				select {
+				case sub <- msg:
+				default:
+					// Subscriptions are sized for the messages expected, anything more is unexpected
+					queueLogger.Warn("NATS message dropped as the subscription is full", "subject", msg.subject, "status", msg.status, "size", len(msg.data))
+				}
+			}
+			c.Unlock()
+		}
+	}
+}
+
+// readMsg decodes the payload of a MSG, or HMSG, the fields being those of the protocol line
+//
+func (c *natsConn) readMsg(fields []string) (msg *natsMsg, sid string, errGo error) {
+
+	// The formats are 'MSG <subject> <sid> [reply-to] <#bytes>' and
+	// 'HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>'
+	headers := strings.ToUpper(fields[0]) == "HMSG"
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(fields) < 3+sizes || len(fields) > 4+sizes {
+		return nil, "", fmt.Errorf("malformed %s", fields[0])
+	}
+
+	msg = &natsMsg{subject: fields[1]}
+	sid = fields[2]
+	if len(fields) == 4+sizes {
+		msg.reply = fields[3]
+	}
+
+	total, errGo := strconv.Atoi(fields[len(fields)-1])
+	if errGo != nil {
+		return nil, "", errGo
+	}
+	hdrLen := 0
+	if headers {
+		if hdrLen, errGo = strconv.Atoi(fields[len(fields)-2]); errGo != nil {
+			return nil, "", errGo
+		}
+	}
+
+	buf := make([]byte, total+2)
+	if _, errGo = io.ReadFull(c.rd, buf); errGo != nil {
+		return nil, "", errGo
+	}
+	if hdrLen > total {
+		return nil, "", fmt.Errorf("malformed %s header length", fields[0])
+	}
+
+	if headers {
+		// The first line of the header is the version optionally followed by a status
+		status := strings.SplitN(string(buf[:hdrLen]), "\r\n", 2)[0]
+		msg.status = strings.TrimSpace(strings.TrimPrefix(status, "NATS/1.0"))
+	}
+	msg.data = buf[hdrLen:total]
+
+	return msg, sid, nil
+}
+
+// subscribe starts delivery of messages on the subject to the returned channel, which holds
+// up to size messages that have not yet been received
+//
+func (c *natsConn) subscribe(subject string, size int) (sid string, msgC chan *natsMsg, err errors.Error) {
+	c.Lock()
+	if c.failure != nil {
+		c.Unlock()
+		return "", nil, errors.Wrap(c.failure).With("stack", stack.Trace().TrimRuntime())
+	}
+	c.lastSID++
+	sid = strconv.FormatUint(c.lastSID, 10)
+	msgC = make(chan *natsMsg, size)
+	c.subs[sid] = msgC
+	c.Unlock()
+
+	if err = c.write(5*time.Second, fmt.Sprintf("SUB %s %s\r\n", subject, sid)); err != nil {
+		return "", nil, err.With("subject", subject)
+	}
+	return sid, msgC, nil
+}
+
+// unsubscribe stops delivery of messages for a subscription
+//
+func (c *natsConn) unsubscribe(sid string) {
+	c.Lock()
+	delete(c.subs, sid)
+	c.Unlock()
+
+	c.write(5*time.Second, fmt.Sprintf("UNSUB %s\r\n", sid))
+}
+
+// publish sends a message to the subject, replies being sent to the reply subject when
+// this is specified
+//
+func (c *natsConn) publish(subject string, reply string, data []byte) (err errors.Error) {
+	return c.publishHeaders(subject, reply, nil, data)
+}
+
+// publishHeaders sends a message to the subject along with headers, the message being sent
+// without any headers when none are supplied
+//
+func (c *natsConn) publishHeaders(subject string, reply string, headers map[string]string, data []byte) (err errors.Error) {
+	cmd := "PUB " + subject
+	if len(headers) != 0 {
+		cmd = "HPUB " + subject
+	}
+	if len(reply) != 0 {
+		cmd += " " + reply
+	}
+
+	if len(headers) == 0 {
+		err = c.write(5*time.Second, fmt.Sprintf("%s %d\r\n%s\r\n", cmd, len(data), data))
+	} else {
+		hdr := "NATS/1.0\r\n"
+		for k, v := range headers {
+			// Line breaks would end the header early
+			hdr += k + ": " + strings.NewReplacer("\r", " ", "\n", " ").Replace(v) + "\r\n"
+		}
+		hdr += "\r\n"
+		err = c.write(5*time.Second, fmt.Sprintf("%s %d %d\r\n%s%s\r\n", cmd, len(hdr), len(hdr)+len(data), hdr, data))
+	}
+	if err != nil {
+		return err.With("subject", subject)
+	}
+	return nil
+}
+
+// flush waits for the server to process everything sent to it
+//
+func (c *natsConn) flush(timeout time.Duration) (err errors.Error) {
+	pong := make(chan struct{})
+
+	c.Lock()
+	if c.failure != nil {
+		c.Unlock()
+		return errors.Wrap(c.failure).With("stack", stack.Trace().TrimRuntime())
+	}
+	c.pongs = append(c.pongs, pong)
+	c.Unlock()
+
+	if err = c.write(timeout, "PING\r\n"); err != nil {
+		return err
+	}
+
+	select {
+	case <-pong:
+		c.Lock()
+		defer c.Unlock()
+		if c.failure != nil {
+			return errors.Wrap(c.failure).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timeout waiting for the NATS server").With("stack", stack.Trace().TrimRuntime())
+	}
+}
+
+// newInbox generates a unique subject for receiving replies
+//
+func newInbox() string {
+	return "_INBOX." + xid.New().String()
+}
+
+// request sends a message to the subject and waits for the first reply
+//
+func (c *natsConn) request(subject string, data []byte, timeout time.Duration) (msg *natsMsg, err errors.Error) {
+	return c.requestHeaders(subject, nil, data, timeout)
+}
+
+// requestHeaders sends a message, along with headers, to the subject and waits for the first reply
+//
+func (c *natsConn) requestHeaders(subject string, headers map[string]string, data []byte, timeout time.Duration) (msg *natsMsg, err errors.Error) {
+	inbox := newInbox()
+	sid, msgC, err := c.subscribe(inbox, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unsubscribe(sid)
+
+	if err = c.publishHeaders(subject, inbox, headers, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg, isOpen := <-msgC:
+		if !isOpen {
+			c.Lock()
+			defer c.Unlock()
+			return nil, errors.Wrap(c.failure).With("stack", stack.Trace().TrimRuntime()).With("subject", subject)
+		}
+		if strings.HasPrefix(msg.status, "503") {
+			return nil, errors.New("no responders available for the request").With("stack", stack.Trace().TrimRuntime()).With("subject", subject)
+		}
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, errors.New("timeout waiting for a reply").With("stack", stack.Trace().TrimRuntime()).With("subject", subject)
+	}
+}
@@ -0,0 +1,66 @@
+package runner
+
+// This file contains the definitions used to give queues a scheduling priority and weight.  Queue
+// servers that support them use tags, labels or queue arguments to carry the priority and weight
+// of a queue, studioml-priority and studioml-weight, alongside the queue itself.
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// PriorityAttr is the name of the tag, label or argument holding the priority of a queue
+	PriorityAttr = "studioml-priority"
+
+	// WeightAttr is the name of the tag, label or argument holding the weight of a queue
+	WeightAttr = "studioml-weight"
+)
+
+// QueuePriority describes how a queue is scheduled relative to other queues
+//
+type QueuePriority struct {
+	Priority int     `json:"priority"` // Queues with higher priorities are checked for work first
+	Weight   float64 `json:"weight"`   // The share of checks a queue gets relative to other queues of the same priority
+}
+
+// DefaultQueuePriority is used for queues without a priority or weight
+//
+var DefaultQueuePriority = QueuePriority{Priority: 0, Weight: 1}
+
+// QueuePrioritizer is implemented by task queues able to retrieve the priority and weight of a queue
+// from the queue server, isPresent is false when neither was set for the queue
+//
+type QueuePrioritizer interface {
+	Priority(ctx context.Context, subscription string) (priority QueuePriority, isPresent bool, err errors.Error)
+}
+
+// ParseQueuePriority extracts the priority and weight of a queue from its attributes, using the default
+// for any that are missing, isPresent is false when neither attribute is present
+//
+func ParseQueuePriority(attrs map[string]interface{}) (priority QueuePriority, isPresent bool, err errors.Error) {
+	priority = DefaultQueuePriority
+
+	if value, isFound := attrs[PriorityAttr]; isFound {
+		errGo := error(nil)
+		if priority.Priority, errGo = strconv.Atoi(fmt.Sprint(value)); errGo != nil {
+			return DefaultQueuePriority, false, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With(PriorityAttr, value)
+		}
+		isPresent = true
+	}
+	if value, isFound := attrs[WeightAttr]; isFound {
+		errGo := error(nil)
+		if priority.Weight, errGo = strconv.ParseFloat(fmt.Sprint(value), 64); errGo != nil {
+			return DefaultQueuePriority, false, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With(WeightAttr, value)
+		}
+		if priority.Weight <= 0 {
+			return DefaultQueuePriority, false, errors.New("queue weights must be positive").With("stack", stack.Trace().TrimRuntime()).With(WeightAttr, value)
+		}
+		isPresent = true
+	}
+	return priority, isPresent, nil
+}
@@ -0,0 +1,30 @@
+package runner
+
+import (
+	"testing"
+)
+
+// This file contains tests for the parsing of queue priorities from queue attributes
+
+func TestParseQueuePriority(t *testing.T) {
+
+	if priority, isPresent, err := ParseQueuePriority(map[string]interface{}{"other": "1"}); err != nil || isPresent || priority != DefaultQueuePriority {
+		t.Fatalf("unexpected priority %+v %v %v", priority, isPresent, err)
+	}
+
+	// RabbitMQ arguments are decoded from JSON and so arrive as numbers
+	priority, isPresent, err := ParseQueuePriority(map[string]interface{}{PriorityAttr: float64(10), WeightAttr: "2.5"})
+	if err != nil || !isPresent || priority.Priority != 10 || priority.Weight != 2.5 {
+		t.Fatalf("unexpected priority %+v %v %v", priority, isPresent, err)
+	}
+
+	for _, attrs := range []map[string]interface{}{
+		{PriorityAttr: "high"},
+		{WeightAttr: "0"},
+		{WeightAttr: "-1"},
+	} {
+		if _, _, err := ParseQueuePriority(attrs); err == nil {
+			t.Fatalf("invalid attributes %v were accepted", attrs)
+		}
+	}
+}
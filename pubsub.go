@@ -5,32 +5,217 @@ package runner
 
 import (
 	"flag"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	pubsubv1 "cloud.google.com/go/pubsub/apiv1"
 	"golang.org/x/net/context"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
 
 	"github.com/go-stack/stack"
+	"github.com/golang/protobuf/proto"
 	"github.com/karlmutch/errors"
 )
 
 var (
-	pubsubTimeoutOpt = flag.Duration("pubsub-timeout", time.Duration(5*time.Second), "the period of time discrete pubsub operations use for timeouts")
+	pubsubTimeoutOpt  = flag.Duration("pubsub-timeout", time.Duration(5*time.Second), "the period of time discrete pubsub operations use for timeouts")
+	pubsubSyncOpt     = flag.Bool("pubsub-sync", true, "lease a single message at a time from PubSub subscriptions using synchronous pulls, when false streaming pulls that can run several messages at once are used")
+	pubsubEmulatorOpt = flag.String("pubsub-emulator-host", "", "the host:port of a PubSub emulator, or stand-in, to be used in place of Google PubSub")
 )
 
+const (
+	// pubsubAckDeadline is the ack deadline given to messages leased using synchronous pulls, the
+	// deadline is extended while the message is being handled
+	pubsubAckDeadline = 60 * time.Second
+
+	// pubsubAttemptsRetention is how long the failed attempts of a message are remembered after
+	// it was last seen by the runner
+	pubsubAttemptsRetention = 24 * time.Hour
+)
+
+// pubsubAttempts holds the failed attempts this runner has made for PubSub messages, keyed using
+// the subscription and message ID.  They are only used for messages that arrive without a delivery
+// attempt, from subscriptions that have no dead letter policy or using streaming pulls, as the
+// delivery attempts counted by PubSub are shared by every runner.
+//
+var pubsubAttempts = struct {
+	failures map[string]int
+	seen     map[string]time.Time
+	sync.Mutex
+}{
+	failures: map[string]int{},
+	seen:     map[string]time.Time{},
+}
+
+// pubsubFailures returns the failed attempts recorded for a message, counts for messages that
+// have not been seen within the retention period are also discarded
+//
+func pubsubFailures(key string) (failures int) {
+	pubsubAttempts.Lock()
+	defer pubsubAttempts.Unlock()
+
+	for k, seen := range pubsubAttempts.seen {
+		if time.Since(seen) > pubsubAttemptsRetention {
+			delete(pubsubAttempts.failures, k)
+			delete(pubsubAttempts.seen, k)
+		}
+	}
+	return pubsubAttempts.failures[key]
+}
+
+// pubsubFailed records a failed attempt for a message that is being released to be retried, or
+// forgets the message once it has been removed from the subscription when done is true
+//
+func pubsubFailed(key string, done bool) {
+	pubsubAttempts.Lock()
+	defer pubsubAttempts.Unlock()
+
+	if done {
+		delete(pubsubAttempts.failures, key)
+		delete(pubsubAttempts.seen, key)
+		return
+	}
+	pubsubAttempts.failures[key]++
+	pubsubAttempts.seen[key] = time.Now()
+}
+
+// pubsubReceived is a received message along with the delivery attempt that PubSub counts for
+// subscriptions having a dead letter policy.  The vendored PubSub client predates delivery attempts
+// and drops the field and so synchronous pulls decode their responses using these types.
+//
+type pubsubReceived struct {
+	AckId           string                  `protobuf:"bytes,1,opt,name=ack_id,json=ackId"`
+	Message         *pubsubpb.PubsubMessage `protobuf:"bytes,2,opt,name=message"`
+	DeliveryAttempt int32                   `protobuf:"varint,3,opt,name=delivery_attempt,json=deliveryAttempt"`
+}
+
+func (m *pubsubReceived) Reset()         { *m = pubsubReceived{} }
+func (m *pubsubReceived) String() string { return proto.CompactTextString(m) }
+func (*pubsubReceived) ProtoMessage()    {}
+
+// pubsubPullResponse is the response to a synchronous pull including the delivery attempts
+//
+type pubsubPullResponse struct {
+	ReceivedMessages []*pubsubReceived `protobuf:"bytes,1,rep,name=received_messages,json=receivedMessages"`
+}
+
+func (m *pubsubPullResponse) Reset()         { *m = pubsubPullResponse{} }
+func (m *pubsubPullResponse) String() string { return proto.CompactTextString(m) }
+func (*pubsubPullResponse) ProtoMessage()    {}
+
+func init() {
+	RegisterTaskQueue("pubsub", func(uri string, creds string) (tq TaskQueue, err errors.Error) {
+		return NewPubSub(uri, creds)
+	})
+}
+
 type PubSub struct {
-	project string
-	creds   string
+	project      string
+	creds        string
+	subscription string // The only subscription to be used, empty when all subscriptions are used
+	emulator     string // The host:port of an emulator used in place of Google PubSub
 }
 
-func NewPubSub(project string, creds string) (ps *PubSub, err errors.Error) {
+// NewPubSub creates a task queue using a pubsub://project/subscription URI, the subscription
+// being optional.  creds is the credentials JSON file for the project, the application default
+// credentials being used when it is empty.  An emulator=host:port query parameter replaces the
+// pubsub-emulator-host option.
+//
+func NewPubSub(uri string, creds string) (ps *PubSub, err errors.Error) {
+
+	parsed, errGo := url.Parse(uri)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", uri)
+	}
+	if parsed.Scheme != "pubsub" || len(parsed.Host) == 0 {
+		return nil, errors.New("PubSub queues require a pubsub://project URI").With("stack", stack.Trace().TrimRuntime()).With("uri", uri)
+	}
+
+	emulator := parsed.Query().Get("emulator")
+	if len(emulator) == 0 {
+		emulator = *pubsubEmulatorOpt
+	}
+
 	return &PubSub{
-		project: project,
-		creds:   creds,
+		project:      parsed.Host,
+		creds:        creds,
+		subscription: strings.Trim(parsed.Path, "/"),
+		emulator:     emulator,
+	}, nil
+}
+
+// options returns the options for the PubSub clients.  When an emulator is used a connection to
+// it is made without credentials or TLS, in the same way as the PUBSUB_EMULATOR_HOST environment
+// variable is handled by the PubSub client, and returned so that it can be closed along with the
+// client using it.
+//
+func (ps *PubSub) options() (opts []option.ClientOption, conn *grpc.ClientConn, err errors.Error) {
+	if len(ps.emulator) != 0 {
+		conn, errGo := grpc.Dial(ps.emulator, grpc.WithInsecure())
+		if errGo != nil {
+			return nil, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("emulator", ps.emulator)
+		}
+		return []option.ClientOption{option.WithGRPCConn(conn)}, conn, nil
+	}
+	if len(ps.creds) == 0 {
+		return []option.ClientOption{}, nil, nil
+	}
+	return []option.ClientOption{option.WithCredentialsFile(ps.creds)}, nil, nil
+}
+
+// closeEmulator closes a connection to an emulator, clients do not always close connections
+// that they were given
+//
+func closeEmulator(conn *grpc.ClientConn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// client returns a PubSub client for the project, along with a function that closes the
+// client and any emulator connection it used
+//
+func (ps *PubSub) client(ctx context.Context) (client *pubsub.Client, release func(), err errors.Error) {
+	opts, conn, err := ps.options()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, errGo := pubsub.NewClient(ctx, ps.project, opts...)
+	if errGo != nil {
+		closeEmulator(conn)
+		return nil, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project)
+	}
+	return client, func() {
+		client.Close()
+		closeEmulator(conn)
+	}, nil
+}
+
+// subscriber returns a client for the low level subscriber API of the project, along with a
+// function that closes the client and any emulator connection it used
+//
+func (ps *PubSub) subscriber(ctx context.Context) (client *pubsubv1.SubscriberClient, release func(), err errors.Error) {
+	opts, conn, err := ps.options()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, errGo := pubsubv1.NewSubscriberClient(ctx, opts...)
+	if errGo != nil {
+		closeEmulator(conn)
+		return nil, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project)
+	}
+	return client, func() {
+		client.Close()
+		closeEmulator(conn)
 	}, nil
 }
 
@@ -41,11 +226,11 @@ func (ps *PubSub) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (kno
 	ctx, cancel := context.WithTimeout(context.Background(), *pubsubTimeoutOpt)
 	defer cancel()
 
-	client, errGo := pubsub.NewClient(ctx, ps.project, option.WithCredentialsFile(ps.creds))
-	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	client, release, err := ps.client(ctx)
+	if err != nil {
+		return nil, err
 	}
-	defer client.Close()
+	defer release()
 
 	// Get all of the known subscriptions in the project and make a record of them
 	subs := client.Subscriptions(ctx)
@@ -57,6 +242,9 @@ func (ps *PubSub) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (kno
 		if errGo != nil {
 			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 		}
+		if len(ps.subscription) != 0 && ps.subscription != sub.ID() {
+			continue
+		}
 		known[sub.ID()] = true
 	}
 
@@ -64,45 +252,261 @@ func (ps *PubSub) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (kno
 }
 
 func (ps *PubSub) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
-	client, errGo := pubsub.NewClient(ctx, ps.project, option.WithCredentialsFile(ps.creds))
-	if errGo != nil {
-		return true, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project)
+	client, release, err := ps.client(ctx)
+	if err != nil {
+		return true, err
 	}
-	defer client.Close()
+	defer release()
 
-	exists, errGo = client.Subscription(subscription).Exists(ctx)
+	exists, errGo := client.Subscription(subscription).Exists(ctx)
 	if errGo != nil {
 		return true, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project)
 	}
 	return exists, nil
 }
 
+// Priority retrieves the priority and weight of a subscription from its labels, labels cannot
+// contain periods and so weights are given as whole numbers
+//
+func (ps *PubSub) Priority(ctx context.Context, subscription string) (priority QueuePriority, isPresent bool, err errors.Error) {
+	client, release, err := ps.subscriber(ctx)
+	if err != nil {
+		return DefaultQueuePriority, false, err
+	}
+	defer release()
+
+	sub, errGo := client.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{
+		Subscription: "projects/" + ps.project + "/subscriptions/" + subscription,
+	})
+	if errGo != nil {
+		return DefaultQueuePriority, false, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project).With("subscription", subscription)
+	}
+
+	attrs := make(map[string]interface{}, len(sub.Labels))
+	for k, v := range sub.Labels {
+		attrs[k] = v
+	}
+	return ParseQueuePriority(attrs)
+}
+
+// Work handles a message from the subscription.  Synchronous pulls are used to lease a single
+// message unless the pubsub-sync option is turned off, in which case messages are received using
+// a streaming pull that can hand several messages to the handler at once.
+//
 func (ps *PubSub) Work(ctx context.Context, qTimeout time.Duration, subscription string, handler MsgHandler) (msgs uint64, resource *Resource, err errors.Error) {
+	if *pubsubSyncOpt {
+		return ps.pull(ctx, qTimeout, subscription, handler)
+	}
+	return ps.receive(ctx, subscription, handler)
+}
+
+// pull leases a single message from the subscription, waiting up to qTimeout for one to arrive,
+// and extends the ack deadline of the message until the handler is done with it
+//
+func (ps *PubSub) pull(ctx context.Context, qTimeout time.Duration, subscription string, handler MsgHandler) (msgs uint64, resource *Resource, err errors.Error) {
+
+	client, release, err := ps.client(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer release()
 
-	client, errGo := pubsub.NewClient(ctx, ps.project, option.WithCredentialsFile(ps.creds))
+	subc, releaseSub, err := ps.subscriber(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer releaseSub()
+
+	name := "projects/" + ps.project + "/subscriptions/" + subscription
+
+	pullCtx, pullCancel := context.WithTimeout(ctx, qTimeout)
+	resp := &pubsubPullResponse{}
+	errGo := subc.Connection().Invoke(pullCtx, "/google.pubsub.v1.Subscriber/Pull", &pubsubpb.PullRequest{
+		Subscription: name,
+		MaxMessages:  1,
+	}, resp)
+	pullCancel()
 	if errGo != nil {
-		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project)
+		// No message arriving before the queue timeout is not an error
+		if ctx.Err() == nil && pullCtx.Err() != nil {
+			return 0, nil, nil
+		}
+		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project).With("subscription", subscription)
+	}
+	if len(resp.ReceivedMessages) == 0 {
+		return 0, nil, nil
+	}
+	received := resp.ReceivedMessages[0]
+
+	deadline := func(ctx context.Context, d time.Duration) (errGo error) {
+		return subc.ModifyAckDeadline(ctx, &pubsubpb.ModifyAckDeadlineRequest{
+			Subscription:       name,
+			AckIds:             []string{received.AckId},
+			AckDeadlineSeconds: int32(d / time.Second),
+		})
+	}
+
+	// The subscription ack deadline can be as short as 10 seconds and so the deadline is extended
+	// before the handler is started, and then periodically until the handler is done
+	if errGo = deadline(ctx, pubsubAckDeadline); errGo != nil {
+		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project).With("subscription", subscription)
+	}
+
+	quitC := make(chan struct{})
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		for {
+			select {
+			case <-time.After(pubsubAckDeadline / 3):
+				deadline(ctx, pubsubAckDeadline)
+			case <-quitC:
+				return
+			}
+		}
+	}()
+
+	resource, ack, err := ps.deliver(ctx, client, subscription, received.Message.MessageId, received.Message.Data, received.Message.Attributes,
+		int(received.DeliveryAttempt), handler)
+
+	close(quitC)
+	<-doneC
+
+	// Messages that are not acknowledged are made available again immediately
+	if ack {
+		errGo = subc.Acknowledge(ctx, &pubsubpb.AcknowledgeRequest{
+			Subscription: name,
+			AckIds:       []string{received.AckId},
+		})
+	} else {
+		errGo = deadline(ctx, 0)
+	}
+	if errGo != nil && err == nil {
+		err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project).With("subscription", subscription)
+	}
+	return 1, resource, err
+}
+
+// receive handles messages from the subscription using a streaming pull, messages are handled
+// concurrently until the context is cancelled
+//
+func (ps *PubSub) receive(ctx context.Context, subscription string, handler MsgHandler) (msgs uint64, resource *Resource, err errors.Error) {
+
+	client, release, err := ps.client(ctx)
+	if err != nil {
+		return 0, nil, err
 	}
-	defer client.Close()
+	defer release()
 
 	sub := client.Subscription(subscription)
 	sub.ReceiveSettings.MaxExtension = time.Duration(12 * time.Hour)
 
-	errGo = sub.Receive(ctx,
+	// Guards the err return value which is set by concurrent message callbacks
+	errLock := sync.Mutex{}
+
+	errGo := sub.Receive(ctx,
 		func(ctx context.Context, msg *pubsub.Message) {
 
-			if rsc, ack := handler(ctx, ps.project, subscription, ps.creds, msg.Data); ack {
-				msg.Ack()
-				resource = rsc
-			} else {
+			defer atomic.AddUint64(&msgs, 1)
+
+			rsc, ack, errDeliver := ps.deliver(ctx, client, subscription, msg.ID, msg.Data, msg.Attributes, 0, handler)
+			if errDeliver != nil {
+				errLock.Lock()
+				err = errDeliver
+				errLock.Unlock()
+			}
+			if !ack {
 				msg.Nack()
+				return
+			}
+			if rsc != nil {
+				errLock.Lock()
+				resource = rsc
+				errLock.Unlock()
 			}
-			atomic.AddUint64(&msgs, 1)
+			msg.Ack()
 		})
 
 	if errGo != nil {
 		return msgs, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	return msgs, resource, nil
+	errLock.Lock()
+	defer errLock.Unlock()
+	return msgs, resource, err
+}
+
+// deliver passes a message to the handler, ack is returned as true when the message is to be
+// removed from the subscription, because it was handled or because it was dead-lettered.  Failed
+// messages that can be retried are released so that PubSub redelivers them to the subscription,
+// rather than being republished to the topic which would copy them to every subscription.
+// deliveryAttempt is the attempt counted by PubSub, or 0 when PubSub did not supply it in which
+// case the attempts made by this runner are counted.
+//
+func (ps *PubSub) deliver(ctx context.Context, client *pubsub.Client, subscription string, id string, data []byte, attributes map[string]string,
+	deliveryAttempt int, handler MsgHandler) (resource *Resource, ack bool, err errors.Error) {
+
+	// Messages republished by earlier versions of the runner carry a count of their attempts
+	key := subscription + "/" + id
+	attempts, _ := strconv.Atoi(attributes[AttemptsAttr])
+	if deliveryAttempt > 0 {
+		attempts += deliveryAttempt - 1
+	} else {
+		attempts += pubsubFailures(key)
+	}
+
+	dCtx, delivery := withDelivery(ctx, attempts+1)
+	rsc, ack := handler(dCtx, ps.project, subscription, ps.creds, data)
+	if ack {
+		pubsubFailed(key, true)
+		return rsc, true, nil
+	}
+
+	reason, isDead := delivery.deadLetter()
+	switch {
+	case isDead:
+		if dlq := deadLetterQueue(); len(dlq) != 0 {
+			if errGo := ps.republish(ctx, client.Topic(dlq), data, attributes, FailureReasonAttr, reason); errGo != nil {
+				return nil, false, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project).With("subscription", subscription)
+			}
+		}
+		pubsubFailed(key, true)
+		return rsc, true, nil
+	case delivery.failed() && deliveryAttempt == 0:
+		pubsubFailed(key, false)
+	}
+	return nil, false, nil
+}
+
+// Publish sends a message to the named topic of the project
+//
+func (ps *PubSub) Publish(ctx context.Context, queue string, msg []byte) (err errors.Error) {
+	client, release, err := ps.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	topic := client.Topic(queue)
+	defer topic.Stop()
+
+	if _, errGo := topic.Publish(ctx, &pubsub.Message{Data: msg}).Get(ctx); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project).With("topic", queue)
+	}
+	return nil
+}
+
+// republish sends a copy of a message to a topic with an attribute added, or replaced
+//
+func (ps *PubSub) republish(ctx context.Context, topic *pubsub.Topic, data []byte, attributes map[string]string, attr string, value string) (errGo error) {
+	attrs := map[string]string{}
+	for k, v := range attributes {
+		attrs[k] = v
+	}
+	attrs[attr] = value
+
+	defer topic.Stop()
+
+	_, errGo = topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attrs}).Get(ctx)
+	return errGo
 }
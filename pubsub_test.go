@@ -0,0 +1,318 @@
+package runner
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
+)
+
+// This file contains tests for PubSub subscriptions that use a local stand-in for the PubSub
+// emulator
+
+// pubsubStandIn implements enough of the PubSub subscriber API to pull, acknowledge and modify
+// the deadlines of messages, the remainder of the API is left unimplemented
+//
+type pubsubStandIn struct {
+	waiting    []string       // Messages waiting to be pulled
+	leased     map[string]int // The last ack deadline given to each message in flight
+	acked      []string
+	maxPulled  int32          // The largest number of messages requested by a pull
+	open       int            // The number of client connections that are open
+	deadLetter bool           // Set to count delivery attempts, as subscriptions with a dead letter policy do
+	deliveries map[string]int // The number of times each message has been pulled
+	sync.Mutex
+}
+
+// pubsubStandInMethod serves a unary method of the stand-in
+//
+func pubsubStandInMethod(name string, newReq func() interface{}, call func(psi *pubsubStandIn, ctx context.Context, req interface{}) (interface{}, error)) (desc grpc.MethodDesc) {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newReq()
+			if errGo := dec(req); errGo != nil {
+				return nil, errGo
+			}
+			return call(srv.(*pubsubStandIn), ctx, req)
+		},
+	}
+}
+
+// pubsubStandInDesc describes the subscriber methods of the stand-in, pulls respond with the
+// delivery attempts that the generated service cannot carry
+//
+var pubsubStandInDesc = grpc.ServiceDesc{
+	ServiceName: "google.pubsub.v1.Subscriber",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		pubsubStandInMethod("Pull",
+			func() interface{} { return &pubsubpb.PullRequest{} },
+			func(psi *pubsubStandIn, ctx context.Context, req interface{}) (interface{}, error) {
+				return psi.Pull(ctx, req.(*pubsubpb.PullRequest))
+			}),
+		pubsubStandInMethod("ModifyAckDeadline",
+			func() interface{} { return &pubsubpb.ModifyAckDeadlineRequest{} },
+			func(psi *pubsubStandIn, ctx context.Context, req interface{}) (interface{}, error) {
+				return psi.ModifyAckDeadline(ctx, req.(*pubsubpb.ModifyAckDeadlineRequest))
+			}),
+		pubsubStandInMethod("Acknowledge",
+			func() interface{} { return &pubsubpb.AcknowledgeRequest{} },
+			func(psi *pubsubStandIn, ctx context.Context, req interface{}) (interface{}, error) {
+				return psi.Acknowledge(ctx, req.(*pubsubpb.AcknowledgeRequest))
+			}),
+	},
+}
+
+// trackingListener counts the client connections of the stand-in that are open
+//
+type trackingListener struct {
+	net.Listener
+	psi *pubsubStandIn
+}
+
+type trackedConn struct {
+	net.Conn
+	psi  *pubsubStandIn
+	once sync.Once
+}
+
+func (l *trackingListener) Accept() (conn net.Conn, errGo error) {
+	if conn, errGo = l.Listener.Accept(); errGo != nil {
+		return nil, errGo
+	}
+	l.psi.Lock()
+	l.psi.open++
+	l.psi.Unlock()
+	return &trackedConn{Conn: conn, psi: l.psi}, nil
+}
+
+func (c *trackedConn) Close() (errGo error) {
+	c.once.Do(func() {
+		c.psi.Lock()
+		c.psi.open--
+		c.psi.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// openConns waits for the clients of the stand-in to close their connections and returns the
+// number that remain open
+//
+func (psi *pubsubStandIn) openConns() (open int) {
+	for i := 0; i != 100; i++ {
+		psi.Lock()
+		open = psi.open
+		psi.Unlock()
+		if open == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return open
+}
+
+func (psi *pubsubStandIn) Pull(ctx context.Context, req *pubsubpb.PullRequest) (resp *pubsubPullResponse, errGo error) {
+	psi.Lock()
+	defer psi.Unlock()
+
+	if req.MaxMessages > psi.maxPulled {
+		psi.maxPulled = req.MaxMessages
+	}
+	resp = &pubsubPullResponse{}
+	for len(psi.waiting) != 0 && len(resp.ReceivedMessages) < int(req.MaxMessages) {
+		data := psi.waiting[0]
+		psi.waiting = psi.waiting[1:]
+		psi.leased[data] = 10
+		psi.deliveries[data]++
+		received := &pubsubReceived{
+			AckId:   data,
+			Message: &pubsubpb.PubsubMessage{Data: []byte(data), MessageId: data},
+		}
+		if psi.deadLetter {
+			received.DeliveryAttempt = int32(psi.deliveries[data])
+		}
+		resp.ReceivedMessages = append(resp.ReceivedMessages, received)
+	}
+	return resp, nil
+}
+
+func (psi *pubsubStandIn) ModifyAckDeadline(ctx context.Context, req *pubsubpb.ModifyAckDeadlineRequest) (*empty.Empty, error) {
+	psi.Lock()
+	defer psi.Unlock()
+
+	for _, id := range req.AckIds {
+		if req.AckDeadlineSeconds == 0 {
+			delete(psi.leased, id)
+			psi.waiting = append(psi.waiting, id)
+			continue
+		}
+		psi.leased[id] = int(req.AckDeadlineSeconds)
+	}
+	return &empty.Empty{}, nil
+}
+
+func (psi *pubsubStandIn) Acknowledge(ctx context.Context, req *pubsubpb.AcknowledgeRequest) (*empty.Empty, error) {
+	psi.Lock()
+	defer psi.Unlock()
+
+	for _, id := range req.AckIds {
+		delete(psi.leased, id)
+		psi.acked = append(psi.acked, id)
+	}
+	return &empty.Empty{}, nil
+}
+
+// newPubSubStandIn starts a stand-in holding the messages supplied and returns a task queue that
+// uses it as an emulator.  Only the subscriber API is served so publishing to a topic fails.
+//
+func newPubSubStandIn(t *testing.T, waiting ...string) (psi *pubsubStandIn, ps *PubSub, stop func()) {
+	psi = &pubsubStandIn{
+		waiting:    waiting,
+		leased:     map[string]int{},
+		deliveries: map[string]int{},
+	}
+
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	srv := grpc.NewServer()
+	srv.RegisterService(&pubsubStandInDesc, psi)
+	go srv.Serve(&trackingListener{Listener: listener, psi: psi})
+
+	ps, err := NewPubSub("pubsub://studio-project?emulator="+listener.Addr().String(), "")
+	if err != nil {
+		srv.Stop()
+		t.Fatal(err)
+	}
+	if ps.emulator != listener.Addr().String() {
+		srv.Stop()
+		t.Fatalf("emulator %s rather than %s", ps.emulator, listener.Addr().String())
+	}
+	return psi, ps, srv.Stop
+}
+
+// TestPubSubPull checks that synchronous pulls lease one message at a time, extend the deadline
+// of the message while it is handled, and acknowledge or release it when done without leaving
+// connections to the emulator open
+//
+func TestPubSubPull(t *testing.T) {
+
+	psi, ps, stop := newPubSubStandIn(t, "first", "second")
+	defer stop()
+
+	handler := func(ack bool) MsgHandler {
+		return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (resource *Resource, consume bool) {
+			psi.Lock()
+			defer psi.Unlock()
+			// Only the message being handled is leased and its deadline has been extended
+			if len(psi.leased) != 1 || psi.leased[string(data)] != int(pubsubAckDeadline/time.Second) {
+				t.Fatalf("unexpected leases %v while handling %s", psi.leased, string(data))
+			}
+			return &Resource{}, ack
+		}
+	}
+
+	// The first message is released and returns to the back of the subscription, the second is
+	// acknowledged
+	for _, ack := range []bool{false, true} {
+		if cnt, _, err := ps.Work(context.Background(), time.Second, "sub", handler(ack)); err != nil || cnt != 1 {
+			t.Fatalf("work failed %d %v", cnt, err)
+		}
+	}
+
+	if open := psi.openConns(); open != 0 {
+		t.Fatalf("%d connections to the emulator were left open", open)
+	}
+
+	psi.Lock()
+	defer psi.Unlock()
+	if psi.maxPulled != 1 {
+		t.Fatalf("%d messages pulled at once rather than 1", psi.maxPulled)
+	}
+	if len(psi.acked) != 1 || psi.acked[0] != "second" || len(psi.leased) != 0 {
+		t.Fatalf("unexpected acknowledgements %v and leases %v", psi.acked, psi.leased)
+	}
+	if len(psi.waiting) != 1 || psi.waiting[0] != "first" {
+		t.Fatalf("unexpected messages waiting %v", psi.waiting)
+	}
+}
+
+// TestPubSubRetries checks that failed messages are released back to their subscription, rather
+// than being republished to the topic, and that the attempts are counted until the message is
+// dead-lettered
+//
+func TestPubSubRetries(t *testing.T) {
+
+	defer setDeadLetter(t, 3, "")()
+
+	psi, ps, stop := newPubSubStandIn(t, "failing")
+	defer stop()
+
+	attempts := []int{}
+	handler := failingHandler(&attempts, true)
+	for i := 0; i != 4; i++ {
+		if _, _, err := ps.Work(context.Background(), 100*time.Millisecond, "sub", handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+
+	psi.Lock()
+	defer psi.Unlock()
+	if len(psi.acked) != 1 || len(psi.waiting) != 0 || len(psi.leased) != 0 {
+		t.Fatalf("the message was not dead-lettered %v %v %v", psi.acked, psi.waiting, psi.leased)
+	}
+	if failures := pubsubFailures("sub/failing"); failures != 0 {
+		t.Fatalf("%d failures remembered after the message was dead-lettered", failures)
+	}
+}
+
+// TestPubSubDeliveryAttempts checks that the delivery attempts counted by PubSub, for subscriptions
+// with a dead letter policy, are used in place of the attempts made by the runner so that attempts
+// made by other runners are included
+//
+func TestPubSubDeliveryAttempts(t *testing.T) {
+
+	defer setDeadLetter(t, 3, "")()
+
+	psi, ps, stop := newPubSubStandIn(t, "failing")
+	defer stop()
+
+	// The message has already been attempted once by another runner
+	psi.Lock()
+	psi.deadLetter = true
+	psi.deliveries["failing"] = 1
+	psi.Unlock()
+
+	attempts := []int{}
+	handler := failingHandler(&attempts, true)
+	for i := 0; i != 3; i++ {
+		if _, _, err := ps.Work(context.Background(), 100*time.Millisecond, "sub", handler); err != nil {
+			t.Fatal(err)
+		}
+		if failures := pubsubFailures("sub/failing"); failures != 0 {
+			t.Fatalf("%d failures counted by the runner rather than PubSub", failures)
+		}
+	}
+
+	if len(attempts) != 2 || attempts[0] != 2 || attempts[1] != 3 {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+
+	psi.Lock()
+	defer psi.Unlock()
+	if len(psi.acked) != 1 || len(psi.waiting) != 0 || len(psi.leased) != 0 {
+		t.Fatalf("the message was not dead-lettered %v %v %v", psi.acked, psi.waiting, psi.leased)
+	}
+}
@@ -154,9 +154,6 @@ export LC_ALL=en_US.utf8
 locale
 date
 {
-{{range $key, $value := .E.Request.Config.Env}}
-export {{$key}}="{{$value}}"
-{{end}}
 {{range $key, $value := .E.ExprEnvs}}
 export {{$key}}="{{$value}}"
 {{end}}
@@ -214,9 +211,10 @@ date
 
 // Run will use a generated script file and will run it to completion while marshalling
 // results and files from the computation.  Run is a blocking call and will only return
-// upon completion or termination of the process it starts
+// upon completion or termination of the process it starts.  secrets are added to the
+// environment of the process and do not appear in the script.
 //
-func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]Artifact) (err errors.Error) {
+func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]Artifact, secrets map[string]string) (err errors.Error) {
 
 	// Create a new TMPDIR because the python pip tends to leave dirt behind
 	// when doing pip builds etc
@@ -231,6 +229,7 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]Artifact) (err
 	//
 	cmd := exec.Command("/bin/bash", "-c", "export TMPDIR="+tmpDir+"; "+p.Script)
 	cmd.Dir = path.Dir(p.Script)
+	cmd.Env = secretsEnv(secrets)
 
 	stdout, errGo := cmd.StdoutPipe()
 	if errGo != nil {
@@ -284,7 +283,7 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]Artifact) (err
 
 	InfoSlack(p.Request.Config.Runner.SlackDest, fmt.Sprintf("logging %s", outputFN), []string{})
 
-	if errGo = cmd.Start(); err != nil {
+	if errGo = cmd.Start(); errGo != nil {
 		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -333,7 +332,7 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]Artifact) (err
 	done.Wait()
 	close(stopCP)
 
-	if errGo = cmd.Wait(); err != nil {
+	if errGo = cmd.Wait(); errGo != nil {
 		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
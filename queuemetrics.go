@@ -0,0 +1,31 @@
+package runner
+
+// This file contains the definitions used to report the messages held by queues, these are
+// exported by the runner to allow pools of runners to be sized to match the work waiting.
+
+import (
+	"context"
+	"time"
+
+	"github.com/karlmutch/errors"
+)
+
+// QueueMetrics describes the messages held by a queue, values that the queue server is unable
+// to supply are set to -1
+//
+type QueueMetrics struct {
+	Depth    int64         // Messages waiting to be delivered
+	InFlight int64         // Messages delivered to a runner that are not yet acknowledged
+	Age      time.Duration // The age of the oldest message waiting to be delivered
+}
+
+// UnknownQueueMetrics is the starting point for queues that supply only some metrics
+//
+var UnknownQueueMetrics = QueueMetrics{Depth: -1, InFlight: -1, Age: -1}
+
+// QueueInspector is implemented by task queues able to retrieve the metrics of a queue from the
+// queue server
+//
+type QueueInspector interface {
+	Metrics(ctx context.Context, subscription string) (metrics QueueMetrics, err errors.Error)
+}
@@ -0,0 +1,441 @@
+package runner
+
+// This file contains the implementation of a task queue that uses Redis Streams.  Each
+// stream is a queue and runners share the work on a stream using a consumer group, messages
+// are expected to be added to streams with the request held in a field named data, for example
+//
+//    XADD rmq_cpu * data '{"experiment": ...}'
+//
+// Messages that have been read by a consumer, but not acknowledged, are periodically claimed by
+// the consumer to show it is alive.  Messages whose consumer has not claimed them within the
+// claim idle period, for example when a runner has crashed, are reclaimed by other runners.
+
+import (
+	"context"
+	"flag"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	redisClaimIdleOpt = flag.Duration("redis-claim-idle", time.Duration(5*time.Minute), "the period of time a redis stream message is held by a consumer without being claimed before other runners can reclaim it")
+)
+
+func init() {
+	factory := func(uri string, creds string) (tq TaskQueue, err errors.Error) {
+		return NewRedisQueue(uri, creds)
+	}
+	RegisterTaskQueue("redis", factory)
+	RegisterTaskQueue("rediss", factory)
+}
+
+const (
+	redisDefaultGroup = "studioml"
+	redisDataField    = "data"
+	redisBlock        = time.Duration(2 * time.Second)
+)
+
+// RedisQueue is a task queue implemented using Redis Streams and consumer groups
+//
+type RedisQueue struct {
+	project   string        // The redis URI the queue was created from
+	url       *url.URL      // The parsed redis URI
+	group     string        // The consumer group shared by runners
+	consumer  string        // The name of this runner within the consumer group
+	claimIdle time.Duration // The time a message can go without being claimed before it can be reclaimed
+	delete    bool          // Delete messages from the stream once they are acknowledged
+}
+
+// NewRedisQueue creates a task queue using a redis:// or rediss:// URI, the consumer group
+// can be specified using the group query parameter.  Acknowledged messages are deleted from
+// their stream when the delete query parameter is true, deleting a message removes it for every
+// consumer group reading the stream.
+//
+func NewRedisQueue(project string, creds string) (rq *RedisQueue, err errors.Error) {
+
+	uri, errGo := url.Parse(project)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if uri.Scheme != "redis" && uri.Scheme != "rediss" {
+		return nil, errors.New("redis queues require a redis:// or rediss:// URI").With("stack", stack.Trace().TrimRuntime()).With("scheme", uri.Scheme)
+	}
+
+	group := uri.Query().Get("group")
+	if len(group) == 0 {
+		group = redisDefaultGroup
+	}
+
+	deleteAcked := false
+	if value := uri.Query().Get("delete"); len(value) != 0 {
+		if deleteAcked, errGo = strconv.ParseBool(value); errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("delete", value)
+		}
+	}
+
+	host, _ := os.Hostname()
+
+	return &RedisQueue{
+		project:   project,
+		url:       uri,
+		group:     group,
+		consumer:  host + "-" + xid.New().String(),
+		claimIdle: *redisClaimIdleOpt,
+		delete:    deleteAcked,
+	}, nil
+}
+
+func (rq *RedisQueue) attach(timeout time.Duration) (conn *respConn, err errors.Error) {
+	if conn, err = dialRESP(rq.url, timeout); err != nil {
+		return nil, err.With("host", rq.url.Host)
+	}
+	return conn, nil
+}
+
+// Refresh scans the redis database for streams with names matching the expression
+//
+func (rq *RedisQueue) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (known map[string]interface{}, err errors.Error) {
+
+	conn, err := rq.attach(timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	known = map[string]interface{}{}
+
+	cursor := "0"
+	for {
+		reply, err := conn.do(timeout, "SCAN", cursor, "COUNT", "100", "TYPE", "stream")
+		if err != nil {
+			return nil, err.With("host", rq.url.Host)
+		}
+		items, isArray := reply.([]interface{})
+		if !isArray || len(items) != 2 {
+			return nil, errors.New("unexpected SCAN reply").With("stack", stack.Trace().TrimRuntime()).With("host", rq.url.Host)
+		}
+		keys, _ := items[1].([]interface{})
+		for _, key := range keys {
+			name := respString(key)
+			if qNameMatch != nil && !qNameMatch.MatchString(name) {
+				continue
+			}
+			known[name] = rq.group
+		}
+
+		if cursor = respString(items[0]); cursor == "0" {
+			break
+		}
+	}
+	return known, nil
+}
+
+// Exists checks that the stream is still present
+//
+func (rq *RedisQueue) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
+
+	conn, err := rq.attach(15 * time.Second)
+	if err != nil {
+		return true, err
+	}
+	defer conn.Close()
+
+	reply, err := conn.do(15*time.Second, "TYPE", subscription)
+	if err != nil {
+		return true, err.With("host", rq.url.Host).With("subscription", subscription)
+	}
+	return respString(reply) == "stream", nil
+}
+
+// Send adds a message to the named stream, creating the stream if needed
+//
+func (rq *RedisQueue) Send(subscription string, msg []byte) (err errors.Error) {
+
+	conn, err := rq.attach(15 * time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.do(15*time.Second, "XADD", subscription, "*", redisDataField, string(msg)); err != nil {
+		return err.With("host", rq.url.Host).With("subscription", subscription)
+	}
+	return nil
+}
+
+// Publish adds a message to the named stream, creating the stream if needed
+//
+func (rq *RedisQueue) Publish(ctx context.Context, queue string, msg []byte) (err errors.Error) {
+	return rq.Send(queue, msg)
+}
+
+// redisEntry extracts the ID and the data field from a stream entry, entries that were
+// deleted while pending are returned with an empty ID
+//
+func redisEntry(entry interface{}) (id string, data []byte) {
+	fields, isArray := entry.([]interface{})
+	if !isArray || len(fields) != 2 {
+		return "", nil
+	}
+	id = respString(fields[0])
+	values, _ := fields[1].([]interface{})
+	for i := 0; i+1 < len(values); i += 2 {
+		if respString(values[i]) == redisDataField {
+			data = []byte(respString(values[i+1]))
+		}
+	}
+	return id, data
+}
+
+// next retrieves a message for this consumer, messages abandoned by other consumers are
+// preferred over new messages so that they are not starved
+//
+func (rq *RedisQueue) next(conn *respConn, stream string, timeout time.Duration) (id string, data []byte, err errors.Error) {
+
+	// The group is created at the start of the stream so that messages sent before any runner
+	// started are processed
+	if reply, err := conn.send(timeout, "XGROUP", "CREATE", stream, rq.group, "0"); err != nil {
+		return "", nil, err
+	} else if msg, isErr := reply.(respError); isErr && !strings.HasPrefix(string(msg), "BUSYGROUP") {
+		return "", nil, errors.New(string(msg)).With("stack", stack.Trace().TrimRuntime()).With("stream", stream).With("group", rq.group)
+	}
+
+	minIdle := strconv.FormatInt(int64(rq.claimIdle/time.Millisecond), 10)
+	reply, err := conn.do(timeout, "XAUTOCLAIM", stream, rq.group, rq.consumer, minIdle, "0-0", "COUNT", "1")
+	if err != nil {
+		return "", nil, err.With("stream", stream).With("group", rq.group)
+	}
+	if items, isArray := reply.([]interface{}); isArray && len(items) >= 2 {
+		entries, _ := items[1].([]interface{})
+		for _, entry := range entries {
+			if id, data = redisEntry(entry); len(id) != 0 {
+				return id, data, nil
+			}
+		}
+	}
+
+	block := strconv.FormatInt(int64(redisBlock/time.Millisecond), 10)
+	reply, err = conn.do(timeout+redisBlock, "XREADGROUP", "GROUP", rq.group, rq.consumer, "COUNT", "1", "BLOCK", block, "STREAMS", stream, ">")
+	if err != nil {
+		return "", nil, err.With("stream", stream).With("group", rq.group)
+	}
+	streams, _ := reply.([]interface{})
+	for _, s := range streams {
+		parts, isArray := s.([]interface{})
+		if !isArray || len(parts) != 2 {
+			continue
+		}
+		entries, _ := parts[1].([]interface{})
+		for _, entry := range entries {
+			if id, data = redisEntry(entry); len(id) != 0 {
+				return id, data, nil
+			}
+		}
+	}
+	return "", nil, nil
+}
+
+// attempts returns the number of times a pending message has been delivered to consumers, 0
+// being returned if this could not be determined
+//
+func (rq *RedisQueue) attempts(conn *respConn, stream string, id string, timeout time.Duration) (attempts int) {
+	reply, err := conn.do(timeout, "XPENDING", stream, rq.group, id, id, "1")
+	if err != nil {
+		return 0
+	}
+	entries, _ := reply.([]interface{})
+	if len(entries) != 1 {
+		return 0
+	}
+	fields, _ := entries[0].([]interface{})
+	if len(fields) != 4 {
+		return 0
+	}
+	if count, isInt := fields[3].(int64); isInt {
+		return int(count)
+	}
+	return 0
+}
+
+// claim renews the claim this consumer holds on a pending message, owned is returned as false
+// when the message is no longer pending for this consumer, for example because it was reclaimed
+// by another consumer after earlier claims failed
+//
+func (rq *RedisQueue) claim(conn *respConn, stream string, id string, timeout time.Duration) (owned bool, err errors.Error) {
+	reply, err := conn.do(timeout, "XPENDING", stream, rq.group, id, id, "1", rq.consumer)
+	if err != nil {
+		return false, err.With("host", rq.url.Host).With("stream", stream).With("id", id)
+	}
+	if entries, _ := reply.([]interface{}); len(entries) == 0 {
+		return false, nil
+	}
+	if _, err = conn.do(timeout, "XCLAIM", stream, rq.group, rq.consumer, "0", id, "JUSTID"); err != nil {
+		return true, err.With("host", rq.url.Host).With("stream", stream).With("id", id)
+	}
+	return true, nil
+}
+
+// heartbeat claims a message periodically, until quitC is closed, to prevent other consumers
+// from reclaiming it.  A connection of its own is used, which is redialed after failures so that
+// a network blip does not leave the message to be reclaimed and run a second time.
+//
+func (rq *RedisQueue) heartbeat(stream string, id string, timeout time.Duration, quitC <-chan struct{}) (doneC chan struct{}) {
+	doneC = make(chan struct{})
+	go func() {
+		defer close(doneC)
+
+		var conn *respConn
+		defer func() {
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+
+		for {
+			select {
+			case <-time.After(rq.claimIdle / 3):
+			case <-quitC:
+				return
+			}
+
+			// A failed claim is retried immediately using a new connection
+			for retry := 0; retry != 2; retry++ {
+				if conn == nil {
+					var err errors.Error
+					if conn, err = rq.attach(timeout); err != nil {
+						queueLogger.Warn("redis message claim could not connect", "stream", stream, "id", id, "error", err.Error())
+						continue
+					}
+				}
+				owned, err := rq.claim(conn, stream, id, timeout)
+				if err != nil {
+					queueLogger.Warn("redis message claim failed", "stream", stream, "id", id, "error", err.Error())
+					conn.Close()
+					conn = nil
+					continue
+				}
+				if !owned {
+					queueLogger.Warn("redis message was reclaimed by another consumer while being processed", "stream", stream, "id", id)
+					return
+				}
+				break
+			}
+		}
+	}()
+	return doneC
+}
+
+// Work reads a single message from the stream using the consumer group and passes it to the handler,
+// messages that are not acknowledged by the handler are made available for other consumers to claim
+// unless they are dead-lettered
+//
+func (rq *RedisQueue) Work(ctx context.Context, qTimeout time.Duration, subscription string, handler MsgHandler) (msgCnt uint64, resource *Resource, err errors.Error) {
+
+	conn, err := rq.attach(qTimeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	id, data, err := rq.next(conn, subscription, qTimeout)
+	if err != nil {
+		return 0, nil, err.With("host", rq.url.Host)
+	}
+	if len(id) == 0 {
+		return 0, nil, nil
+	}
+
+	// Make sure that the main ctx has not been Done with before continuing
+	select {
+	case <-ctx.Done():
+		rq.release(conn, subscription, id, qTimeout)
+		return 0, nil, errors.New("queue worker cancel received").With("stack", stack.Trace().TrimRuntime()).With("host", rq.url.Host).With("subscription", subscription)
+	default:
+	}
+
+	ctx, delivery := withDelivery(ctx, rq.attempts(conn, subscription, id, qTimeout))
+
+	// Claim the message periodically to prevent other consumers from reclaiming it
+	quitC := make(chan struct{})
+	doneC := rq.heartbeat(subscription, id, qTimeout, quitC)
+
+	rsc, ack := handler(ctx, rq.project, subscription, "", data)
+	close(quitC)
+	<-doneC
+
+	// The connection the message was read using has been idle while the message was handled
+	// and is replaced before being used to settle the message.  A failed settle is retried using
+	// another connection, as an unsettled message is reclaimed and handled all over again
+	conn.Close()
+	conn = nil
+
+	for retry := 0; retry != 2; retry++ {
+		fresh, errSettle := rq.attach(qTimeout)
+		if errSettle != nil {
+			queueLogger.Warn("redis message settle could not connect", "stream", subscription, "id", id, "error", errSettle.Error())
+			err = errSettle
+			continue
+		}
+		conn = fresh
+
+		if resource, err = rq.settle(conn, subscription, id, data, rsc, ack, delivery, qTimeout); err == nil {
+			return 1, resource, nil
+		}
+		queueLogger.Warn("redis message settle failed", "stream", subscription, "id", id, "error", err.Error())
+		conn.Close()
+		conn = nil
+	}
+	return 1, nil, err
+}
+
+// release returns a message to the group by marking it as having been idle long enough
+// for another consumer to reclaim it
+//
+func (rq *RedisQueue) release(conn *respConn, stream string, id string, timeout time.Duration) {
+	idle := strconv.FormatInt(int64(rq.claimIdle/time.Millisecond), 10)
+	conn.do(timeout, "XCLAIM", stream, rq.group, rq.consumer, "0", id, "IDLE", idle, "JUSTID")
+}
+
+// settle acknowledges, dead-letters or releases a message that has been handled according to
+// the handlers result and the delivery policy
+//
+func (rq *RedisQueue) settle(conn *respConn, stream string, id string, data []byte, rsc *Resource, ack bool, delivery *Delivery, timeout time.Duration) (resource *Resource, err errors.Error) {
+
+	if !ack {
+		reason, isDead := delivery.deadLetter()
+		if !isDead {
+			rq.release(conn, stream, id, timeout)
+			return nil, nil
+		}
+		if dlq := deadLetterQueue(); len(dlq) != 0 {
+			if _, err = conn.do(timeout, "XADD", dlq, "*", redisDataField, string(data), FailureReasonAttr, reason); err != nil {
+				rq.release(conn, stream, id, timeout)
+				return nil, err.With("host", rq.url.Host).With("subscription", stream).With("dead-letter", dlq)
+			}
+		}
+	}
+
+	if _, err = conn.do(timeout, "XACK", stream, rq.group, id); err != nil {
+		return nil, err.With("host", rq.url.Host).With("subscription", stream)
+	}
+	// Deleting the message would remove it for any other consumer groups reading the stream
+	if rq.delete {
+		if _, err = conn.do(timeout, "XDEL", stream, id); err != nil {
+			return nil, err.With("host", rq.url.Host).With("subscription", stream)
+		}
+	}
+	return rsc, nil
+}
@@ -0,0 +1,652 @@
+package runner
+
+// This file contains tests for the redis streams task queue along with an in-process
+// stand-in for a redis server that implements the subset of the streams commands
+// used by the queue
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type standInEntry struct {
+	ms     uint64
+	seq    uint64
+	fields []interface{}
+}
+
+func (e *standInEntry) id() string {
+	return fmt.Sprintf("%d-%d", e.ms, e.seq)
+}
+
+func (e *standInEntry) reply() []interface{} {
+	return []interface{}{e.id(), e.fields}
+}
+
+type standInPending struct {
+	consumer  string
+	delivered time.Time
+	count     int
+}
+
+type standInGroup struct {
+	lastMs  uint64
+	lastSeq uint64
+	pending map[string]*standInPending
+}
+
+type standInStream struct {
+	entries []*standInEntry
+	groups  map[string]*standInGroup
+	lastMs  uint64
+	lastSeq uint64
+}
+
+func (s *standInStream) find(id string) (entry *standInEntry) {
+	for _, entry := range s.entries {
+		if entry.id() == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+// redisStandIn is a single database redis server supporting the streams commands used by the queue
+//
+type redisStandIn struct {
+	listener net.Listener
+	password string
+	streams  map[string]*standInStream
+	conns    map[net.Conn]bool // Open client connections
+	refused  int               // The number of new connections still to be refused
+	sync.Mutex
+}
+
+func newRedisStandIn(password string) (srv *redisStandIn, errGo error) {
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		return nil, errGo
+	}
+	srv = &redisStandIn{
+		listener: listener,
+		password: password,
+		streams:  map[string]*standInStream{},
+		conns:    map[net.Conn]bool{},
+	}
+	go func() {
+		for {
+			conn, errGo := listener.Accept()
+			if errGo != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv, nil
+}
+
+func (srv *redisStandIn) Close() {
+	srv.listener.Close()
+}
+
+// drop closes the open client connections, as a network failure would
+//
+func (srv *redisStandIn) drop() {
+	srv.Lock()
+	defer srv.Unlock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+}
+
+// refuse closes the next count client connections as soon as they are accepted
+//
+func (srv *redisStandIn) refuse(count int) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.refused = count
+}
+
+// owner returns the consumer a message is pending for
+//
+func (srv *redisStandIn) owner(stream string, group string, id string) (consumer string) {
+	srv.Lock()
+	defer srv.Unlock()
+	if p, isPresent := srv.streams[stream].groups[group].pending[id]; isPresent {
+		return p.consumer
+	}
+	return ""
+}
+
+func (srv *redisStandIn) pending(stream string, group string) (ids []string) {
+	srv.Lock()
+	defer srv.Unlock()
+	if s, isPresent := srv.streams[stream]; isPresent {
+		if g, isPresent := s.groups[group]; isPresent {
+			for id := range g.pending {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (srv *redisStandIn) serve(conn net.Conn) {
+	srv.Lock()
+	if srv.refused > 0 {
+		srv.refused--
+		srv.Unlock()
+		conn.Close()
+		return
+	}
+	srv.conns[conn] = true
+	srv.Unlock()
+	defer func() {
+		srv.Lock()
+		delete(srv.conns, conn)
+		srv.Unlock()
+		conn.Close()
+	}()
+
+	rd := bufio.NewReader(conn)
+	authed := len(srv.password) == 0
+	for {
+		cmd, errGo := readRESP(rd)
+		if errGo != nil {
+			return
+		}
+		items, _ := cmd.([]interface{})
+		args := make([]string, 0, len(items))
+		for _, item := range items {
+			args = append(args, respString(item))
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		var reply interface{}
+		switch name := strings.ToUpper(args[0]); {
+		case name == "AUTH":
+			if args[len(args)-1] != srv.password {
+				reply = respError("WRONGPASS invalid username-password pair")
+				break
+			}
+			authed = true
+			reply = "OK"
+		case !authed:
+			reply = respError("NOAUTH Authentication required.")
+		case strings.HasPrefix(name, "XREADGROUP"):
+			reply = srv.xreadgroup(args)
+		default:
+			srv.Lock()
+			reply = srv.command(name, args)
+			srv.Unlock()
+		}
+
+		if _, errGo = conn.Write(encodeRESP(reply)); errGo != nil {
+			return
+		}
+	}
+}
+
+func encodeRESP(reply interface{}) (b []byte) {
+	switch v := reply.(type) {
+	case nil:
+		return []byte("$-1\r\n")
+	case respError:
+		return []byte("-" + string(v) + "\r\n")
+	case string:
+		return []byte("+" + v + "\r\n")
+	case int:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
+	case []byte:
+		return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+	case []interface{}:
+		b = []byte(fmt.Sprintf("*%d\r\n", len(v)))
+		for _, item := range v {
+			if s, isString := item.(string); isString {
+				item = []byte(s)
+			}
+			b = append(b, encodeRESP(item)...)
+		}
+		return b
+	}
+	return []byte("-ERR unsupported reply\r\n")
+}
+
+func after(ms uint64, seq uint64, lastMs uint64, lastSeq uint64) bool {
+	return ms > lastMs || (ms == lastMs && seq > lastSeq)
+}
+
+// command executes the non blocking commands with the server lock held
+//
+func (srv *redisStandIn) command(name string, args []string) (reply interface{}) {
+	switch name {
+	case "PING", "SELECT":
+		return "OK"
+	case "SCAN":
+		keys := []interface{}{}
+		for name := range srv.streams {
+			keys = append(keys, name)
+		}
+		return []interface{}{"0", keys}
+	case "TYPE":
+		if _, isPresent := srv.streams[args[1]]; isPresent {
+			return "stream"
+		}
+		return "none"
+	case "DEL":
+		delete(srv.streams, args[1])
+		return 1
+	case "XADD":
+		s, isPresent := srv.streams[args[1]]
+		if !isPresent {
+			s = &standInStream{groups: map[string]*standInGroup{}}
+			srv.streams[args[1]] = s
+		}
+		entry := &standInEntry{ms: uint64(time.Now().UnixNano() / int64(time.Millisecond))}
+		if entry.ms <= s.lastMs {
+			entry.ms = s.lastMs
+			entry.seq = s.lastSeq + 1
+		}
+		s.lastMs, s.lastSeq = entry.ms, entry.seq
+		for _, field := range args[3:] {
+			entry.fields = append(entry.fields, field)
+		}
+		s.entries = append(s.entries, entry)
+		return []byte(entry.id())
+	}
+
+	if name == "XGROUP" {
+		s, isPresent := srv.streams[args[2]]
+		if !isPresent {
+			return respError("ERR The XGROUP subcommand requires the key to exist")
+		}
+		if _, isPresent := s.groups[args[3]]; isPresent {
+			return respError("BUSYGROUP Consumer Group name already exists")
+		}
+		g := &standInGroup{pending: map[string]*standInPending{}}
+		if args[4] == "$" {
+			g.lastMs, g.lastSeq = s.lastMs, s.lastSeq
+		}
+		s.groups[args[3]] = g
+		return "OK"
+	}
+
+	s, isPresent := srv.streams[args[1]]
+	if !isPresent {
+		return respError("NOGROUP No such key or consumer group")
+	}
+
+	switch name {
+	case "XDEL":
+		for i, entry := range s.entries {
+			if entry.id() == args[2] {
+				s.entries = append(s.entries[:i], s.entries[i+1:]...)
+				return 1
+			}
+		}
+		return 0
+	}
+
+	g, isPresent := s.groups[args[2]]
+	if !isPresent {
+		return respError("NOGROUP No such key or consumer group")
+	}
+
+	switch name {
+	case "XACK":
+		if _, isPresent := g.pending[args[3]]; isPresent {
+			delete(g.pending, args[3])
+			return 1
+		}
+		return 0
+	case "XAUTOCLAIM":
+		minIdle, _ := strconv.Atoi(args[4])
+		ids := []string{}
+		for id, p := range g.pending {
+			if time.Since(p.delivered) >= time.Duration(minIdle)*time.Millisecond {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		entries := []interface{}{}
+		deleted := []interface{}{}
+		for _, id := range ids {
+			entry := s.find(id)
+			if entry == nil {
+				delete(g.pending, id)
+				deleted = append(deleted, id)
+				continue
+			}
+			if len(entries) == 0 {
+				g.pending[id] = &standInPending{consumer: args[3], delivered: time.Now(), count: g.pending[id].count + 1}
+				entries = append(entries, entry.reply())
+			}
+		}
+		return []interface{}{"0-0", entries, deleted}
+	case "XPENDING":
+		// Only the extended form using the range of a single ID is supported
+		entries := []interface{}{}
+		if p, isPresent := g.pending[args[3]]; isPresent && (len(args) < 7 || args[6] == p.consumer) {
+			entries = append(entries, []interface{}{args[3], p.consumer, int(time.Since(p.delivered) / time.Millisecond), p.count})
+		}
+		return entries
+	case "XCLAIM":
+		idle := time.Duration(0)
+		ids := []interface{}{}
+		for i := 5; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "IDLE":
+				ms, _ := strconv.Atoi(args[i+1])
+				idle = time.Duration(ms) * time.Millisecond
+				i++
+			case "JUSTID":
+			default:
+				ids = append(ids, args[i])
+			}
+		}
+		claimed := []interface{}{}
+		for _, id := range ids {
+			if p, isPresent := g.pending[id.(string)]; isPresent {
+				p.consumer = args[3]
+				p.delivered = time.Now().Add(-1 * idle)
+				claimed = append(claimed, id)
+			}
+		}
+		return claimed
+	}
+	return respError("ERR unknown command " + name)
+}
+
+// xreadgroup delivers the next message after the last delivered to the group waiting
+// for up to the block time for one to arrive
+//
+func (srv *redisStandIn) xreadgroup(args []string) (reply interface{}) {
+	group, consumer, block, stream := args[2], args[3], 0, args[len(args)-2]
+	for i, arg := range args {
+		if strings.ToUpper(arg) == "BLOCK" {
+			block, _ = strconv.Atoi(args[i+1])
+		}
+	}
+
+	deadline := time.Now().Add(time.Duration(block) * time.Millisecond)
+	for {
+		srv.Lock()
+		s, isPresent := srv.streams[stream]
+		if !isPresent {
+			srv.Unlock()
+			return respError("NOGROUP No such key or consumer group")
+		}
+		g, isPresent := s.groups[group]
+		if !isPresent {
+			srv.Unlock()
+			return respError("NOGROUP No such key or consumer group")
+		}
+		for _, entry := range s.entries {
+			if after(entry.ms, entry.seq, g.lastMs, g.lastSeq) {
+				g.lastMs, g.lastSeq = entry.ms, entry.seq
+				g.pending[entry.id()] = &standInPending{consumer: consumer, delivered: time.Now(), count: 1}
+				srv.Unlock()
+				return []interface{}{[]interface{}{stream, []interface{}{entry.reply()}}}
+			}
+		}
+		srv.Unlock()
+
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRedisQueue exercises the redis task queue against the stand-in server
+//
+func TestRedisQueue(t *testing.T) {
+
+	srv, errGo := newRedisStandIn("secret")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer srv.Close()
+
+	uri := fmt.Sprintf("redis://:secret@%s/0?group=test", srv.listener.Addr().String())
+
+	tq, err := NewTaskQueue(uri, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq, isRedis := tq.(*RedisQueue)
+	if !isRedis {
+		t.Fatal(fmt.Errorf("%s did not create a redis queue", uri))
+	}
+
+	bad, err := NewRedisQueue(fmt.Sprintf("redis://:wrong@%s", srv.listener.Addr().String()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bad.Refresh(nil, time.Second); err == nil {
+		t.Fatal(fmt.Errorf("an incorrect password was accepted"))
+	}
+
+	for _, msg := range []string{"first", "second"} {
+		if err = rq.Send("redis_test", []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rq.Send("other", []byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+
+	known, err := rq.Refresh(regexp.MustCompile("^redis_"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isPresent := known["redis_test"]; !isPresent || len(known) != 1 {
+		t.Fatal(fmt.Errorf("unexpected streams %v", known))
+	}
+
+	ctx := context.Background()
+
+	received := []string{}
+	handler := func(ack bool) MsgHandler {
+		return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+			received = append(received, string(data))
+			return &Resource{Cpus: "1"}, ack
+		}
+	}
+
+	// A message that is not acknowledged is redelivered ahead of newer messages
+	if cnt, rsc, err := rq.Work(ctx, time.Second, "redis_test", handler(false)); err != nil || cnt != 1 || rsc != nil {
+		t.Fatal(fmt.Errorf("unexpected nack result %d %v %v", cnt, rsc, err))
+	}
+	for i := 0; i != 2; i++ {
+		if cnt, rsc, err := rq.Work(ctx, time.Second, "redis_test", handler(true)); err != nil || cnt != 1 || rsc == nil {
+			t.Fatal(fmt.Errorf("unexpected ack result %d %v %v", cnt, rsc, err))
+		}
+	}
+	if strings.Join(received, ",") != "first,first,second" {
+		t.Fatal(fmt.Errorf("unexpected delivery order %v", received))
+	}
+	if pending := srv.pending("redis_test", "test"); len(pending) != 0 {
+		t.Fatal(fmt.Errorf("messages left pending %v", pending))
+	}
+
+	// A message read by a consumer that then goes away is reclaimed once it has been idle,
+	// and a consumer that is processing a message keeps it from being reclaimed
+	crashed, _ := NewRedisQueue(uri, "")
+	conn, err := crashed.attach(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rq.Send("redis_test", []byte("abandoned")); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, err := crashed.next(conn, "redis_test", time.Second); err != nil || len(id) == 0 {
+		t.Fatal(fmt.Errorf("message could not be read %v", err))
+	}
+	conn.Close()
+
+	rq.claimIdle = 300 * time.Millisecond
+	time.Sleep(rq.claimIdle)
+
+	other, _ := NewRedisQueue(uri, "")
+	other.claimIdle = rq.claimIdle
+
+	received = []string{}
+	// Connections are dropped part way through, the claims made after that must reconnect
+	slow := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+		received = append(received, string(data))
+		time.Sleep(rq.claimIdle / 2)
+		srv.drop()
+		time.Sleep(5 * rq.claimIdle / 2)
+		return nil, true
+	}
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		if cnt, _, err := rq.Work(ctx, time.Second, "redis_test", slow); err != nil || cnt != 1 {
+			t.Error(fmt.Errorf("abandoned message was not reclaimed %d %v", cnt, err))
+		}
+	}()
+
+	time.Sleep(2 * rq.claimIdle)
+	if cnt, _, err := other.Work(ctx, time.Second, "redis_test", handler(true)); err != nil || cnt != 0 {
+		t.Fatal(fmt.Errorf("message being processed was reclaimed %d %v", cnt, err))
+	}
+	<-doneC
+
+	if strings.Join(received, ",") != "abandoned" {
+		t.Fatal(fmt.Errorf("unexpected messages %v", received))
+	}
+
+	if exists, err := rq.Exists(ctx, "redis_test"); err != nil || !exists {
+		t.Fatal(fmt.Errorf("stream was not found %v", err))
+	}
+	conn, _ = rq.attach(time.Second)
+	conn.do(time.Second, "DEL", "redis_test")
+	conn.Close()
+	if exists, err := rq.Exists(ctx, "redis_test"); err != nil || exists {
+		t.Fatal(fmt.Errorf("deleted stream was found %v", err))
+	}
+}
+
+// TestRedisQueueGroups checks that a consumer does not take back a message that was reclaimed
+// by another consumer, and that acknowledged messages remain for other consumer groups
+//
+func TestRedisQueueGroups(t *testing.T) {
+
+	srv, errGo := newRedisStandIn("")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer srv.Close()
+
+	uri := fmt.Sprintf("redis://%s/0?group=first", srv.listener.Addr().String())
+	rq, err := NewRedisQueue(uri, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq.claimIdle = 300 * time.Millisecond
+
+	if err = rq.Send("redis_groups", []byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := rq.attach(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.do(time.Second, "XGROUP", "CREATE", "redis_groups", "second", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+		ids := srv.pending("redis_groups", "first")
+		if len(ids) != 1 {
+			t.Errorf("unexpected pending messages %v", ids)
+			return nil, true
+		}
+		// Another consumer reclaims the message, claims made after that must leave it alone
+		if _, err := conn.do(time.Second, "XCLAIM", "redis_groups", "first", "thief", "0", ids[0], "JUSTID"); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(rq.claimIdle)
+		if owner := srv.owner("redis_groups", "first", ids[0]); owner != "thief" {
+			t.Errorf("reclaimed message was taken back by %s", owner)
+		}
+		return nil, true
+	}
+	if cnt, _, err := rq.Work(context.Background(), time.Second, "redis_groups", handler); err != nil || cnt != 1 {
+		t.Fatalf("work failed %d %v", cnt, err)
+	}
+
+	// The message was acknowledged by the first group and must still be available to the second
+	second, err := NewRedisQueue(fmt.Sprintf("redis://%s/0?group=second", srv.listener.Addr().String()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := ""
+	if cnt, _, err := second.Work(context.Background(), time.Second, "redis_groups",
+		func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+			received = string(data)
+			return nil, true
+		}); err != nil || cnt != 1 || received != "shared" {
+		t.Fatalf("message was not delivered to the second group %d %s %v", cnt, received, err)
+	}
+}
+
+// TestRedisQueueRedial checks that a message is settled when the connection used to settle it
+// fails once, and that a worker whose redial keeps failing returns an error and leaves the message
+// pending for another consumer
+//
+func TestRedisQueueRedial(t *testing.T) {
+
+	srv, errGo := newRedisStandIn("secret")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer srv.Close()
+
+	rq, err := NewRedisQueue(fmt.Sprintf("redis://:secret@%s/0?group=redial", srv.listener.Addr().String()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"first", "second"} {
+		if err = rq.Send("redis_redial", []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	refusing := func(count int) MsgHandler {
+		return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (*Resource, bool) {
+			srv.refuse(count)
+			return &Resource{Cpus: "1"}, true
+		}
+	}
+
+	if cnt, rsc, err := rq.Work(context.Background(), time.Second, "redis_redial", refusing(1)); err != nil || cnt != 1 || rsc == nil {
+		t.Fatal(fmt.Errorf("message was not settled after a failed redial %d %v %v", cnt, rsc, err))
+	}
+	if pending := srv.pending("redis_redial", "redial"); len(pending) != 0 {
+		t.Fatal(fmt.Errorf("messages left pending %v", pending))
+	}
+
+	if cnt, _, err := rq.Work(context.Background(), time.Second, "redis_redial", refusing(2)); err == nil || cnt != 1 {
+		t.Fatal(fmt.Errorf("failed redials were not reported %d %v", cnt, err))
+	}
+	if pending := srv.pending("redis_redial", "redial"); len(pending) != 1 {
+		t.Fatal(fmt.Errorf("unsettled message is not pending %v", pending))
+	}
+}
@@ -13,60 +13,253 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
-
-	"github.com/dustin/go-humanize"
+	"strconv"
+	"strings"
 
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 )
 
+// Resource describes the resources needed by an experiment, or the resources available on
+// a machine.
+//
+// Cpus can be a whole or fractional number of cores or Kubernetes style millicores, for example
+// 500m.  Hdd, Ram, and GpuMem accept both humanize style strings, 6gb, and Kubernetes style
+// quantities, 16Gi.  The values are parsed once, when the resource is decoded or created, and
+// are available from the Quantities method.
+//
+// Cpus was once a whole number of cores, code that used it that way can use the Cores method.
+//
+// Constraints are tests applied to the labels of the node the experiment is to run on, for
+// example 'cuda.compute >= 7.0', please see labels.go for more information.
+//
 type Resource struct {
-	Cpus   uint   `json:"cpus"`
-	Gpus   uint   `json:"gpus"`
-	Hdd    string `json:"hdd"`
-	Ram    string `json:"ram"`
-	GpuMem string `json:"gpuMem"`
+	Cpus        string   `json:"cpus"`
+	Gpus        uint     `json:"gpus"`
+	Hdd         string   `json:"hdd"`
+	Ram         string   `json:"ram"`
+	GpuMem      string   `json:"gpuMem"`
+	Constraints []string `json:"constraints,omitempty"`
+
+	parsed *resourceCache
 }
 
-func (l *Resource) Fit(r *Resource) (didFit bool, err errors.Error) {
+// ResourceQuantities contains the exact values described by a Resource
+//
+type ResourceQuantities struct {
+	MilliCPU uint64
+	Gpus     uint
+	Hdd      uint64
+	Ram      uint64
+	GpuMem   uint64
+}
 
-	lRam, errGo := humanize.ParseBytes(l.Ram)
-	if errGo != nil {
-		return false, errors.New("left side RAM could not be parsed").With("stack", stack.Trace().TrimRuntime())
+// resourceCache holds the parsed quantities along with the strings they were parsed from
+// so that changes to the exported fields are detected
+//
+type resourceCache struct {
+	cpus   string
+	hdd    string
+	ram    string
+	gpuMem string
+	values ResourceQuantities
+}
+
+// NewResource produces a Resource from exact quantities, the string fields are
+// formatted without any loss of precision
+//
+func NewResource(values ResourceQuantities) (r *Resource) {
+	r = &Resource{
+		Cpus:   FormatCPU(values.MilliCPU),
+		Gpus:   values.Gpus,
+		Hdd:    FormatBytes(values.Hdd),
+		Ram:    FormatBytes(values.Ram),
+		GpuMem: FormatBytes(values.GpuMem),
 	}
+	r.cache(values)
+	return r
+}
 
-	rRam, errGo := humanize.ParseBytes(r.Ram)
-	if errGo != nil {
-		return false, errors.New("right side RAM could not be parsed").With("stack", stack.Trace().TrimRuntime())
+// cache records the parsed values of the resource, it is only called while the resource is
+// being created so that resources shared between goroutines are only ever read
+//
+func (l *Resource) cache(values ResourceQuantities) {
+	l.parsed = &resourceCache{
+		cpus:   l.Cpus,
+		hdd:    l.Hdd,
+		ram:    l.Ram,
+		gpuMem: l.GpuMem,
+		values: values,
 	}
+}
 
-	lHdd, errGo := humanize.ParseBytes(l.Hdd)
-	if errGo != nil {
-		return false, errors.New("left side Hdd could not be parsed").With("stack", stack.Trace().TrimRuntime())
+// Quantities returns the exact values of the resource, the string fields are only
+// parsed when they have changed since the resource was created.  Empty fields are
+// treated as zero.
+//
+func (l *Resource) Quantities() (values ResourceQuantities, err errors.Error) {
+	if c := l.parsed; c != nil && c.cpus == l.Cpus && c.hdd == l.Hdd && c.ram == l.Ram && c.gpuMem == l.GpuMem {
+		values = c.values
+		values.Gpus = l.Gpus
+		return values, nil
 	}
+	return l.parse()
+}
 
-	rHdd, errGo := humanize.ParseBytes(r.Hdd)
-	if errGo != nil {
-		return false, errors.New("right side Hdd could not be parsed").With("stack", stack.Trace().TrimRuntime())
+// Cores returns the number of whole cores needed to supply the cpus of the resource,
+// fractions of a core are rounded up.  Zero is returned when the cpus cannot be parsed.
+//
+func (l *Resource) Cores() (cores uint) {
+	values, err := l.Quantities()
+	if err != nil {
+		return 0
 	}
+	return uint((values.MilliCPU + 999) / 1000)
+}
 
-	lGpuMem, errGo := humanize.ParseBytes(l.GpuMem)
-	// GpuMem is optional so handle the case when it does not parse and is empty
+// parse converts the string fields of the resource into exact values
+//
+func (l *Resource) parse() (values ResourceQuantities, err errors.Error) {
+
+	values.Gpus = l.Gpus
+
+	var errGo error
+	if 0 != len(l.Cpus) {
+		if values.MilliCPU, errGo = ParseCPU(l.Cpus); errGo != nil {
+			return values, errors.Wrap(errGo, fmt.Sprintf("cpus could not be parsed '%s'", l.Cpus)).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if 0 != len(l.Ram) {
+		if values.Ram, errGo = ParseBytes(l.Ram); errGo != nil {
+			return values, errors.Wrap(errGo, fmt.Sprintf("ram could not be parsed '%s'", l.Ram)).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if 0 != len(l.Hdd) {
+		if values.Hdd, errGo = ParseBytes(l.Hdd); errGo != nil {
+			return values, errors.Wrap(errGo, fmt.Sprintf("hdd could not be parsed '%s'", l.Hdd)).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
 	if 0 != len(l.GpuMem) {
-		if errGo != nil {
-			return false, errors.New(fmt.Sprintf("left side gpuMem could not be parsed '%s'", l.GpuMem)).With("stack", stack.Trace().TrimRuntime())
+		if values.GpuMem, errGo = ParseBytes(l.GpuMem); errGo != nil {
+			return values, errors.Wrap(errGo, fmt.Sprintf("gpuMem could not be parsed '%s'", l.GpuMem)).With("stack", stack.Trace().TrimRuntime())
 		}
 	}
+	return values, nil
+}
+
+// UnmarshalJSON accepts the cpus value as either a JSON number or a string, the
+// value is normalized to whole cores, or millicores when fractional
+//
+func (l *Resource) UnmarshalJSON(data []byte) (errGo error) {
+	type plain Resource
+	rsc := struct {
+		*plain
+		Cpus json.RawMessage `json:"cpus"`
+	}{
+		plain: (*plain)(l),
+	}
+	if errGo = json.Unmarshal(data, &rsc); errGo != nil {
+		return errGo
+	}
 
-	rGpuMem, errGo := humanize.ParseBytes(r.GpuMem)
-	// GpuMem is optional so handle the case when it does not parse and is empty
-	if 0 != len(r.GpuMem) {
+	cpus := ""
+	if !isNull(rsc.Cpus) {
+		if errGo = json.Unmarshal(rsc.Cpus, &cpus); errGo != nil {
+			cpus = string(rsc.Cpus)
+		}
+	}
+	l.Cpus = ""
+	if 0 != len(cpus) {
+		milliCPU, errGo := ParseCPU(cpus)
 		if errGo != nil {
-			return false, errors.New(fmt.Sprintf("right side gpuMem could not be parsed '%s'", r.GpuMem)).With("stack", stack.Trace().TrimRuntime())
+			return fmt.Errorf("cpus could not be parsed '%s'", cpus)
+		}
+		l.Cpus = FormatCPU(milliCPU)
+	}
+	values, err := l.parse()
+	if err != nil {
+		return err
+	}
+	l.cache(values)
+	return nil
+}
+
+// MarshalJSON emits whole numbers of cores as a JSON number for compatibility with
+// existing clients and fractional cores as a millicore string
+//
+func (l Resource) MarshalJSON() (data []byte, errGo error) {
+	type plain Resource
+	rsc := struct {
+		plain
+		Cpus interface{} `json:"cpus"`
+	}{
+		plain: plain(l),
+		Cpus:  l.Cpus,
+	}
+	if cores, errGo := strconv.ParseUint(l.Cpus, 10, 64); errGo == nil {
+		rsc.Cpus = cores
+	} else if 0 == len(l.Cpus) {
+		rsc.Cpus = 0
+	}
+	return json.Marshal(rsc)
+}
+
+// Fit tests whether the resources described by the receiver fit within the resources of r
+//
+func (l *Resource) Fit(r *Resource) (didFit bool, err errors.Error) {
+
+	lValues, err := l.Quantities()
+	if err != nil {
+		return false, errors.Wrap(err, "left side could not be parsed").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	rValues, err := r.Quantities()
+	if err != nil {
+		return false, errors.Wrap(err, "right side could not be parsed").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	return lValues.MilliCPU <= rValues.MilliCPU && lValues.Gpus <= rValues.Gpus && lValues.Hdd <= rValues.Hdd &&
+		lValues.Ram <= rValues.Ram && lValues.GpuMem <= rValues.GpuMem, nil
+}
+
+// FitCount returns the number of copies of the resources described by the receiver that fit within
+// the resources of r, unbounded is true when the receiver needs no resources at all
+//
+func (l *Resource) FitCount(r *Resource) (copies uint64, unbounded bool, err errors.Error) {
+
+	lValues, err := l.Quantities()
+	if err != nil {
+		return 0, false, errors.Wrap(err, "left side could not be parsed").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	rValues, err := r.Quantities()
+	if err != nil {
+		return 0, false, errors.Wrap(err, "right side could not be parsed").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	unbounded = true
+	limit := func(need uint64, free uint64) {
+		if need == 0 {
+			return
+		}
+		if unbounded || free/need < copies {
+			copies = free / need
 		}
+		unbounded = false
 	}
+	limit(lValues.MilliCPU, rValues.MilliCPU)
+	limit(uint64(lValues.Gpus), uint64(rValues.Gpus))
+	limit(lValues.Hdd, rValues.Hdd)
+	limit(lValues.Ram, rValues.Ram)
+	limit(lValues.GpuMem, rValues.GpuMem)
 
-	return l.Cpus <= r.Cpus && l.Gpus <= r.Gpus && lHdd <= rHdd && lRam <= rRam && lGpuMem <= rGpuMem, nil
+	return copies, unbounded, nil
+}
+
+// Unmet returns the constraints of the resource that the node labels do not satisfy
+//
+func (l *Resource) Unmet(labels Labels) (unmet []string, err errors.Error) {
+	return labels.Unmet(l.Constraints)
 }
 
 func (l *Resource) Clone() (r *Resource) {
@@ -83,11 +276,14 @@ func (l *Resource) Clone() (r *Resource) {
 	if err := dec.Decode(r); err != nil {
 		return nil
 	}
+
+	// The parsed values are not encoded and so are shared, they are never modified once created
+	r.parsed = l.parsed
 	return r
 }
 
 type Config struct {
-	Cloud                  interface{}       `json:"cloud"`
+	Cloud                  *Cloud            `json:"cloud"`
 	Database               Database          `json:"database"`
 	SaveWorkspaceFrequency string            `json:"saveWorkspaceFrequency"`
 	Lifetime               string            `json:"experimentLifetime"`
@@ -99,6 +295,7 @@ type Config struct {
 
 type RunnerCustom struct {
 	SlackDest string `json:"slack_destination"`
+	ReplyTo   string `json:"reply_to"` // A queue, on the queue server the request arrived from, that lifecycle events are published to
 }
 
 type Database struct {
@@ -116,20 +313,20 @@ type Experiment struct {
 	Args               []string            `json:"args"`
 	Artifacts          map[string]Artifact `json:"artifacts"`
 	Filename           string              `json:"filename"`
-	Git                interface{}         `json:"git"`
+	Git                *Git                `json:"git"`
 	Info               Info                `json:"info"`
 	Key                string              `json:"key"`
-	Metric             interface{}         `json:"metric"`
-	Project            interface{}         `json:"project"`
+	Metric             *Metric             `json:"metric"`
+	Project            *Project            `json:"project"`
 	Pythonenv          []string            `json:"pythonenv"`
 	PythonVer          int64               `json:"pythonver"`
 	Resource           Resource            `json:"resources_needed"`
 	Status             string              `json:"status"`
 	TimeAdded          float64             `json:"time_added"`
 	MaxDuration        string              `json:"max_duration"`
-	TimeFinished       interface{}         `json:"time_finished"`
-	TimeLastCheckpoint interface{}         `json:"time_last_checkpoint"`
-	TimeStarted        interface{}         `json:"time_started"`
+	TimeFinished       *Timestamp          `json:"time_finished"`
+	TimeLastCheckpoint *Timestamp          `json:"time_last_checkpoint"`
+	TimeStarted        *Timestamp          `json:"time_started"`
 }
 
 type Request struct {
@@ -150,15 +347,45 @@ type Artifact struct {
 	Qualified string `json:"qualified"`
 }
 
+// UnmarshalRequest will validate a message against the request schema and then
+// extract the request it contains, for more information about validation see
+// ValidateRequest
+//
 func UnmarshalRequest(data []byte) (r *Request, err errors.Error) {
-	r = &Request{}
-	errGo := json.Unmarshal(data, r)
-	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+
+	r, report, err := ParseRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	if !report.Valid() {
+		return nil, errors.New("request failed validation").With("version", report.Version).
+			With("fields", strings.Join(report.Fields(), ", ")).With("stack", stack.Trace().TrimRuntime())
 	}
 	return r, nil
 }
 
+// ParseRequest validates a message against the request schema and, when it is valid, extracts
+// the request it contains.  The validation report is returned so that callers can report every
+// problem found with an invalid request, in which case the request is nil.
+//
+func ParseRequest(data []byte) (r *Request, report *ValidationReport, err errors.Error) {
+
+	if report, err = ValidateRequest(data); err != nil || !report.Valid() {
+		return nil, report, err
+	}
+
+	_, rqst, err := openEnvelope(data)
+	if err != nil {
+		return nil, report, err
+	}
+
+	r = &Request{}
+	if errGo := json.Unmarshal(rqst, r); errGo != nil {
+		return nil, report, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return r, report, nil
+}
+
 func (r *Request) Marshal() ([]byte, error) {
 	return json.Marshal(r)
 }
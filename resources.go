@@ -30,12 +30,12 @@ type Allocated struct {
 }
 
 type AllocRequest struct {
-	Group     string // Used to cluster together requests that can share some types of partitioned resources
-	MaxCPU    uint
-	MaxMem    uint64
-	MaxGPU    uint
-	MaxGPUMem uint64
-	MaxDisk   uint64
+	Group       string // Used to cluster together requests that can share some types of partitioned resources
+	MaxMilliCPU uint64
+	MaxMem      uint64
+	MaxGPU      uint
+	MaxGPUMem   uint64
+	MaxDisk     uint64
 }
 
 type Resources struct{}
@@ -91,7 +91,7 @@ func (*Resources) AllocResources(rqst AllocRequest) (alloc *Allocated, err error
 	}
 
 	// CPU resources next
-	if alloc.CPU, err = AllocCPU(rqst.MaxCPU, rqst.MaxMem); err != nil {
+	if alloc.CPU, err = AllocCPU(rqst.MaxMilliCPU, rqst.MaxMem); err != nil {
 		alloc.Release()
 		return nil, err
 	}
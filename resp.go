@@ -0,0 +1,198 @@
+package runner
+
+// This file contains a minimal client for the REdis Serialization Protocol (RESP) used by the
+// Redis task queue.  Only the request and reply handling needed by the queue is implemented,
+// commands being sent as arrays of bulk strings and replies decoded into go types.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// respError is an error reply sent by the server, it is returned as a reply value so that
+// callers can inspect expected errors, for example a consumer group already existing
+//
+type respError string
+
+// respConn is a single connection to a redis server, requests are serialized by the
+// connection allowing it to be shared by go routines
+//
+type respConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	sync.Mutex
+}
+
+// dialRESP connects to the server identified by a redis:// or rediss:// URI, authenticating and
+// selecting the database from the path when these are present in the URI
+//
+func dialRESP(uri *url.URL, timeout time.Duration) (c *respConn, err errors.Error) {
+
+	host := uri.Host
+	if len(uri.Port()) == 0 {
+		host = net.JoinHostPort(uri.Hostname(), "6379")
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var errGo error
+	if uri.Scheme == "rediss" {
+		conn, errGo = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: uri.Hostname()})
+	} else {
+		conn, errGo = dialer.Dial("tcp", host)
+	}
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("host", host)
+	}
+
+	c = &respConn{
+		conn: conn,
+		rd:   bufio.NewReader(conn),
+	}
+
+	if uri.User != nil {
+		args := []string{"AUTH"}
+		pass, hasPass := uri.User.Password()
+		if !hasPass {
+			// A lone user info field is treated as a password, as done by the redis cli
+			pass = uri.User.Username()
+		} else if len(uri.User.Username()) != 0 {
+			args = append(args, uri.User.Username())
+		}
+		if _, err = c.do(timeout, append(args, pass)...); err != nil {
+			c.Close()
+			return nil, err.With("host", host)
+		}
+	}
+
+	if db := strings.Trim(uri.Path, "/"); len(db) != 0 && db != "0" {
+		if _, err = c.do(timeout, "SELECT", db); err != nil {
+			c.Close()
+			return nil, err.With("host", host)
+		}
+	}
+
+	return c, nil
+}
+
+// Close releases the network connection
+//
+func (c *respConn) Close() {
+	c.conn.Close()
+}
+
+// send writes a command to the server and returns the reply which may be a respError
+//
+func (c *respConn) send(timeout time.Duration, args ...string) (reply interface{}, err errors.Error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if errGo := c.conn.SetDeadline(time.Now().Add(timeout)); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	cmd := strings.Builder{}
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, errGo := io.WriteString(c.conn, cmd.String()); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("command", args[0])
+	}
+
+	reply, errGo := readRESP(c.rd)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("command", args[0])
+	}
+	return reply, nil
+}
+
+// do writes a command to the server and returns the reply, error replies being returned as errors
+//
+func (c *respConn) do(timeout time.Duration, args ...string) (reply interface{}, err errors.Error) {
+	if reply, err = c.send(timeout, args...); err != nil {
+		return nil, err
+	}
+	if msg, isErr := reply.(respError); isErr {
+		return nil, errors.New(string(msg)).With("stack", stack.Trace().TrimRuntime()).With("command", args[0])
+	}
+	return reply, nil
+}
+
+// readRESP decodes a single reply, simple strings are returned as strings, bulk strings as
+// byte slices, integers as int64, arrays as slices of interface{}, and null values as nil
+//
+func readRESP(rd *bufio.Reader) (reply interface{}, errGo error) {
+	line, errGo := rd.ReadString('\n')
+	if errGo != nil {
+		return nil, errGo
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty RESP reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, errGo := strconv.Atoi(line[1:])
+		if errGo != nil {
+			return nil, errGo
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, errGo = io.ReadFull(rd, buf); errGo != nil {
+			return nil, errGo
+		}
+		return buf[:size], nil
+	case '*':
+		size, errGo := strconv.Atoi(line[1:])
+		if errGo != nil {
+			return nil, errGo
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], errGo = readRESP(rd); errGo != nil {
+				return nil, errGo
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown RESP reply type %q", line[0])
+}
+
+// respString converts simple and bulk string replies to a string
+//
+func respString(reply interface{}) (value string) {
+	switch v := reply.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return ""
+}
@@ -0,0 +1,461 @@
+package runner
+
+// This file contains the implementation of a versioned schema for requests
+// arriving from studioml queues along with a validator that checks every field
+// in a request before it is handed to the runner for processing.
+//
+// Messages can arrive in one of two forms.  The original studioml python clients
+// send a bare request document, these are treated as version 0 of the schema.
+// Newer clients wrap the request inside an envelope that carries an explicit version,
+// for example
+//
+//    {"version": 1, "request": {"config": {...}, "experiment": {...}}}
+//
+// The schema itself is available in JSON Schema form using RequestSchema so that
+// clients can validate their own documents before queuing them.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// RequestSchemaVersion is the most recent version of the request envelope understood by the runner
+	RequestSchemaVersion = 1
+)
+
+// RequestEnvelope is the versioned wrapper used by clients to send requests
+//
+type RequestEnvelope struct {
+	Version int             `json:"version"`
+	Request json.RawMessage `json:"request"`
+}
+
+// FieldError describes a single problem found with a field inside a request, the
+// field is described using a dotted path from the root of the request
+//
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ValidationReport contains the complete set of problems found within a request.  Warnings
+// describe problems that do not stop the request from being run, for example fields that are
+// not recognized within version 0 requests.
+//
+type ValidationReport struct {
+	Version  int          `json:"version"`
+	Errors   []FieldError `json:"errors"`
+	Warnings []FieldError `json:"warnings,omitempty"`
+}
+
+// Valid returns true when the validated request had no problems
+//
+func (report *ValidationReport) Valid() bool {
+	return report != nil && len(report.Errors) == 0
+}
+
+// Fields returns a human readable summary of the field level errors, one line per field
+//
+func (report *ValidationReport) Fields() (fields []string) {
+	return describeFields(report.Errors)
+}
+
+// WarningFields returns a human readable summary of the field level warnings, one line per field
+//
+func (report *ValidationReport) WarningFields() (fields []string) {
+	return describeFields(report.Warnings)
+}
+
+func describeFields(fieldErrs []FieldError) (fields []string) {
+	fields = make([]string, 0, len(fieldErrs))
+	for _, fieldErr := range fieldErrs {
+		fields = append(fields, fmt.Sprintf("%s: %s", fieldErr.Field, fieldErr.Reason))
+	}
+	return fields
+}
+
+func (report *ValidationReport) add(field string, reason string) {
+	report.Errors = append(report.Errors, FieldError{Field: field, Reason: reason})
+}
+
+func (report *ValidationReport) warn(field string, reason string) {
+	report.Warnings = append(report.Warnings, FieldError{Field: field, Reason: reason})
+}
+
+// schemaNode is a subset of the JSON Schema draft-07 vocabulary sufficient to describe
+// the requests the runner understands.  Formats not defined by JSON Schema, for example
+// duration and bytes, are validated by the runner and serve as documentation for others
+//
+type schemaNode struct {
+	Schema      string                 `json:"$schema,omitempty"`
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Type        []string               `json:"type,omitempty"`
+	Format      string                 `json:"format,omitempty"`
+	Minimum     *float64               `json:"minimum,omitempty"`
+	Properties  map[string]*schemaNode `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+	Additional  interface{}            `json:"additionalProperties,omitempty"`
+	Items       *schemaNode            `json:"items,omitempty"`
+
+	warnAdditional bool // Additional properties are allowed but reported as warnings
+}
+
+func typed(kinds ...string) *schemaNode {
+	return &schemaNode{Type: kinds}
+}
+
+func (node *schemaNode) format(format string) *schemaNode {
+	node.Format = format
+	return node
+}
+
+func (node *schemaNode) min(value float64) *schemaNode {
+	node.Minimum = &value
+	return node
+}
+
+func object(props map[string]*schemaNode, required []string, additional interface{}) *schemaNode {
+	return &schemaNode{
+		Type:       []string{"object"},
+		Properties: props,
+		Required:   required,
+		Additional: additional,
+	}
+}
+
+func arrayOf(items *schemaNode) *schemaNode {
+	return &schemaNode{Type: []string{"array", "null"}, Items: items}
+}
+
+// lenient allows an object to contain properties that are not described, each one being reported
+// as a warning
+//
+func (node *schemaNode) lenient() *schemaNode {
+	node.Additional = true
+	node.warnAdditional = true
+	return node
+}
+
+// requestSchema builds the schema for the specified version of the request format.
+//
+// Version 0 documents are produced by existing python clients that include a number of fields the
+// runner does not use, these are listed explicitly so that typing mistakes in the fields
+// that are used can still be detected.  Unknown fields in version 0 documents are reported as
+// warnings, as older clients can add fields of their own, while version 1 rejects them and is
+// also strict about the contents of the config block
+//
+func requestSchema(version int) (schema *schemaNode, err errors.Error) {
+
+	if version < 0 || version > RequestSchemaVersion {
+		return nil, errors.New("unsupported request schema version").With("version", version).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	resource := object(map[string]*schemaNode{
+		"cpus":        typed("number", "string").min(0).format("cpu"),
+		"gpus":        typed("integer").min(0),
+		"hdd":         typed("string").format("bytes"),
+		"ram":         typed("string").format("bytes"),
+		"gpuMem":      typed("string", "null").format("bytes"),
+		"constraints": arrayOf(typed("string").format("constraint")),
+	}, []string{"hdd", "ram"}, false)
+
+	artifact := object(map[string]*schemaNode{
+		"bucket":    typed("string", "null"),
+		"key":       typed("string", "null"),
+		"hash":      typed("string", "null"),
+		"local":     typed("string", "null"),
+		"mutable":   typed("boolean", "null"),
+		"unpack":    typed("boolean", "null"),
+		"qualified": typed("string", "null").format("uri"),
+	}, nil, false)
+
+	experiment := object(map[string]*schemaNode{
+		"args":                 arrayOf(typed("string")),
+		"artifacts":            object(nil, nil, artifact),
+		"filename":             typed("string", "null"),
+		"git":                  typed("object", "string", "null"),
+		"info":                 typed("object", "null"),
+		"key":                  typed("string"),
+		"metric":               typed("object", "string", "null"),
+		"owner":                typed("string", "null"),
+		"project":              typed("object", "string", "null"),
+		"pythonenv":            arrayOf(typed("string")),
+		"pythonver":            typed("integer", "null").min(0),
+		"resources_needed":     resource,
+		"status":               typed("string", "null"),
+		"time_added":           typed("number", "null"),
+		"max_duration":         typed("string", "null").format("duration"),
+		"time_finished":        typed("number", "string", "null").format("timestamp"),
+		"time_last_checkpoint": typed("number", "string", "null").format("timestamp"),
+		"time_started":         typed("number", "string", "null").format("timestamp"),
+	}, []string{"key", "resources_needed"}, false)
+
+	database := object(map[string]*schemaNode{
+		"apiKey":            typed("string", "null"),
+		"authDomain":        typed("string", "null"),
+		"databaseURL":       typed("string", "null"),
+		"messagingSenderId": typed("integer", "null"),
+		"projectId":         typed("string", "null"),
+		"storageBucket":     typed("string", "null"),
+		"type":              typed("string", "null"),
+		"use_email_auth":    typed("boolean", "null"),
+	}, nil, true)
+
+	config := object(map[string]*schemaNode{
+		"cloud":                  typed("object", "null"),
+		"database":               database,
+		"saveWorkspaceFrequency": typed("string", "null").format("duration"),
+		"experimentLifetime":     typed("string", "null").format("duration"),
+		"verbose":                typed("string", "null"),
+		"env":                    object(nil, nil, typed("string")),
+		"pip":                    arrayOf(typed("string")),
+		"runner": object(map[string]*schemaNode{
+			"slack_destination": typed("string", "null"),
+			"reply_to":          typed("string", "null"),
+		}, nil, false),
+	}, nil, true)
+
+	if version >= 1 {
+		// Blocks that are used by the python client and passed through by the runner are
+		// permitted but not inspected, everything else in the config is now checked
+		for _, opaque := range []string{"optimizer", "storage", "server", "resources_needed"} {
+			config.Properties[opaque] = typed()
+		}
+		config.Additional = false
+	} else {
+		for _, node := range []*schemaNode{resource, artifact, experiment, config.Properties["runner"]} {
+			node.lenient()
+		}
+	}
+
+	schema = object(map[string]*schemaNode{
+		"config":     config,
+		"experiment": experiment,
+	}, []string{"experiment"}, version == 0)
+
+	schema.Schema = "http://json-schema.org/draft-07/schema#"
+	schema.Title = fmt.Sprintf("studioml request version %d", version)
+
+	return schema, nil
+}
+
+// RequestSchema returns a JSON Schema document describing the requests the runner will accept
+// for the specified schema version
+//
+func RequestSchema(version int) (schema []byte, err errors.Error) {
+	node, err := requestSchema(version)
+	if err != nil {
+		return nil, err
+	}
+	schema, errGo := json.MarshalIndent(node, "", "  ")
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("version", version).With("stack", stack.Trace().TrimRuntime())
+	}
+	return schema, nil
+}
+
+// openEnvelope will examine a message and if it is wrapped in a versioned envelope will
+// return the version and the request contained within, otherwise the message is treated as
+// a version 0 request
+//
+func openEnvelope(data []byte) (version int, rqst []byte, err errors.Error) {
+
+	probe := map[string]json.RawMessage{}
+	if errGo := json.Unmarshal(data, &probe); errGo != nil {
+		return 0, nil, errors.Wrap(errGo, "request is not a JSON object").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if _, isPresent := probe["version"]; !isPresent {
+		return 0, data, nil
+	}
+
+	envelope := &RequestEnvelope{}
+	if errGo := json.Unmarshal(data, envelope); errGo != nil {
+		return 0, nil, errors.Wrap(errGo, "request envelope is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(envelope.Request) == 0 {
+		return envelope.Version, nil, errors.New("request envelope has no request").With("version", envelope.Version).With("stack", stack.Trace().TrimRuntime())
+	}
+	return envelope.Version, envelope.Request, nil
+}
+
+// ValidateRequest checks a message against the request schema and returns a report containing
+// all of the problems that were found.  An error is only returned if the message could not be
+// examined at all, for example when it is not JSON
+//
+func ValidateRequest(data []byte) (report *ValidationReport, err errors.Error) {
+
+	version, rqst, err := openEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+
+	report = &ValidationReport{
+		Version: version,
+		Errors:  []FieldError{},
+	}
+
+	schema, err := requestSchema(version)
+	if err != nil {
+		report.add("version", fmt.Sprintf("version %d is not supported, %d is the latest known version", version, RequestSchemaVersion))
+		return report, nil
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(rqst))
+	dec.UseNumber()
+	if errGo := dec.Decode(&doc); errGo != nil {
+		return nil, errors.Wrap(errGo, "request is not valid JSON").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	schema.validate("", doc, report)
+
+	return report, nil
+}
+
+func joinField(parent string, name string) string {
+	if len(parent) == 0 {
+		return name
+	}
+	return parent + "." + name
+}
+
+func jsonKind(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, errGo := strconv.ParseInt(v.String(), 10, 64); errGo == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func (node *schemaNode) accepts(kind string) bool {
+	if len(node.Type) == 0 {
+		return true
+	}
+	for _, aType := range node.Type {
+		if aType == kind || (aType == "number" && kind == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// validate walks the decoded JSON document alongside the schema adding any problems
+// found to the report
+//
+func (node *schemaNode) validate(field string, value interface{}, report *ValidationReport) {
+
+	kind := jsonKind(value)
+	if !node.accepts(kind) {
+		report.add(field, fmt.Sprintf("expected %s but found %s", strings.Join(node.Type, " or "), kind))
+		return
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		if node.Minimum != nil {
+			if f, errGo := v.Float64(); errGo == nil && f < *node.Minimum {
+				report.add(field, fmt.Sprintf("%s is below the minimum of %v", v.String(), *node.Minimum))
+			}
+		}
+	case string:
+		node.validateFormat(field, v, report)
+	case []interface{}:
+		if node.Items != nil {
+			for i, item := range v {
+				node.Items.validate(fmt.Sprintf("%s[%d]", field, i), item, report)
+			}
+		}
+	case map[string]interface{}:
+		node.validateObject(field, v, report)
+	}
+}
+
+func (node *schemaNode) validateFormat(field string, value string, report *ValidationReport) {
+	if len(value) == 0 {
+		return
+	}
+	switch node.Format {
+	case "bytes":
+		if _, errGo := ParseBytes(value); errGo != nil {
+			report.add(field, fmt.Sprintf("'%s' is not a valid quantity of bytes", value))
+		}
+	case "constraint":
+		if _, err := ParseConstraint(value); err != nil {
+			report.add(field, fmt.Sprintf("'%s' is not a valid constraint", value))
+		}
+	case "cpu":
+		if _, errGo := ParseCPU(value); errGo != nil {
+			report.add(field, fmt.Sprintf("'%s' is not a valid quantity of cpus", value))
+		}
+	case "duration":
+		if _, errGo := time.ParseDuration(value); errGo != nil {
+			report.add(field, fmt.Sprintf("'%s' is not a valid duration", value))
+		}
+	case "uri":
+		if _, errGo := url.ParseRequestURI(value); errGo != nil {
+			report.add(field, fmt.Sprintf("'%s' is not a valid URI", value))
+		}
+	case "timestamp":
+		if errGo := (&Timestamp{}).UnmarshalJSON([]byte(strconv.Quote(value))); errGo != nil {
+			report.add(field, fmt.Sprintf("'%s' is neither epoch seconds nor an RFC 3339 time", value))
+		}
+	}
+}
+
+func (node *schemaNode) validateObject(field string, value map[string]interface{}, report *ValidationReport) {
+
+	for _, name := range node.Required {
+		if item, isPresent := value[name]; !isPresent || item == nil {
+			report.add(joinField(field, name), "is required")
+		}
+	}
+
+	// Visit the fields in a consistent order so that reports are reproducible
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if prop, isPresent := node.Properties[name]; isPresent {
+			prop.validate(joinField(field, name), value[name], report)
+			continue
+		}
+		switch additional := node.Additional.(type) {
+		case *schemaNode:
+			additional.validate(joinField(field, name), value[name], report)
+		case bool:
+			if !additional {
+				report.add(joinField(field, name), "is not a recognized field")
+			} else if node.warnAdditional {
+				report.warn(joinField(field, name), "is not a recognized field")
+			}
+		}
+	}
+}
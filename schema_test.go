@@ -0,0 +1,157 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+)
+
+// This file contains tests for the request schema validation
+
+const (
+	validLegacyRqst = `{
+  "experiment": {
+    "key": "1530054412_70d7eaf4",
+    "filename": "train_cifar10.py",
+    "args": ["10"],
+    "owner": "guest",
+    "time_added": 1530054413.134781,
+    "time_started": null,
+    "max_duration": "20m",
+    "pythonver": 2,
+    "resources_needed": {"hdd": "3gb", "gpus": 1, "ram": "2gb", "cpus": 1, "gpuMem": "4gb"},
+    "artifacts": {
+      "output": {"bucket": "b", "key": "k", "qualified": "s3://host/b/k", "mutable": true, "unpack": true}
+    }
+  },
+  "config": {
+    "experimentLifetime": "30m",
+    "optimizer": {"visualization": true},
+    "env": {"PATH": "%PATH%:./bin"},
+    "runner": {"slack_destination": "@someone"}
+  }
+}`
+)
+
+func TestValidateLegacy(t *testing.T) {
+	report, err := ValidateRequest([]byte(validLegacyRqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() {
+		t.Fatal(strings.Join(report.Fields(), ", "))
+	}
+	if report.Version != 0 {
+		t.Fatalf("unexpected version %d", report.Version)
+	}
+
+	if _, err = UnmarshalRequest([]byte(validLegacyRqst)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateFieldErrors(t *testing.T) {
+	rqst := strings.Replace(validLegacyRqst, `"resources_needed"`, `"resources_neded"`, 1)
+	rqst = strings.Replace(rqst, `"20m"`, `"20 minutes"`, 1)
+	rqst = strings.Replace(rqst, `"PATH": "%PATH%:./bin"`, `"PATH": 1`, 1)
+
+	report, err := ValidateRequest([]byte(rqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"experiment.resources_needed",
+		"experiment.max_duration",
+		"config.env.PATH",
+	}
+	found := map[string]bool{}
+	for _, fieldErr := range report.Errors {
+		found[fieldErr.Field] = true
+	}
+	for _, field := range expected {
+		if !found[field] {
+			t.Fatalf("%s was not reported in %s", field, strings.Join(report.Fields(), ", "))
+		}
+	}
+	if len(report.Errors) != len(expected) {
+		t.Fatalf("unexpected errors reported %s", strings.Join(report.Fields(), ", "))
+	}
+
+	// Version 0 requests can contain fields the runner does not know, these are warnings
+	if len(report.Warnings) != 1 || report.Warnings[0].Field != "experiment.resources_neded" {
+		t.Fatalf("unexpected warnings reported %s", strings.Join(report.WarningFields(), ", "))
+	}
+
+	if _, err = UnmarshalRequest([]byte(rqst)); err == nil {
+		t.Fatal("invalid request was accepted")
+	}
+
+	// Parsing returns the same report without a request
+	r, parsed, err := ParseRequest([]byte(rqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != nil || len(parsed.Errors) != len(expected) {
+		t.Fatalf("invalid request was parsed %v %s", r, strings.Join(parsed.Fields(), ", "))
+	}
+}
+
+func TestValidateEnvelope(t *testing.T) {
+	rqst := `{"version": 1, "request": ` + validLegacyRqst + `}`
+
+	report, err := ValidateRequest([]byte(rqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() || report.Version != 1 {
+		t.Fatalf("envelope version %d was rejected %s", report.Version, strings.Join(report.Fields(), ", "))
+	}
+
+	r, err := UnmarshalRequest([]byte(rqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Experiment.Key != "1530054412_70d7eaf4" {
+		t.Fatalf("unexpected experiment key %s", r.Experiment.Key)
+	}
+
+	// Version 1 rejects the unknown fields that version 0 only warns about
+	rqst = strings.Replace(rqst, `"gpuMem"`, `"gpuMemory"`, 1)
+	if report, err = ValidateRequest([]byte(rqst)); err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() || len(report.Warnings) != 0 {
+		t.Fatalf("unknown resource field was accepted in a version 1 request %s", strings.Join(report.Fields(), ", "))
+	}
+	if legacy, _ := ValidateRequest([]byte(strings.Replace(validLegacyRqst, `"gpuMem"`, `"gpuMemory"`, 1))); !legacy.Valid() || len(legacy.Warnings) != 1 {
+		t.Fatalf("unknown resource field was not a warning in a version 0 request %s", strings.Join(legacy.Fields(), ", "))
+	}
+
+	// Version 1 no longer allows unknown fields inside the config block
+	rqst = `{"version": 1, "request": ` + strings.Replace(validLegacyRqst, `"verbose"`, `"verbos"`, 1) + `}`
+	rqst = strings.Replace(rqst, `"experimentLifetime"`, `"experimentLifetme"`, 1)
+	if report, err = ValidateRequest([]byte(rqst)); err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() {
+		t.Fatal("unknown config field was accepted in a version 1 request")
+	}
+
+	if report, err = ValidateRequest([]byte(`{"version": 99, "request": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() {
+		t.Fatal("unknown envelope version was accepted")
+	}
+}
+
+func TestRequestSchema(t *testing.T) {
+	for version := 0; version <= RequestSchemaVersion; version++ {
+		if _, err := RequestSchema(version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := RequestSchema(RequestSchemaVersion + 1); err == nil {
+		t.Fatal("schema for an unknown version was produced")
+	}
+}
@@ -0,0 +1,208 @@
+package runner
+
+// This file contains the implementation of encrypted environment variable values
+// that clients can place into the env section of a request.
+//
+// Clients encrypt values to the public key of the runners that will process their
+// work.  An ephemeral curve25519 key is used with the runners public key to derive
+// a shared AES-256-GCM key, the name of the environment variable is used as additional
+// authenticated data so that encrypted values cannot be moved between variables.
+// Encrypted values have the following form
+//
+//    encrypted:<base64 of ephemeral public key | nonce | ciphertext>
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// EncryptedEnvPrefix marks environment variable values that have been encrypted
+	EncryptedEnvPrefix = "encrypted:"
+
+	envKeyLabel = "studioml-env-v1"
+	envKeySize  = 32
+)
+
+// EnvKey contains the curve25519 key pair a runner uses to decrypt environment variable values
+//
+type EnvKey struct {
+	private [envKeySize]byte
+	public  [envKeySize]byte
+}
+
+// NewEnvKey generates a new key pair
+//
+func NewEnvKey() (key *EnvKey, err errors.Error) {
+	key = &EnvKey{}
+	if _, errGo := io.ReadFull(rand.Reader, key.private[:]); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	curve25519.ScalarBaseMult(&key.public, &key.private)
+	return key, nil
+}
+
+// LoadEnvKey reads a base64 encoded curve25519 private key from the named file
+//
+func LoadEnvKey(fn string) (key *EnvKey, err errors.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	raw, errGo := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, "private key was not base64 encoded").With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	if len(raw) != envKeySize {
+		return nil, errors.New("private key has the wrong length").With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+
+	key = &EnvKey{}
+	copy(key.private[:], raw)
+	curve25519.ScalarBaseMult(&key.public, &key.private)
+	return key, nil
+}
+
+// PrivateKey returns the base64 encoded private key, suitable for saving to a file that LoadEnvKey can read
+//
+func (key *EnvKey) PrivateKey() string {
+	return base64.StdEncoding.EncodeToString(key.private[:])
+}
+
+// PublicKey returns the base64 encoded public key that clients use to encrypt values
+//
+func (key *EnvKey) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(key.public[:])
+}
+
+// IsEncryptedEnvValue tests an environment variable value to see if it is encrypted
+//
+func IsEncryptedEnvValue(value string) bool {
+	return strings.HasPrefix(value, EncryptedEnvPrefix)
+}
+
+func envCipher(shared *[envKeySize]byte, ephemeral *[envKeySize]byte, public *[envKeySize]byte) (aead cipher.AEAD, err errors.Error) {
+
+	// A shared secret of all zeros indicates a low order point was supplied
+	if bytes.Equal(shared[:], make([]byte, envKeySize)) {
+		return nil, errors.New("invalid key exchange").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(envKeyLabel))
+	hash.Write(shared[:])
+	hash.Write(ephemeral[:])
+	hash.Write(public[:])
+
+	block, errGo := aes.NewCipher(hash.Sum(nil))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if aead, errGo = cipher.NewGCM(block); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return aead, nil
+}
+
+// EncryptEnvValue is used by clients to encrypt the value of the named environment variable
+// using the base64 encoded public key of a runner
+//
+func EncryptEnvValue(publicKey string, name string, value string) (encrypted string, err errors.Error) {
+
+	raw, errGo := base64.StdEncoding.DecodeString(publicKey)
+	if errGo != nil || len(raw) != envKeySize {
+		return "", errors.New("public key was not a base64 encoded curve25519 key").With("stack", stack.Trace().TrimRuntime())
+	}
+	public := [envKeySize]byte{}
+	copy(public[:], raw)
+
+	ephemeral, err := NewEnvKey()
+	if err != nil {
+		return "", err
+	}
+
+	shared := [envKeySize]byte{}
+	curve25519.ScalarMult(&shared, &ephemeral.private, &public)
+
+	aead, err := envCipher(&shared, &ephemeral.public, &public)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, errGo = io.ReadFull(rand.Reader, nonce); errGo != nil {
+		return "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sealed := append(append(ephemeral.public[:], nonce...), aead.Seal(nil, nonce, []byte(value), []byte(name))...)
+
+	return EncryptedEnvPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptEnvValue extracts the plain text for the named environment variable.  Errors
+// never contain the value being decrypted.
+//
+func (key *EnvKey) DecryptEnvValue(name string, encrypted string) (value string, err errors.Error) {
+
+	if !IsEncryptedEnvValue(encrypted) {
+		return "", errors.New("value is not encrypted").With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sealed, errGo := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted, EncryptedEnvPrefix))
+	if errGo != nil {
+		return "", errors.New("encrypted value was not base64 encoded").With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(sealed) < envKeySize {
+		return "", errors.New("encrypted value is truncated").With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	ephemeral := [envKeySize]byte{}
+	copy(ephemeral[:], sealed[:envKeySize])
+
+	shared := [envKeySize]byte{}
+	curve25519.ScalarMult(&shared, &key.private, &ephemeral)
+
+	aead, err := envCipher(&shared, &ephemeral, &key.public)
+	if err != nil {
+		return "", err.With("name", name)
+	}
+
+	sealed = sealed[envKeySize:]
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is truncated").With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	plain, errGo := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if errGo != nil {
+		return "", errors.New("value could not be decrypted, the wrong key may have been used").With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	return string(plain), nil
+}
+
+// secretsEnv returns the environment of the runner with the decrypted env values of an
+// experiment added.  Decrypted values are passed to experiments this way rather than using the
+// generated scripts as the scripts echo their contents into the experiment output.
+//
+func secretsEnv(secrets map[string]string, prefixes ...string) (env []string) {
+	env = os.Environ()
+	for k, v := range secrets {
+		env = append(env, k+"="+v)
+		for _, prefix := range prefixes {
+			env = append(env, prefix+k+"="+v)
+		}
+	}
+	return env
+}
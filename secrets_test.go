@@ -0,0 +1,148 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// This file contains tests for the encryption of environment variable values
+
+func TestEncryptedEnv(t *testing.T) {
+
+	key, err := NewEnvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Round trip the private key through a file the way the runner will load it
+	dir, errGo := ioutil.TempDir("", "env-key")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "env.key")
+	if errGo = ioutil.WriteFile(fn, []byte(key.PrivateKey()+"\n"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	loaded, err := LoadEnvKey(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.PublicKey() != key.PublicKey() {
+		t.Fatal("loaded key did not match the generated key")
+	}
+
+	secret := "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+	encrypted, err := EncryptEnvValue(key.PublicKey(), "AWS_SECRET_ACCESS_KEY", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedEnvValue(encrypted) || strings.Contains(encrypted, secret) {
+		t.Fatalf("value %s was not encrypted", encrypted)
+	}
+
+	plain, err := loaded.DecryptEnvValue("AWS_SECRET_ACCESS_KEY", encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != secret {
+		t.Fatal("decrypted value did not match")
+	}
+
+	// The value must not be usable under another name, or with another key
+	if _, err = loaded.DecryptEnvValue("AWS_ACCESS_KEY_ID", encrypted); err == nil {
+		t.Fatal("value was decrypted using the wrong name")
+	}
+	other, err := NewEnvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.DecryptEnvValue("AWS_SECRET_ACCESS_KEY", encrypted); err == nil {
+		t.Fatal("value was decrypted using the wrong key")
+	}
+	if err != nil && strings.Contains(err.Error(), secret) {
+		t.Fatal("error exposed the secret")
+	}
+}
+
+// TestSecretsNotLogged checks that decrypted env values reach the experiment using its process
+// environment and appear in neither the generated script nor the output log of the experiment
+//
+func TestSecretsNotLogged(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "env-secrets")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	if errGo = os.MkdirAll(filepath.Join(dir, "output"), 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	// Quotes, expansions and backticks would break, or be run by, a script holding the value
+	secret := `pa"ss$(echo injected)` + "`id`"
+	rqst := &Request{
+		Config: Config{
+			Env: map[string]string{"STUDIO_SECRET": EncryptedEnvPrefix + "opaque"},
+		},
+		Experiment: Experiment{Key: "secrets", Filename: "experiment.py"},
+	}
+
+	ve, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := struct {
+		Request    *Request
+		ExprEnvs   map[string]string
+		RootDir    string
+		ExprDir    string
+		ExprSubDir string
+	}{
+		Request:  rqst,
+		ExprEnvs: map[string]string{"STUDIO_PLAIN": "visible"},
+		RootDir:  dir,
+		ExprDir:  dir,
+	}
+	if err = ve.Make(&Allocated{}, e); err != nil {
+		t.Fatal(err)
+	}
+
+	script, errGo := ioutil.ReadFile(ve.Script)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if strings.Contains(string(script), secret) || strings.Contains(string(script), "STUDIO_SECRET") {
+		t.Fatal("generated script contains the secret")
+	}
+
+	// The generated script installs python packages, so a script that traces itself in the same
+	// way is used to check that the value reaches the experiment, only a digest of it is output
+	traced := "#!/bin/bash -x\nset -v\nexport | grep -c STUDIO_SECRET\nprintenv STUDIO_SECRET | tr -d '\\n' | sha256sum\n"
+	if errGo = ioutil.WriteFile(ve.Script, []byte(traced), 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if err = ve.Run(context.Background(), map[string]Artifact{}, map[string]string{"STUDIO_SECRET": secret}); err != nil {
+		t.Fatal(err)
+	}
+
+	output, errGo := ioutil.ReadFile(filepath.Join(dir, "output", "output"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if strings.Contains(string(output), secret) || strings.Contains(string(output), "injected") {
+		t.Fatalf("output log contains the secret %s", string(output))
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if !strings.Contains(string(output), hex.EncodeToString(sum[:])) {
+		t.Fatalf("experiment did not receive the secret %s", string(output))
+	}
+}
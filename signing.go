@@ -0,0 +1,189 @@
+package runner
+
+// This file contains the implementation of signed message envelopes that allow
+// runners to verify that experiments were queued by a trusted client.
+//
+// A signed message wraps the original message, either a bare request or a versioned
+// request envelope, using the following JSON form
+//
+//    {"key_id": "...", "signature": "<base64>", "payload": "<base64>"}
+//
+// The signature is an ed25519 signature of the raw payload bytes.  Runners locate the
+// public key used to verify the signature using the key_id within a directory of
+// trusted keys, one key per file with the file name, minus any extension, being the key_id.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// SignedEnvelope is used to carry a signed message across a queue
+//
+type SignedEnvelope struct {
+	KeyID     string `json:"key_id"`
+	Signature []byte `json:"signature"`
+	Payload   []byte `json:"payload"`
+}
+
+// TrustedKeys is a catalog of the public keys that a runner will accept signatures from
+//
+type TrustedKeys struct {
+	dir  string
+	keys map[string]ed25519.PublicKey
+	sync.Mutex
+}
+
+// SignMsg is used by clients to wrap a message in a signed envelope using their private key
+//
+func SignMsg(keyID string, key ed25519.PrivateKey, payload []byte) (msg []byte, err errors.Error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid ed25519 private key").With("key_id", keyID).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	msg, errGo := json.Marshal(&SignedEnvelope{
+		KeyID:     keyID,
+		Signature: ed25519.Sign(key, payload),
+		Payload:   payload,
+	})
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("key_id", keyID).With("stack", stack.Trace().TrimRuntime())
+	}
+	return msg, nil
+}
+
+// OpenSignedMsg will examine a message and if it is a signed envelope return its contents
+// without verifying the signature.  Messages that are not signed are returned unchanged.
+//
+func OpenSignedMsg(msg []byte) (envelope *SignedEnvelope, payload []byte, err errors.Error) {
+	probe := map[string]json.RawMessage{}
+	if errGo := json.Unmarshal(msg, &probe); errGo != nil {
+		return nil, nil, errors.Wrap(errGo, "message is not a JSON object").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	_, hasSig := probe["signature"]
+	_, hasPayload := probe["payload"]
+	if !hasSig || !hasPayload {
+		return nil, msg, nil
+	}
+
+	envelope = &SignedEnvelope{}
+	if errGo := json.Unmarshal(msg, envelope); errGo != nil {
+		return nil, nil, errors.Wrap(errGo, "signed envelope is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+	return envelope, envelope.Payload, nil
+}
+
+// NewTrustedKeys loads the public keys found within the specified directory, the
+// directory can be reloaded at a later time using the Refresh method
+//
+func NewTrustedKeys(dir string) (keys *TrustedKeys, err errors.Error) {
+	keys = &TrustedKeys{
+		dir:  dir,
+		keys: map[string]ed25519.PublicKey{},
+	}
+	return keys, keys.Refresh()
+}
+
+// parsePublicKey accepts either a base64 encoded raw ed25519 public key, or an
+// OpenSSH authorized_keys style ssh-ed25519 line
+//
+func parsePublicKey(data []byte) (key ed25519.PublicKey, err errors.Error) {
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte("ssh-ed25519")) {
+		sshKey, _, _, _, errGo := ssh.ParseAuthorizedKey(data)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		cryptoKey, isCrypto := sshKey.(ssh.CryptoPublicKey)
+		if !isCrypto {
+			return nil, errors.New("ssh key could not be converted").With("stack", stack.Trace().TrimRuntime())
+		}
+		key, isEd := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+		if !isEd {
+			return nil, errors.New("ssh key was not an ed25519 key").With("stack", stack.Trace().TrimRuntime())
+		}
+		return key, nil
+	}
+
+	raw, errGo := base64.StdEncoding.DecodeString(string(data))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, "public key was not base64 encoded").With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New(fmt.Sprintf("public key was %d bytes, expected %d", len(raw), ed25519.PublicKeySize)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Refresh will reload the public keys from the trusted keys directory.  Should any of the key
+// files be invalid the previously loaded keys are retained and an error returned.
+//
+func (tk *TrustedKeys) Refresh() (err errors.Error) {
+
+	files, errGo := ioutil.ReadDir(tk.dir)
+	if errGo != nil {
+		return errors.Wrap(errGo, "could not load trusted keys").With("stack", stack.Trace().TrimRuntime()).With("dir", tk.dir)
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(files))
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		fn := filepath.Join(tk.dir, file.Name())
+		data, errGo := ioutil.ReadFile(fn)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+		}
+		key, err := parsePublicKey(data)
+		if err != nil {
+			return err.With("file", fn)
+		}
+		keys[strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))] = key
+	}
+
+	tk.Lock()
+	tk.keys = keys
+	tk.Unlock()
+
+	return nil
+}
+
+// Verify checks that a message is a signed envelope that was signed using one of the trusted keys.
+// If so the payload is returned along with the ID of the key that signed it.
+//
+func (tk *TrustedKeys) Verify(msg []byte) (payload []byte, keyID string, err errors.Error) {
+
+	envelope, payload, err := OpenSignedMsg(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	if envelope == nil {
+		return nil, "", errors.New("message was not signed").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	tk.Lock()
+	key, isPresent := tk.keys[envelope.KeyID]
+	tk.Unlock()
+
+	if !isPresent {
+		return nil, envelope.KeyID, errors.New("message was signed with an untrusted key").With("key_id", envelope.KeyID).With("stack", stack.Trace().TrimRuntime())
+	}
+	if !ed25519.Verify(key, payload, envelope.Signature) {
+		return nil, envelope.KeyID, errors.New("message signature is invalid").With("key_id", envelope.KeyID).With("stack", stack.Trace().TrimRuntime())
+	}
+	return payload, envelope.KeyID, nil
+}
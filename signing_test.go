@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// This file contains tests for the signing and verification of queued messages
+
+func TestSignedMsgs(t *testing.T) {
+
+	pub, priv, errGo := ed25519.GenerateKey(rand.Reader)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	_, untrusted, errGo := ed25519.GenerateKey(rand.Reader)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	dir, errGo := ioutil.TempDir("", "trusted-keys")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	if errGo = ioutil.WriteFile(filepath.Join(dir, "ops.pub"), []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	keys, err := NewTrustedKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := SignMsg("ops", priv, []byte(validLegacyRqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, keyID, err := keys.Verify(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "ops" || string(payload) != validLegacyRqst {
+		t.Fatalf("unexpected key %s or payload", keyID)
+	}
+
+	// Tamper with the payload after signing
+	tampered, err := SignMsg("ops", priv, []byte(validLegacyRqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, _, err := OpenSignedMsg(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedPayload := strings.Replace(validLegacyRqst, "train_cifar10.py", "evil.py", 1)
+	envelope.Payload = []byte(tamperedPayload)
+	if _, _, err = keys.Verify([]byte(`{"key_id": "ops", "signature": "` + base64.StdEncoding.EncodeToString(envelope.Signature) +
+		`", "payload": "` + base64.StdEncoding.EncodeToString(envelope.Payload) + `"}`)); err == nil {
+		t.Fatal("tampered message was accepted")
+	}
+
+	// A message signed by a key that is not trusted, and one that is not signed
+	other, err := SignMsg("ops", untrusted, []byte(validLegacyRqst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = keys.Verify(other); err == nil {
+		t.Fatal("message signed by an untrusted key was accepted")
+	}
+	if _, _, err = keys.Verify([]byte(validLegacyRqst)); err == nil {
+		t.Fatal("unsigned message was accepted")
+	}
+}
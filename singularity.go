@@ -118,9 +118,6 @@ ai.sentient.maintainer Karl Mutch
 ai.sentient.version 0.0
 
 %post
-{{range $key, $value := .E.Request.Config.Env}}
-    echo 'export {{$key}}="{{$value}}"' >> $SINGULARITY_ENVIRONMENT
-{{end}}
 {{range $key, $value := .E.ExprEnvs}}
     echo 'export {{$key}}="{{$value}}"' >> $SINGULARITY_ENVIRONMENT
 {{end}}
@@ -226,7 +223,7 @@ func (s *Singularity) runBuildScript(script string) (err errors.Error) {
 		}
 	}()
 
-	return runWait(ctx, script, filepath.Join(s.BaseDir, "_runner"), outputFN, reporterC)
+	return runWait(ctx, script, filepath.Join(s.BaseDir, "_runner"), outputFN, nil, reporterC)
 }
 
 func (s *Singularity) makeExecScript(e interface{}) (fn string, err errors.Error) {
@@ -288,9 +285,10 @@ func (s *Singularity) Make(alloc *Allocated, e interface{}) (err errors.Error) {
 
 // Run will use a generated script file and will run it to completion while marshalling
 // results and files from the computation.  Run is a blocking call and will only return
-// upon completion or termination of the process it starts
+// upon completion or termination of the process it starts.  secrets are added to the
+// environment of the container and are not built into the image.
 //
-func (s *Singularity) Run(ctx context.Context, refresh map[string]Artifact) (err errors.Error) {
+func (s *Singularity) Run(ctx context.Context, refresh map[string]Artifact, secrets map[string]string) (err errors.Error) {
 
 	outputFN := filepath.Join(s.BaseDir, "output", "output")
 	script := filepath.Join(s.BaseDir, "_runner", "exec.sh")
@@ -312,16 +310,19 @@ func (s *Singularity) Run(ctx context.Context, refresh map[string]Artifact) (err
 		}
 	}()
 
-	return runWait(ctx, script, filepath.Join(s.BaseDir, "_runner"), outputFN, reporterC)
+	return runWait(ctx, script, filepath.Join(s.BaseDir, "_runner"), outputFN, secrets, reporterC)
 }
 
-func runWait(ctx context.Context, script string, dir string, outputFN string, errorC chan *string) (err errors.Error) {
+func runWait(ctx context.Context, script string, dir string, outputFN string, secrets map[string]string, errorC chan *string) (err errors.Error) {
 
 	// Move to starting the process that we will monitor with the experiment running within
 	// it
 	//
 	cmd := exec.Command("/bin/bash", "-c", script)
 	cmd.Dir = dir
+	// Singularity also sets variables carrying the SINGULARITYENV_ prefix within containers
+	// that do not inherit the environment of the host
+	cmd.Env = secretsEnv(secrets, "SINGULARITYENV_")
 
 	stdout, errGo := cmd.StdoutPipe()
 	if errGo != nil {
@@ -372,7 +373,7 @@ func runWait(ctx context.Context, script string, dir string, outputFN string, er
 		}
 	}(f, outC, errC, stopCP)
 
-	if errGo = cmd.Start(); err != nil {
+	if errGo = cmd.Start(); errGo != nil {
 		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -426,7 +427,7 @@ func runWait(ctx context.Context, script string, dir string, outputFN string, er
 	done.Wait()
 	close(stopCP)
 
-	if errGo = cmd.Wait(); err != nil {
+	if errGo = cmd.Wait(); errGo != nil {
 		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
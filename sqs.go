@@ -5,62 +5,256 @@ package runner
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
+
+	"github.com/rs/xid"
 )
 
 var (
 	sqsTimeoutOpt = flag.Duration("sqs-timeout", time.Duration(15*time.Second), "the period of time for discrete SQS operations to use for timeouts")
+	sqsWaitOpt    = flag.Duration("sqs-wait", time.Duration(20*time.Second), "the period of time SQS receive requests long-poll for messages, limited to 20 seconds by SQS and to the queue timeout of the runner")
+)
+
+const (
+	// sqsMaxWait is the longest wait SQS allows for a receive request
+	sqsMaxWait = 20 * time.Second
+
+	// sqsDefaultGroup is the group used for messages sent to FIFO queues without a group of their own
+	sqsDefaultGroup = "studioml"
+
+	// sqsHoldbackRetention is how long the held back receives of a message are remembered after
+	// it was last held back
+	sqsHoldbackRetention = time.Hour
 )
 
+var (
+	// sqsGroups holds the groups of FIFO queues with a message being handled on this host
+	sqsGroups = &sqsGroupsInFlight{
+		groups:    map[string]bool{},
+		holdbacks: map[string]int{},
+		heldAt:    map[string]time.Time{},
+	}
+)
+
+func init() {
+	RegisterTaskQueue("sqs", func(uri string, creds string) (tq TaskQueue, err errors.Error) {
+		return NewSQS(uri, creds)
+	})
+}
+
 type SQS struct {
-	project string
-	creds   *AWSCred
+	project  string
+	creds    *AWSCred
+	profile  string                      // The profile used from the shared AWS config and credentials files
+	queue    string                      // The name of the only queue to be used, empty when all matching queues are used
+	sessions map[string]*session.Session // Sessions for each region, created on first use and then reused
+	sync.Mutex
 }
 
-func NewSQS(project string, creds string) (sqs *SQS, err errors.Error) {
-	// Use the creds directory to locate all of the credentials for AWS within
-	// a hierarchy of directories
+// NewSQS creates a task queue using an sqs://region/queue?profile=name URI.  The queue is optional
+// and when absent all queues in the region are candidates for work.  Credentials are taken from the
+// comma separated AWS credential and config files in creds, or when no files are supplied from the
+// named, or default, profile of the shared AWS files.  The project query parameter can be used to
+// name the queues in logs and messages, defaulting to aws_ and the directory, or profile, name.
+//
+// The regions query parameter adds a comma separated list of regions whose queues are also used,
+// along with any regions listed in the config file.  The endpoint query parameter replaces the AWS
+// endpoint, and that of the config file, for example to use a local SQS compatible stand-in.
+//
+func NewSQS(uri string, creds string) (sq *SQS, err errors.Error) {
+
+	parsed, errGo := url.Parse(uri)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", uri)
+	}
+	if parsed.Scheme != "sqs" {
+		return nil, errors.New("SQS queues require an sqs:// URI").With("stack", stack.Trace().TrimRuntime()).With("scheme", parsed.Scheme)
+	}
 
-	awsCreds, err := AWSExtractCreds(strings.Split(creds, ","))
-	if err != nil {
-		return nil, err
+	sq = &SQS{
+		profile:  parsed.Query().Get("profile"),
+		queue:    strings.Trim(parsed.Path, "/"),
+		sessions: map[string]*session.Session{},
+	}
+
+	if len(creds) != 0 {
+		// Use the creds directory to locate all of the credentials for AWS within
+		// a hierarchy of directories
+		if sq.creds, err = AWSExtractCreds(strings.Split(creds, ",")); err != nil {
+			return nil, err
+		}
+	} else {
+		profile := sq.profile
+		if len(profile) == 0 {
+			profile = "default"
+		}
+		sq.creds = &AWSCred{
+			Project: "aws_" + profile,
+			Creds:   credentials.NewSharedCredentials("", profile),
+		}
+	}
+
+	// A region in the URI takes precedence over any region in the credential files
+	if len(parsed.Host) != 0 {
+		sq.creds.Region = parsed.Host
 	}
+	if len(sq.creds.Region) == 0 {
+		return nil, errors.New("no region was supplied for the SQS queue").With("stack", stack.Trace().TrimRuntime()).With("uri", uri)
+	}
+	regions := sq.creds.Regions
+	if extra := parsed.Query().Get("regions"); len(extra) != 0 {
+		regions = append(regions, strings.Split(extra, ",")...)
+	}
+	sq.creds.Regions = AWSRegions(sq.creds.Region, regions)
 
-	return &SQS{
-		project: project,
-		creds:   awsCreds,
-	}, nil
+	if endpoint := parsed.Query().Get("endpoint"); len(endpoint) != 0 {
+		sq.creds.Endpoint = endpoint
+	}
+
+	sq.project = sq.creds.Project
+	if project := parsed.Query().Get("project"); len(project) != 0 {
+		sq.project = project
+	}
+
+	if len(sq.profile) == 0 {
+		sq.profile = "default"
+	}
+	return sq, nil
 }
 
-func (sq *SQS) listQueues(qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutput, err errors.Error) {
+// client returns an SQS client for the region using the session cached for the region
+//
+func (sq *SQS) client(region string) (svc *sqs.SQS, err errors.Error) {
+	sq.Lock()
+	defer sq.Unlock()
+
+	if sess, isPresent := sq.sessions[region]; isPresent {
+		return sqs.New(sess), nil
+	}
+
+	cfg := aws.Config{
+		Region:                        aws.String(region),
+		Credentials:                   sq.creds.Creds,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	}
+	if len(sq.creds.Endpoint) != 0 {
+		cfg.Endpoint = aws.String(sq.creds.Endpoint)
+	}
 
 	sess, errGo := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String(sq.creds.Region),
-			Credentials:                   sq.creds.Creds,
-			CredentialsChainVerboseErrors: aws.Bool(true),
-		},
-		Profile: "default",
+		Config:  cfg,
+		Profile: sq.profile,
 	})
-
 	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds).With("region", region)
 	}
+	sq.sessions[region] = sess
+
+	return sqs.New(sess), nil
+}
+
+// regionURL splits a subscription into the region and url of the queue
+//
+func regionURL(subscription string) (region string, url string, err errors.Error) {
+	regionUrl := strings.SplitN(subscription, ":", 2)
+	if len(regionUrl) != 2 {
+		return "", "", errors.New("malformed sqs subscription").With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+	}
+	return regionUrl[0], regionUrl[1], nil
+}
+
+// isFIFO is true for the names, and urls, of FIFO queues
+//
+func isFIFO(queue string) (fifo bool) {
+	return strings.HasSuffix(queue, ".fifo")
+}
+
+// sqsGroupsInFlight tracks the message groups of FIFO queues that have a message being handled,
+// along with the number of times messages were held back because their group was in flight
+//
+type sqsGroupsInFlight struct {
+	groups    map[string]bool
+	holdbacks map[string]int       // The receives of each message that were held back, indexed by message ID
+	heldAt    map[string]time.Time // When each message was last held back
+	sync.Mutex
+}
+
+// start records that a message from the group is being handled, false is returned if a message
+// from the group is already being handled
+//
+func (inFlight *sqsGroupsInFlight) start(url string, group string) (started bool) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	key := url + " " + group
+	if inFlight.groups[key] {
+		return false
+	}
+	inFlight.groups[key] = true
+	return true
+}
+
+func (inFlight *sqsGroupsInFlight) finish(url string, group string) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	delete(inFlight.groups, url+" "+group)
+}
+
+// holdback records that a message was received and then held back, messages that have not been
+// held back within the retention are also forgotten
+//
+func (inFlight *sqsGroupsInFlight) holdback(id string) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	for msg, heldAt := range inFlight.heldAt {
+		if time.Since(heldAt) > sqsHoldbackRetention {
+			delete(inFlight.holdbacks, msg)
+			delete(inFlight.heldAt, msg)
+		}
+	}
+	inFlight.holdbacks[id]++
+	inFlight.heldAt[id] = time.Now()
+}
+
+// held returns the number of times a message that is about to be handled was held back and
+// forgets them
+//
+func (inFlight *sqsGroupsInFlight) held(id string) (holdbacks int) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	holdbacks = inFlight.holdbacks[id]
+	delete(inFlight.holdbacks, id)
+	delete(inFlight.heldAt, id)
+	return holdbacks
+}
+
+func (sq *SQS) listQueues(region string, qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutput, err errors.Error) {
 
 	// Create a SQS service client.
-	svc := sqs.New(sess)
+	svc, err := sq.client(region)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), *sqsTimeoutOpt)
 	defer cancel()
@@ -71,7 +265,7 @@ func (sq *SQS) listQueues(qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutp
 	if errGo != nil {
 		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
 	}
-	if qNameMatch == nil {
+	if qNameMatch == nil && len(sq.queue) == 0 {
 		return qs, nil
 	}
 
@@ -88,18 +282,21 @@ func (sq *SQS) listQueues(qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutp
 			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
 		}
 		paths := strings.Split(fullURL.Path, "/")
-		if qNameMatch.MatchString(paths[len(paths)-1]) {
+		if len(sq.queue) != 0 && sq.queue != paths[len(paths)-1] {
+			continue
+		}
+		if qNameMatch == nil || qNameMatch.MatchString(paths[len(paths)-1]) {
 			queues.QueueUrls = append(queues.QueueUrls, qURL)
 		}
 	}
 	return queues, nil
 }
 
-func (sq *SQS) refresh(qNameMatch *regexp.Regexp) (known []string, err errors.Error) {
+func (sq *SQS) refresh(region string, qNameMatch *regexp.Regexp) (known []string, err errors.Error) {
 
 	known = []string{}
 
-	result, err := sq.listQueues(qNameMatch)
+	result, err := sq.listQueues(region, qNameMatch)
 	if err != nil {
 		return known, err
 	}
@@ -115,16 +312,28 @@ func (sq *SQS) refresh(qNameMatch *regexp.Regexp) (known []string, err errors.Er
 	return known, nil
 }
 
+// QueueName returns the name of the queue, the last element of the URL path, from a subscription
+// holding the region and URL of the queue
+//
+func (sq *SQS) QueueName(subscription string) (name string) {
+	return subscription[strings.LastIndex(subscription, "/")+1:]
+}
+
+// Refresh lists the matching queues within each of the regions served by the credentials
+//
 func (sq *SQS) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (known map[string]interface{}, err errors.Error) {
 
-	found, err := sq.refresh(qNameMatch)
-	if err != nil {
-		return known, err
-	}
+	known = map[string]interface{}{}
 
-	known = make(map[string]interface{}, len(found))
-	for _, url := range found {
-		known[fmt.Sprintf("%s:%s", sq.creds.Region, url)] = sq.creds
+	for _, region := range sq.creds.Regions {
+		found, err := sq.refresh(region, qNameMatch)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, url := range found {
+			known[fmt.Sprintf("%s:%s", region, url)] = sq.creds
+		}
 	}
 
 	return known, nil
@@ -132,7 +341,12 @@ func (sq *SQS) Refresh(qNameMatch *regexp.Regexp, timeout time.Duration) (known
 
 func (sq *SQS) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
 
-	queues, err := sq.listQueues(nil)
+	region, _, err := regionURL(subscription)
+	if err != nil {
+		return true, err
+	}
+
+	queues, err := sq.listQueues(region, nil)
 	if err != nil {
 		return true, err
 	}
@@ -149,24 +363,16 @@ func (sq *SQS) Exists(ctx context.Context, subscription string) (exists bool, er
 
 func (sq *SQS) Work(ctx context.Context, qTimeout time.Duration, subscription string, handler MsgHandler) (msgCnt uint64, resource *Resource, err errors.Error) {
 
-	regionUrl := strings.SplitN(subscription, ":", 2)
-	url := regionUrl[1]
-
-	sess, errGo := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String(sq.creds.Region),
-			Credentials:                   sq.creds.Creds,
-			CredentialsChainVerboseErrors: aws.Bool(true),
-		},
-		Profile: "default",
-	})
-
-	if errGo != nil {
-		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
+	region, url, err := regionURL(subscription)
+	if err != nil {
+		return 0, nil, err
 	}
 
 	// Create a SQS service client.
-	svc := sqs.New(sess)
+	svc, err := sq.client(region)
+	if err != nil {
+		return 0, nil, err
+	}
 
 	qCtx, qCancel := context.WithTimeout(context.Background(), qTimeout)
 	defer func() {
@@ -184,14 +390,35 @@ func (sq *SQS) Work(ctx context.Context, qTimeout time.Duration, subscription st
 		}
 	}()
 
+	// Long-poll for a message, leaving time for the response to arrive before the queue timeout
+	wait := *sqsWaitOpt
+	if wait > sqsMaxWait {
+		wait = sqsMaxWait
+	}
+	if limit := qTimeout - time.Second; wait > limit {
+		wait = limit
+	}
+	if wait < 0 {
+		wait = 0
+	}
+
 	visTimeout := int64(30)
-	waitTimeout := int64(5)
-	msgs, errGo := svc.ReceiveMessageWithContext(qCtx,
-		&sqs.ReceiveMessageInput{
-			QueueUrl:          &url,
-			VisibilityTimeout: &visTimeout,
-			WaitTimeSeconds:   &waitTimeout,
-		})
+	waitTimeout := int64(wait / time.Second)
+	receive := &sqs.ReceiveMessageInput{
+		QueueUrl:          &url,
+		VisibilityTimeout: &visTimeout,
+		WaitTimeSeconds:   &waitTimeout,
+		AttributeNames: []*string{
+			aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount),
+			aws.String(sqs.MessageSystemAttributeNameMessageGroupId),
+		},
+	}
+	// Retries of a receive from a FIFO queue made by the SDK reuse the attempt ID so that SQS
+	// returns the same messages rather than leaving their groups blocked until they become visible
+	if isFIFO(url) {
+		receive.ReceiveRequestAttemptId = aws.String(xid.New().String())
+	}
+	msgs, errGo := svc.ReceiveMessageWithContext(qCtx, receive)
 	if errGo != nil {
 		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
 	}
@@ -205,6 +432,24 @@ func (sq *SQS) Work(ctx context.Context, qTimeout time.Duration, subscription st
 		return 0, nil, errors.New("queue worker cancel received").With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
 	default:
 	}
+	// SQS does not deliver further messages from a FIFO group while one is in flight, unless the
+	// visibility of the message expires.  Messages from a group that is still being handled on
+	// this host are hidden again so that the group is never run out of order, the receive being
+	// recorded so that it is not counted as an attempt when the message is handled.
+	group := aws.StringValue(msgs.Messages[0].Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+	if len(group) != 0 {
+		if !sqsGroups.start(url, group) {
+			sqsGroups.holdback(aws.StringValue(msgs.Messages[0].MessageId))
+			svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          &url,
+				ReceiptHandle:     msgs.Messages[0].ReceiptHandle,
+				VisibilityTimeout: &visTimeout,
+			})
+			return 0, nil, nil
+		}
+		defer sqsGroups.finish(url, group)
+	}
+
 	// Start a visbility timeout extender that runs until the work is done
 	// Changing the timeout restarts the timer on the SQS side, for more information
 	// see http://docs.aws.amazon.com/AWSSimpleQueueService/latest/SQSDeveloperGuide/sqs-visibility-timeout.html
@@ -226,9 +471,31 @@ func (sq *SQS) Work(ctx context.Context, qTimeout time.Duration, subscription st
 		}
 	}()
 
-	rsc, ack := handler(ctx, sq.project, url, "", []byte(*msgs.Messages[0].Body))
+	attempts := 0
+	if count, isPresent := msgs.Messages[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; isPresent && count != nil {
+		attempts, _ = strconv.Atoi(*count)
+	}
+	if len(group) != 0 {
+		if attempts -= sqsGroups.held(aws.StringValue(msgs.Messages[0].MessageId)); attempts < 1 {
+			attempts = 1
+		}
+	}
+
+	dCtx, delivery := withDelivery(ctx, attempts)
+	if len(group) != 0 {
+		dCtx = withMessageGroup(dCtx, group)
+	}
+	rsc, ack := handler(dCtx, sq.project, url, "", []byte(*msgs.Messages[0].Body))
 	close(quitC)
 
+	if !ack {
+		if reason, isDead := delivery.deadLetter(); isDead {
+			if err = sq.deadLetter(svc, msgs.Messages[0], reason); err == nil {
+				ack = true
+			}
+		}
+	}
+
 	if ack {
 		// Delete the message
 		svc.DeleteMessage(&sqs.DeleteMessageInput{
@@ -238,13 +505,155 @@ func (sq *SQS) Work(ctx context.Context, qTimeout time.Duration, subscription st
 		resource = rsc
 	} else {
 		// Set visibility timeout to 0, in otherwords Nack the message
-		visTimeout = 0
 		svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
 			QueueUrl:          &url,
 			ReceiptHandle:     msgs.Messages[0].ReceiptHandle,
-			VisibilityTimeout: &visTimeout,
+			VisibilityTimeout: aws.Int64(0),
 		})
 	}
 
-	return 1, resource, nil
+	return 1, resource, err
+}
+
+// Priority retrieves the priority and weight of a queue from its tags
+//
+func (sq *SQS) Priority(ctx context.Context, subscription string) (priority QueuePriority, isPresent bool, err errors.Error) {
+
+	region, url, err := regionURL(subscription)
+	if err != nil {
+		return DefaultQueuePriority, false, err
+	}
+
+	svc, err := sq.client(region)
+	if err != nil {
+		return DefaultQueuePriority, false, err
+	}
+
+	tags, errGo := svc.ListQueueTagsWithContext(ctx, &sqs.ListQueueTagsInput{QueueUrl: aws.String(url)})
+	if errGo != nil {
+		return DefaultQueuePriority, false, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+	}
+
+	attrs := make(map[string]interface{}, len(tags.Tags))
+	for k, v := range tags.Tags {
+		attrs[k] = aws.StringValue(v)
+	}
+	return ParseQueuePriority(attrs)
+}
+
+// Metrics retrieves the approximate number of messages waiting on, and in flight from, a queue.
+// SQS only offers the age of the oldest message through CloudWatch and so it is not reported.
+//
+func (sq *SQS) Metrics(ctx context.Context, subscription string) (metrics QueueMetrics, err errors.Error) {
+
+	metrics = UnknownQueueMetrics
+
+	region, url, err := regionURL(subscription)
+	if err != nil {
+		return metrics, err
+	}
+
+	svc, err := sq.client(region)
+	if err != nil {
+		return metrics, err
+	}
+
+	attrs, errGo := svc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(url),
+		AttributeNames: []*string{
+			aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages),
+			aws.String(sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible),
+		},
+	})
+	if errGo != nil {
+		return metrics, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+	}
+
+	if count, isPresent := attrs.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]; isPresent {
+		if metrics.Depth, errGo = strconv.ParseInt(aws.StringValue(count), 10, 64); errGo != nil {
+			metrics.Depth = -1
+		}
+	}
+	if count, isPresent := attrs.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]; isPresent {
+		if metrics.InFlight, errGo = strconv.ParseInt(aws.StringValue(count), 10, 64); errGo != nil {
+			metrics.InFlight = -1
+		}
+	}
+	return metrics, nil
+}
+
+// Publish sends a message to the named queue within the primary region used by the runner
+//
+func (sq *SQS) Publish(ctx context.Context, queue string, msg []byte) (err errors.Error) {
+
+	svc, err := sq.client(sq.creds.Region)
+	if err != nil {
+		return err
+	}
+
+	qURL, errGo := svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("queue", queue)
+	}
+	send := &sqs.SendMessageInput{
+		QueueUrl:    qURL.QueueUrl,
+		MessageBody: aws.String(string(msg)),
+	}
+	// FIFO queues need a group, and a deduplication ID unless content based deduplication is enabled
+	if isFIFO(queue) {
+		group := MessageGroup(ctx)
+		if len(group) == 0 {
+			group = sqsDefaultGroup
+		}
+		sum := sha256.Sum256(msg)
+		send.MessageGroupId = aws.String(group)
+		send.MessageDeduplicationId = aws.String(hex.EncodeToString(sum[:]))
+	}
+	_, errGo = svc.SendMessageWithContext(ctx, send)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("queue", queue)
+	}
+	return nil
+}
+
+// deadLetter sends a failed message to the dead-letter queue, when one is configured, with the
+// reason for the failure as a message attribute
+//
+func (sq *SQS) deadLetter(svc *sqs.SQS, msg *sqs.Message, reason string) (err errors.Error) {
+	dlq := deadLetterQueue()
+	if len(dlq) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *sqsTimeoutOpt)
+	defer cancel()
+
+	dlqURL, errGo := svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(dlq)})
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dead-letter", dlq)
+	}
+	send := &sqs.SendMessageInput{
+		QueueUrl:    dlqURL.QueueUrl,
+		MessageBody: msg.Body,
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			FailureReasonAttr: {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(reason),
+			},
+		},
+	}
+	// FIFO dead-letter queues keep the group of the failed message
+	if isFIFO(dlq) {
+		group := aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+		if len(group) == 0 {
+			group = sqsDefaultGroup
+		}
+		send.MessageGroupId = aws.String(group)
+		send.MessageDeduplicationId = msg.MessageId
+	}
+	_, errGo = svc.SendMessageWithContext(ctx, send)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dead-letter", dlq)
+	}
+	return nil
 }
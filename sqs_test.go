@@ -0,0 +1,326 @@
+package runner
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This file contains tests for SQS queues that use a local stand-in for the SQS service
+
+// sqsStandIn implements enough of the SQS query API to list, receive and delete messages, the
+// queues of each region are kept apart using the region the requests were signed for
+//
+type sqsStandIn struct {
+	url      string
+	queues   map[string][]string // Messages waiting on each region/queue
+	received map[string]string   // Messages in flight indexed by receipt handle
+	receives map[string]int      // The times each message has been received
+	deleted  int
+	hidden   int      // Messages left in flight by visibility changes
+	waits    []string // The WaitTimeSeconds of each receive request
+	sync.Mutex
+}
+
+var sqsSigned = regexp.MustCompile(`Credential=[^/]+/[^/]+/([^/]+)/sqs/`)
+
+func (sis *sqsStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if errGo := r.ParseForm(); errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusBadRequest)
+		return
+	}
+	region := ""
+	if matches := sqsSigned.FindStringSubmatch(r.Header.Get("Authorization")); len(matches) == 2 {
+		region = matches[1]
+	}
+	queue := strings.TrimPrefix(strings.TrimPrefix(r.Form.Get("QueueUrl"), sis.url), "/")
+
+	sis.Lock()
+	defer sis.Unlock()
+
+	action := r.Form.Get("Action")
+	result := ""
+	switch action {
+	case "ListQueues":
+		for name := range sis.queues {
+			if path.Dir(name) == region {
+				result += fmt.Sprintf("<QueueUrl>%s/%s</QueueUrl>", sis.url, name)
+			}
+		}
+	case "ReceiveMessage":
+		sis.waits = append(sis.waits, r.Form.Get("WaitTimeSeconds"))
+		if msgs := sis.queues[queue]; len(msgs) != 0 {
+			sis.queues[queue] = msgs[1:]
+			handle := fmt.Sprintf("%s#%d", queue, len(sis.received))
+			sis.received[handle] = msgs[0]
+			sis.receives[msgs[0]]++
+			sum := md5.Sum([]byte(msgs[0]))
+			// Messages on FIFO queues are all sent using the group named after the queue
+			group := ""
+			if strings.HasSuffix(queue, ".fifo") {
+				group = "<Attribute><Name>MessageGroupId</Name><Value>" + path.Base(queue) + "</Value></Attribute>"
+			}
+			// Message IDs are the same for every receive of a message, unlike receipt handles
+			result = fmt.Sprintf("<Message><MessageId>%s</MessageId><ReceiptHandle>%s</ReceiptHandle><MD5OfBody>%s</MD5OfBody><Body>%s</Body>"+
+				"<Attribute><Name>ApproximateReceiveCount</Name><Value>%d</Value></Attribute>%s</Message>",
+				hex.EncodeToString(sum[:]), handle, hex.EncodeToString(sum[:]), msgs[0], sis.receives[msgs[0]], group)
+		}
+	case "DeleteMessage":
+		delete(sis.received, r.Form.Get("ReceiptHandle"))
+		sis.deleted++
+	case "ChangeMessageVisibility":
+		if body, isPresent := sis.received[r.Form.Get("ReceiptHandle")]; isPresent {
+			if r.Form.Get("VisibilityTimeout") != "0" {
+				sis.hidden++
+				break
+			}
+			delete(sis.received, r.Form.Get("ReceiptHandle"))
+			sis.queues[queue] = append(sis.queues[queue], body)
+		}
+	case "GetQueueAttributes":
+		inFlight := 0
+		for handle := range sis.received {
+			if strings.HasPrefix(handle, queue+"#") {
+				inFlight++
+			}
+		}
+		result = fmt.Sprintf("<Attribute><Name>ApproximateNumberOfMessages</Name><Value>%d</Value></Attribute>"+
+			"<Attribute><Name>ApproximateNumberOfMessagesNotVisible</Name><Value>%d</Value></Attribute>", len(sis.queues[queue]), inFlight)
+	default:
+		http.Error(w, "unsupported action "+action, http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "<%sResponse><%sResult>%s</%sResult><ResponseMetadata><RequestId>stand-in</RequestId></ResponseMetadata></%sResponse>",
+		action, action, result, action, action)
+}
+
+// expire returns an in flight message to its queue in the same way as the visibility timeout
+// of the message expiring
+//
+func (sis *sqsStandIn) expire(body string) {
+	sis.Lock()
+	defer sis.Unlock()
+
+	for handle, msg := range sis.received {
+		if msg == body {
+			delete(sis.received, handle)
+			queue := strings.SplitN(handle, "#", 2)[0]
+			sis.queues[queue] = append([]string{body}, sis.queues[queue]...)
+		}
+	}
+}
+
+// newSQSStandIn starts a stand-in holding the queues supplied and returns an SQS task queue that
+// uses it for the us-west-2 and us-east-1 regions, the returned function stops the stand-in
+//
+func newSQSStandIn(t *testing.T, queues map[string][]string) (sis *sqsStandIn, sq *SQS, stop func()) {
+
+	sis = &sqsStandIn{
+		queues:   queues,
+		received: map[string]string{},
+		receives: map[string]int{},
+	}
+	srv := httptest.NewServer(sis)
+	sis.url = srv.URL
+
+	dir, errGo := ioutil.TempDir("", "sqs-stand-in")
+	if errGo != nil {
+		srv.Close()
+		t.Fatal(errGo)
+	}
+	stop = func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+
+	files := []string{filepath.Join(dir, "config"), filepath.Join(dir, "credentials")}
+	contents := []string{
+		"[default]\nregion=us-west-2\nregions=us-east-1\nendpoint_url=" + srv.URL + "\n",
+		"[default]\naws_access_key_id=stand-in\naws_secret_access_key=stand-in\n",
+	}
+	for i, fn := range files {
+		if errGo = ioutil.WriteFile(fn, []byte(contents[i]), 0600); errGo != nil {
+			stop()
+			t.Fatal(errGo)
+		}
+	}
+
+	sq, err := NewSQS("sqs://", strings.Join(files, ","))
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return sis, sq, stop
+}
+
+func TestSQSStandIn(t *testing.T) {
+
+	sis, sq, stop := newSQSStandIn(t, map[string][]string{
+		"us-west-2/sqs_west": {"west-1", "west-2"},
+		"us-east-1/sqs_east": {"east-1"},
+		"us-east-1/other":    {"other-1"},
+	})
+	defer stop()
+
+	if len(sq.creds.Regions) != 2 || sq.creds.Endpoint != sis.url {
+		t.Fatalf("unexpected credentials %+v", sq.creds)
+	}
+
+	// Queues are found in every region served by the credentials
+	known, err := sq.Refresh(regexp.MustCompile("^sqs_"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	west := "us-west-2:" + sis.url + "/us-west-2/sqs_west"
+	east := "us-east-1:" + sis.url + "/us-east-1/sqs_east"
+	for _, name := range []string{west, east} {
+		if _, isPresent := known[name]; !isPresent || len(known) != 2 {
+			t.Fatalf("queue %s not found in %v", name, known)
+		}
+	}
+
+	handler := func(ack bool) MsgHandler {
+		return func(ctx context.Context, project string, subscription string, credentials string, data []byte) (resource *Resource, consume bool) {
+			if DeliveryAttempt(ctx) != 1 {
+				t.Fatalf("delivery attempt %d rather than 1", DeliveryAttempt(ctx))
+			}
+			return &Resource{}, ack
+		}
+	}
+
+	// Messages not acknowledged are returned to the queue, the rest are deleted
+	for _, test := range []struct {
+		queue string
+		ack   bool
+	}{{west, false}, {west, true}, {east, true}} {
+		if cnt, _, err := sq.Work(context.Background(), 5*time.Second, test.queue, handler(test.ack)); err != nil || cnt != 1 {
+			t.Fatalf("work on %s failed %d %v", test.queue, cnt, err)
+		}
+	}
+
+	metrics, err := sq.Metrics(context.Background(), west)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Depth != 1 || metrics.InFlight != 0 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+
+	sis.Lock()
+	defer sis.Unlock()
+	if sis.deleted != 2 {
+		t.Fatalf("%d messages deleted rather than 2", sis.deleted)
+	}
+	// Receives long-poll for as long as the queue timeout allows
+	for _, wait := range sis.waits {
+		if wait != "4" {
+			t.Fatalf("receive waited %s seconds rather than 4", wait)
+		}
+	}
+
+	// Sessions are created once for each region and then reused
+	if len(sq.sessions) != 2 {
+		t.Fatalf("%d sessions rather than 2", len(sq.sessions))
+	}
+}
+
+// TestSQSFIFOGroups checks that a message from a FIFO group is not started while an earlier message
+// from the same group is still being handled
+//
+func TestSQSFIFOGroups(t *testing.T) {
+
+	sis, sq, stop := newSQSStandIn(t, map[string][]string{
+		"us-west-2/sqs_ordered.fifo": {"first", "second"},
+	})
+	defer stop()
+
+	fifo := "us-west-2:" + sis.url + "/us-west-2/sqs_ordered.fifo"
+
+	nested := uint64(1)
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (resource *Resource, consume bool) {
+		if group := MessageGroup(ctx); group != "sqs_ordered.fifo" {
+			t.Fatalf("message group %s rather than sqs_ordered.fifo", group)
+		}
+		// While this message is in flight the next message from its group must be held back
+		cnt, _, err := sq.Work(context.Background(), 5*time.Second, fifo,
+			func(ctx context.Context, project string, subscription string, credentials string, data []byte) (resource *Resource, consume bool) {
+				t.Fatalf("%s started while an earlier message from its group was in flight", string(data))
+				return nil, false
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nested = cnt
+		return &Resource{}, true
+	}
+
+	if cnt, _, err := sq.Work(context.Background(), 5*time.Second, fifo, handler); err != nil || cnt != 1 {
+		t.Fatalf("work on %s failed %d %v", fifo, cnt, err)
+	}
+	if nested != 0 {
+		t.Fatalf("%d messages handled from a group in flight rather than 0", nested)
+	}
+
+	sis.Lock()
+	defer sis.Unlock()
+	if sis.deleted != 1 || sis.hidden != 1 {
+		t.Fatalf("%d messages deleted and %d hidden rather than 1 and 1", sis.deleted, sis.hidden)
+	}
+}
+
+// TestSQSFIFOHoldback checks that receives of a FIFO message that were held back while its group
+// was in flight are not counted as attempts
+//
+func TestSQSFIFOHoldback(t *testing.T) {
+
+	defer setDeadLetter(t, 2, "")()
+
+	sis, sq, stop := newSQSStandIn(t, map[string][]string{
+		"us-west-2/sqs_held.fifo": {"first", "second"},
+	})
+	defer stop()
+
+	fifo := "us-west-2:" + sis.url + "/us-west-2/sqs_held.fifo"
+
+	// The second message is received, and held back, three times while the first is in flight
+	handler := func(ctx context.Context, project string, subscription string, credentials string, data []byte) (resource *Resource, consume bool) {
+		for i := 0; i != 3; i++ {
+			if _, _, err := sq.Work(context.Background(), 5*time.Second, fifo, failingHandler(&[]int{}, true)); err != nil {
+				t.Fatal(err)
+			}
+			sis.expire("second")
+		}
+		return &Resource{}, true
+	}
+	if cnt, _, err := sq.Work(context.Background(), 5*time.Second, fifo, handler); err != nil || cnt != 1 {
+		t.Fatalf("work on %s failed %d %v", fifo, cnt, err)
+	}
+
+	// Once handled the fourth receive is the first attempt and so the failure is retried rather
+	// than being dead-lettered by the max-attempts of 2
+	attempts := []int{}
+	if cnt, _, err := sq.Work(context.Background(), 5*time.Second, fifo, failingHandler(&attempts, true)); err != nil || cnt != 1 {
+		t.Fatalf("work on %s failed %d %v", fifo, cnt, err)
+	}
+	if len(attempts) != 1 || attempts[0] != 1 {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+
+	sis.Lock()
+	defer sis.Unlock()
+	if sis.receives["second"] != 4 || sis.deleted != 1 || len(sis.queues["us-west-2/sqs_held.fifo"]) != 1 {
+		t.Fatalf("%d receives and %d deletes, the held back message was not retried %v", sis.receives["second"], sis.deleted, sis.queues)
+	}
+}
@@ -3,15 +3,22 @@ package runner
 // This file defines an interface for task queues used by the runner
 import (
 	"context"
-	"os"
+	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 )
 
+var (
+	// queueLogger reports problems found by the background tasks of queue backends, such as
+	// heartbeats, that have no caller to return errors to
+	queueLogger = NewLogger("taskqueue")
+)
+
 // convert types take an int and return a string value.
 type MsgHandler func(ctx context.Context, project string, subscription string, credentials string, data []byte) (resource *Resource, ack bool)
 
@@ -24,23 +31,86 @@ type TaskQueue interface {
 
 	// Check that the specified queue exists
 	Exists(ctx context.Context, subscription string) (exists bool, err errors.Error)
+
+	// Send a message to a queue on the same server, the queue being named as it would be
+	// by the clients of the server rather than using the form returned by Refresh
+	Publish(ctx context.Context, queue string, msg []byte) (err errors.Error)
+}
+
+// QueueNamer is implemented by task queues whose subscriptions, as returned by Refresh, are not
+// the bare queue names that Refresh matches against the queue expression, for example SQS
+// subscriptions that carry the region and URL of the queue
+//
+type QueueNamer interface {
+	QueueName(subscription string) (name string)
+}
+
+// QueueName returns the bare name of the queue for a subscription returned by the Refresh of the
+// task queue, this is the name matched by queue expressions
+//
+func QueueName(tq TaskQueue, subscription string) (name string) {
+	if namer, isNamer := tq.(QueueNamer); isNamer {
+		return namer.QueueName(subscription)
+	}
+	return subscription
+}
+
+// TaskQueueFactory creates a task queue for a queue URI, creds optionally naming
+// the credentials used by the backend
+//
+type TaskQueueFactory func(uri string, creds string) (tq TaskQueue, err errors.Error)
+
+// taskQueues is the registry of backends, indexed by the URI scheme they handle
+//
+var taskQueues = struct {
+	factories map[string]TaskQueueFactory
+	sync.Mutex
+}{factories: map[string]TaskQueueFactory{}}
+
+// RegisterTaskQueue adds a backend for queue URIs using the scheme, backends are typically
+// registered from the init function of the file implementing them
+//
+func RegisterTaskQueue(scheme string, factory TaskQueueFactory) {
+	taskQueues.Lock()
+	defer taskQueues.Unlock()
+
+	taskQueues.factories[strings.ToLower(scheme)] = factory
 }
 
-func NewTaskQueue(project string, creds string) (tq TaskQueue, err errors.Error) {
-	// The Google creds will come down as .json files, AWS will be a number of credential and config file names
-	switch {
-	case strings.HasSuffix(creds, ".json"):
-		return NewPubSub(project, creds)
-	case strings.HasPrefix(project, "amqp://"):
-		return NewRabbitMQ(project, creds)
-	default:
-		files := strings.Split(creds, ",")
-		for _, file := range files {
-			_, errGo := os.Stat(file)
-			if errGo != nil {
-				return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", file).With("project", project)
-			}
-		}
-		return NewSQS(project, creds)
+// NewTaskQueue creates a task queue using the backend registered for the scheme of the
+// queue URI, for example sqs://region/queue, pubsub://project/subscription, amqp://,
+// file:// or redis://
+//
+func NewTaskQueue(uri string, creds string) (tq TaskQueue, err errors.Error) {
+
+	parsed, errGo := url.Parse(uri)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", uri)
+	}
+
+	taskQueues.Lock()
+	factory, isPresent := taskQueues.factories[strings.ToLower(parsed.Scheme)]
+	taskQueues.Unlock()
+
+	if !isPresent {
+		return nil, errors.New("no task queue is available for the URI scheme").With("stack", stack.Trace().TrimRuntime()).With("uri", uri).With("scheme", parsed.Scheme)
 	}
+	return factory(uri, creds)
+}
+
+type messageGroupKey struct{}
+
+// withMessageGroup adds the group of a message to a context, queues that order the messages
+// within a group pass the group to handlers this way and use it when publishing messages
+//
+func withMessageGroup(ctx context.Context, group string) (groupCtx context.Context) {
+	return context.WithValue(ctx, messageGroupKey{}, group)
+}
+
+// MessageGroup returns the group of the message being handled, or an empty string when the queue
+// does not group messages
+//
+func MessageGroup(ctx context.Context) (group string) {
+	group, _ = ctx.Value(messageGroupKey{}).(string)
+	return group
 }
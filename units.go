@@ -4,9 +4,21 @@ package runner
 // string representations of numeric values for RAM and disk space etc
 
 import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
 	"github.com/dustin/go-humanize"
 )
 
+var (
+	// exponentQuantity matches the kubernetes decimal exponent notation, for example 128974848e0,
+	// which would otherwise be treated by humanize as an exabyte suffix
+	exponentQuantity = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[eE][+-]?[0-9]+$`)
+)
+
 // parseBytes returns a value for the input string.
 //
 // This function uses the humanize library from github for go.
@@ -15,6 +27,78 @@ import (
 // Inputs support SI and IEC sizes.  For more information please review
 // https://github.com/dustin/go-humanize/blob/master/bytes.go
 //
+// Kubernetes style quantities such as '16Gi', '500M', and '129e6' are also accepted.
+//
 func ParseBytes(val string) (bytes uint64, err error) {
+	val = strings.TrimSpace(val)
+	if exponentQuantity.MatchString(val) {
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return 0, err
+		}
+		if f >= math.MaxUint64 {
+			return 0, fmt.Errorf("too large: %v", val)
+		}
+		return uint64(math.Ceil(f)), nil
+	}
 	return humanize.ParseBytes(val)
 }
+
+// FormatBytes produces an exact representation of a number of bytes using the largest
+// IEC unit that divides the value evenly, for example 16Gi
+//
+func FormatBytes(bytes uint64) (val string) {
+	if bytes == 0 {
+		return "0"
+	}
+	for _, unit := range []struct {
+		suffix string
+		size   uint64
+	}{
+		{"Ei", humanize.EiByte}, {"Pi", humanize.PiByte}, {"Ti", humanize.TiByte},
+		{"Gi", humanize.GiByte}, {"Mi", humanize.MiByte}, {"Ki", humanize.KiByte},
+	} {
+		if bytes%unit.size == 0 {
+			return strconv.FormatUint(bytes/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatUint(bytes, 10)
+}
+
+// ParseCPU returns the number of millicores for the input string.
+//
+// Inputs can be whole or fractional numbers of cores, '2', '0.5', or Kubernetes
+// style millicores, '500m'.  Fractions of a millicore are rounded up.
+//
+func ParseCPU(val string) (milliCPU uint64, err error) {
+	val = strings.TrimSpace(val)
+
+	scale := 1000.0
+	if strings.HasSuffix(val, "m") {
+		val = strings.TrimSuffix(val, "m")
+		scale = 1.0
+	}
+
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid cpu quantity: %v", val)
+	}
+	if f*scale >= math.MaxUint64 {
+		return 0, fmt.Errorf("too large: %v", val)
+	}
+	// Allow for floating point noise, for example 0.1 cores, before rounding up
+	return uint64(math.Ceil(f*scale - 1e-6)), nil
+}
+
+// FormatCPU produces the representation of a number of millicores, whole numbers of
+// cores are shown as a plain number otherwise millicores are used, for example 1500m
+//
+func FormatCPU(milliCPU uint64) (val string) {
+	if milliCPU%1000 == 0 {
+		return strconv.FormatUint(milliCPU/1000, 10)
+	}
+	return strconv.FormatUint(milliCPU, 10) + "m"
+}
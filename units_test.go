@@ -0,0 +1,89 @@
+package runner
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// This file contains tests for the parsing of resource quantities
+
+func TestQuantities(t *testing.T) {
+
+	for val, expected := range map[string]uint64{"2": 2000, "0.5": 500, "0.1": 100, "500m": 500, "1500m": 1500, "0.0001": 1} {
+		milliCPU, errGo := ParseCPU(val)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if milliCPU != expected {
+			t.Fatalf("cpu %s parsed as %d, expected %d", val, milliCPU, expected)
+		}
+	}
+	if _, errGo := ParseCPU("-1"); errGo == nil {
+		t.Fatal("negative cpu was accepted")
+	}
+
+	for val, expected := range map[string]uint64{"16Gi": 16 * 1024 * 1024 * 1024, "500M": 500000000, "2gb": 2000000000, "129e6": 129000000, "1Ki": 1024} {
+		bytes, errGo := ParseBytes(val)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if bytes != expected {
+			t.Fatalf("bytes %s parsed as %d, expected %d", val, bytes, expected)
+		}
+		if again, _ := ParseBytes(FormatBytes(bytes)); again != bytes {
+			t.Fatalf("bytes %s did not survive formatting as %s", val, FormatBytes(bytes))
+		}
+	}
+}
+
+func TestResourceFit(t *testing.T) {
+
+	needed := &Resource{}
+	if errGo := json.Unmarshal([]byte(`{"cpus": "500m", "gpus": 0, "hdd": "10Gi", "ram": "2gb", "gpuMem": ""}`), needed); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if needed.Cpus != "500m" {
+		t.Fatalf("cpus normalized to %s", needed.Cpus)
+	}
+
+	machine := NewResource(ResourceQuantities{MilliCPU: 1000, Hdd: 20 * 1024 * 1024 * 1024, Ram: 4 * 1000 * 1000 * 1000})
+	fit, err := needed.Fit(machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fit {
+		t.Fatal("fractional cpu did not fit")
+	}
+
+	if copies, unbounded, err := needed.FitCount(machine); err != nil || unbounded || copies != 2 {
+		t.Fatalf("unexpected fit count %d %v %v", copies, unbounded, err)
+	}
+	if _, unbounded, err := NewResource(ResourceQuantities{}).FitCount(machine); err != nil || !unbounded {
+		t.Fatal("an empty request was bounded")
+	}
+
+	clone := machine.Clone()
+	clone.Cpus = "250m"
+	if fit, err = needed.Fit(clone); err != nil || fit {
+		t.Fatal("changed cpus were not detected")
+	}
+
+	// Changed fields are parsed without replacing the values cached when the resource was created
+	if clone.parsed.cpus != "1" || clone.Cores() != 1 {
+		t.Fatal("the parsed values of a resource were modified after it was created")
+	}
+	if needed.Cores() != 1 {
+		t.Fatalf("500m cpus rounded to %d cores", needed.Cores())
+	}
+
+	// Whole cores are sent as numbers to retain compatibility with existing clients
+	needed.Cpus = "2"
+	b, errGo := json.Marshal(needed)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !strings.Contains(string(b), `"cpus":2`) {
+		t.Fatalf("cpus not a number in %s", string(b))
+	}
+}